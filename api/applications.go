@@ -6,11 +6,14 @@ package api
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/google/uuid"
+	khttp "github.com/microsoft/kiota-http-go"
 	msgraphsdkgo "github.com/microsoftgraph/msgraph-sdk-go"
+	msgraphgocore "github.com/microsoftgraph/msgraph-sdk-go-core"
 	auth "github.com/microsoftgraph/msgraph-sdk-go-core/authentication"
 	"github.com/microsoftgraph/msgraph-sdk-go/applications"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
@@ -18,7 +21,8 @@ import (
 
 type ApplicationsClient interface {
 	GetApplication(ctx context.Context, clientID string) (Application, error)
-	CreateApplication(ctx context.Context, displayName string, signInAudience string, tags []string) (Application, error)
+	GetApplicationByObjectID(ctx context.Context, applicationObjectID string) (Application, error)
+	CreateApplication(ctx context.Context, app Application) (Application, error)
 	DeleteApplication(ctx context.Context, applicationObjectID string, permanentlyDelete bool) error
 	ListApplications(ctx context.Context, filter string) ([]Application, error)
 	AddApplicationPassword(ctx context.Context, applicationObjectID string, displayName string, endDateTime time.Time) (PasswordCredential, error)
@@ -30,13 +34,21 @@ var _ GroupsClient = (*MSGraphClient)(nil)
 var _ ServicePrincipalClient = (*MSGraphClient)(nil)
 
 type MSGraphClient struct {
-	client *msgraphsdkgo.GraphServiceClient
+	client  *msgraphsdkgo.GraphServiceClient
+	baseURL string
 }
 
 type Application struct {
-	AppID               string
-	AppObjectID         string
-	PasswordCredentials []PasswordCredential
+	AppID                      string
+	AppObjectID                string
+	DisplayName                string
+	SignInAudience             string
+	Description                string
+	Notes                      string
+	ServiceManagementReference string
+	Tags                       []string
+	Owners                     []string // object IDs of users or groups
+	PasswordCredentials        []PasswordCredential
 }
 
 type PasswordCredential struct {
@@ -49,7 +61,10 @@ type PasswordCredential struct {
 // the Microsoft Graph API. It can be configured to target alternative national cloud
 // deployments via graphURI. For details on the client configuration see
 // https://learn.microsoft.com/en-us/graph/sdks/national-clouds
-func NewMSGraphClient(graphURI string, creds azcore.TokenCredential) (*MSGraphClient, error) {
+//
+// The transport sends each HTTP attempt after the Graph middleware, including
+// retries. If it is nil, the default transport of the Graph SDK is used.
+func NewMSGraphClient(graphURI string, creds azcore.TokenCredential, transport http.RoundTripper) (*MSGraphClient, error) {
 	scopes := []string{
 		fmt.Sprintf("%s/.default", graphURI),
 	}
@@ -59,20 +74,33 @@ func NewMSGraphClient(graphURI string, creds azcore.TokenCredential) (*MSGraphCl
 		return nil, err
 	}
 
-	adapter, err := msgraphsdkgo.NewGraphRequestAdapter(authProvider)
+	clientOptions := msgraphsdkgo.GetDefaultClientOptions()
+	middlewares := msgraphgocore.GetDefaultMiddlewaresWithOptions(&clientOptions)
+	httpClient := khttp.GetDefaultClient(middlewares...)
+	httpClient.Transport = khttp.NewCustomTransportWithParentTransport(transport, middlewares...)
+
+	adapter, err := msgraphsdkgo.NewGraphRequestAdapterWithParseNodeFactoryAndSerializationWriterFactoryAndHttpClient(authProvider, nil, nil, httpClient)
 	if err != nil {
 		return nil, err
 	}
 
-	adapter.SetBaseUrl(fmt.Sprintf("%s/v1.0", graphURI))
+	baseURL := fmt.Sprintf("%s/v1.0", graphURI)
+	adapter.SetBaseUrl(baseURL)
 	client := msgraphsdkgo.NewGraphServiceClient(adapter)
 
 	ac := &MSGraphClient{
-		client: client,
+		client:  client,
+		baseURL: baseURL,
 	}
 	return ac, nil
 }
 
+// directoryObjectURL returns the URL that binds the directory object by
+// reference. It is under the Graph endpoint of the configured cloud.
+func (c *MSGraphClient) directoryObjectURL(objectID string) string {
+	return fmt.Sprintf("%s/directoryObjects/%s", c.baseURL, objectID)
+}
+
 func (c *MSGraphClient) GetApplication(ctx context.Context, clientID string) (Application, error) {
 	filter := fmt.Sprintf("appId eq '%s'", clientID)
 	req := applications.ApplicationsRequestBuilderGetRequestConfiguration{
@@ -99,6 +127,16 @@ func (c *MSGraphClient) GetApplication(ctx context.Context, clientID string) (Ap
 	return getApplicationResponse(app), nil
 }
 
+// GetApplicationByObjectID gets an Azure application object by its object ID.
+func (c *MSGraphClient) GetApplicationByObjectID(ctx context.Context, applicationObjectID string) (Application, error) {
+	resp, err := c.client.Applications().ByApplicationId(applicationObjectID).Get(ctx, nil)
+	if err != nil {
+		return Application{}, err
+	}
+
+	return getApplicationResponse(resp), nil
+}
+
 func (c *MSGraphClient) ListApplications(ctx context.Context, filter string) ([]Application, error) {
 
 	req := &applications.ApplicationsRequestBuilderGetQueryParameters{
@@ -120,15 +158,36 @@ func (c *MSGraphClient) ListApplications(ctx context.Context, filter string) ([]
 	return apps, nil
 }
 
-// CreateApplication create a new Azure application object.
-func (c *MSGraphClient) CreateApplication(ctx context.Context, displayName string, signInAudience string, tags []string) (Application, error) {
+// CreateApplication create a new Azure application object. The object IDs
+// and credentials of app are ignored.
+func (c *MSGraphClient) CreateApplication(ctx context.Context, app Application) (Application, error) {
 	requestBody := models.NewApplication()
-	requestBody.SetDisplayName(&displayName)
-	requestBody.SetTags(tags)
+	requestBody.SetDisplayName(&app.DisplayName)
+	requestBody.SetTags(app.Tags)
 
-	// only set signInAudience if it's non-empty
-	if signInAudience != "" {
-		requestBody.SetSignInAudience(&signInAudience)
+	// only set the optional fields if they are non-empty
+	if app.SignInAudience != "" {
+		requestBody.SetSignInAudience(&app.SignInAudience)
+	}
+	if app.Description != "" {
+		requestBody.SetDescription(&app.Description)
+	}
+	if app.Notes != "" {
+		requestBody.SetNotes(&app.Notes)
+	}
+	if app.ServiceManagementReference != "" {
+		requestBody.SetServiceManagementReference(&app.ServiceManagementReference)
+	}
+
+	// owners are bound by reference when the application is created
+	if len(app.Owners) > 0 {
+		var owners []string
+		for _, owner := range app.Owners {
+			owners = append(owners, c.directoryObjectURL(owner))
+		}
+		requestBody.SetAdditionalData(map[string]interface{}{
+			"owners@odata.bind": owners,
+		})
 	}
 
 	resp, err := c.client.Applications().Post(ctx, requestBody, nil)
@@ -205,10 +264,22 @@ func ptrToString(s *string) string {
 
 func getApplicationResponse(app models.Applicationable) Application {
 	if app != nil {
+		var owners []string
+		for _, owner := range app.GetOwners() {
+			owners = append(owners, ptrToString(owner.GetId()))
+		}
+
 		return Application{
-			AppID:               ptrToString(app.GetAppId()),
-			AppObjectID:         ptrToString(app.GetId()),
-			PasswordCredentials: getPasswordCredentialsForApplication(app),
+			AppID:                      ptrToString(app.GetAppId()),
+			AppObjectID:                ptrToString(app.GetId()),
+			DisplayName:                ptrToString(app.GetDisplayName()),
+			SignInAudience:             ptrToString(app.GetSignInAudience()),
+			Description:                ptrToString(app.GetDescription()),
+			Notes:                      ptrToString(app.GetNotes()),
+			ServiceManagementReference: ptrToString(app.GetServiceManagementReference()),
+			Tags:                       app.GetTags(),
+			Owners:                     owners,
+			PasswordCredentials:        getPasswordCredentialsForApplication(app),
 		}
 
 	}
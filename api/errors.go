@@ -0,0 +1,27 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// IsNotFound returns whether err reports that the requested directory object
+// does not exist.
+func IsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var odataErr *odataerrors.ODataError
+	if errors.As(err, &odataErr) && odataErr.ResponseStatusCode == http.StatusNotFound {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "Request_ResourceNotFound")
+}
@@ -5,7 +5,6 @@ package api
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/microsoftgraph/msgraph-sdk-go/groups"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
@@ -14,8 +13,11 @@ import (
 type GroupsClient interface {
 	AddGroupMember(ctx context.Context, groupObjectID string, memberObjectID string) error
 	RemoveGroupMember(ctx context.Context, groupObjectID, memberObjectID string) error
+	AddGroupOwner(ctx context.Context, groupObjectID string, ownerObjectID string) error
+	RemoveGroupOwner(ctx context.Context, groupObjectID, ownerObjectID string) error
 	GetGroup(ctx context.Context, objectID string) (result Group, err error)
 	ListGroups(ctx context.Context, filter string) (result []Group, err error)
+	QueryGroups(ctx context.Context, filter string, limit int) (result []Group, err error)
 }
 
 type Group struct {
@@ -25,7 +27,7 @@ type Group struct {
 
 func (c *MSGraphClient) AddGroupMember(ctx context.Context, groupObjectID string, memberObjectID string) error {
 	req := models.NewReferenceCreate()
-	odataId := fmt.Sprintf("https://graph.microsoft.com/v1.0/directoryObjects/%s", memberObjectID)
+	odataId := c.directoryObjectURL(memberObjectID)
 	req.SetOdataId(&odataId)
 
 	return c.client.Groups().ByGroupId(groupObjectID).Members().Ref().Post(ctx, req, nil)
@@ -35,6 +37,18 @@ func (c *MSGraphClient) RemoveGroupMember(ctx context.Context, groupObjectID, me
 	return c.client.Groups().ByGroupId(groupObjectID).Members().ByDirectoryObjectId(memberObjectID).Ref().Delete(ctx, nil)
 }
 
+func (c *MSGraphClient) AddGroupOwner(ctx context.Context, groupObjectID string, ownerObjectID string) error {
+	req := models.NewReferenceCreate()
+	odataId := c.directoryObjectURL(ownerObjectID)
+	req.SetOdataId(&odataId)
+
+	return c.client.Groups().ByGroupId(groupObjectID).Owners().Ref().Post(ctx, req, nil)
+}
+
+func (c *MSGraphClient) RemoveGroupOwner(ctx context.Context, groupObjectID, ownerObjectID string) error {
+	return c.client.Groups().ByGroupId(groupObjectID).Owners().ByDirectoryObjectId(ownerObjectID).Ref().Delete(ctx, nil)
+}
+
 func (c *MSGraphClient) GetGroup(ctx context.Context, groupID string) (Group, error) {
 	resp, err := c.client.Groups().ByGroupId(groupID).Get(ctx, nil)
 	if err != nil {
@@ -65,6 +79,46 @@ func (c *MSGraphClient) ListGroups(ctx context.Context, filter string) ([]Group,
 	return g, nil
 }
 
+// QueryGroups returns up to limit groups that match the OData filter,
+// following the pages of the result as needed.
+func (c *MSGraphClient) QueryGroups(ctx context.Context, filter string, limit int) ([]Group, error) {
+	// Graph returns at most 999 groups per page
+	top := int32(limit)
+	if top > 999 {
+		top = 999
+	}
+	configuration := &groups.GroupsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &groups.GroupsRequestBuilderGetQueryParameters{
+			Filter: &filter,
+			Top:    &top,
+		},
+	}
+
+	groupList, err := c.client.Groups().Get(ctx, configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	var g []Group
+	for {
+		for _, group := range groupList.GetValue() {
+			g = append(g, getGroupResponse(group))
+			if len(g) >= limit {
+				return g, nil
+			}
+		}
+
+		nextLink := groupList.GetOdataNextLink()
+		if nextLink == nil || *nextLink == "" {
+			return g, nil
+		}
+		groupList, err = c.client.Groups().WithUrl(*nextLink).Get(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 func getGroupResponse(group models.Groupable) Group {
 	if group != nil {
 		return Group{
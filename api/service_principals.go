@@ -5,7 +5,9 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -15,8 +17,11 @@ import (
 
 type ServicePrincipalClient interface {
 	// CreateServicePrincipal in Azure. The password returned is the actual password that the appID was created with
-	CreateServicePrincipal(ctx context.Context, appID string, startDate time.Time, endDate time.Time) (id string, password string, err error)
+	CreateServicePrincipal(ctx context.Context, appID string, attributes CustomSecurityAttributes, startDate time.Time, endDate time.Time) (id string, password string, err error)
 	DeleteServicePrincipal(ctx context.Context, spObjectID string, permanentlyDelete bool) error
+	GetServicePrincipalByID(ctx context.Context, spObjectID string) (ServicePrincipal, error)
+	// ListServicePrincipalGroups lists the groups the service principal is a direct member of.
+	ListServicePrincipalGroups(ctx context.Context, spObjectID string) ([]Group, error)
 }
 
 type ServicePrincipal struct {
@@ -24,10 +29,137 @@ type ServicePrincipal struct {
 	AppID string
 }
 
-func (c *MSGraphClient) CreateServicePrincipal(ctx context.Context, appID string, startDate time.Time, endDate time.Time) (string, string, error) {
+// CustomSecurityAttributes maps attribute set names to the custom security
+// attributes assigned to a service principal. Attribute values may be strings,
+// booleans, integers, or lists of strings or integers.
+type CustomSecurityAttributes map[string]map[string]interface{}
+
+// Validate checks that all attribute values have a supported type.
+func (a CustomSecurityAttributes) Validate() error {
+	_, err := a.toGraph()
+	return err
+}
+
+// toGraph converts the attributes to the representation expected by MS Graph,
+// which requires the OData type of every attribute set and of non-string
+// attribute values.
+func (a CustomSecurityAttributes) toGraph() (models.CustomSecurityAttributeValueable, error) {
+	data := make(map[string]interface{}, len(a))
+	for set, attributes := range a {
+		if set == "" {
+			return nil, fmt.Errorf("custom security attribute set name must not be empty")
+		}
+
+		values := map[string]interface{}{
+			"@odata.type": "#Microsoft.DirectoryServices.CustomSecurityAttributeValue",
+		}
+		for name, raw := range attributes {
+			if name == "" {
+				return nil, fmt.Errorf("custom security attribute name in set %q must not be empty", set)
+			}
+
+			value, odataType, err := customSecurityAttributeValue(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for custom security attribute %q in set %q: %w", name, set, err)
+			}
+			if odataType != "" {
+				values[name+"@odata.type"] = odataType
+			}
+			values[name] = value
+		}
+		data[set] = values
+	}
+
+	result := models.NewCustomSecurityAttributeValue()
+	result.SetAdditionalData(data)
+	return result, nil
+}
+
+func customSecurityAttributeValue(raw interface{}) (interface{}, string, error) {
+	switch v := raw.(type) {
+	case string, bool:
+		return v, "", nil
+	case []string:
+		if len(v) == 0 {
+			return nil, "", fmt.Errorf("list must not be empty")
+		}
+		return v, "#Collection(String)", nil
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, "", fmt.Errorf("list must not be empty")
+		}
+		if _, ok := v[0].(string); ok {
+			var values []string
+			for _, elem := range v {
+				s, ok := elem.(string)
+				if !ok {
+					return nil, "", fmt.Errorf("list elements must all be strings or all be integers")
+				}
+				values = append(values, s)
+			}
+			return values, "#Collection(String)", nil
+		}
+
+		var values []int32
+		for _, elem := range v {
+			i, err := toInt32(elem)
+			if err != nil {
+				return nil, "", fmt.Errorf("list elements must all be strings or all be integers")
+			}
+			values = append(values, i)
+		}
+		return values, "#Collection(Int32)", nil
+	default:
+		i, err := toInt32(raw)
+		if err != nil {
+			return nil, "", err
+		}
+		return i, "#Int32", nil
+	}
+}
+
+func toInt32(raw interface{}) (int32, error) {
+	var i int64
+	switch v := raw.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an integer", v.String())
+		}
+		i = n
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		i = int64(v)
+	case int:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	default:
+		return 0, fmt.Errorf("unsupported type %T", raw)
+	}
+
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		return 0, fmt.Errorf("%d is out of range", i)
+	}
+	return int32(i), nil
+}
+
+func (c *MSGraphClient) CreateServicePrincipal(ctx context.Context, appID string, attributes CustomSecurityAttributes, startDate time.Time, endDate time.Time) (string, string, error) {
 	spReq := models.NewServicePrincipal()
 	spReq.SetAppId(&appID)
 
+	if len(attributes) > 0 {
+		csa, err := attributes.toGraph()
+		if err != nil {
+			return "", "", err
+		}
+		spReq.SetCustomSecurityAttributes(csa)
+	}
+
 	sp, err := c.client.ServicePrincipals().Post(ctx, spReq, nil)
 	if err != nil {
 		return "", "", err
@@ -95,6 +227,30 @@ func (c *MSGraphClient) GetServicePrincipalByID(ctx context.Context, spObjectID
 	return getServicePrincipalResponse(sp), nil
 }
 
+func (c *MSGraphClient) ListServicePrincipalGroups(ctx context.Context, spObjectID string) ([]Group, error) {
+	groups := c.client.ServicePrincipals().ByServicePrincipalId(spObjectID).MemberOf().GraphGroup()
+	groupList, err := groups.Get(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Group
+	for {
+		for _, group := range groupList.GetValue() {
+			result = append(result, getGroupResponse(group))
+		}
+
+		nextLink := groupList.GetOdataNextLink()
+		if nextLink == nil || *nextLink == "" {
+			return result, nil
+		}
+		groupList, err = groups.WithUrl(*nextLink).Get(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 func getServicePrincipalResponse(sp models.ServicePrincipalable) ServicePrincipal {
 	if sp != nil {
 		return ServicePrincipal{
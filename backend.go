@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/locksutil"
@@ -35,6 +36,28 @@ type azureSecretBackend struct {
 	// operation that must be locked per Application Object ID.
 	appLocks       []*locksutil.LockEntry
 	updatePassword bool
+
+	// Changes to a role and the Azure objects it manages are locked per role
+	// name.
+	roleLocks []*locksutil.LockEntry
+
+	// Rotations of the keys of a storage role are locked per storage role
+	// name. Changes to the other non-SP roles (SAS, ACR, Cosmos DB and Service
+	// Bus roles) use the same locks, keyed by their storage path.
+	storageRoleLocks []*locksutil.LockEntry
+
+	// Creating a storage, Cosmos DB or Service Bus role is locked per resource
+	// ID, so that two roles can't take over the keys of the same resource.
+	resourceLocks []*locksutil.LockEntry
+
+	// lastReconcile is the last time the periodic func reconciled roles.
+	lastReconcile time.Time
+
+	// issueLocks serialize issuing credentials for roles that limit their
+	// number of active credentials. issueLimiters holds the issue rate
+	// limiter of each role, keyed by role name.
+	issueLocks    []*locksutil.LockEntry
+	issueLimiters sync.Map
 }
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
@@ -63,14 +86,29 @@ func backend() *azureSecretBackend {
 		Paths: framework.PathAppend(
 			pathsRole(&b),
 			[]*framework.Path{
+				pathRoleReconcile(&b),
+				pathRoleExport(&b),
+				pathRoleImport(&b),
+				pathRoleValidate(&b),
+				pathRoleHistory(&b),
+				pathRoleRollback(&b),
 				pathConfig(&b),
 				pathServicePrincipal(&b),
 				pathRotateRoot(&b),
 			},
+			pathsStorageRole(&b),
+			pathsSASRole(&b),
+			pathsACRRole(&b),
+			pathsCosmosDBRole(&b),
+			pathsServiceBusRole(&b),
+			pathsAKSRole(&b),
 		),
 		Secrets: []*framework.Secret{
 			secretServicePrincipal(&b),
 			secretStaticServicePrincipal(&b),
+			secretACRToken(&b),
+			secretAKS(&b),
+			secretManagedIdentity(&b),
 		},
 		BackendType: logical.TypeLogical,
 		Invalidate:  b.invalidate,
@@ -84,6 +122,10 @@ func backend() *azureSecretBackend {
 	}
 	b.getProvider = newAzureProvider
 	b.appLocks = locksutil.CreateLocks()
+	b.roleLocks = locksutil.CreateLocks()
+	b.storageRoleLocks = locksutil.CreateLocks()
+	b.resourceLocks = locksutil.CreateLocks()
+	b.issueLocks = locksutil.CreateLocks()
 
 	return &b
 }
@@ -98,78 +140,107 @@ func (b *azureSecretBackend) periodicFunc(ctx context.Context, sys *logical.Requ
 		!replicationState.HasState(consts.ReplicationPerformanceStandby) {
 
 		b.Logger().Debug("starting periodic func")
-		if !b.updatePassword {
-			b.Logger().Debug("periodic func", "rotate-root", "no rotate-root update")
-			return nil
-		}
 
-		config, err := b.getConfig(ctx, sys.Storage)
-		if err != nil {
-			return err
+		var merr *multierror.Error
+		if err := b.swapRootCredentials(ctx, sys); err != nil {
+			merr = multierror.Append(merr, err)
 		}
-
-		// Config can be nil if deleted or when the engine is enabled
-		// but not yet configured.
-		if config == nil {
-			return nil
+		if err := b.reconcileRoles(ctx, sys); err != nil {
+			merr = multierror.Append(merr, err)
 		}
-
-		// Password should be at least a minute old before we process it
-		if config.NewClientSecret == "" || (time.Since(config.NewClientSecretCreated) < time.Minute) {
-			return nil
+		if err := b.rotateStorageRoles(ctx, sys); err != nil {
+			merr = multierror.Append(merr, err)
 		}
-
-		b.Logger().Debug("periodic func", "rotate-root", "new password detected, swapping in storage")
-		client, err := b.getClient(ctx, sys.Storage)
-		if err != nil {
-			return err
+		if err := b.rotateCosmosDBRoles(ctx, sys); err != nil {
+			merr = multierror.Append(merr, err)
 		}
-
-		apps, err := client.provider.ListApplications(ctx, fmt.Sprintf("appId eq '%s'", config.ClientID))
-		if err != nil {
-			return err
+		if err := b.rotateServiceBusRoles(ctx, sys); err != nil {
+			merr = multierror.Append(merr, err)
 		}
+		return merr.ErrorOrNil()
+	}
 
-		if len(apps) == 0 {
-			return fmt.Errorf("no application found")
-		}
-		if len(apps) > 1 {
-			return fmt.Errorf("multiple applications found - double check your client_id")
-		}
+	return nil
+}
 
-		app := apps[0]
+// swapRootCredentials replaces the root credentials in the config with the
+// new password created by rotate-root once it is at least a minute old.
+func (b *azureSecretBackend) swapRootCredentials(ctx context.Context, sys *logical.Request) (err error) {
+	if !b.updatePassword {
+		b.Logger().Debug("periodic func", "rotate-root", "no rotate-root update")
+		return nil
+	}
 
-		credsToDelete := []string{}
-		for _, cred := range app.PasswordCredentials {
-			if cred.KeyID != config.NewClientSecretKeyID {
-				credsToDelete = append(credsToDelete, cred.KeyID)
-			}
-		}
+	config, err := b.getConfig(ctx, sys.Storage)
+	if err != nil {
+		return err
+	}
 
-		if len(credsToDelete) != 0 {
-			b.Logger().Debug("periodic func", "rotate-root", "removing old passwords from Azure")
-			err = removeApplicationPasswords(ctx, client.provider, app.AppObjectID, credsToDelete...)
-			if err != nil {
-				return err
-			}
-		}
+	// Config can be nil if deleted or when the engine is enabled
+	// but not yet configured.
+	if config == nil {
+		return nil
+	}
+
+	// Password should be at least a minute old before we process it
+	if config.NewClientSecret == "" || (time.Since(config.NewClientSecretCreated) < time.Minute) {
+		return nil
+	}
+
+	b.Logger().Debug("periodic func", "rotate-root", "new password detected, swapping in storage")
+	defer func() {
+		recordRootSwap(err)
+	}()
+
+	client, err := b.getClient(ctx, sys.Storage)
+	if err != nil {
+		return err
+	}
+
+	apps, err := client.provider.ListApplications(ctx, fmt.Sprintf("appId eq '%s'", config.ClientID))
+	if err != nil {
+		return err
+	}
+
+	if len(apps) == 0 {
+		return fmt.Errorf("no application found")
+	}
+	if len(apps) > 1 {
+		return fmt.Errorf("multiple applications found - double check your client_id")
+	}
+
+	app := apps[0]
 
-		b.Logger().Debug("periodic func", "rotate-root", "updating config with new password")
-		config.ClientSecret = config.NewClientSecret
-		config.ClientSecretKeyID = config.NewClientSecretKeyID
-		config.RootPasswordExpirationDate = config.NewClientSecretExpirationDate
-		config.NewClientSecret = ""
-		config.NewClientSecretKeyID = ""
-		config.NewClientSecretCreated = time.Time{}
+	credsToDelete := []string{}
+	for _, cred := range app.PasswordCredentials {
+		if cred.KeyID != config.NewClientSecretKeyID {
+			credsToDelete = append(credsToDelete, cred.KeyID)
+		}
+	}
 
-		err = b.saveConfig(ctx, config, sys.Storage)
+	if len(credsToDelete) != 0 {
+		b.Logger().Debug("periodic func", "rotate-root", "removing old passwords from Azure")
+		err = removeApplicationPasswords(ctx, client.provider, app.AppObjectID, credsToDelete...)
 		if err != nil {
 			return err
 		}
+	}
 
-		b.updatePassword = false
+	b.Logger().Debug("periodic func", "rotate-root", "updating config with new password")
+	config.ClientSecret = config.NewClientSecret
+	config.ClientSecretKeyID = config.NewClientSecretKeyID
+	config.RootPasswordExpirationDate = config.NewClientSecretExpirationDate
+	config.NewClientSecret = ""
+	config.NewClientSecretKeyID = ""
+	config.NewClientSecretCreated = time.Time{}
+
+	err = b.saveConfig(ctx, config, sys.Storage)
+	if err != nil {
+		return err
 	}
 
+	b.updatePassword = false
+
 	return nil
 }
 
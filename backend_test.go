@@ -26,6 +26,12 @@ var (
 )
 
 func getTestBackendMocked(t *testing.T, initConfig bool) (*azureSecretBackend, logical.Storage) {
+	return getTestBackendMockedWithEvents(t, initConfig, nil)
+}
+
+// getTestBackendMockedWithEvents is getTestBackendMocked for a backend that
+// sends its events to the given sender.
+func getTestBackendMockedWithEvents(t *testing.T, initConfig bool, events logical.EventSender) (*azureSecretBackend, logical.Storage) {
 	b := backend()
 
 	config := &logical.BackendConfig{
@@ -34,14 +40,20 @@ func getTestBackendMocked(t *testing.T, initConfig bool) (*azureSecretBackend, l
 			DefaultLeaseTTLVal: defaultLeaseTTLHr,
 			MaxLeaseTTLVal:     maxLeaseTTLHr,
 		},
-		StorageView: &logical.InmemStorage{},
+		StorageView:  &logical.InmemStorage{},
+		EventsSender: events,
 	}
 	err := b.Setup(context.Background(), config)
 	if err != nil {
 		t.Fatalf("unable to create backend: %v", err)
 	}
 
-	b.settings = new(clientSettings)
+	// The settings match the environment of the config
+	cloudConfig, err := cloudConfigFromName("AZURECHINACLOUD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.settings = &clientSettings{CloudConfig: cloudConfig}
 	mockProvider := newMockProvider()
 	b.getProvider = func(s *clientSettings) (AzureProvider, error) {
 		return mockProvider, nil
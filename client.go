@@ -12,22 +12,37 @@ import (
 	"os"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
 	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/helper/template"
 	"github.com/hashicorp/vault/sdk/logical"
 
 	"github.com/hashicorp/vault-plugin-secrets-azure/api"
 )
 
 const (
-	appNamePrefix  = "vault-"
 	retryTimeout   = 80 * time.Second
 	clientLifetime = 30 * time.Minute
 
+	// The default name templates match the application names used before
+	// name_template was configurable.
+	defaultAppNameTemplate          = `vault-{{ uuid }}`
+	defaultPersistedAppNameTemplate = `vault-{{ .RoleName }}-{{ unix_time }}`
+
+	// Azure limits application display names to 120 characters.
+	maxAppNameLength = 120
+
+	// Tags recording the origin of applications created by Vault.
+	vaultMountAccessorTagPrefix = "vault_mount_accessor:"
+	vaultEntityIDTagPrefix      = "vault_entity_id:"
+
 	azurePublicCloudBaseURI = "https://graph.microsoft.com"
 	azureChinaCloudBaseURI  = "https://microsoftgraph.chinacloudapi.cn"
 	azureUSGovCloudBaseURI  = "https://graph.microsoft.us"
@@ -36,6 +51,14 @@ const (
 	azureUSGovCloudEnvName  = "AZUREUSGOVERNMENTCLOUD"
 
 	errInvalidApplicationObject = "does not reference a valid application object"
+
+	// How a service principal is added to an Azure group
+	groupRelationshipMember = "member"
+	groupRelationshipOwner  = "owner"
+
+	// Bounds on the number of groups a group filter may select
+	defaultGroupFilterMatches = 10
+	maxGroupFilterMatches     = 100
 )
 
 // client offers higher level Azure operations that provide a simpler interface
@@ -52,33 +75,118 @@ func (c *client) Valid() bool {
 	return c != nil && time.Now().Before(c.expiration)
 }
 
-// createApp creates a new Azure application.
+// createApp creates a new Azure application from the given parameters.
 // An Application is a needed to create service principals used by
 // the caller for authentication.
-func (c *client) createApp(ctx context.Context, signInAudience string, tags []string) (app api.Application, err error) {
-	// TODO: Make this name customizable with the same logic as username customization
-	name := uuid.New().String()
+func (c *client) createApp(ctx context.Context, params api.Application) (app api.Application, err error) {
+	return c.provider.CreateApplication(ctx, params)
+}
 
-	name = appNamePrefix + name
+// newApplication returns the parameters of a new application for the role.
+// The mount accessor and entity ID of the request are recorded as tags so
+// that the application can be traced back to its origin in Vault. The token
+// accessor isn't, as tags can be read by anyone in the tenant and an accessor
+// is enough to look up or revoke its token.
+func (b *azureSecretBackend) newApplication(ctx context.Context, req *logical.Request, roleName string, role *roleEntry) (api.Application, error) {
+	name, err := b.generateAppName(ctx, req, roleName, role)
+	if err != nil {
+		return api.Application{}, err
+	}
+
+	tags := append([]string{}, role.Tags...)
+	if req.MountAccessor != "" {
+		tags = append(tags, vaultMountAccessorTagPrefix+req.MountAccessor)
+	}
+	if req.EntityID != "" {
+		tags = append(tags, vaultEntityIDTagPrefix+req.EntityID)
+	}
 
-	result, err := c.provider.CreateApplication(ctx, name, signInAudience, tags)
+	return api.Application{
+		DisplayName:                name,
+		SignInAudience:             role.SignInAudience,
+		Description:                role.Description,
+		Notes:                      role.Notes,
+		ServiceManagementReference: role.ServiceManagementReference,
+		Tags:                       tags,
+		Owners:                     role.Owners,
+	}, nil
+}
 
-	return result, err
+// appNameMetadata is the data available to application name templates.
+type appNameMetadata struct {
+	RoleName    string
+	DisplayName string
+	EntityID    string
 }
 
-func (c *client) createAppWithName(ctx context.Context, rolename string, signInAudience string, tags []string) (app api.Application, err error) {
-	intSuffix := fmt.Sprintf("%d", time.Now().Unix())
-	name := fmt.Sprintf("%s%s-%s", appNamePrefix, rolename, intSuffix)
+// generateAppName renders the display name of a new application for the role.
+// The role's name_template takes precedence over the one in the config.
+func (b *azureSecretBackend) generateAppName(ctx context.Context, req *logical.Request, roleName string, role *roleEntry) (string, error) {
+	nameTemplate := defaultAppNameTemplate
+	if role.PersistApp {
+		nameTemplate = defaultPersistedAppNameTemplate
+	}
+
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return "", err
+	}
+	if config != nil && config.NameTemplate != "" {
+		nameTemplate = config.NameTemplate
+	}
+	if role.NameTemplate != "" {
+		nameTemplate = role.NameTemplate
+	}
 
-	result, err := c.provider.CreateApplication(ctx, name, signInAudience, tags)
+	return renderAppName(nameTemplate, appNameMetadata{
+		RoleName:    roleName,
+		DisplayName: req.DisplayName,
+		EntityID:    req.EntityID,
+	})
+}
 
-	return result, err
+// validateNameTemplate checks that a name template can be parsed and renders
+// a valid application name.
+func validateNameTemplate(nameTemplate string) error {
+	_, err := renderAppName(nameTemplate, appNameMetadata{
+		RoleName:    "role",
+		DisplayName: "token",
+		EntityID:    "00000000-0000-0000-0000-000000000000",
+	})
+	return err
+}
+
+func renderAppName(nameTemplate string, metadata appNameMetadata) (string, error) {
+	tmpl, err := template.NewTemplate(template.Template(nameTemplate))
+	if err != nil {
+		return "", fmt.Errorf("invalid name_template: %w", err)
+	}
+
+	name, err := tmpl.Generate(metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate application name: %w", err)
+	}
+
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("application name must not be empty")
+	}
+	if utf8.RuneCountInString(name) > maxAppNameLength {
+		return "", fmt.Errorf("application name %q is longer than %d characters", name, maxAppNameLength)
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("application name %q contains an invalid character %q", name, r)
+		}
+	}
+
+	return name, nil
 }
 
 // createSP creates a new service principal.
 func (c *client) createSP(
 	ctx context.Context,
 	app api.Application,
+	attributes api.CustomSecurityAttributes,
 	duration time.Duration) (spID string, password string, err error) {
 
 	type idPass struct {
@@ -86,9 +194,9 @@ func (c *client) createSP(
 		Password string
 	}
 
-	resultRaw, err := retry(ctx, func() (interface{}, bool, error) {
+	resultRaw, err := retry(ctx, "CreateServicePrincipal", func() (interface{}, bool, error) {
 		now := time.Now()
-		spID, password, err := c.provider.CreateServicePrincipal(ctx, app.AppID, now, now.Add(duration))
+		spID, password, err := c.provider.CreateServicePrincipal(ctx, app.AppID, attributes, now, now.Add(duration))
 
 		// Propagation delays within Azure can cause this error occasionally, so don't quit on it.
 		if err != nil && (strings.Contains(err.Error(), errInvalidApplicationObject)) {
@@ -162,6 +270,38 @@ func (c *client) generateUUIDs(length int) ([]string, error) {
 	return assignmentIDs, nil
 }
 
+// lookupAzureRole looks up the definition of an Azure role by its ID or, if
+// none is set, by its name, and sets both on the role. Roles that can't be
+// found are returned as an error response.
+func (c *client) lookupAzureRole(ctx context.Context, r *AzureRole) (*logical.Response, error) {
+	var roleDef armauthorization.RoleDefinition
+	if r.RoleID != "" {
+		roleDefResp, err := c.provider.GetRoleDefinitionByID(ctx, r.RoleID)
+		if err != nil {
+			if strings.Contains(err.Error(), "RoleDefinitionDoesNotExist") {
+				return logical.ErrorResponse("no role found for role_id: '%s'", r.RoleID), nil
+			}
+			return nil, fmt.Errorf("unable to lookup Azure role: %w", err)
+		}
+
+		roleDef = roleDefResp.RoleDefinition
+	} else {
+		defs, err := c.findRoles(ctx, r.RoleName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to lookup Azure role: %w", err)
+		}
+		if l := len(defs); l == 0 {
+			return logical.ErrorResponse("no role found for role_name: '%s'", r.RoleName), nil
+		} else if l > 1 {
+			return logical.ErrorResponse("multiple matches found for role_name: '%s'. Specify role by ID instead.", r.RoleName), nil
+		}
+		roleDef = *defs[0]
+	}
+
+	r.RoleName, r.RoleID = *roleDef.Name, *roleDef.ID
+	return nil, nil
+}
+
 // assignRoles assigns Azure roles to a service principal.
 func (c *client) assignRoles(ctx context.Context, spID string, roles []*AzureRole, assignmentIDs []string) ([]string, error) {
 	var ids []string
@@ -171,7 +311,7 @@ func (c *client) assignRoles(ctx context.Context, spID string, roles []*AzureRol
 	}
 
 	for i, role := range roles {
-		resultRaw, err := retry(ctx, func() (interface{}, bool, error) {
+		resultRaw, err := retry(ctx, "CreateRoleAssignment", func() (interface{}, bool, error) {
 			if assignmentIDs[i] == "" {
 				return nil, true, fmt.Errorf("assignmentID at index %d was empty", i)
 			}
@@ -228,11 +368,17 @@ func (c *client) unassignRoles(ctx context.Context, roleIDs []string) error {
 	return merr.ErrorOrNil()
 }
 
-// addGroupMemberships adds the service principal to the Azure groups.
+// addGroupMemberships adds the service principal to the Azure groups, as a
+// member or as an owner depending on the relationship of each group.
 func (c *client) addGroupMemberships(ctx context.Context, spID string, groups []*AzureGroup) error {
 	for _, group := range groups {
-		_, err := retry(ctx, func() (interface{}, bool, error) {
-			err := c.provider.AddGroupMember(ctx, group.ObjectID, spID)
+		_, err := retry(ctx, "AddGroupMembership", func() (interface{}, bool, error) {
+			var err error
+			if group.isOwner() {
+				err = c.provider.AddGroupOwner(ctx, group.ObjectID, spID)
+			} else {
+				err = c.provider.AddGroupMember(ctx, group.ObjectID, spID)
+			}
 
 			// Propagation delays within Azure can cause this error occasionally, so don't quit on it.
 			if err != nil && strings.Contains(err.Error(), "Request_ResourceNotFound") {
@@ -271,17 +417,97 @@ func (c *client) removeGroupMemberships(ctx context.Context, servicePrincipalObj
 	return merr.ErrorOrNil()
 }
 
+// removeGroupOwnerships removes the passed service principal from the owners
+// of the passed groups. As with group memberships, an attempt is made to
+// remove all ownerships, and not return immediately if there is an error.
+func (c *client) removeGroupOwnerships(ctx context.Context, servicePrincipalObjectID string, groupIDs []string) error {
+	var merr *multierror.Error
+
+	for _, id := range groupIDs {
+		if err := c.provider.RemoveGroupOwner(ctx, id, servicePrincipalObjectID); err != nil {
+			// If an ownership was removed manually then Azure returns a error with a Status=404
+			if strings.Contains(err.Error(), "Status=404") {
+				continue
+			}
+			merr = multierror.Append(merr, fmt.Errorf("error removing group ownership: %w", err))
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
 // groupObjectIDs is a helper for converting a list of AzureGroup
-// objects to a list of their object IDs.
+// objects to a list of the object IDs of the groups that the service
+// principal is a member of.
 func groupObjectIDs(groups []*AzureGroup) []string {
 	groupIDs := make([]string, 0, len(groups))
 	for _, group := range groups {
-		groupIDs = append(groupIDs, group.ObjectID)
+		if !group.isOwner() {
+			groupIDs = append(groupIDs, group.ObjectID)
+		}
+	}
+	return groupIDs
+}
 
+// groupOwnerObjectIDs returns the object IDs of the groups that the service
+// principal is an owner of.
+func groupOwnerObjectIDs(groups []*AzureGroup) []string {
+	groupIDs := make([]string, 0)
+	for _, group := range groups {
+		if group.isOwner() {
+			groupIDs = append(groupIDs, group.ObjectID)
+		}
 	}
 	return groupIDs
 }
 
+// resolveGroupFilters replaces the groups that are selected by a filter with
+// the groups that match the filter. A filter that matches more groups than
+// its maximum is an error. Groups that are selected more than once with the
+// same relationship are only included once.
+func (c *client) resolveGroupFilters(ctx context.Context, groups []*AzureGroup) ([]*AzureGroup, error) {
+	resolved := make([]*AzureGroup, 0, len(groups))
+	seen := make(map[string]bool)
+	add := func(g *AzureGroup) {
+		key := strings.ToLower(g.ObjectID) + "||" + g.Relationship
+		if !seen[key] {
+			seen[key] = true
+			resolved = append(resolved, g)
+		}
+	}
+
+	for _, group := range groups {
+		if group.Filter == "" {
+			add(group)
+			continue
+		}
+
+		maxMatches := group.MaxMatches
+		if maxMatches == 0 {
+			maxMatches = defaultGroupFilterMatches
+		}
+
+		// Ask for one more group than allowed to detect too many matches
+		matches, err := c.provider.QueryGroups(ctx, group.Filter, maxMatches+1)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query Azure groups with filter '%s': %w", group.Filter, err)
+		}
+		if len(matches) > maxMatches {
+			return nil, fmt.Errorf("group filter '%s' matches more than %d groups", group.Filter, maxMatches)
+		}
+
+		for _, match := range matches {
+			add(&AzureGroup{
+				GroupName:    match.DisplayName,
+				ObjectID:     match.ID,
+				Relationship: group.Relationship,
+			})
+		}
+	}
+
+	return resolved, nil
+}
+
 // search for roles by name
 func (c *client) findRoles(ctx context.Context, roleName string) ([]*armauthorization.RoleDefinition, error) {
 	return c.provider.ListRoleDefinitions(ctx, fmt.Sprintf("subscriptions/%s", c.settings.SubscriptionID), fmt.Sprintf("roleName eq '%s'", roleName))
@@ -290,7 +516,37 @@ func (c *client) findRoles(ctx context.Context, roleName string) ([]*armauthoriz
 // findGroups is used to find a group by name. It returns all groups matching
 // the provided name.
 func (c *client) findGroups(ctx context.Context, groupName string) ([]api.Group, error) {
-	return c.provider.ListGroups(ctx, fmt.Sprintf("displayName eq '%s'", groupName))
+	return c.provider.ListGroups(ctx, fmt.Sprintf("displayName eq '%s'", escapeODataString(groupName)))
+}
+
+// escapeODataString escapes the quotes of a value to be put in a string
+// literal of an OData filter.
+func escapeODataString(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+// lookupGroup finds a group by object ID or, if no ID is given, by name. A
+// lookup by name must match exactly one group.
+func (c *client) lookupGroup(ctx context.Context, groupName, objectID string) (api.Group, error) {
+	if objectID != "" {
+		group, err := c.provider.GetGroup(ctx, objectID)
+		if err != nil {
+			return api.Group{}, fmt.Errorf("unable to lookup Azure group %q: %w", objectID, err)
+		}
+		return group, nil
+	}
+
+	groups, err := c.findGroups(ctx, groupName)
+	if err != nil {
+		return api.Group{}, fmt.Errorf("unable to lookup Azure group %q: %w", groupName, err)
+	}
+	if l := len(groups); l == 0 {
+		return api.Group{}, fmt.Errorf("no group found for group_name: '%s'", groupName)
+	} else if l > 1 {
+		return api.Group{}, fmt.Errorf("multiple matches found for group_name: '%s'", groupName)
+	}
+
+	return groups[0], nil
 }
 
 // clientSettings is used by a client to configure the connections to Azure.
@@ -301,8 +557,15 @@ type clientSettings struct {
 	ClientID       string
 	ClientSecret   string
 	GraphURI       string
+	Environment    string
 	CloudConfig    cloud.Configuration
 	PluginEnv      *logical.PluginEnvironment
+	Logger         hclog.Logger
+}
+
+// keyVault returns the Key Vault service of the configured cloud.
+func (s *clientSettings) keyVault() cloud.ServiceConfiguration {
+	return s.CloudConfig.Services[keyVaultServiceName]
 }
 
 // getClientSettings creates a new clientSettings object.
@@ -318,6 +581,7 @@ func (b *azureSecretBackend) getClientSettings(ctx context.Context, config *azur
 	}
 
 	settings := new(clientSettings)
+	settings.Logger = b.Logger()
 
 	settings.ClientID = firstAvailable(os.Getenv("AZURE_CLIENT_ID"), config.ClientID)
 	settings.ClientSecret = firstAvailable(os.Getenv("AZURE_CLIENT_SECRET"), config.ClientSecret)
@@ -333,9 +597,10 @@ func (b *azureSecretBackend) getClientSettings(ctx context.Context, config *azur
 	}
 
 	envName := firstAvailable(os.Getenv("AZURE_ENVIRONMENT"), config.Environment, "AZUREPUBLICCLOUD")
+	settings.Environment = envName
 	if envName == "" {
 		// Default to Azure public cloud
-		settings.CloudConfig = cloud.AzurePublic
+		settings.CloudConfig, _ = cloudConfigFromName(azurePublicCloudEnvName)
 		settings.GraphURI = azurePublicCloudBaseURI
 	} else {
 		var err error
@@ -359,12 +624,22 @@ func (b *azureSecretBackend) getClientSettings(ctx context.Context, config *azur
 	return settings, nil
 }
 
+// keyVaultServiceName is the data plane of key vaults in the cloud
+// configurations. Its endpoint is the DNS suffix of the key vaults of the
+// cloud, and its audience the resource that tokens for them are scoped to.
+const keyVaultServiceName cloud.ServiceName = "keyVault"
+
 func cloudConfigFromName(name string) (cloud.Configuration, error) {
 	configs := map[string]cloud.Configuration{
 		azureChinaCloudEnvName:  cloud.AzureChina,
 		azurePublicCloudEnvName: cloud.AzurePublic,
 		azureUSGovCloudEnvName:  cloud.AzureGovernment,
 	}
+	keyVaults := map[string]cloud.ServiceConfiguration{
+		azureChinaCloudEnvName:  {Endpoint: "vault.azure.cn", Audience: "https://vault.azure.cn"},
+		azurePublicCloudEnvName: {Endpoint: "vault.azure.net", Audience: "https://vault.azure.net"},
+		azureUSGovCloudEnvName:  {Endpoint: "vault.usgovcloudapi.net", Audience: "https://vault.usgovcloudapi.net"},
+	}
 
 	name = strings.ToUpper(name)
 	c, ok := configs[name]
@@ -372,6 +647,15 @@ func cloudConfigFromName(name string) (cloud.Configuration, error) {
 		return c, fmt.Errorf("err: no cloud configuration matching the name %q", name)
 	}
 
+	// The configurations of the SDK are shared, so the Key Vault service is
+	// added to a copy of their services.
+	services := make(map[cloud.ServiceName]cloud.ServiceConfiguration, len(c.Services)+1)
+	for k, v := range c.Services {
+		services[k] = v
+	}
+	services[keyVaultServiceName] = keyVaults[name]
+	c.Services = services
+
 	return c, nil
 }
 
@@ -397,8 +681,9 @@ func graphURIFromName(name string) (string, error) {
 //   - the context is cancelled
 //   - 80 seconds elapses. Vault's default request timeout is 90s; we want to expire before then.
 //
-// Delays are random but will average 5 seconds.
-func retry(ctx context.Context, f func() (interface{}, bool, error)) (interface{}, error) {
+// Delays are random but will average 5 seconds. The attempts made and the time
+// spent waiting are emitted as metrics for the operation.
+func retry(ctx context.Context, operation string, f func() (interface{}, bool, error)) (interface{}, error) {
 	delayTimer := time.NewTimer(0)
 	if _, hasTimeout := ctx.Deadline(); !hasTimeout {
 		var cancel func()
@@ -406,16 +691,27 @@ func retry(ctx context.Context, f func() (interface{}, bool, error)) (interface{
 		defer cancel()
 	}
 
+	var attempts int
+	var waitStart time.Time
+	defer func() {
+		recordRetry(operation, attempts, waitStart)
+	}()
+
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	var lastErr error
 	for {
 		select {
 		case <-delayTimer.C:
+			attempts++
 			result, done, err := f()
 			if done {
 				return result, err
 			}
 			lastErr = err
+			if waitStart.IsZero() {
+				waitStart = time.Now()
+			}
+			tracePropagationWait(ctx, operation, attempts)
 
 			delay := time.Duration(2+rng.Intn(6)) * time.Second
 			delayTimer.Reset(delay)
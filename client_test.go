@@ -17,7 +17,7 @@ func TestRetry(t *testing.T) {
 	}
 	t.Parallel()
 	t.Run("First try success", func(t *testing.T) {
-		_, err := retry(context.Background(), func() (interface{}, bool, error) {
+		_, err := retry(context.Background(), "test", func() (interface{}, bool, error) {
 			return nil, true, nil
 		})
 		assertErrorIsNil(t, err)
@@ -27,7 +27,7 @@ func TestRetry(t *testing.T) {
 		t.Parallel()
 		count := 0
 
-		_, err := retry(context.Background(), func() (interface{}, bool, error) {
+		_, err := retry(context.Background(), "test", func() (interface{}, bool, error) {
 			count++
 			if count >= 3 {
 				return nil, true, nil
@@ -41,7 +41,7 @@ func TestRetry(t *testing.T) {
 
 	t.Run("Error on attempt", func(t *testing.T) {
 		t.Parallel()
-		_, err := retry(context.Background(), func() (interface{}, bool, error) {
+		_, err := retry(context.Background(), "test", func() (interface{}, bool, error) {
 			return nil, true, errors.New("Fail")
 		})
 		if err == nil || !strings.Contains(err.Error(), "Fail") {
@@ -61,7 +61,7 @@ func TestRetry(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		called := 0
-		_, err := retry(ctx, func() (interface{}, bool, error) {
+		_, err := retry(ctx, "test", func() (interface{}, bool, error) {
 			called++
 			return nil, false, nil
 		})
@@ -85,7 +85,7 @@ func TestRetry(t *testing.T) {
 		}()
 
 		start := time.Now()
-		_, err := retry(ctx, func() (interface{}, bool, error) {
+		_, err := retry(ctx, "test", func() (interface{}, bool, error) {
 			return nil, false, nil
 		})
 		elapsed := time.Now().Sub(start)
@@ -114,3 +114,56 @@ func assertDuration(t *testing.T, actual, expected, delta time.Duration) {
 		t.Fatalf("Actual duration %s does not equal expected %s with delta %s", actual, expected, delta)
 	}
 }
+
+func TestRenderAppName(t *testing.T) {
+	metadata := appNameMetadata{
+		RoleName:    "my-role",
+		DisplayName: "token",
+		EntityID:    "b7a41a9c-2b58-4fd2-8b87-3ad9d2f6a8e0",
+	}
+
+	tests := map[string]struct {
+		template string
+		expected string
+		wantErr  bool
+	}{
+		"role and display name": {
+			template: "vault-{{ .RoleName }}-{{ .DisplayName }}",
+			expected: "vault-my-role-token",
+		},
+		"entity ID": {
+			template: "{{ .EntityID }}",
+			expected: "b7a41a9c-2b58-4fd2-8b87-3ad9d2f6a8e0",
+		},
+		"too long": {
+			template: "{{ .RoleName }}" + strings.Repeat("a", maxAppNameLength),
+			wantErr:  true,
+		},
+		"empty": {
+			template: "{{ .Missing }}",
+			wantErr:  true,
+		},
+		"control character": {
+			template: "vault-\t{{ .RoleName }}",
+			wantErr:  true,
+		},
+		"invalid template": {
+			template: "vault-{{ .RoleName",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := renderAppName(tc.template, metadata)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got name %q", actual)
+				}
+				return
+			}
+			assertErrorIsNil(t, err)
+			equal(t, tc.expected, actual)
+		})
+	}
+}
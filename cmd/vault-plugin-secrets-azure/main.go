@@ -4,12 +4,16 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
 	azuresecrets "github.com/hashicorp/vault-plugin-secrets-azure"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/plugin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
@@ -20,14 +24,45 @@ func main() {
 	tlsConfig := apiClientMeta.GetTLSConfig()
 	tlsProviderFunc := api.VaultPluginTLSProvider(tlsConfig)
 
-	err := plugin.ServeMultiplex(&plugin.ServeOpts{
+	shutdown, err := setupTracing(context.Background())
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	err = plugin.ServeMultiplex(&plugin.ServeOpts{
 		BackendFactoryFunc: azuresecrets.Factory,
 		// set the TLSProviderFunc so that the plugin maintains backwards
 		// compatibility with Vault versions that don’t support plugin AutoMTLS
 		TLSProviderFunc: tlsProviderFunc,
 	})
+	shutdown(context.Background())
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 }
+
+// setupTracing exports the spans of the plugin over OTLP/HTTP when an OTLP
+// endpoint is configured with the standard OTEL_EXPORTER_OTLP_* environment
+// variables. The service name and resource attributes are read from
+// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES. The returned function flushes
+// the spans that were not exported yet.
+func setupTracing(ctx context.Context) (func(context.Context), error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) {}, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) {
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Types of the events sent for the lifecycle of credentials. Their metadata
+// identifies the role and Azure objects involved, and never holds secrets.
+const (
+	eventCredsCreate = "azure/creds-create"
+	eventCredsRenew  = "azure/creds-renew"
+	eventCredsRevoke = "azure/creds-revoke"
+	eventRotateRoot  = "azure/rotate-root"
+	eventWALRollback = "azure/wal-rollback"
+	eventAppDelete   = "azure/app-delete"
+)
+
+// sendEvent sends an event with the metadata pairs. Events are best effort:
+// failures are logged rather than failing the operation, and nothing is sent
+// if events aren't enabled in Vault.
+func (b *azureSecretBackend) sendEvent(ctx context.Context, eventType string, metadataPairs ...string) {
+	err := logical.SendEvent(ctx, b, eventType, metadataPairs...)
+	if err != nil && !errors.Is(err, framework.ErrNoEvents) {
+		b.Logger().Error("error sending event", "type", eventType, "err", err)
+	}
+}
+
+// sendSecretEvent sends an event for an operation on a lease issued for a
+// role. The metadata is taken from the internal data of the lease.
+func (b *azureSecretBackend) sendSecretEvent(ctx context.Context, eventType string, operation string, secret *logical.Secret) {
+	metadata := []string{
+		logical.EventMetadataOperation, operation,
+		logical.EventMetadataModified, "true",
+	}
+
+	for _, key := range []string{"role", "secret_type", "app_object_id", "sp_object_id", "identity_id"} {
+		if v, ok := secret.InternalData[key].(string); ok && v != "" {
+			metadata = append(metadata, key, v)
+		}
+	}
+
+	// Scopes are kept as a []string until the lease is stored, after which they
+	// are decoded as a []interface{}.
+	var scopes []string
+	switch v := secret.InternalData["scopes"].(type) {
+	case []string:
+		scopes = v
+	case []interface{}:
+		for _, scope := range v {
+			if s, ok := scope.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	if len(scopes) > 0 {
+		metadata = append(metadata, "scopes", strings.Join(scopes, ","))
+	}
+
+	b.sendEvent(ctx, eventType, metadata...)
+}
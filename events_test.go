@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestCredentialEvents(t *testing.T) {
+	events := logical.NewMockEventSender()
+	b, s := getTestBackendMockedWithEvents(t, true, events)
+	testRoleCreate(t, b, s, "test_role", testRole)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	clientSecret := resp.Data["client_secret"].(string)
+	secret := resp.Secret
+	secret.IssueTime = time.Now()
+	fakeSaveLoad(secret)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	equal(t, 3, len(events.Events))
+	for i, expected := range []struct {
+		eventType string
+		operation string
+	}{
+		{eventCredsCreate, "create"},
+		{eventCredsRenew, "renew"},
+		{eventCredsRevoke, "revoke"},
+	} {
+		event := events.Events[i]
+		equal(t, logical.EventType(expected.eventType), event.Type)
+
+		metadata := event.Event.Metadata.AsMap()
+		equal(t, expected.operation, metadata[logical.EventMetadataOperation])
+		equal(t, "test_role", metadata["role"])
+		equal(t, SecretTypeSP, metadata["secret_type"])
+		equal(t, secret.InternalData["app_object_id"], metadata["app_object_id"])
+		equal(t, secret.InternalData["sp_object_id"], metadata["sp_object_id"])
+		equal(t, "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b", metadata["scopes"])
+
+		// Events never carry the credentials
+		for k, v := range metadata {
+			if strings.Contains(v.(string), clientSecret) {
+				t.Fatalf("expected no secret in event metadata, found it in %q", k)
+			}
+		}
+	}
+}
+
+func TestStaticCredentialEvents(t *testing.T) {
+	events := logical.NewMockEventSender()
+	b, s := getTestBackendMockedWithEvents(t, true, events)
+	testRoleCreate(t, b, s, "test_role", testStaticSPRole)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	fakeSaveLoad(resp.Secret)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	equal(t, 2, len(events.Events))
+	equal(t, logical.EventType(eventCredsCreate), events.Events[0].Type)
+	equal(t, logical.EventType(eventCredsRevoke), events.Events[1].Type)
+	metadata := events.Events[1].Event.Metadata.AsMap()
+	equal(t, SecretTypeStaticSP, metadata["secret_type"])
+	equal(t, testStaticSPAppObjID, metadata["app_object_id"])
+	if _, ok := metadata["key_id"]; ok {
+		t.Fatal("expected no password key ID in event metadata")
+	}
+}
+
+func TestWALRollbackEvents(t *testing.T) {
+	events := logical.NewMockEventSender()
+	b, s := getTestBackendMockedWithEvents(t, true, events)
+
+	err := b.walRollback(context.Background(), &logical.Request{Storage: s}, walAppKey, map[string]interface{}{
+		"AppID":      "app-id",
+		"AppObjID":   "app-object-id",
+		"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	assertErrorIsNil(t, err)
+
+	equal(t, 1, len(events.Events))
+	equal(t, logical.EventType(eventWALRollback), events.Events[0].Type)
+	equal(t, map[string]interface{}{
+		logical.EventMetadataOperation: "rollback",
+		logical.EventMetadataModified:  "true",
+		"wal_kind":                     walAppKey,
+		"app_object_id":                "app-object-id",
+	}, events.Events[0].Event.Metadata.AsMap())
+
+	// Failed rollbacks are retried, so no event is sent for them
+	err = b.walRollback(context.Background(), &logical.Request{Storage: s}, "unknown", nil)
+	if err == nil {
+		t.Fatal("expected an error for an unknown WAL kind")
+	}
+	equal(t, 1, len(events.Events))
+}
+
+func TestEventsDisabled(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	testRoleCreate(t, b, s, "test_role", testRole)
+
+	// Credentials are issued when Vault has no event sender
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// The two keys of Cosmos DB accounts and authorization rules
+	keyPrimary   = "primary"
+	keySecondary = "secondary"
+
+	defaultKeyRotationPeriod = 24 * time.Hour
+)
+
+// keyPair names the two keys of a resource.
+type keyPair [2]string
+
+var (
+	primarySecondaryKeys = keyPair{keyPrimary, keySecondary}
+	storageKeys          = keyPair{storageKey1, storageKey2}
+)
+
+// keyRotation is the rotation state of a role that alternates between the two
+// keys of a resource: key1 and key2 of storage accounts, or the primary and
+// secondary keys of Cosmos DB accounts and authorization rules.
+type keyRotation struct {
+	RotationPeriod time.Duration `json:"rotation_period"`
+	ActiveKey      string        `json:"active_key"`
+	LastRotated    time.Time     `json:"last_rotated"`
+}
+
+// rotationDue reports whether the role should be rotated by the periodic func.
+func (r *keyRotation) rotationDue() bool {
+	return r.RotationPeriod > 0 && time.Since(r.LastRotated) >= r.RotationPeriod
+}
+
+// inactiveKey returns the key of the pair that is regenerated by the next
+// rotation. It is the key that was not handed out since the last rotation.
+func (r *keyRotation) inactiveKey(keys keyPair) string {
+	if r.ActiveKey == keys[1] {
+		return keys[0]
+	}
+	return keys[1]
+}
+
+// rotated makes keyName the active key after it was regenerated.
+func (r *keyRotation) rotated(keyName string) {
+	r.ActiveKey = keyName
+	r.LastRotated = time.Now().UTC()
+}
+
+func (r *keyRotation) data() map[string]interface{} {
+	return map[string]interface{}{
+		"rotation_period": int64(r.RotationPeriod.Seconds()),
+		"active_key":      r.ActiveKey,
+		"last_rotated":    r.LastRotated,
+	}
+}
+
+// resourceRoleName returns the name of another role stored under storagePath
+// that manages the keys of a resource, or "" if there is none. Two roles
+// rotating the same keys would invalidate each other's credentials. Callers
+// hold the resource lock of the resource ID.
+func resourceRoleName[T any](ctx context.Context, s logical.Storage, storagePath, name string, manages func(*T) bool) (string, error) {
+	names, err := s.List(ctx, storagePath+"/")
+	if err != nil {
+		return "", fmt.Errorf("error listing roles: %w", err)
+	}
+
+	for _, other := range names {
+		if other == name {
+			continue
+		}
+		entry, err := s.Get(ctx, storagePath+"/"+other)
+		if err != nil {
+			return "", fmt.Errorf("error reading role %q: %w", other, err)
+		}
+		if entry == nil {
+			continue
+		}
+
+		role := new(T)
+		if err := entry.DecodeJSON(role); err != nil {
+			return "", err
+		}
+		if manages(role) {
+			return other, nil
+		}
+	}
+
+	return "", nil
+}
+
+// rotateDueRoles calls rotateIfDue for each role stored under storagePath,
+// collecting the errors.
+func rotateDueRoles(ctx context.Context, req *logical.Request, storagePath, kind string,
+	rotateIfDue func(ctx context.Context, req *logical.Request, name string) error,
+) error {
+	names, err := req.Storage.List(ctx, storagePath+"/")
+	if err != nil {
+		return fmt.Errorf("error listing %s roles: %w", kind, err)
+	}
+
+	var merr *multierror.Error
+	for _, name := range names {
+		if err := rotateIfDue(ctx, req, name); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("error rotating %s role %q: %w", kind, name, err))
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
@@ -0,0 +1,186 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/template"
+)
+
+const (
+	// Limits the number of key vaults credentials are written to, as each
+	// one is written when credentials are issued or rotated.
+	maxSyncDestinations = 10
+
+	// Content types of the synced secrets
+	syncContentTypeClientSecret     = "client_secret"
+	syncContentTypeConnectionString = "connection_string"
+)
+
+// keyVaultSecretNameRegex matches valid Key Vault secret names.
+var keyVaultSecretNameRegex = regexp.MustCompile(`^[a-zA-Z0-9-]{1,127}$`)
+
+// SyncDestination is an Azure Key Vault secret that the credentials issued or
+// rotated by a role are written to, so that workloads such as App Service can
+// read them through Key Vault references. The secret name is a template.
+type SyncDestination struct {
+	VaultURL           string `json:"vault_url"`
+	SecretNameTemplate string `json:"secret_name_template"`
+}
+
+// syncSecretMetadata is the data available to secret name templates.
+type syncSecretMetadata struct {
+	RoleName string
+}
+
+// secretName renders the name of the secret for the role.
+func (d *SyncDestination) secretName(roleName string) (string, error) {
+	tmpl, err := template.NewTemplate(template.Template(d.SecretNameTemplate))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret_name_template: %w", err)
+	}
+
+	name, err := tmpl.Generate(syncSecretMetadata{
+		RoleName: roleName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate secret name: %w", err)
+	}
+	if !keyVaultSecretNameRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid secret name %q; Key Vault secret names are 1 to 127 letters, digits and hyphens", name)
+	}
+	return name, nil
+}
+
+// parseSyncDestinations parses and validates the JSON list of sync
+// destinations of a role. The key vaults must be in the cloud of the Key
+// Vault service.
+func parseSyncDestinations(raw string, keyVault cloud.ServiceConfiguration) ([]*SyncDestination, error) {
+	destinations := make([]*SyncDestination, 0)
+	if err := jsonutil.DecodeJSON([]byte(raw), &destinations); err != nil {
+		return nil, fmt.Errorf("error parsing sync destinations '%s': %w", raw, err)
+	}
+	if len(destinations) > maxSyncDestinations {
+		return nil, fmt.Errorf("at most %d sync destinations are allowed", maxSyncDestinations)
+	}
+
+	seen := make(map[string]bool)
+	for _, d := range destinations {
+		d.VaultURL = strings.TrimSuffix(d.VaultURL, "/")
+		u, err := url.Parse(d.VaultURL)
+		if err != nil || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid vault_url %q; it must be the URL of a key vault, such as https://example.%s", d.VaultURL, keyVault.Endpoint)
+		}
+		if _, err := keyVaultScope(d.VaultURL, keyVault); err != nil {
+			return nil, fmt.Errorf("invalid vault_url: %w", err)
+		}
+		if d.SecretNameTemplate == "" {
+			return nil, fmt.Errorf("secret_name_template is required for key vault %q", d.VaultURL)
+		}
+		if _, err := d.secretName("role"); err != nil {
+			return nil, err
+		}
+
+		key := strings.ToLower(d.VaultURL) + "||" + strings.ToLower(d.SecretNameTemplate)
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate sync destination %q in key vault %q", d.SecretNameTemplate, d.VaultURL)
+		}
+		seen[key] = true
+	}
+
+	return destinations, nil
+}
+
+// syncSecret writes the value to the secrets of the role's sync destinations
+// and returns the IDs of the secret versions that were written. A failed
+// destination doesn't stop the others from being written; the errors are
+// returned together.
+func (c *client) syncSecret(ctx context.Context, roleName string, destinations []*SyncDestination, value string, contentType string, tags map[string]string) ([]string, error) {
+	secretTags := map[string]string{
+		vaultRoleTag: roleName,
+	}
+	for k, v := range tags {
+		secretTags[k] = v
+	}
+
+	var ids []string
+	var merr *multierror.Error
+	for _, d := range destinations {
+		name, err := d.secretName(roleName)
+		if err != nil {
+			merr = multierror.Append(merr, err)
+			continue
+		}
+
+		id, err := c.provider.SetKeyVaultSecret(ctx, d.VaultURL, name, value, contentType, secretTags)
+		if err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("error writing secret %q to key vault %q: %w", name, d.VaultURL, err))
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, merr.ErrorOrNil()
+}
+
+// disableSyncedSecrets disables the secret versions written by syncSecret,
+// once the credentials they hold are revoked.
+func (c *client) disableSyncedSecrets(ctx context.Context, secretIDs []string) error {
+	var merr *multierror.Error
+	for _, id := range secretIDs {
+		if err := c.provider.DisableKeyVaultSecret(ctx, id); err != nil && !isResourceNotFound(err) {
+			merr = multierror.Append(merr, fmt.Errorf("error disabling key vault secret %q: %w", id, err))
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// keySync is the Key Vault sync state of a role that rotates the keys of a
+// resource: the secrets that the connection string of the active key is
+// written to, and the versions of them that hold each key.
+type keySync struct {
+	SyncDestinations []*SyncDestination  `json:"sync_destinations"`
+	SyncedSecretIDs  map[string][]string `json:"synced_secret_ids"`
+}
+
+// syncRotatedKey writes the connection string of the newly regenerated key to
+// the sync destinations of a role, and disables the secret versions that held
+// the key before it was regenerated. Failures are logged rather than returned,
+// as the key was rotated regardless.
+func (b *azureSecretBackend) syncRotatedKey(ctx context.Context, c *client, roleKind, name string, sync *keySync, keyName, connectionString string) {
+	if len(sync.SyncDestinations) == 0 && len(sync.SyncedSecretIDs[keyName]) == 0 {
+		return
+	}
+
+	b.disableRegeneratedKey(ctx, c, roleKind, name, sync, keyName)
+
+	ids, err := c.syncSecret(ctx, name, sync.SyncDestinations, connectionString, syncContentTypeConnectionString, nil)
+	if err != nil {
+		b.Logger().Warn("error syncing rotated key to key vault", roleKind+"-role", name, "err", err)
+	}
+
+	if sync.SyncedSecretIDs == nil {
+		sync.SyncedSecretIDs = make(map[string][]string)
+	}
+	sync.SyncedSecretIDs[keyName] = ids
+}
+
+// disableRegeneratedKey disables the secret versions that held a key before it
+// was regenerated, as they hold a key that is no longer valid. It is called on
+// its own when the new value of the key can't be synced.
+func (b *azureSecretBackend) disableRegeneratedKey(ctx context.Context, c *client, roleKind, name string, sync *keySync, keyName string) {
+	if err := c.disableSyncedSecrets(ctx, sync.SyncedSecretIDs[keyName]); err != nil {
+		b.Logger().Warn("error disabling synced secrets of regenerated key", roleKind+"-role", name, "err", err)
+	}
+	delete(sync.SyncedSecretIDs, keyName)
+}
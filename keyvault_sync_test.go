@@ -0,0 +1,256 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The key vaults of the tests are in the cloud of the mocked backend's config.
+const (
+	testKeyVaultURL         = "https://example.vault.azure.cn"
+	testUnreachableVaultURL = "https://unreachable.vault.azure.cn"
+)
+
+// testKeyVaultService returns the Key Vault service of the cloud.
+func testKeyVaultService(t *testing.T, environment string) cloud.ServiceConfiguration {
+	t.Helper()
+	cloudConfig, err := cloudConfigFromName(environment)
+	assertErrorIsNil(t, err)
+	return cloudConfig.Services[keyVaultServiceName]
+}
+
+func TestParseSyncDestinations(t *testing.T) {
+	keyVault := testKeyVaultService(t, "AZURECHINACLOUD")
+	destinations, err := parseSyncDestinations(encodeJSON([]SyncDestination{
+		{VaultURL: testKeyVaultURL + "/", SecretNameTemplate: "{{ .RoleName }}-secret"},
+		{VaultURL: "https://other.vault.azure.cn", SecretNameTemplate: "app-secret"},
+	}), keyVault)
+	assertErrorIsNil(t, err)
+	equal(t, []*SyncDestination{
+		{VaultURL: testKeyVaultURL, SecretNameTemplate: "{{ .RoleName }}-secret"},
+		{VaultURL: "https://other.vault.azure.cn", SecretNameTemplate: "app-secret"},
+	}, destinations)
+
+	name, err := destinations[0].secretName("web-app")
+	assertErrorIsNil(t, err)
+	equal(t, "web-app-secret", name)
+
+	tests := map[string]struct {
+		raw string
+		msg string
+	}{
+		"invalid JSON": {
+			raw: `{"vault_url": "https://example.vault.azure.cn"}`,
+			msg: "error parsing sync destinations",
+		},
+		"http URL": {
+			raw: `[{"vault_url": "http://example.vault.azure.cn", "secret_name_template": "s"}]`,
+			msg: "invalid vault_url",
+		},
+		"URL with path": {
+			raw: `[{"vault_url": "https://example.vault.azure.cn/secrets/s", "secret_name_template": "s"}]`,
+			msg: "invalid vault_url",
+		},
+		"missing template": {
+			raw: `[{"vault_url": "https://example.vault.azure.cn"}]`,
+			msg: "secret_name_template is required",
+		},
+		"invalid template": {
+			raw: `[{"vault_url": "https://example.vault.azure.cn", "secret_name_template": "{{ .RoleName"}]`,
+			msg: "invalid secret_name_template",
+		},
+		"invalid secret name": {
+			raw: `[{"vault_url": "https://example.vault.azure.cn", "secret_name_template": "{{ .RoleName }}_secret"}]`,
+			msg: "invalid secret name",
+		},
+		"other cloud": {
+			raw: `[{"vault_url": "https://example.vault.azure.net", "secret_name_template": "s"}]`,
+			msg: "key vaults of the configured cloud are under vault.azure.cn",
+		},
+		"other domain": {
+			raw: `[{"vault_url": "https://example.vault.azure.cn.attacker.com", "secret_name_template": "s"}]`,
+			msg: "invalid vault_url",
+		},
+		"duplicate": {
+			raw: `[{"vault_url": "https://example.vault.azure.cn", "secret_name_template": "s"}, {"vault_url": "https://EXAMPLE.vault.azure.cn/", "secret_name_template": "S"}]`,
+			msg: "duplicate sync destination",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseSyncDestinations(tc.raw, keyVault)
+			if err == nil || !strings.Contains(err.Error(), tc.msg) {
+				t.Fatalf("expected error containing %q, got: %v", tc.msg, err)
+			}
+		})
+	}
+
+	var many []SyncDestination
+	for i := 0; i <= maxSyncDestinations; i++ {
+		many = append(many, SyncDestination{VaultURL: testKeyVaultURL, SecretNameTemplate: fmt.Sprintf("secret-%d", i)})
+	}
+	if _, err := parseSyncDestinations(encodeJSON(many), keyVault); err == nil {
+		t.Fatal("expected an error for too many sync destinations")
+	}
+}
+
+func TestStaticSPSync(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	mp := getMockProvider(t, b, s)
+
+	role := map[string]interface{}{
+		"application_object_id": testStaticSPAppObjID,
+		"sync_destinations": encodeJSON([]SyncDestination{
+			{VaultURL: testKeyVaultURL, SecretNameTemplate: "{{ .RoleName }}-client-secret"},
+			{VaultURL: testUnreachableVaultURL, SecretNameTemplate: "client-secret"},
+		}),
+	}
+	testRoleCreate(t, b, s, "web-app", role)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/web-app",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	// The unreachable vault doesn't fail issuing the password
+	equal(t, 1, len(resp.Warnings))
+	if !strings.Contains(resp.Warnings[0], testUnreachableVaultURL) {
+		t.Fatalf("expected a warning for the unreachable key vault, got: %v", resp.Warnings)
+	}
+
+	versions := mp.keyVaultSecretVersions(testKeyVaultURL, "web-app-client-secret")
+	equal(t, 1, len(versions))
+	equal(t, resp.Data["client_secret"], versions[0].Value)
+	equal(t, syncContentTypeClientSecret, versions[0].ContentType)
+	equal(t, map[string]string{"vault_role": "web-app", "client_id": resp.Data["client_id"].(string)}, versions[0].Tags)
+	equal(t, true, versions[0].Enabled)
+	equal(t, []string{versions[0].ID}, resp.Secret.InternalData["synced_secret_ids"])
+
+	fakeSaveLoad(resp.Secret)
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	versions = mp.keyVaultSecretVersions(testKeyVaultURL, "web-app-client-secret")
+	equal(t, false, versions[0].Enabled)
+
+	t.Run("dynamic role", func(t *testing.T) {
+		resp := testRoleCreateBasic(t, b, s, "dynamic", map[string]interface{}{
+			"azure_roles":       testRole["azure_roles"],
+			"sync_destinations": role["sync_destinations"],
+		})
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "existing or persisted application") {
+			t.Fatalf("expected an error for sync destinations of a dynamic role, got: %v", resp)
+		}
+	})
+}
+
+func TestStorageRoleSync(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	mp := getMockProvider(t, b, s)
+
+	testStorageRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+		"storage_account_id": testStorageAccountID,
+		"sync_destinations": encodeJSON([]SyncDestination{
+			{VaultURL: testKeyVaultURL, SecretNameTemplate: "storage-{{ .RoleName | replace \"_\" \"-\" }}"},
+		}),
+	})
+
+	connectionString := func() string {
+		resp := testStorageRoleRead(t, b, s, "storage-creds/test_role")
+		return resp.Data["connection_string"].(string)
+	}
+	rotate := func() {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "storage-roles/test_role/rotate",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+	}
+
+	// The key regenerated when the role is created is synced
+	versions := mp.keyVaultSecretVersions(testKeyVaultURL, "storage-test-role")
+	equal(t, 1, len(versions))
+	equal(t, connectionString(), versions[0].Value)
+	equal(t, syncContentTypeConnectionString, versions[0].ContentType)
+
+	// The previously active key is still valid, so its version stays enabled
+	rotate()
+	versions = mp.keyVaultSecretVersions(testKeyVaultURL, "storage-test-role")
+	equal(t, 2, len(versions))
+	equal(t, connectionString(), versions[1].Value)
+	equal(t, true, versions[0].Enabled)
+
+	// Regenerating key2 again disables the version that held it
+	rotate()
+	versions = mp.keyVaultSecretVersions(testKeyVaultURL, "storage-test-role")
+	equal(t, 3, len(versions))
+	equal(t, connectionString(), versions[2].Value)
+	equal(t, false, versions[0].Enabled)
+	equal(t, true, versions[1].Enabled)
+
+	resp := testStorageRoleRead(t, b, s, "storage-roles/test_role")
+	equal(t, []*SyncDestination{
+		{VaultURL: testKeyVaultURL, SecretNameTemplate: "storage-{{ .RoleName | replace \"_\" \"-\" }}"},
+	}, resp.Data["sync_destinations"])
+}
+
+func TestCosmosDBRoleSync(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	mp := getMockProvider(t, b, s)
+
+	testCosmosDBRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+		"cosmosdb_account_id": testCosmosDBAccountID,
+		"sync_destinations": encodeJSON([]SyncDestination{
+			{VaultURL: testKeyVaultURL, SecretNameTemplate: "cosmos"},
+		}),
+	})
+
+	resp := testCosmosDBRoleRead(t, b, s, "cosmosdb-creds/test_role")
+	versions := mp.keyVaultSecretVersions(testKeyVaultURL, "cosmos")
+	equal(t, 1, len(versions))
+	equal(t, resp.Data["connection_string"], versions[0].Value)
+
+	rotate := func() {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "cosmosdb-roles/test_role/rotate",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+	}
+	rotate()
+	equal(t, 2, len(mp.keyVaultSecretVersions(testKeyVaultURL, "cosmos")))
+
+	// The version holding the regenerated key is disabled even if the new
+	// key can't be listed to be synced
+	mp.failNextListCosmosDBKeys = true
+	rotate()
+	versions = mp.keyVaultSecretVersions(testKeyVaultURL, "cosmos")
+	equal(t, 2, len(versions))
+	equal(t, false, versions[0].Enabled)
+	equal(t, true, versions[1].Enabled)
+
+	// Keys are synced again on the next rotation, which regenerates the key
+	// of the second version
+	rotate()
+	versions = mp.keyVaultSecretVersions(testKeyVaultURL, "cosmos")
+	equal(t, 3, len(versions))
+	equal(t, testCosmosDBRoleRead(t, b, s, "cosmosdb-creds/test_role").Data["connection_string"], versions[2].Value)
+	equal(t, false, versions[1].Enabled)
+	equal(t, true, versions[2].Enabled)
+}
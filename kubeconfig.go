@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// aksServerID is the application ID of the AKS AAD server, which tokens
+	// for AKS clusters with managed AAD integration are issued for.
+	aksServerID = "6dae42f8-4368-4678-94ff-3960e28e3630"
+
+	// kubeloginSecretEnv is the environment variable kubelogin reads the
+	// client secret of a service principal from.
+	kubeloginSecretEnv = "AAD_SERVICE_PRINCIPAL_CLIENT_SECRET"
+)
+
+// kubeconfig is the subset of a kubeconfig file that is read from the user
+// kubeconfig of a cluster and written for credentials.
+type kubeconfig struct {
+	APIVersion     string              `yaml:"apiVersion"`
+	Kind           string              `yaml:"kind"`
+	Clusters       []kubeconfigCluster `yaml:"clusters"`
+	Contexts       []kubeconfigContext `yaml:"contexts"`
+	CurrentContext string              `yaml:"current-context"`
+	Users          []kubeconfigUser    `yaml:"users"`
+}
+
+type kubeconfigCluster struct {
+	Name    string `yaml:"name"`
+	Cluster struct {
+		Server                   string `yaml:"server"`
+		CertificateAuthorityData string `yaml:"certificate-authority-data,omitempty"`
+	} `yaml:"cluster"`
+}
+
+type kubeconfigContext struct {
+	Name    string `yaml:"name"`
+	Context struct {
+		Cluster   string `yaml:"cluster"`
+		User      string `yaml:"user"`
+		Namespace string `yaml:"namespace,omitempty"`
+	} `yaml:"context"`
+}
+
+type kubeconfigUser struct {
+	Name string `yaml:"name"`
+	User struct {
+		Exec *kubeconfigExec `yaml:"exec,omitempty"`
+	} `yaml:"user"`
+}
+
+type kubeconfigExec struct {
+	APIVersion      string              `yaml:"apiVersion"`
+	Command         string              `yaml:"command"`
+	Args            []string            `yaml:"args"`
+	Env             []map[string]string `yaml:"env"`
+	InteractiveMode string              `yaml:"interactiveMode"`
+}
+
+// kubeconfigServicePrincipal holds what a kubeconfig needs to authenticate as
+// a service principal with kubelogin.
+type kubeconfigServicePrincipal struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	Environment  string
+}
+
+// clusterFromKubeconfig returns the first cluster of a kubeconfig, which has
+// the server and CA of an AKS cluster in its user kubeconfig.
+func clusterFromKubeconfig(data []byte) (kubeconfigCluster, error) {
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return kubeconfigCluster{}, fmt.Errorf("error parsing kubeconfig: %w", err)
+	}
+	if len(config.Clusters) == 0 || config.Clusters[0].Cluster.Server == "" {
+		return kubeconfigCluster{}, errors.New("kubeconfig has no cluster server")
+	}
+	return config.Clusters[0], nil
+}
+
+// servicePrincipalKubeconfig renders a kubeconfig for the cluster that uses
+// kubelogin to get tokens for the service principal, in the namespace.
+func servicePrincipalKubeconfig(cluster kubeconfigCluster, namespace string, sp kubeconfigServicePrincipal) (string, error) {
+	user := kubeconfigUser{Name: sp.ClientID}
+	user.User.Exec = &kubeconfigExec{
+		APIVersion: "client.authentication.k8s.io/v1beta1",
+		Command:    "kubelogin",
+		Args: []string{
+			"get-token",
+			"--login", "spn",
+			"--environment", sp.Environment,
+			"--server-id", aksServerID,
+			"--tenant-id", sp.TenantID,
+			"--client-id", sp.ClientID,
+		},
+		Env: []map[string]string{
+			{"name": kubeloginSecretEnv, "value": sp.ClientSecret},
+		},
+		InteractiveMode: "Never",
+	}
+
+	context := kubeconfigContext{Name: cluster.Name}
+	context.Context.Cluster = cluster.Name
+	context.Context.User = user.Name
+	context.Context.Namespace = namespace
+
+	out, err := yaml.Marshal(&kubeconfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		Clusters:       []kubeconfigCluster{cluster},
+		Contexts:       []kubeconfigContext{context},
+		CurrentContext: context.Name,
+		Users:          []kubeconfigUser{user},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,304 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	SecretTypeManagedIdentity = "managed_identity"
+
+	// defaultFederatedCredentialAudience is the audience of tokens exchanged
+	// for Azure AD tokens, used if a federated credential sets none.
+	defaultFederatedCredentialAudience = "api://AzureADTokenExchange"
+
+	// Azure limits the number of federated credentials of an identity.
+	maxFederatedCredentials = 20
+
+	// Azure limits user-assigned managed identity names to 128 characters.
+	maxIdentityNameLength = 128
+
+	// vaultRoleTag is the Azure tag recording the role a managed identity was
+	// created for.
+	vaultRoleTag = "vault_role"
+)
+
+var (
+	// identityInvalidNameChars matches the characters that aren't allowed in
+	// the names of user-assigned managed identities.
+	identityInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+	// federatedCredentialNameRegex matches valid federated credential names.
+	federatedCredentialNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{2,119}$`)
+)
+
+// FederatedCredential is a federated identity credential that is added to the
+// managed identities created for a role, so that tokens of an external
+// identity provider can be exchanged for tokens of the identity.
+type FederatedCredential struct {
+	Name      string   `json:"name"`
+	Issuer    string   `json:"issuer"`
+	Subject   string   `json:"subject"`
+	Audiences []string `json:"audiences"`
+}
+
+func secretManagedIdentity(b *azureSecretBackend) *framework.Secret {
+	return &framework.Secret{
+		Type:   SecretTypeManagedIdentity,
+		Renew:  b.spRenew,
+		Revoke: measureRevoke(b.managedIdentityRevoke),
+	}
+}
+
+// validateManagedIdentityRole checks the settings of a role that issues
+// managed identities, which can't use the properties of applications.
+func validateManagedIdentityRole(role *roleEntry) error {
+	if role.ApplicationObjectID != "" || role.PersistApp {
+		return errors.New("application_object_id and persist_app can't be used with managed identities")
+	}
+	if role.hasAppProperties() || role.SignInAudience != "" || len(role.Tags) > 0 || role.PermanentlyDelete {
+		return errors.New("sign_in_audience, tags, permanently_delete, owners, notes, service_management_reference and custom_security_attributes can't be used with managed identities")
+	}
+	if role.ManagedIdentityResourceGroup == "" {
+		return errors.New("managed_identity_resource_group is required for managed identities")
+	}
+	if _, err := parseResourceID(role.ManagedIdentityResourceGroup, resourceGroupResourceType); err != nil {
+		return fmt.Errorf("invalid managed_identity_resource_group: %w", err)
+	}
+
+	return validateFederatedCredentials(role.FederatedCredentials)
+}
+
+// validateFederatedCredentials checks the federated credentials, and names and
+// sets the default audience of those that have none.
+func validateFederatedCredentials(credentials []*FederatedCredential) error {
+	if len(credentials) > maxFederatedCredentials {
+		return fmt.Errorf("at most %d federated credentials are allowed", maxFederatedCredentials)
+	}
+
+	names := make(map[string]bool)
+	for i, c := range credentials {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("vault-%d", i)
+		}
+		if !federatedCredentialNameRegex.MatchString(c.Name) {
+			return fmt.Errorf("invalid federated credential name %q", c.Name)
+		}
+		if names[strings.ToLower(c.Name)] {
+			return fmt.Errorf("duplicate federated credential name %q", c.Name)
+		}
+		names[strings.ToLower(c.Name)] = true
+
+		issuer, err := url.Parse(c.Issuer)
+		if err != nil || issuer.Scheme != "https" || issuer.Host == "" {
+			return fmt.Errorf("issuer of federated credential %q must be an https URL", c.Name)
+		}
+		if c.Subject == "" {
+			return fmt.Errorf("subject of federated credential %q is required", c.Name)
+		}
+		if len(c.Audiences) == 0 {
+			c.Audiences = []string{defaultFederatedCredentialAudience}
+		}
+	}
+
+	return nil
+}
+
+// createManagedIdentitySecret creates a user-assigned managed identity with
+// the Azure roles, groups and federated credentials of the role, and returns
+// its client ID as a lease. Managed identities have no secret of their own.
+func (b *azureSecretBackend) createManagedIdentitySecret(ctx context.Context, req *logical.Request, c *client, roleName string, role *roleEntry) (*logical.Response, error) {
+	s := req.Storage
+
+	appName, err := b.generateAppName(ctx, req, roleName, role)
+	if err != nil {
+		return nil, err
+	}
+	name, err := identityName(appName)
+	if err != nil {
+		return nil, err
+	}
+	identityID := fmt.Sprintf("%s/providers/%s/%s", role.ManagedIdentityResourceGroup, userAssignedIdentityResourceType, name)
+
+	// Write a WAL entry in case the identity isn't fully created. The identity
+	// is deleted as part of WAL rollback.
+	walID, err := framework.PutWAL(ctx, s, walManagedIdentityKey, &walManagedIdentity{
+		IdentityID: identityID,
+		Expiration: time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing WAL: %w", err)
+	}
+
+	tags := map[string]string{
+		vaultRoleTag: roleName,
+	}
+	if req.MountAccessor != "" {
+		tags[strings.TrimSuffix(vaultMountAccessorTagPrefix, ":")] = req.MountAccessor
+	}
+	if req.EntityID != "" {
+		tags[strings.TrimSuffix(vaultEntityIDTagPrefix, ":")] = req.EntityID
+	}
+
+	identity, err := c.provider.CreateUserAssignedIdentity(ctx, identityID, role.ManagedIdentityLocation, tags)
+	if err != nil {
+		return nil, fmt.Errorf("error creating managed identity: %w", err)
+	}
+	principalID := identity.Properties.PrincipalID
+
+	// Federated credentials of an identity can't be written concurrently, so
+	// they are added one at a time.
+	for _, fc := range role.FederatedCredentials {
+		if err := c.provider.CreateFederatedIdentityCredential(ctx, identityID, fc); err != nil {
+			return nil, fmt.Errorf("error adding federated credential %q: %w", fc.Name, err)
+		}
+	}
+
+	assignmentIDs, err := c.generateUUIDs(len(role.AzureRoles))
+	if err != nil {
+		return nil, fmt.Errorf("error generating assignment IDs; err=%w", err)
+	}
+
+	// Write a second WAL entry in case the Role assignments don't complete
+	rWALID, err := framework.PutWAL(ctx, s, walAppRoleAssignment, &walAppRoleAssign{
+		SpID:          principalID,
+		AssignmentIDs: assignmentIDs,
+		AzureRoles:    role.AzureRoles,
+		Expiration:    time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing WAL: %w", err)
+	}
+
+	// Assign Azure roles to the identity
+	raIDs, err := c.assignRoles(ctx, principalID, role.AzureRoles, assignmentIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Assign Azure group memberships to the identity
+	if err := c.addGroupMemberships(ctx, principalID, role.AzureGroups); err != nil {
+		return nil, err
+	}
+
+	// The identity is fully created so delete the WALs
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return nil, fmt.Errorf("error deleting WAL: %w", err)
+	}
+
+	if err := framework.DeleteWAL(ctx, s, rWALID); err != nil {
+		return nil, fmt.Errorf("error deleting role assignment WAL: %w", err)
+	}
+
+	data := map[string]interface{}{
+		"client_id":    identity.Properties.ClientID,
+		"principal_id": principalID,
+		"tenant_id":    identity.Properties.TenantID,
+		"identity_id":  identityID,
+	}
+	internalData := map[string]interface{}{
+		"identity_id":          identityID,
+		"sp_object_id":         principalID,
+		"role_assignment_ids":  raIDs,
+		"group_membership_ids": groupObjectIDs(role.AzureGroups),
+		"group_owner_ids":      groupOwnerObjectIDs(role.AzureGroups),
+		"scopes":               roleScopes(role.AzureRoles),
+		"role":                 roleName,
+	}
+
+	return b.Secret(SecretTypeManagedIdentity).Response(data, internalData), nil
+}
+
+func (b *azureSecretBackend) managedIdentityRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp := new(logical.Response)
+
+	identityIDRaw, ok := req.Secret.InternalData["identity_id"]
+	if !ok {
+		return nil, errors.New("internal data 'identity_id' not found")
+	}
+	identityID := identityIDRaw.(string)
+
+	var principalID string
+	if principalIDRaw, ok := req.Secret.InternalData["sp_object_id"]; ok {
+		principalID = principalIDRaw.(string)
+	}
+
+	var raIDs []string
+	if req.Secret.InternalData["role_assignment_ids"] != nil {
+		for _, v := range req.Secret.InternalData["role_assignment_ids"].([]interface{}) {
+			raIDs = append(raIDs, v.(string))
+		}
+	}
+
+	var gmIDs []string
+	if req.Secret.InternalData["group_membership_ids"] != nil {
+		for _, v := range req.Secret.InternalData["group_membership_ids"].([]interface{}) {
+			gmIDs = append(gmIDs, v.(string))
+		}
+	}
+
+	var goIDs []string
+	if req.Secret.InternalData["group_owner_ids"] != nil {
+		for _, v := range req.Secret.InternalData["group_owner_ids"].([]interface{}) {
+			goIDs = append(goIDs, v.(string))
+		}
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("error during revoke: %w", err)
+	}
+
+	// Removing role assignments and group memberships is effectively a garbage
+	// collection operation. Errors will be noted but won't fail the revocation
+	// process. Deleting the identity, however, *is* required to consider the
+	// secret revoked.
+	if err := c.unassignRoles(ctx, raIDs); err != nil {
+		resp.AddWarning(err.Error())
+	}
+
+	if err := c.removeGroupMemberships(ctx, principalID, gmIDs); err != nil {
+		resp.AddWarning(err.Error())
+	}
+
+	if err := c.removeGroupOwnerships(ctx, principalID, goIDs); err != nil {
+		resp.AddWarning(err.Error())
+	}
+
+	if err := c.provider.DeleteUserAssignedIdentity(ctx, identityID); err != nil && !isResourceNotFound(err) {
+		return resp, fmt.Errorf("error deleting managed identity: %w", err)
+	}
+
+	b.sendSecretEvent(ctx, eventCredsRevoke, "revoke", req.Secret)
+
+	if err := untrackLease(ctx, req.Storage, req.Secret); err != nil {
+		resp.AddWarning(fmt.Sprintf("error removing lease record: %s", err))
+	}
+
+	return resp, nil
+}
+
+// identityName turns a generated application name into a valid name for a
+// user-assigned managed identity.
+func identityName(appName string) (string, error) {
+	name := identityInvalidNameChars.ReplaceAllString(appName, "-")
+	name = strings.TrimLeft(name, "-_")
+	if len(name) > maxIdentityNameLength {
+		name = name[:maxIdentityNameLength]
+	}
+	if len(name) < 3 {
+		return "", fmt.Errorf("generated name %q is too short for a managed identity", appName)
+	}
+	return name, nil
+}
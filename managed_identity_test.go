@@ -0,0 +1,244 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const testResourceGroupID = "/subscriptions/FAKE_SUB_ID/resourceGroups/identities"
+
+var testManagedIdentityRole = map[string]interface{}{
+	"credential_type":                 "managed_identity",
+	"managed_identity_resource_group": testResourceGroupID,
+	"azure_roles": encodeJSON([]AzureRole{
+		{
+			RoleName: "Owner",
+			RoleID:   "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+			Scope:    "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b",
+		},
+	}),
+	"federated_credentials": encodeJSON([]FederatedCredential{
+		{
+			Issuer:  "https://token.actions.githubusercontent.com",
+			Subject: "repo:example/app:ref:refs/heads/main",
+		},
+		{
+			Name:      "kubernetes",
+			Issuer:    "https://oidc.example.com/cluster",
+			Subject:   "system:serviceaccount:default:app",
+			Audiences: []string{"api://custom"},
+		},
+	}),
+}
+
+func TestManagedIdentityRole(t *testing.T) {
+	t.Run("create and read", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testManagedIdentityRole)
+
+		resp, err := testRoleRead(t, b, s, "test_role")
+		assertRespNoError(t, resp, err)
+		equal(t, "managed_identity", resp.Data["credential_type"])
+		equal(t, testResourceGroupID, resp.Data["managed_identity_resource_group"])
+		equal(t, []*FederatedCredential{
+			{
+				Name:      "vault-0",
+				Issuer:    "https://token.actions.githubusercontent.com",
+				Subject:   "repo:example/app:ref:refs/heads/main",
+				Audiences: []string{defaultFederatedCredentialAudience},
+			},
+			{
+				Name:      "kubernetes",
+				Issuer:    "https://oidc.example.com/cluster",
+				Subject:   "system:serviceaccount:default:app",
+				Audiences: []string{"api://custom"},
+			},
+		}, resp.Data["federated_credentials"])
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, "eastus", role.ManagedIdentityLocation)
+		equal(t, "managed_identity", role.credentialMode())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		tests := map[string]struct {
+			data map[string]interface{}
+			msg  string
+		}{
+			"invalid credential type": {
+				data: map[string]interface{}{"credential_type": "certificate"},
+				msg:  "invalid credential_type",
+			},
+			"missing resource group": {
+				data: map[string]interface{}{"managed_identity_resource_group": ""},
+				msg:  "managed_identity_resource_group is required",
+			},
+			"invalid resource group": {
+				data: map[string]interface{}{"managed_identity_resource_group": testStorageAccountID},
+				msg:  "invalid managed_identity_resource_group",
+			},
+			"unknown resource group": {
+				data: map[string]interface{}{"managed_identity_resource_group": testResourceGroupID + "-missing"},
+				msg:  "unable to look up resource group",
+			},
+			"application properties": {
+				data: map[string]interface{}{"notes": "created by vault"},
+				msg:  "can't be used with managed identities",
+			},
+			"persisted app": {
+				data: map[string]interface{}{"persist_app": true},
+				msg:  "can't be used with managed identities",
+			},
+			"invalid issuer": {
+				data: map[string]interface{}{"federated_credentials": `[{"issuer": "http://example.com", "subject": "s"}]`},
+				msg:  "must be an https URL",
+			},
+			"missing subject": {
+				data: map[string]interface{}{"federated_credentials": `[{"issuer": "https://example.com"}]`},
+				msg:  "subject of federated credential",
+			},
+			"duplicate name": {
+				data: map[string]interface{}{"federated_credentials": `[{"name": "fc1", "issuer": "https://example.com", "subject": "a"}, {"name": "FC1", "issuer": "https://example.com", "subject": "b"}]`},
+				msg:  "duplicate federated credential name",
+			},
+			"service principal": {
+				data: map[string]interface{}{"credential_type": "service_principal"},
+				msg:  "can only be used with managed identities",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				data := make(map[string]interface{})
+				for k, v := range testManagedIdentityRole {
+					data[k] = v
+				}
+				for k, v := range tc.data {
+					data[k] = v
+				}
+
+				resp := testRoleCreateBasic(t, b, s, "test_role", data)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+}
+
+func TestManagedIdentityRead(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	testRoleCreate(t, b, s, "test_role", testManagedIdentityRole)
+	mp := getMockProvider(t, b, s)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:           logical.ReadOperation,
+		Path:                "creds/test_role",
+		Storage:             s,
+		ClientTokenAccessor: "test-accessor",
+		MountAccessor:       "test-mount-accessor",
+	})
+	assertRespNoError(t, resp, err)
+	equal(t, SecretTypeManagedIdentity, resp.Secret.InternalData["secret_type"])
+	if _, ok := resp.Data["client_secret"]; ok {
+		t.Fatal("expected no client secret for a managed identity")
+	}
+
+	identityID := resp.Data["identity_id"].(string)
+	if !strings.HasPrefix(identityID, testResourceGroupID+"/providers/Microsoft.ManagedIdentity/userAssignedIdentities/vault-") {
+		t.Fatalf("unexpected identity ID: %s", identityID)
+	}
+	identity, ok := mp.managedIdentity(identityID)
+	if !ok {
+		t.Fatal("expected the managed identity to exist")
+	}
+	equal(t, identity.Properties.ClientID, resp.Data["client_id"])
+	equal(t, identity.Properties.PrincipalID, resp.Data["principal_id"])
+	equal(t, "FAKE_TENANT_ID", resp.Data["tenant_id"])
+	equal(t, map[string]string{
+		vaultRoleTag:           "test_role",
+		"vault_mount_accessor": "test-mount-accessor",
+	}, mp.managedIdentityTags[identityID])
+
+	var names []string
+	for _, fc := range mp.federatedCredentialsOf(identityID) {
+		names = append(names, fc.Name)
+	}
+	equal(t, []string{"vault-0", "kubernetes"}, names)
+
+	// The Azure roles are assigned to the principal of the identity
+	raIDs := resp.Secret.InternalData["role_assignment_ids"].([]string)
+	equal(t, 1, len(raIDs))
+	equal(t, identity.Properties.PrincipalID, *mp.roleAssignments[raIDs[0]].Properties.PrincipalID)
+
+	fakeSaveLoad(resp.Secret)
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	if _, ok := mp.managedIdentity(identityID); ok {
+		t.Fatal("expected the managed identity to be deleted")
+	}
+	if _, ok := mp.roleAssignments[raIDs[0]]; ok {
+		t.Fatal("expected the role assignment to be deleted")
+	}
+	ids, err := roleLeaseIDs(context.Background(), s, "test_role")
+	assertErrorIsNil(t, err)
+	equal(t, 0, len(ids))
+}
+
+func TestManagedIdentityRoleDeleteWithLeases(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	testRoleCreate(t, b, s, "test_role", testManagedIdentityRole)
+	mp := getMockProvider(t, b, s)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	identityID := resp.Data["identity_id"].(string)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "roles/test_role",
+		Data:      map[string]interface{}{"force": true},
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	if _, ok := mp.managedIdentity(identityID); ok {
+		t.Fatal("expected the managed identity of the outstanding lease to be deleted")
+	}
+}
+
+func TestIdentityName(t *testing.T) {
+	for appName, expected := range map[string]string{
+		"vault-test-1234":           "vault-test-1234",
+		"vault test.role/1":         "vault-test-role-1",
+		"--vault_role":              "vault_role",
+		strings.Repeat("a", 200):    strings.Repeat("a", maxIdentityNameLength),
+		"Vault Role (team-a) 12:00": "Vault-Role--team-a--12-00",
+	} {
+		name, err := identityName(appName)
+		assertErrorIsNil(t, err)
+		equal(t, expected, name)
+	}
+
+	if _, err := identityName("-."); err == nil {
+		t.Fatal("expected an error for a name that is too short")
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys of the metrics emitted through Vault's telemetry.
+var (
+	// Latency of each provider call, labeled by service, operation and the
+	// status code of the last HTTP response.
+	metricProviderRequest = []string{"azure", "provider", "request"}
+	// HTTP attempts retried by the Azure SDKs within a provider call.
+	metricProviderRetries = []string{"azure", "provider", "retries"}
+
+	// Latency of issuing and revoking leased credentials, labeled by role.
+	metricCredsIssue  = []string{"azure", "creds", "issue"}
+	metricCredsRevoke = []string{"azure", "creds", "revoke"}
+
+	// Attempts made by retry, and the time spent waiting for Azure to
+	// propagate objects before an attempt succeeded or retry gave up.
+	metricRetryAttempts   = []string{"azure", "retry", "attempts"}
+	metricPropagationWait = []string{"azure", "retry", "propagation_wait"}
+
+	metricWALRollback = []string{"azure", "wal", "rollback"}
+	metricRootSwap    = []string{"azure", "root", "swap"}
+)
+
+// Services that provider calls are sent to.
+const (
+	serviceGraph    = "graph"
+	serviceARM      = "arm"
+	serviceStorage  = "storage"
+	serviceKeyVault = "keyvault"
+)
+
+type providerCallKey struct{}
+
+// providerCall records the HTTP attempts sent for a provider call, including
+// the ones retried by the Azure SDKs.
+type providerCall struct {
+	mu         sync.Mutex
+	attempts   int
+	statusCode int
+	requestIDs []attribute.KeyValue
+}
+
+// recordAttempt records an HTTP attempt for the provider call of the request
+// context, if there is one. resp is nil if no response was received.
+func recordAttempt(ctx context.Context, resp *http.Response, requestIDs []attribute.KeyValue) {
+	call, ok := ctx.Value(providerCallKey{}).(*providerCall)
+	if !ok {
+		return
+	}
+
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	call.attempts++
+	call.requestIDs = requestIDs
+	call.statusCode = 0
+	if resp != nil {
+		call.statusCode = resp.StatusCode
+	}
+}
+
+// attemptTransport records each HTTP attempt sent through the next transport.
+type attemptTransport struct {
+	next http.RoundTripper
+}
+
+func (t attemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return sendAttempt(req, t.next.RoundTrip)
+}
+
+// measureProviderCall calls f in a span and emits its latency, the status
+// code of its last HTTP response and the number of attempts that were retried.
+// The span holds the Azure request IDs of the last attempt, which are also
+// logged if the call failed.
+func measureProviderCall[T any](ctx context.Context, logger hclog.Logger, service, operation string, f func(context.Context) (T, error)) (T, error) {
+	ctx, span := tracer().Start(ctx, operation, trace.WithAttributes(
+		attrService.String(service),
+		attrOperation.String(operation),
+	))
+	defer span.End()
+
+	call := &providerCall{}
+	start := time.Now()
+	result, err := f(context.WithValue(ctx, providerCallKey{}, call))
+
+	call.mu.Lock()
+	attempts, statusCode, requestIDs := call.attempts, call.statusCode, call.requestIDs
+	call.mu.Unlock()
+
+	span.SetAttributes(requestIDs...)
+	span.SetAttributes(attrAttempts.Int(attempts))
+	setSpanError(span, err)
+	if err != nil {
+		logProviderCallError(logger, service, operation, statusCode, requestIDs, err)
+	}
+
+	status := "none"
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	metrics.MeasureSinceWithLabels(metricProviderRequest, start, []metrics.Label{
+		{Name: "service", Value: service},
+		{Name: "operation", Value: operation},
+		{Name: "status_code", Value: status},
+	})
+	if attempts > 1 {
+		metrics.IncrCounterWithLabels(metricProviderRetries, float32(attempts-1), []metrics.Label{
+			{Name: "service", Value: service},
+			{Name: "operation", Value: operation},
+		})
+	}
+
+	return result, err
+}
+
+func measureProviderCallErr(ctx context.Context, logger hclog.Logger, service, operation string, f func(context.Context) error) error {
+	_, err := measureProviderCall(ctx, logger, service, operation, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, f(ctx)
+	})
+	return err
+}
+
+// logProviderCallError logs a failed provider call with the Azure request IDs
+// of its last attempt, which Azure support asks for to look into a request.
+// Resources not being found is expected by some callers, so it is only logged
+// at debug level.
+func logProviderCallError(logger hclog.Logger, service, operation string, statusCode int, requestIDs []attribute.KeyValue, err error) {
+	args := []interface{}{"service", service, "operation", operation}
+	if statusCode != 0 {
+		args = append(args, "status_code", statusCode)
+	}
+	for _, kv := range requestIDs {
+		args = append(args, strings.TrimPrefix(string(kv.Key), "azure."), kv.Value.AsString())
+	}
+	args = append(args, "error", err)
+
+	if isResourceNotFound(err) {
+		logger.Debug("azure call failed", args...)
+		return
+	}
+	logger.Warn("azure call failed", args...)
+}
+
+// statusLabel labels the outcome of an operation.
+func statusLabel(err error) metrics.Label {
+	if err != nil {
+		return metrics.Label{Name: "status", Value: "error"}
+	}
+	return metrics.Label{Name: "status", Value: "ok"}
+}
+
+// respErr returns the error of a handler, including an error response.
+func respErr(resp *logical.Response, err error) error {
+	if err == nil && resp != nil && resp.IsError() {
+		return resp.Error()
+	}
+	return err
+}
+
+// measureIssue wraps a handler issuing leased credentials for the role in
+// the request path to emit its latency.
+func measureIssue(f framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		start := time.Now()
+		resp, err := f(ctx, req, d)
+
+		role, _ := d.Get("role").(string)
+		metrics.MeasureSinceWithLabels(metricCredsIssue, start, []metrics.Label{
+			{Name: "role", Value: role},
+			statusLabel(respErr(resp, err)),
+		})
+		return resp, err
+	}
+}
+
+// measureRevoke wraps the revocation handler of a secret type to emit its
+// latency.
+func measureRevoke(f framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		start := time.Now()
+		resp, err := f(ctx, req, d)
+
+		role, _ := req.Secret.InternalData["role"].(string)
+		metrics.MeasureSinceWithLabels(metricCredsRevoke, start, []metrics.Label{
+			{Name: "role", Value: role},
+			statusLabel(respErr(resp, err)),
+		})
+		return resp, err
+	}
+}
+
+// recordRetry emits the attempts made by retry for an operation, and the
+// time since the first attempt that had to wait for propagation, if any.
+func recordRetry(operation string, attempts int, waitStart time.Time) {
+	labels := []metrics.Label{{Name: "operation", Value: operation}}
+	metrics.AddSampleWithLabels(metricRetryAttempts, float32(attempts), labels)
+	if !waitStart.IsZero() {
+		metrics.MeasureSinceWithLabels(metricPropagationWait, waitStart, labels)
+	}
+}
+
+func recordWALRollback(kind string, err error) {
+	metrics.IncrCounterWithLabels(metricWALRollback, 1, []metrics.Label{
+		{Name: "wal_kind", Value: kind},
+		statusLabel(err),
+	})
+}
+
+func recordRootSwap(err error) {
+	metrics.IncrCounterWithLabels(metricRootSwap, 1, []metrics.Label{statusLabel(err)})
+}
@@ -0,0 +1,236 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// newTestMetrics sends the metrics emitted by the test to an in-memory sink.
+func newTestMetrics(t *testing.T) *metrics.InmemSink {
+	t.Helper()
+
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	cfg := metrics.DefaultConfig("vault")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(cfg, sink)
+	assertErrorIsNil(t, err)
+
+	t.Cleanup(func() {
+		metrics.NewGlobal(cfg, &metrics.BlackholeSink{})
+	})
+	return sink
+}
+
+// sampleCount returns the number of samples emitted for the key.
+func sampleCount(sink *metrics.InmemSink, key string) int {
+	var count int
+	for _, interval := range sink.Data() {
+		interval.RLock()
+		if v, ok := interval.Samples[key]; ok {
+			count += v.Count
+		}
+		interval.RUnlock()
+	}
+	return count
+}
+
+// counterSum returns the sum of the counter for the key.
+func counterSum(sink *metrics.InmemSink, key string) float64 {
+	var sum float64
+	for _, interval := range sink.Data() {
+		interval.RLock()
+		if v, ok := interval.Counters[key]; ok {
+			sum += v.Sum
+		}
+		interval.RUnlock()
+	}
+	return sum
+}
+
+func TestProviderMetrics(t *testing.T) {
+	sink := newTestMetrics(t)
+	accountID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.DocumentDB/databaseAccounts/cosmos"
+
+	var attempts int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != accountID {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+			return
+		}
+
+		// Azure being slow to answer the first attempts is retried by the SDK
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": "` + accountID + `", "name": "cosmos"}`))
+	}))
+	defer srv.Close()
+
+	opts := &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Endpoint: srv.URL,
+						Audience: srv.URL,
+					},
+				},
+			},
+			Transport: transporter{sender: srv.Client()},
+			Retry: policy.RetryOptions{
+				RetryDelay:    time.Millisecond,
+				MaxRetryDelay: time.Millisecond,
+			},
+		},
+	}
+	armClient, err := arm.NewClient("test", "v0.0.0", staticTokenCredential{}, opts)
+	assertErrorIsNil(t, err)
+	p := newInstrumentedProvider(&provider{armClient: armClient}, nil)
+
+	_, err = p.GetCosmosDBAccount(context.Background(), accountID)
+	assertErrorIsNil(t, err)
+	equal(t, 1, sampleCount(sink, "vault.azure.provider.request;service=arm;operation=GetCosmosDBAccount;status_code=200"))
+	equal(t, float64(2), counterSum(sink, "vault.azure.provider.retries;service=arm;operation=GetCosmosDBAccount"))
+
+	_, err = p.ListCosmosDBKeys(context.Background(), accountID+"-missing")
+	if !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	equal(t, 1, sampleCount(sink, "vault.azure.provider.request;service=arm;operation=ListCosmosDBKeys;status_code=404"))
+	equal(t, float64(0), counterSum(sink, "vault.azure.provider.retries;service=arm;operation=ListCosmosDBKeys"))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGraphAttemptMetrics(t *testing.T) {
+	sink := newTestMetrics(t)
+
+	var sent int
+	transport := attemptTransport{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		if sent == 1 {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
+	})}
+
+	// The Graph middleware retries within the call, so every attempt is
+	// recorded, and the status code is the one of the last response.
+	p := newInstrumentedProvider(newMockProvider(), nil)
+	call := func(ctx context.Context) (struct{}, error) {
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://graph.microsoft.com/v1.0/groups", nil)
+			assertErrorIsNil(t, err)
+			transport.RoundTrip(req)
+		}
+		return struct{}{}, nil
+	}
+	_, err := measureProviderCall(context.Background(), hclog.NewNullLogger(), serviceGraph, "ListGroups", call)
+	assertErrorIsNil(t, err)
+	equal(t, 1, sampleCount(sink, "vault.azure.provider.request;service=graph;operation=ListGroups;status_code=429"))
+	equal(t, float64(1), counterSum(sink, "vault.azure.provider.retries;service=graph;operation=ListGroups"))
+
+	// Calls answered without an HTTP response have no status code
+	_, err = p.ListGroups(context.Background(), "")
+	assertErrorIsNil(t, err)
+	equal(t, 1, sampleCount(sink, "vault.azure.provider.request;service=graph;operation=ListGroups;status_code=none"))
+}
+
+func TestCredentialMetrics(t *testing.T) {
+	sink := newTestMetrics(t)
+	b, s := getTestBackendMocked(t, true)
+	testRoleCreate(t, b, s, "test_role", testRole)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	fakeSaveLoad(resp.Secret)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/missing_role",
+		Storage:   s,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected an error response for a missing role, got: %v, %v", resp, err)
+	}
+
+	equal(t, 1, sampleCount(sink, "vault.azure.creds.issue;role=test_role;status=ok"))
+	equal(t, 1, sampleCount(sink, "vault.azure.creds.revoke;role=test_role;status=ok"))
+	equal(t, 1, sampleCount(sink, "vault.azure.creds.issue;role=missing_role;status=error"))
+}
+
+func TestRetryMetrics(t *testing.T) {
+	sink := newTestMetrics(t)
+
+	_, err := retry(context.Background(), "CreateServicePrincipal", func() (interface{}, bool, error) {
+		return nil, true, nil
+	})
+	assertErrorIsNil(t, err)
+	equal(t, 1, sampleCount(sink, "vault.azure.retry.attempts;operation=CreateServicePrincipal"))
+	equal(t, 0, sampleCount(sink, "vault.azure.retry.propagation_wait;operation=CreateServicePrincipal"))
+
+	// Waiting for the object to propagate is measured until retry gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = retry(ctx, "CreateRoleAssignment", func() (interface{}, bool, error) {
+		return nil, false, nil
+	})
+	if err == nil {
+		t.Fatal("expected an error once the context is done")
+	}
+	equal(t, 1, sampleCount(sink, "vault.azure.retry.attempts;operation=CreateRoleAssignment"))
+	equal(t, 1, sampleCount(sink, "vault.azure.retry.propagation_wait;operation=CreateRoleAssignment"))
+}
+
+func TestWALRollbackMetrics(t *testing.T) {
+	sink := newTestMetrics(t)
+	b, s := getTestBackendMocked(t, true)
+
+	err := b.walRollback(context.Background(), &logical.Request{Storage: s}, walAppKey, map[string]interface{}{
+		"AppID":      "app-id",
+		"AppObjID":   "app-object-id",
+		"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	assertErrorIsNil(t, err)
+	equal(t, float64(1), counterSum(sink, "vault.azure.wal.rollback;wal_kind="+walAppKey+";status=ok"))
+
+	err = b.walRollback(context.Background(), &logical.Request{Storage: s}, walAppKey, "invalid")
+	if err == nil {
+		t.Fatal("expected an error for invalid WAL data")
+	}
+	equal(t, float64(1), counterSum(sink, "vault.azure.wal.rollback;wal_kind="+walAppKey+";status=error"))
+}
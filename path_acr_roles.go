@@ -0,0 +1,520 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerregistry/armcontainerregistry"
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	SecretTypeACRToken = "acr_token"
+
+	acrRolesStoragePath = "acr-roles"
+
+	// acrNamePrefix is the prefix of the scope maps and tokens created for
+	// credentials.
+	acrNamePrefix = "vault-"
+
+	// acrRoleNameLength limits the part of a token name taken from the role
+	// name, as token names can be at most 50 characters.
+	acrRoleNameLength = 30
+)
+
+// acrActions are the repository actions a scope map can grant.
+var acrActions = []string{
+	"content/read",
+	"content/write",
+	"content/delete",
+	"metadata/read",
+	"metadata/write",
+}
+
+// acrInvalidNameChars matches the characters that aren't allowed in the names
+// of scope maps and tokens.
+var acrInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+// acrRoleEntry is a role that issues tokens for a container registry, scoped
+// to repositories and actions by a scope map.
+type acrRoleEntry struct {
+	RegistryID   string        `json:"registry_id"`
+	LoginServer  string        `json:"login_server"`
+	Repositories []string      `json:"repositories"`
+	Actions      []string      `json:"actions"`
+	TTL          time.Duration `json:"ttl"`
+	MaxTTL       time.Duration `json:"max_ttl"`
+}
+
+func secretACRToken(b *azureSecretBackend) *framework.Secret {
+	return &framework.Secret{
+		Type:   SecretTypeACRToken,
+		Renew:  b.acrTokenRenew,
+		Revoke: measureRevoke(b.acrTokenRevoke),
+	}
+}
+
+func pathsACRRole(b *azureSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "acr-roles/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "acr-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the ACR role.",
+				},
+				"registry_id": {
+					Type:        framework.TypeString,
+					Description: "Resource ID of the container registry that tokens are issued for.",
+				},
+				"repositories": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Repositories that tokens grant access to.",
+				},
+				"actions": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Actions that tokens may perform on the repositories: content/read, content/write, content/delete, metadata/read or metadata/write.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default lease for generated credentials. If not set or set to 0, will use system default.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum lifetime of generated credentials. If not set or set to 0, will use system default.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathACRRoleRead,
+				logical.CreateOperation: b.pathACRRoleUpdate,
+				logical.UpdateOperation: b.pathACRRoleUpdate,
+				logical.DeleteOperation: b.pathACRRoleDelete,
+			},
+			HelpSynopsis:    acrRoleHelpSyn,
+			HelpDescription: acrRoleHelpDesc,
+			ExistenceCheck:  b.pathACRRoleExistenceCheck,
+		},
+		{
+			Pattern: "acr-roles/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "acr-roles",
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathACRRoleList,
+			},
+			HelpSynopsis:    acrRoleListHelpSyn,
+			HelpDescription: acrRoleListHelpDesc,
+		},
+		{
+			Pattern: "acr-creds/" + framework.GenericNameRegex("role"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "request",
+				OperationSuffix: "acr-token",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the ACR role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback:                    measureIssue(b.pathACRTokenRead),
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+			HelpSynopsis:    acrTokenHelpSyn,
+			HelpDescription: acrTokenHelpDesc,
+		},
+	}
+}
+
+func (b *azureSecretBackend) pathACRRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getACRRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *azureSecretBackend) pathACRRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getACRRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"registry_id":  role.RegistryID,
+			"login_server": role.LoginServer,
+			"repositories": role.Repositories,
+			"actions":      role.Actions,
+			"ttl":          int64(role.TTL.Seconds()),
+			"max_ttl":      int64(role.MaxTTL.Seconds()),
+		},
+	}, nil
+}
+
+func (b *azureSecretBackend) pathACRRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, acrRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getACRRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, fmt.Errorf("ACR role entry not found during update operation")
+		}
+		role = &acrRoleEntry{}
+	}
+
+	if repositories, ok := d.GetOk("repositories"); ok {
+		role.Repositories = repositories.([]string)
+	}
+	if actions, ok := d.GetOk("actions"); ok {
+		role.Actions = actions.([]string)
+	}
+	if ttl, ok := d.GetOk("ttl"); ok {
+		role.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if maxTTL, ok := d.GetOk("max_ttl"); ok {
+		role.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+
+	if err := validateACRRole(role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	registryID := d.Get("registry_id").(string)
+	if registryID == "" && role.RegistryID == "" {
+		return logical.ErrorResponse("registry_id is required"), nil
+	}
+	if registryID != "" && registryID != role.RegistryID {
+		if role.RegistryID != "" {
+			return logical.ErrorResponse("registry_id can't be changed; create a new role instead"), nil
+		}
+
+		c, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		registry, err := c.provider.GetContainerRegistry(ctx, registryID)
+		if err != nil {
+			return logical.ErrorResponse("unable to look up container registry %q: %s", registryID, err), nil
+		}
+		if registry.Properties == nil || registry.Properties.LoginServer == nil {
+			return logical.ErrorResponse("container registry %q has no login server", registryID), nil
+		}
+		role.RegistryID = registryID
+		role.LoginServer = *registry.Properties.LoginServer
+	}
+
+	if err := saveACRRole(ctx, req.Storage, role, name); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// validateACRRole checks the repositories, actions and TTLs of the role, and
+// normalizes its actions.
+func validateACRRole(role *acrRoleEntry) error {
+	if len(role.Repositories) == 0 {
+		return errors.New("repositories is required")
+	}
+	for _, repo := range role.Repositories {
+		if repo == "" || strings.ContainsAny(repo, " \t") {
+			return fmt.Errorf("invalid repository %q", repo)
+		}
+	}
+
+	if len(role.Actions) == 0 {
+		return errors.New("actions is required")
+	}
+	actions := make(map[string]bool)
+	for _, action := range role.Actions {
+		action = strings.ToLower(action)
+		if !strutil.StrListContains(acrActions, action) {
+			return fmt.Errorf("invalid action %q; allowed actions are %s", action, strings.Join(acrActions, ", "))
+		}
+		actions[action] = true
+	}
+	role.Actions = nil
+	for _, action := range acrActions {
+		if actions[action] {
+			role.Actions = append(role.Actions, action)
+		}
+	}
+
+	if role.MaxTTL != 0 && role.TTL > role.MaxTTL {
+		return errors.New("ttl cannot be greater than max_ttl")
+	}
+
+	return nil
+}
+
+func (b *azureSecretBackend) pathACRRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", acrRolesStoragePath, name)); err != nil {
+		return nil, fmt.Errorf("error deleting ACR role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathACRRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, acrRolesStoragePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing ACR roles: %w", err)
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+// pathACRTokenRead creates a scope map and a token for the role, and returns
+// a password of the token as a lease.
+func (b *azureSecretBackend) pathACRTokenRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName := d.Get("role").(string)
+
+	role, err := getACRRole(ctx, roleName, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("ACR role %q does not exist", roleName), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	name := acrResourceName(roleName)
+
+	// Write a WAL entry in case the token isn't fully created. The scope map
+	// and token are deleted as part of WAL rollback.
+	walID, err := framework.PutWAL(ctx, req.Storage, walACRToken, &walACR{
+		RegistryID: role.RegistryID,
+		Name:       name,
+		Expiration: time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing WAL: %w", err)
+	}
+
+	var scopeActions []*string
+	for _, repo := range role.Repositories {
+		for _, action := range role.Actions {
+			scopeAction := fmt.Sprintf("repositories/%s/%s", repo, action)
+			scopeActions = append(scopeActions, &scopeAction)
+		}
+	}
+	description := fmt.Sprintf("Created by Vault for role %q", roleName)
+	scopeMap, err := c.provider.CreateScopeMap(ctx, role.RegistryID, name, armcontainerregistry.ScopeMap{
+		Properties: &armcontainerregistry.ScopeMapProperties{
+			Actions:     scopeActions,
+			Description: &description,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating scope map: %w", err)
+	}
+	if scopeMap.ID == nil {
+		return nil, errors.New("created scope map has no ID")
+	}
+
+	status := armcontainerregistry.TokenStatusEnabled
+	token, err := c.provider.CreateRegistryToken(ctx, role.RegistryID, name, armcontainerregistry.Token{
+		Properties: &armcontainerregistry.TokenProperties{
+			ScopeMapID: scopeMap.ID,
+			Status:     &status,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating token: %w", err)
+	}
+	if token.ID == nil {
+		return nil, errors.New("created token has no ID")
+	}
+
+	// The password expires with the lease in case revocation fails.
+	maxTTL := role.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = b.System().MaxLeaseTTL()
+	}
+	expiry := time.Now().Add(maxTTL)
+	passwordName := armcontainerregistry.TokenPasswordNamePassword1
+	creds, err := c.provider.GenerateRegistryCredentials(ctx, role.RegistryID, armcontainerregistry.GenerateCredentialsParameters{
+		TokenID: token.ID,
+		Expiry:  &expiry,
+		Name:    &passwordName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating token password: %w", err)
+	}
+	if creds.Username == nil || len(creds.Passwords) == 0 || creds.Passwords[0].Value == nil {
+		return nil, errors.New("generated credentials have no password")
+	}
+
+	// The token is fully created so delete the WAL
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		return nil, fmt.Errorf("error deleting WAL: %w", err)
+	}
+
+	data := map[string]interface{}{
+		"username":     *creds.Username,
+		"password":     *creds.Passwords[0].Value,
+		"login_server": role.LoginServer,
+	}
+	internalData := map[string]interface{}{
+		"registry_id": role.RegistryID,
+		"name":        name,
+		"role":        roleName,
+	}
+
+	resp := b.Secret(SecretTypeACRToken).Response(data, internalData)
+	resp.Secret.TTL = role.TTL
+	resp.Secret.MaxTTL = role.MaxTTL
+	return resp, nil
+}
+
+func (b *azureSecretBackend) acrTokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleRaw, ok := req.Secret.InternalData["role"]
+	if !ok {
+		return nil, errors.New("internal data 'role' not found")
+	}
+
+	role, err := getACRRole(ctx, roleRaw.(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if role == nil {
+		return nil, fmt.Errorf("ACR role %q has been deleted", roleRaw.(string))
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = role.TTL
+	resp.Secret.MaxTTL = role.MaxTTL
+
+	return resp, nil
+}
+
+func (b *azureSecretBackend) acrTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp := new(logical.Response)
+
+	registryIDRaw, ok := req.Secret.InternalData["registry_id"]
+	if !ok {
+		return nil, errors.New("internal data 'registry_id' not found")
+	}
+	nameRaw, ok := req.Secret.InternalData["name"]
+	if !ok {
+		return nil, errors.New("internal data 'name' not found")
+	}
+	registryID := registryIDRaw.(string)
+	name := nameRaw.(string)
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("error during revoke: %w", err)
+	}
+
+	// Deleting the token is required to consider the secret revoked. Deleting
+	// the scope map is effectively a garbage collection operation, so errors
+	// will be noted but won't fail the revocation process.
+	if err := c.provider.DeleteRegistryToken(ctx, registryID, name); err != nil && !isResourceNotFound(err) {
+		return nil, fmt.Errorf("error deleting token: %w", err)
+	}
+	if err := c.provider.DeleteScopeMap(ctx, registryID, name); err != nil && !isResourceNotFound(err) {
+		resp.AddWarning(fmt.Sprintf("error deleting scope map: %s", err))
+	}
+
+	return resp, nil
+}
+
+// acrResourceName returns a unique name for the scope map and token of a
+// credential, which identifies the role it was issued for.
+func acrResourceName(roleName string) string {
+	name := acrInvalidNameChars.ReplaceAllString(roleName, "-")
+	if len(name) > acrRoleNameLength {
+		name = name[:acrRoleNameLength]
+	}
+
+	return acrNamePrefix + name + "-" + strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+}
+
+func saveACRRole(ctx context.Context, s logical.Storage, role *acrRoleEntry, name string) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", acrRolesStoragePath, name), role)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getACRRole(ctx context.Context, name string, s logical.Storage) (*acrRoleEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", acrRolesStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading ACR role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(acrRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const (
+	acrRoleHelpSyn  = "Manage the Vault roles used to generate Azure Container Registry tokens."
+	acrRoleHelpDesc = `
+This path allows you to read and write roles that generate tokens for an Azure
+Container Registry. Each credential is a new registry token with its own scope
+map, which grants the role's actions on the role's repositories.
+
+The registry_id is the resource ID of the registry, and can't be changed once
+the role is created. Actions are content/read, content/write, content/delete,
+metadata/read and metadata/write.
+`
+	acrRoleListHelpSyn  = "List existing ACR roles."
+	acrRoleListHelpDesc = "List existing ACR roles by name."
+	acrTokenHelpSyn     = "Request an Azure Container Registry token for a given Vault role."
+	acrTokenHelpDesc    = `
+This path creates a registry token scoped to the repositories and actions of
+the role, and returns its username and password along with the login server of
+the registry. The token and its scope map are deleted when the lease is
+revoked.
+`
+)
@@ -0,0 +1,274 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const testRegistryID = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.ContainerRegistry/registries/fakeregistry"
+
+func TestACRRole(t *testing.T) {
+	t.Run("create and read", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testACRRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"registry_id":  testRegistryID,
+			"repositories": "app/api,app/web",
+			"actions":      "metadata/read,content/read",
+			"ttl":          1800,
+			"max_ttl":      3600,
+		})
+
+		resp := testACRRoleRead(t, b, s, "acr-roles/test_role")
+		equal(t, map[string]interface{}{
+			"registry_id":  testRegistryID,
+			"login_server": "fakeregistry.azurecr.io",
+			"repositories": []string{"app/api", "app/web"},
+			"actions":      []string{"content/read", "metadata/read"},
+			"ttl":          int64(1800),
+			"max_ttl":      int64(3600),
+		}, resp.Data)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "acr-roles/",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		equal(t, []string{"test_role"}, resp.Data["keys"])
+	})
+
+	t.Run("credentials and revocation", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testACRRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"registry_id":  testRegistryID,
+			"repositories": "app/api",
+			"actions":      "content/read,content/write",
+			"ttl":          1800,
+		})
+
+		resp := testACRRoleRead(t, b, s, "acr-creds/test_role")
+		equal(t, 30*time.Minute, resp.Secret.TTL)
+		equal(t, "fakeregistry.azurecr.io", resp.Data["login_server"])
+		if resp.Data["password"] == "" {
+			t.Fatal("expected a password")
+		}
+		username := resp.Data["username"].(string)
+		if !strings.HasPrefix(username, "vault-test-role-") {
+			t.Fatalf("unexpected username: %s", username)
+		}
+		equal(t, username, resp.Secret.InternalData["name"])
+
+		mp := getMockProvider(t, b, s)
+		if !mp.registryTokenExists(testRegistryID, username) {
+			t.Fatal("expected the token to exist")
+		}
+		scopeMap, ok := mp.scopeMap(testRegistryID, username)
+		if !ok {
+			t.Fatal("expected the scope map to exist")
+		}
+		var actions []string
+		for _, a := range scopeMap.Properties.Actions {
+			actions = append(actions, *a)
+		}
+		equal(t, []string{"repositories/app/api/content/read", "repositories/app/api/content/write"}, actions)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		if mp.registryTokenExists(testRegistryID, username) {
+			t.Fatal("expected the token to be deleted")
+		}
+		if _, ok := mp.scopeMap(testRegistryID, username); ok {
+			t.Fatal("expected the scope map to be deleted")
+		}
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testACRRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"registry_id":  testRegistryID,
+			"repositories": "app/api",
+			"actions":      "content/read",
+		})
+		resp := testACRRoleRead(t, b, s, "acr-creds/test_role")
+		secret := resp.Secret
+		secret.IssueTime = time.Now()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "acr-roles/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		if err == nil {
+			t.Fatal("expected an error renewing a lease of a deleted role")
+		}
+	})
+
+	t.Run("WAL rollback", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testACRRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"registry_id":  testRegistryID,
+			"repositories": "app/api",
+			"actions":      "content/read",
+		})
+		resp := testACRRoleRead(t, b, s, "acr-creds/test_role")
+		name := resp.Data["username"].(string)
+
+		walID, err := framework.PutWAL(context.Background(), s, walACRToken, &walACR{
+			RegistryID: testRegistryID,
+			Name:       name,
+			Expiration: time.Now().Add(maxWALAge),
+		})
+		assertErrorIsNil(t, err)
+		entry, err := framework.GetWAL(context.Background(), s, walID)
+		assertErrorIsNil(t, err)
+
+		err = b.walRollback(context.Background(), &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		assertErrorIsNil(t, err)
+
+		mp := getMockProvider(t, b, s)
+		if mp.registryTokenExists(testRegistryID, name) {
+			t.Fatal("expected the token to be deleted")
+		}
+		if _, ok := mp.scopeMap(testRegistryID, name); ok {
+			t.Fatal("expected the scope map to be deleted")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testACRRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"registry_id":  testRegistryID,
+			"repositories": "app/api",
+			"actions":      "content/read",
+		})
+
+		tests := map[string]struct {
+			name string
+			data map[string]interface{}
+			msg  string
+		}{
+			"missing registry": {
+				name: "new_role",
+				data: map[string]interface{}{"repositories": "app", "actions": "content/read"},
+				msg:  "registry_id is required",
+			},
+			"unknown registry": {
+				name: "new_role",
+				data: map[string]interface{}{"registry_id": testRegistryID + "-missing", "repositories": "app", "actions": "content/read"},
+				msg:  "unable to look up container registry",
+			},
+			"changed registry": {
+				name: "test_role",
+				data: map[string]interface{}{"registry_id": testRegistryID + "-other"},
+				msg:  "can't be changed",
+			},
+			"missing repositories": {
+				name: "new_role",
+				data: map[string]interface{}{"registry_id": testRegistryID, "actions": "content/read"},
+				msg:  "repositories is required",
+			},
+			"missing actions": {
+				name: "new_role",
+				data: map[string]interface{}{"registry_id": testRegistryID, "repositories": "app"},
+				msg:  "actions is required",
+			},
+			"invalid action": {
+				name: "new_role",
+				data: map[string]interface{}{"registry_id": testRegistryID, "repositories": "app", "actions": "content/push"},
+				msg:  "invalid action",
+			},
+			"ttl above max_ttl": {
+				name: "new_role",
+				data: map[string]interface{}{"registry_id": testRegistryID, "repositories": "app", "actions": "content/read", "ttl": 7200, "max_ttl": 3600},
+				msg:  "ttl cannot be greater than max_ttl",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.CreateOperation,
+					Path:      "acr-roles/" + tc.name,
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "acr-creds/missing",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected error for a missing ACR role, got: %v", resp)
+		}
+	})
+}
+
+func TestACRResourceName(t *testing.T) {
+	name := acrResourceName("a_very.long_role_name_that_is_over_the_limit")
+	if len(name) > 50 || acrInvalidNameChars.MatchString(name) {
+		t.Fatalf("invalid name %q", name)
+	}
+	if !strings.HasPrefix(name, "vault-a-very-long-role-name-that-is--") {
+		t.Fatalf("unexpected name %q", name)
+	}
+}
+
+func testACRRoleWrite(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "acr-roles/" + name,
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
+
+func testACRRoleRead(t *testing.T, b *azureSecretBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	if resp == nil {
+		t.Fatalf("expected a response from %s", path)
+	}
+
+	return resp
+}
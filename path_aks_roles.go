@@ -0,0 +1,418 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	SecretTypeAKS = "aks_service_principal"
+
+	aksRolesStoragePath = "aks-roles"
+)
+
+// kubernetesNamespaceRegex matches valid Kubernetes namespace names, which are
+// DNS labels.
+var kubernetesNamespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// aksRoleEntry is a role that issues dynamic service principals with an Azure
+// RBAC for Kubernetes role in a namespace of an AKS cluster.
+type aksRoleEntry struct {
+	ClusterID   string        `json:"cluster_id"`
+	ClusterName string        `json:"cluster_name"`
+	Namespace   string        `json:"namespace"`
+	RoleName    string        `json:"role_name"`
+	RoleID      string        `json:"role_id"`
+	TTL         time.Duration `json:"ttl"`
+	MaxTTL      time.Duration `json:"max_ttl"`
+}
+
+// scope returns the scope the Azure role is assigned at, which is the
+// namespace of the cluster.
+func (r *aksRoleEntry) scope() string {
+	return r.ClusterID + "/namespaces/" + r.Namespace
+}
+
+func secretAKS(b *azureSecretBackend) *framework.Secret {
+	return &framework.Secret{
+		Type:   SecretTypeAKS,
+		Renew:  b.aksRenew,
+		Revoke: measureRevoke(b.spRevoke),
+	}
+}
+
+func pathsAKSRole(b *azureSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "aks-roles/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "aks-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the AKS role.",
+				},
+				"cluster_id": {
+					Type:        framework.TypeString,
+					Description: "Resource ID of the AKS cluster that credentials are issued for.",
+				},
+				"namespace": {
+					Type:        framework.TypeString,
+					Description: "Kubernetes namespace that the Azure role is assigned in.",
+				},
+				"role_name": {
+					Type:        framework.TypeString,
+					Description: "Name of the Azure RBAC for Kubernetes role, for example Azure Kubernetes Service RBAC Reader.",
+				},
+				"role_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the Azure RBAC for Kubernetes role. Takes precedence over role_name.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default lease for generated credentials. If not set or set to 0, will use system default.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum lifetime of generated credentials. If not set or set to 0, will use system default.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathAKSRoleRead,
+				logical.CreateOperation: b.pathAKSRoleUpdate,
+				logical.UpdateOperation: b.pathAKSRoleUpdate,
+				logical.DeleteOperation: b.pathAKSRoleDelete,
+			},
+			HelpSynopsis:    aksRoleHelpSyn,
+			HelpDescription: aksRoleHelpDesc,
+			ExistenceCheck:  b.pathAKSRoleExistenceCheck,
+		},
+		{
+			Pattern: "aks-roles/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "aks-roles",
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathAKSRoleList,
+			},
+			HelpSynopsis:    aksRoleListHelpSyn,
+			HelpDescription: aksRoleListHelpDesc,
+		},
+		{
+			Pattern: "aks-creds/" + framework.GenericNameRegex("role"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "request",
+				OperationSuffix: "aks-credentials",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the AKS role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback:                    measureIssue(b.pathAKSCredsRead),
+					ForwardPerformanceSecondary: true,
+					ForwardPerformanceStandby:   true,
+				},
+			},
+			HelpSynopsis:    aksCredsHelpSyn,
+			HelpDescription: aksCredsHelpDesc,
+		},
+	}
+}
+
+func (b *azureSecretBackend) pathAKSRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getAKSRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *azureSecretBackend) pathAKSRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getAKSRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"cluster_id":   role.ClusterID,
+			"cluster_name": role.ClusterName,
+			"namespace":    role.Namespace,
+			"role_name":    role.RoleName,
+			"role_id":      role.RoleID,
+			"ttl":          int64(role.TTL.Seconds()),
+			"max_ttl":      int64(role.MaxTTL.Seconds()),
+		},
+	}, nil
+}
+
+func (b *azureSecretBackend) pathAKSRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, aksRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getAKSRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, fmt.Errorf("AKS role entry not found during update operation")
+		}
+		role = &aksRoleEntry{}
+	}
+
+	if namespace, ok := d.GetOk("namespace"); ok {
+		role.Namespace = namespace.(string)
+	}
+	if ttl, ok := d.GetOk("ttl"); ok {
+		role.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if maxTTL, ok := d.GetOk("max_ttl"); ok {
+		role.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+
+	if role.Namespace == "" {
+		return logical.ErrorResponse("namespace is required"), nil
+	}
+	if !kubernetesNamespaceRegex.MatchString(role.Namespace) {
+		return logical.ErrorResponse("invalid namespace %q", role.Namespace), nil
+	}
+	if role.MaxTTL != 0 && role.TTL > role.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+
+	clusterID := d.Get("cluster_id").(string)
+	if clusterID == "" && role.ClusterID == "" {
+		return logical.ErrorResponse("cluster_id is required"), nil
+	}
+	if clusterID != "" && clusterID != role.ClusterID && role.ClusterID != "" {
+		return logical.ErrorResponse("cluster_id can't be changed; create a new role instead"), nil
+	}
+
+	roleName, hasRoleName := d.GetOk("role_name")
+	roleID, hasRoleID := d.GetOk("role_id")
+	if !hasRoleName && !hasRoleID && role.RoleID == "" {
+		return logical.ErrorResponse("role_name or role_id is required"), nil
+	}
+
+	var c *client
+	if role.ClusterID == "" || hasRoleName || hasRoleID {
+		c, err = b.getClient(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if role.ClusterID == "" {
+		cluster, err := c.provider.GetManagedCluster(ctx, clusterID)
+		if err != nil {
+			return logical.ErrorResponse("unable to look up AKS cluster %q: %s", clusterID, err), nil
+		}
+		if aad := cluster.Properties.AADProfile; aad == nil || !aad.EnableAzureRBAC {
+			return logical.ErrorResponse("AKS cluster %q doesn't have Azure RBAC for Kubernetes authorization enabled", clusterID), nil
+		}
+		role.ClusterID = clusterID
+		role.ClusterName = cluster.Name
+	}
+
+	if hasRoleName || hasRoleID {
+		azureRole := &AzureRole{Scope: role.scope()}
+		if hasRoleName {
+			azureRole.RoleName = roleName.(string)
+		}
+		if hasRoleID {
+			azureRole.RoleID = roleID.(string)
+		}
+		if resp, err := c.lookupAzureRole(ctx, azureRole); resp != nil || err != nil {
+			return resp, err
+		}
+		role.RoleName, role.RoleID = azureRole.RoleName, azureRole.RoleID
+	}
+
+	if err := saveAKSRole(ctx, req.Storage, role, name); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathAKSRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", aksRolesStoragePath, name)); err != nil {
+		return nil, fmt.Errorf("error deleting AKS role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathAKSRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, aksRolesStoragePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing AKS roles: %w", err)
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+// pathAKSCredsRead creates a dynamic service principal with the Azure role of
+// the role assigned in its namespace, and returns it along with a kubeconfig
+// for the cluster that authenticates as it.
+func (b *azureSecretBackend) pathAKSCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName := d.Get("role").(string)
+
+	role, err := getAKSRole(ctx, roleName, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("AKS role %q does not exist", roleName), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the server and CA of the cluster first, so no service principal is
+	// created if the cluster can't be reached.
+	userKubeconfig, err := c.provider.GetClusterUserKubeconfig(ctx, role.ClusterID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cluster user credentials: %w", err)
+	}
+	cluster, err := clusterFromKubeconfig(userKubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.createSPSecret(ctx, req, c, roleName, &roleEntry{
+		AzureRoles: []*AzureRole{
+			{
+				RoleName: role.RoleName,
+				RoleID:   role.RoleID,
+				Scope:    role.scope(),
+			},
+		},
+		TTL:    role.TTL,
+		MaxTTL: role.MaxTTL,
+	}, SecretTypeAKS)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := servicePrincipalKubeconfig(cluster, role.Namespace, kubeconfigServicePrincipal{
+		TenantID:     c.settings.TenantID,
+		ClientID:     resp.Data["client_id"].(string),
+		ClientSecret: resp.Data["client_secret"].(string),
+		Environment:  c.settings.Environment,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating kubeconfig: %w", err)
+	}
+	resp.Data["kubeconfig"] = config
+	resp.Data["cluster_id"] = role.ClusterID
+	resp.Data["namespace"] = role.Namespace
+
+	b.sendSecretEvent(ctx, eventCredsCreate, "create", resp.Secret)
+
+	resp.Secret.TTL = role.TTL
+	resp.Secret.MaxTTL = role.MaxTTL
+	return resp, nil
+}
+
+func (b *azureSecretBackend) aksRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleRaw, ok := req.Secret.InternalData["role"]
+	if !ok {
+		return nil, errors.New("internal data 'role' not found")
+	}
+
+	role, err := getAKSRole(ctx, roleRaw.(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if role == nil {
+		return nil, fmt.Errorf("AKS role %q has been deleted", roleRaw.(string))
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = role.TTL
+	resp.Secret.MaxTTL = role.MaxTTL
+
+	b.sendSecretEvent(ctx, eventCredsRenew, "renew", req.Secret)
+
+	return resp, nil
+}
+
+func saveAKSRole(ctx context.Context, s logical.Storage, role *aksRoleEntry, name string) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", aksRolesStoragePath, name), role)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getAKSRole(ctx context.Context, name string, s logical.Storage) (*aksRoleEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", aksRolesStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading AKS role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(aksRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const (
+	aksRoleHelpSyn  = "Manage the Vault roles used to generate credentials for AKS clusters."
+	aksRoleHelpDesc = `
+This path allows you to read and write roles that generate credentials for an
+Azure Kubernetes Service cluster that uses Azure RBAC for Kubernetes
+authorization. Each credential is a new service principal with the Azure role
+of the role, for example Azure Kubernetes Service RBAC Reader, assigned in the
+role's namespace.
+
+The cluster_id is the resource ID of the cluster, and can't be changed once the
+role is created.
+`
+	aksRoleListHelpSyn  = "List existing AKS roles."
+	aksRoleListHelpDesc = "List existing AKS roles by name."
+	aksCredsHelpSyn     = "Request credentials for an AKS cluster for a given Vault role."
+	aksCredsHelpDesc    = `
+This path creates a service principal with the Azure role of the role assigned
+in its namespace, and returns its client ID and secret along with a kubeconfig
+for the cluster. The kubeconfig uses kubelogin to authenticate as the service
+principal. The service principal is deleted when the lease is revoked.
+`
+)
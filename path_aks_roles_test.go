@@ -0,0 +1,266 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	testAKSClusterID      = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.ContainerService/managedClusters/fakecluster"
+	testAKSLocalClusterID = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.ContainerService/managedClusters/localcluster"
+	testAKSClusterCA      = "RkFLRV9DQQ=="
+)
+
+func TestAKSRole(t *testing.T) {
+	t.Run("create and read", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testAKSRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"cluster_id": testAKSClusterID,
+			"namespace":  "team-a",
+			"role_name":  "Azure Kubernetes Service RBAC Reader",
+			"ttl":        1800,
+			"max_ttl":    3600,
+		})
+
+		resp := testAKSRoleRead(t, b, s, "aks-roles/test_role")
+		roleID := resp.Data["role_id"].(string)
+		if !strings.Contains(roleID, "/roleDefinitions/") {
+			t.Fatalf("expected the role to be looked up, got role_id: %q", roleID)
+		}
+		delete(resp.Data, "role_id")
+		equal(t, map[string]interface{}{
+			"cluster_id":   testAKSClusterID,
+			"cluster_name": "fakecluster",
+			"namespace":    "team-a",
+			"role_name":    "Azure Kubernetes Service RBAC Reader",
+			"ttl":          int64(1800),
+			"max_ttl":      int64(3600),
+		}, resp.Data)
+
+		// The namespace can be changed without looking up the role again
+		testAKSRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"namespace": "team-b",
+		})
+		resp = testAKSRoleRead(t, b, s, "aks-roles/test_role")
+		equal(t, "team-b", resp.Data["namespace"])
+		equal(t, roleID, resp.Data["role_id"])
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "aks-roles/",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		equal(t, []string{"test_role"}, resp.Data["keys"])
+	})
+
+	t.Run("credentials and revocation", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testAKSRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"cluster_id": testAKSClusterID,
+			"namespace":  "team-a",
+			"role_name":  "Azure Kubernetes Service RBAC Reader",
+			"ttl":        1800,
+		})
+		b.settings.TenantID = "tenant"
+		b.settings.Environment = "AZUREPUBLICCLOUD"
+
+		resp := testAKSRoleRead(t, b, s, "aks-creds/test_role")
+		equal(t, 30*time.Minute, resp.Secret.TTL)
+		equal(t, testAKSClusterID, resp.Data["cluster_id"])
+		equal(t, "team-a", resp.Data["namespace"])
+		clientID := resp.Data["client_id"].(string)
+		clientSecret := resp.Data["client_secret"].(string)
+
+		// The role is assigned in the namespace of the cluster
+		mp := getMockProvider(t, b, s)
+		raIDs := resp.Secret.InternalData["role_assignment_ids"].([]string)
+		equal(t, 1, len(raIDs))
+		ra, ok := mp.roleAssignments[raIDs[0]]
+		if !ok {
+			t.Fatal("expected the role assignment to exist")
+		}
+		equal(t, testAKSClusterID+"/namespaces/team-a", *ra.Properties.Scope)
+
+		var config kubeconfig
+		assertErrorIsNil(t, yaml.Unmarshal([]byte(resp.Data["kubeconfig"].(string)), &config))
+		equal(t, 1, len(config.Clusters))
+		equal(t, "https://fakecluster-dns.hcp.eastus.azmk8s.io:443", config.Clusters[0].Cluster.Server)
+		equal(t, testAKSClusterCA, config.Clusters[0].Cluster.CertificateAuthorityData)
+		equal(t, 1, len(config.Contexts))
+		equal(t, config.CurrentContext, config.Contexts[0].Name)
+		equal(t, "team-a", config.Contexts[0].Context.Namespace)
+		equal(t, 1, len(config.Users))
+		exec := config.Users[0].User.Exec
+		equal(t, "kubelogin", exec.Command)
+		equal(t, []string{
+			"get-token",
+			"--login", "spn",
+			"--environment", "AZUREPUBLICCLOUD",
+			"--server-id", aksServerID,
+			"--tenant-id", "tenant",
+			"--client-id", clientID,
+		}, exec.Args)
+		equal(t, []map[string]string{{"name": kubeloginSecretEnv, "value": clientSecret}}, exec.Env)
+
+		appObjID := resp.Secret.InternalData["app_object_id"].(string)
+		fakeSaveLoad(resp.Secret)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		if mp.appExists(appObjID) {
+			t.Fatal("expected the application to be deleted")
+		}
+		if _, ok := mp.roleAssignments[raIDs[0]]; ok {
+			t.Fatal("expected the role assignment to be deleted")
+		}
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testAKSRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"cluster_id": testAKSClusterID,
+			"namespace":  "team-a",
+			"role_name":  "Azure Kubernetes Service RBAC Reader",
+		})
+		resp := testAKSRoleRead(t, b, s, "aks-creds/test_role")
+		secret := resp.Secret
+		secret.IssueTime = time.Now()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "aks-roles/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		if err == nil {
+			t.Fatal("expected renewal to fail once the role is deleted")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testAKSRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"cluster_id": testAKSClusterID,
+			"namespace":  "team-a",
+			"role_name":  "Azure Kubernetes Service RBAC Reader",
+		})
+
+		tests := map[string]struct {
+			name string
+			data map[string]interface{}
+			msg  string
+		}{
+			"missing cluster": {
+				name: "new_role",
+				data: map[string]interface{}{"namespace": "team-a", "role_name": "Reader"},
+				msg:  "cluster_id is required",
+			},
+			"missing namespace": {
+				name: "new_role",
+				data: map[string]interface{}{"cluster_id": testAKSClusterID, "role_name": "Reader"},
+				msg:  "namespace is required",
+			},
+			"invalid namespace": {
+				name: "new_role",
+				data: map[string]interface{}{"cluster_id": testAKSClusterID, "namespace": "Team_A", "role_name": "Reader"},
+				msg:  "invalid namespace",
+			},
+			"missing role": {
+				name: "new_role",
+				data: map[string]interface{}{"cluster_id": testAKSClusterID, "namespace": "team-a"},
+				msg:  "role_name or role_id is required",
+			},
+			"ambiguous role": {
+				name: "new_role",
+				data: map[string]interface{}{"cluster_id": testAKSClusterID, "namespace": "team-a", "role_name": "multiple"},
+				msg:  "multiple matches found",
+			},
+			"unknown cluster": {
+				name: "new_role",
+				data: map[string]interface{}{"cluster_id": testAKSClusterID + "-missing", "namespace": "team-a", "role_name": "Reader"},
+				msg:  "unable to look up AKS cluster",
+			},
+			"cluster without Azure RBAC": {
+				name: "new_role",
+				data: map[string]interface{}{"cluster_id": testAKSLocalClusterID, "namespace": "team-a", "role_name": "Reader"},
+				msg:  "doesn't have Azure RBAC",
+			},
+			"changed cluster": {
+				name: "test_role",
+				data: map[string]interface{}{"cluster_id": testAKSLocalClusterID},
+				msg:  "can't be changed",
+			},
+			"ttl greater than max_ttl": {
+				name: "test_role",
+				data: map[string]interface{}{"ttl": 7200, "max_ttl": 3600},
+				msg:  "ttl cannot be greater than max_ttl",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.CreateOperation,
+					Path:      "aks-roles/" + tc.name,
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+}
+
+func testAKSRoleWrite(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "aks-roles/" + name,
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
+
+func testAKSRoleRead(t *testing.T, b *azureSecretBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	if resp == nil {
+		t.Fatalf("expected a response from %s", path)
+	}
+
+	return resp
+}
@@ -6,6 +6,7 @@ package azuresecrets
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -37,6 +38,11 @@ type azureConfig struct {
 	Environment                   string        `json:"environment"`
 	RootPasswordTTL               time.Duration `json:"root_password_ttl"`
 	RootPasswordExpirationDate    time.Time     `json:"root_password_expiration_date"`
+	NameTemplate                  string        `json:"name_template"`
+	ReconcileInterval             time.Duration `json:"reconcile_interval"`
+	ReconcileRepair               bool          `json:"reconcile_repair"`
+	VerifyRolePermissions         string        `json:"verify_role_permissions"`
+	RoleHistoryVersions           int           `json:"role_history_versions"`
 }
 
 func pathConfig(b *azureSecretBackend) *framework.Path {
@@ -77,6 +83,28 @@ func pathConfig(b *azureSecretBackend) *framework.Path {
 				Description: "The TTL of the root password in Azure. This can be either a number of seconds or a time formatted duration (ex: 24h, 48ds)",
 				Required:    false,
 			},
+			"name_template": {
+				Type:        framework.TypeString,
+				Description: "Template for the display name of generated applications. Supports the .RoleName, .DisplayName and .EntityID fields and functions such as random, uuid and timestamp.",
+			},
+			"reconcile_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often roles with persisted apps are checked for drift from Azure. If not set or set to 0, drift is not checked periodically.",
+			},
+			"reconcile_repair": {
+				Type:        framework.TypeBool,
+				Description: "Repair drift that is detected periodically. If not set, drift is only logged.",
+			},
+			"verify_role_permissions": {
+				Type: framework.TypeString,
+				Description: `Whether role writes check that the configured identity can assign the Azure roles of the
+				role at their scopes. Either "warn" (default), "fail" or "skip".`,
+				AllowedValues: []interface{}{verifyRolePermissionsWarn, verifyRolePermissionsFail, verifyRolePermissionsSkip},
+			},
+			"role_history_versions": {
+				Type:        framework.TypeInt,
+				Description: "Number of versions kept in the history of each role. If not set or set to 0, 10 versions are kept.",
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -156,6 +184,44 @@ func (b *azureSecretBackend) pathConfigWrite(ctx context.Context, req *logical.R
 		config.RootPasswordTTL = defaultRootPasswordTTL
 	}
 
+	if nameTemplate, ok := data.GetOk("name_template"); ok {
+		t := nameTemplate.(string)
+		if t != "" {
+			if err := validateNameTemplate(t); err != nil {
+				merr = multierror.Append(merr, err)
+			}
+		}
+		config.NameTemplate = t
+	}
+
+	if reconcileInterval, ok := data.GetOk("reconcile_interval"); ok {
+		config.ReconcileInterval = time.Second * time.Duration(reconcileInterval.(int))
+	}
+
+	if reconcileRepair, ok := data.GetOk("reconcile_repair"); ok {
+		config.ReconcileRepair = reconcileRepair.(bool)
+	}
+
+	if verifyRolePermissions, ok := data.GetOk("verify_role_permissions"); ok {
+		v := verifyRolePermissions.(string)
+		switch v {
+		case verifyRolePermissionsWarn, verifyRolePermissionsFail, verifyRolePermissionsSkip:
+			config.VerifyRolePermissions = v
+		default:
+			merr = multierror.Append(merr, fmt.Errorf("invalid verify_role_permissions %q", v))
+		}
+	} else if req.Operation == logical.CreateOperation {
+		config.VerifyRolePermissions = verifyRolePermissionsWarn
+	}
+
+	if roleHistoryVersions, ok := data.GetOk("role_history_versions"); ok {
+		if v := roleHistoryVersions.(int); v < 0 {
+			merr = multierror.Append(merr, fmt.Errorf("role_history_versions must not be negative"))
+		} else {
+			config.RoleHistoryVersions = v
+		}
+	}
+
 	if merr.ErrorOrNil() != nil {
 		return logical.ErrorResponse(merr.Error()), nil
 	}
@@ -181,11 +247,16 @@ func (b *azureSecretBackend) pathConfigRead(ctx context.Context, req *logical.Re
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"subscription_id":   config.SubscriptionID,
-			"tenant_id":         config.TenantID,
-			"environment":       config.Environment,
-			"client_id":         config.ClientID,
-			"root_password_ttl": int(config.RootPasswordTTL.Seconds()),
+			"subscription_id":         config.SubscriptionID,
+			"tenant_id":               config.TenantID,
+			"environment":             config.Environment,
+			"client_id":               config.ClientID,
+			"root_password_ttl":       int(config.RootPasswordTTL.Seconds()),
+			"name_template":           config.NameTemplate,
+			"reconcile_interval":      int(config.ReconcileInterval.Seconds()),
+			"reconcile_repair":        config.ReconcileRepair,
+			"verify_role_permissions": config.VerifyRolePermissions,
+			"role_history_versions":   config.RoleHistoryVersions,
 		},
 	}
 
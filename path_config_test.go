@@ -29,11 +29,16 @@ func TestConfig(t *testing.T) {
 				"client_secret":   "testClientSecret",
 			},
 			expected: map[string]interface{}{
-				"subscription_id":   "a228ceec-bf1a-4411-9f95-39678d8cdb34",
-				"tenant_id":         "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
-				"client_id":         "testClientId",
-				"environment":       "",
-				"root_password_ttl": 15768000,
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"environment":             "",
+				"root_password_ttl":       15768000,
+				"name_template":           "",
+				"reconcile_interval":      0,
+				"reconcile_repair":        false,
+				"verify_role_permissions": "warn",
+				"role_history_versions":   0,
 			},
 		},
 		{
@@ -46,11 +51,16 @@ func TestConfig(t *testing.T) {
 				"root_password_ttl": "1m",
 			},
 			expected: map[string]interface{}{
-				"subscription_id":   "a228ceec-bf1a-4411-9f95-39678d8cdb34",
-				"tenant_id":         "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
-				"client_id":         "testClientId",
-				"environment":       "",
-				"root_password_ttl": 60,
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"environment":             "",
+				"root_password_ttl":       60,
+				"name_template":           "",
+				"reconcile_interval":      0,
+				"reconcile_repair":        false,
+				"verify_role_permissions": "warn",
+				"role_history_versions":   0,
 			},
 		},
 		{
@@ -63,11 +73,105 @@ func TestConfig(t *testing.T) {
 				"environment":     "AZURECHINACLOUD",
 			},
 			expected: map[string]interface{}{
-				"subscription_id":   "a228ceec-bf1a-4411-9f95-39678d8cdb34",
-				"tenant_id":         "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
-				"client_id":         "testClientId",
-				"root_password_ttl": 15768000,
-				"environment":       "AZURECHINACLOUD",
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"root_password_ttl":       15768000,
+				"environment":             "AZURECHINACLOUD",
+				"name_template":           "",
+				"reconcile_interval":      0,
+				"reconcile_repair":        false,
+				"verify_role_permissions": "warn",
+				"role_history_versions":   0,
+			},
+		},
+		{
+			name: "name_template set if provided",
+			config: map[string]interface{}{
+				"subscription_id": "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":       "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":       "testClientId",
+				"client_secret":   "testClientSecret",
+				"name_template":   "vault-{{ .RoleName }}-{{ .DisplayName }}-{{ random 8 }}",
+			},
+			expected: map[string]interface{}{
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"environment":             "AZURECHINACLOUD",
+				"root_password_ttl":       15768000,
+				"name_template":           "vault-{{ .RoleName }}-{{ .DisplayName }}-{{ random 8 }}",
+				"reconcile_interval":      0,
+				"reconcile_repair":        false,
+				"verify_role_permissions": "warn",
+				"role_history_versions":   0,
+			},
+		},
+		{
+			name: "reconcile settings set if provided",
+			config: map[string]interface{}{
+				"subscription_id":    "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":          "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":          "testClientId",
+				"client_secret":      "testClientSecret",
+				"reconcile_interval": "1h",
+				"reconcile_repair":   true,
+			},
+			expected: map[string]interface{}{
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"environment":             "AZURECHINACLOUD",
+				"root_password_ttl":       15768000,
+				"name_template":           "vault-{{ .RoleName }}-{{ .DisplayName }}-{{ random 8 }}",
+				"reconcile_interval":      3600,
+				"reconcile_repair":        true,
+				"verify_role_permissions": "warn",
+				"role_history_versions":   0,
+			},
+		},
+		{
+			name: "verify_role_permissions set if provided",
+			config: map[string]interface{}{
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"client_secret":           "testClientSecret",
+				"verify_role_permissions": "fail",
+			},
+			expected: map[string]interface{}{
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"environment":             "AZURECHINACLOUD",
+				"root_password_ttl":       15768000,
+				"name_template":           "vault-{{ .RoleName }}-{{ .DisplayName }}-{{ random 8 }}",
+				"reconcile_interval":      3600,
+				"reconcile_repair":        true,
+				"verify_role_permissions": "fail",
+				"role_history_versions":   0,
+			},
+		},
+		{
+			name: "role_history_versions set if provided",
+			config: map[string]interface{}{
+				"subscription_id":       "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":             "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":             "testClientId",
+				"client_secret":         "testClientSecret",
+				"role_history_versions": 25,
+			},
+			expected: map[string]interface{}{
+				"subscription_id":         "a228ceec-bf1a-4411-9f95-39678d8cdb34",
+				"tenant_id":               "7ac36e27-80fc-4209-a453-e8ad83dc18c2",
+				"client_id":               "testClientId",
+				"environment":             "AZURECHINACLOUD",
+				"root_password_ttl":       15768000,
+				"name_template":           "vault-{{ .RoleName }}-{{ .DisplayName }}-{{ random 8 }}",
+				"reconcile_interval":      3600,
+				"reconcile_repair":        true,
+				"verify_role_permissions": "warn",
+				"role_history_versions":   25,
 			},
 		},
 	}
@@ -167,6 +271,11 @@ func TestConfigDelete(t *testing.T) {
 	testConfigCreate(t, b, s, config)
 
 	delete(config, "client_secret")
+	config["name_template"] = ""
+	config["reconcile_interval"] = 0
+	config["reconcile_repair"] = false
+	config["verify_role_permissions"] = "warn"
+	config["role_history_versions"] = 0
 	testConfigRead(t, b, s, config)
 
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
@@ -182,11 +291,16 @@ func TestConfigDelete(t *testing.T) {
 	}
 
 	config = map[string]interface{}{
-		"subscription_id":   "",
-		"tenant_id":         "",
-		"client_id":         "",
-		"environment":       "",
-		"root_password_ttl": 0,
+		"subscription_id":         "",
+		"tenant_id":               "",
+		"client_id":               "",
+		"environment":             "",
+		"root_password_ttl":       0,
+		"name_template":           "",
+		"reconcile_interval":      0,
+		"reconcile_repair":        false,
+		"verify_role_permissions": "",
+		"role_history_versions":   0,
 	}
 	testConfigRead(t, b, s, config)
 }
@@ -0,0 +1,504 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	cosmosDBRolesStoragePath = "cosmosdb-roles"
+
+	// Values of key_type
+	cosmosDBKeyTypeReadWrite = "read_write"
+	cosmosDBKeyTypeReadOnly  = "read_only"
+)
+
+// cosmosDBRoleEntry is a role that manages either the read-write or the
+// read-only keys of a Cosmos DB account. The key values are not stored; they
+// are read from Azure when credentials are requested.
+type cosmosDBRoleEntry struct {
+	AccountID        string `json:"cosmosdb_account_id"`
+	AccountName      string `json:"account_name"`
+	DocumentEndpoint string `json:"document_endpoint"`
+	KeyType          string `json:"key_type"`
+	keyRotation
+	keySync
+}
+
+// keyKind returns the Cosmos DB kind of the primary or secondary key of the
+// role's key type.
+func (r *cosmosDBRoleEntry) keyKind(keyName string) string {
+	if r.KeyType == cosmosDBKeyTypeReadOnly {
+		return keyName + "Readonly"
+	}
+	return keyName
+}
+
+// connectionString returns a connection string for the account with the key.
+func (r *cosmosDBRoleEntry) connectionString(key string) string {
+	return fmt.Sprintf("AccountEndpoint=%s;AccountKey=%s;", r.DocumentEndpoint, key)
+}
+
+// key returns the value of the primary or secondary key of the role's key
+// type.
+func (r *cosmosDBRoleEntry) key(keys CosmosDBKeys, keyName string) string {
+	switch r.keyKind(keyName) {
+	case "primary":
+		return keys.PrimaryMasterKey
+	case "secondary":
+		return keys.SecondaryMasterKey
+	case "primaryReadonly":
+		return keys.PrimaryReadonlyMasterKey
+	case "secondaryReadonly":
+		return keys.SecondaryReadonlyMasterKey
+	}
+	return ""
+}
+
+func pathsCosmosDBRole(b *azureSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "cosmosdb-roles/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "cosmosdb-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the Cosmos DB role.",
+				},
+				"cosmosdb_account_id": {
+					Type:        framework.TypeString,
+					Description: "Resource ID of the Cosmos DB account whose keys are managed by the role.",
+				},
+				"key_type": {
+					Type:          framework.TypeString,
+					Description:   `Keys managed by the role. Either "read_write" or "read_only". Defaults to "read_write".`,
+					AllowedValues: []interface{}{cosmosDBKeyTypeReadWrite, cosmosDBKeyTypeReadOnly},
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How often the keys are rotated. Set to 0 to only rotate through the rotate endpoint. Defaults to 24 hours.",
+				},
+				"sync_destinations": {
+					Type:        framework.TypeString,
+					Description: "JSON list of Azure Key Vault secrets, by vault_url and secret_name_template, that the connection string of each rotated key is written to.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathCosmosDBRoleRead,
+				logical.CreateOperation: b.pathCosmosDBRoleUpdate,
+				logical.UpdateOperation: b.pathCosmosDBRoleUpdate,
+				logical.DeleteOperation: b.pathCosmosDBRoleDelete,
+			},
+			HelpSynopsis:    cosmosDBRoleHelpSyn,
+			HelpDescription: cosmosDBRoleHelpDesc,
+			ExistenceCheck:  b.pathCosmosDBRoleExistenceCheck,
+		},
+		{
+			Pattern: "cosmosdb-roles/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "cosmosdb-roles",
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathCosmosDBRoleList,
+			},
+			HelpSynopsis:    cosmosDBRoleListHelpSyn,
+			HelpDescription: cosmosDBRoleListHelpDesc,
+		},
+		{
+			Pattern: "cosmosdb-roles/" + framework.GenericNameRegex("name") + "/rotate",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "rotate",
+				OperationSuffix: "cosmosdb-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the Cosmos DB role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathCosmosDBRoleRotate,
+				},
+			},
+			HelpSynopsis:    cosmosDBRoleRotateHelpSyn,
+			HelpDescription: cosmosDBRoleRotateHelpDesc,
+		},
+		{
+			Pattern: "cosmosdb-creds/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "request",
+				OperationSuffix: "cosmosdb-credentials",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the Cosmos DB role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathCosmosDBCredsRead,
+				},
+			},
+			HelpSynopsis:    cosmosDBCredsHelpSyn,
+			HelpDescription: cosmosDBCredsHelpDesc,
+		},
+	}
+}
+
+func (b *azureSecretBackend) pathCosmosDBRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getCosmosDBRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *azureSecretBackend) pathCosmosDBRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getCosmosDBRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: cosmosDBRoleData(role),
+	}, nil
+}
+
+func (b *azureSecretBackend) pathCosmosDBRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, cosmosDBRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getCosmosDBRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, fmt.Errorf("Cosmos DB role entry not found during update operation")
+		}
+		role = &cosmosDBRoleEntry{
+			KeyType: cosmosDBKeyTypeReadWrite,
+			keyRotation: keyRotation{
+				RotationPeriod: defaultKeyRotationPeriod,
+			},
+		}
+	}
+
+	if rotationPeriod, ok := d.GetOk("rotation_period"); ok {
+		role.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if destinations, ok := d.GetOk("sync_destinations"); ok {
+		c, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		role.SyncDestinations, err = parseSyncDestinations(destinations.(string), c.settings.keyVault())
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	accountID := d.Get("cosmosdb_account_id").(string)
+	keyType, keyTypeSet := d.GetOk("key_type")
+	switch {
+	case role.AccountID == "" && accountID == "":
+		return logical.ErrorResponse("cosmosdb_account_id is required"), nil
+	case role.AccountID != "" && accountID != "" && !strings.EqualFold(accountID, role.AccountID):
+		return logical.ErrorResponse("cosmosdb_account_id can't be changed; create a new Cosmos DB role instead"), nil
+	case role.AccountID != "" && keyTypeSet && keyType.(string) != role.KeyType:
+		return logical.ErrorResponse("key_type can't be changed; create a new Cosmos DB role instead"), nil
+	case keyTypeSet && keyType.(string) != cosmosDBKeyTypeReadWrite && keyType.(string) != cosmosDBKeyTypeReadOnly:
+		return logical.ErrorResponse("key_type must be %q or %q", cosmosDBKeyTypeReadWrite, cosmosDBKeyTypeReadOnly), nil
+	}
+
+	if role.AccountID != "" {
+		if err := saveCosmosDBRole(ctx, req.Storage, role, name); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if keyTypeSet {
+		role.KeyType = keyType.(string)
+	}
+
+	resourceLock := locksutil.LockForKey(b.resourceLocks, strings.ToLower(accountID))
+	resourceLock.Lock()
+	defer resourceLock.Unlock()
+
+	other, err := resourceRoleName(ctx, req.Storage, cosmosDBRolesStoragePath, name, func(r *cosmosDBRoleEntry) bool {
+		return strings.EqualFold(r.AccountID, accountID) && r.KeyType == role.KeyType
+	})
+	if err != nil {
+		return nil, err
+	}
+	if other != "" {
+		return logical.ErrorResponse("the %s keys of Cosmos DB account %q are already managed by Cosmos DB role %q", role.KeyType, accountID, other), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := c.provider.GetCosmosDBAccount(ctx, accountID)
+	if err != nil {
+		return logical.ErrorResponse("unable to look up Cosmos DB account %q: %s", accountID, err), nil
+	}
+	role.AccountID = accountID
+	role.AccountName = accountID[strings.LastIndex(accountID, "/")+1:]
+	if account.Name != "" {
+		role.AccountName = account.Name
+	}
+	role.DocumentEndpoint = account.Properties.DocumentEndpoint
+
+	// As with storage roles, Vault takes over the keys by rotating as soon as
+	// the role is created.
+	if err := b.rotateCosmosDBRole(ctx, c, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathCosmosDBRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, cosmosDBRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", cosmosDBRolesStoragePath, name)); err != nil {
+		return nil, fmt.Errorf("error deleting Cosmos DB role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathCosmosDBRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, cosmosDBRolesStoragePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing Cosmos DB roles: %w", err)
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+func (b *azureSecretBackend) pathCosmosDBRoleRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, cosmosDBRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getCosmosDBRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("Cosmos DB role %q does not exist", name), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.rotateCosmosDBRole(ctx, c, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: cosmosDBRoleData(role),
+	}, nil
+}
+
+func (b *azureSecretBackend) pathCosmosDBCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getCosmosDBRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("Cosmos DB role %q does not exist", name), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := c.provider.ListCosmosDBKeys(ctx, role.AccountID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys of Cosmos DB account %q: %w", role.AccountID, err)
+	}
+	key := role.key(keys, role.ActiveKey)
+	if key == "" {
+		return nil, fmt.Errorf("%s key of Cosmos DB account %q not found", role.keyKind(role.ActiveKey), role.AccountID)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"account_name":      role.AccountName,
+			"endpoint":          role.DocumentEndpoint,
+			"key_type":          role.KeyType,
+			"key_name":          role.ActiveKey,
+			"key":               key,
+			"connection_string": role.connectionString(key),
+			"last_rotated":      role.LastRotated,
+		},
+	}, nil
+}
+
+// rotateCosmosDBRole regenerates the inactive key of the role's key type and
+// makes it the active key, as rotateStorageRole does for storage accounts.
+// Callers must hold the lock of the role.
+func (b *azureSecretBackend) rotateCosmosDBRole(ctx context.Context, c *client, s logical.Storage, name string, role *cosmosDBRoleEntry) error {
+	keyName := role.inactiveKey(primarySecondaryKeys)
+
+	if err := c.provider.RegenerateCosmosDBKey(ctx, role.AccountID, role.keyKind(keyName)); err != nil {
+		return fmt.Errorf("error regenerating %s key of Cosmos DB account %q: %w", role.keyKind(keyName), role.AccountID, err)
+	}
+
+	role.rotated(keyName)
+
+	// The regenerate action doesn't return the keys, so they are only listed
+	// if the new key is synced. If they can't be listed, the versions holding
+	// the previous key are still disabled, and the new key is synced on the
+	// next rotation.
+	if len(role.SyncDestinations) > 0 || len(role.SyncedSecretIDs[keyName]) > 0 {
+		keys, err := c.provider.ListCosmosDBKeys(ctx, role.AccountID)
+		if err != nil {
+			b.Logger().Warn("error listing keys to sync, the regenerated key is not synced", "cosmosdb-role", name, "err", err)
+			b.disableRegeneratedKey(ctx, c, "cosmosdb", name, &role.keySync, keyName)
+		} else {
+			b.syncRotatedKey(ctx, c, "cosmosdb", name, &role.keySync, keyName, role.connectionString(role.key(keys, keyName)))
+		}
+	}
+
+	return saveCosmosDBRole(ctx, s, role, name)
+}
+
+// rotateCosmosDBRoles rotates the keys of the Cosmos DB roles whose rotation
+// period has passed since their last rotation.
+func (b *azureSecretBackend) rotateCosmosDBRoles(ctx context.Context, req *logical.Request) error {
+	return rotateDueRoles(ctx, req, cosmosDBRolesStoragePath, "Cosmos DB", b.rotateCosmosDBRoleIfDue)
+}
+
+func (b *azureSecretBackend) rotateCosmosDBRoleIfDue(ctx context.Context, req *logical.Request, name string) error {
+	lock := locksutil.LockForKey(b.storageRoleLocks, cosmosDBRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getCosmosDBRole(ctx, name, req.Storage)
+	if err != nil {
+		return err
+	}
+	if role == nil || !role.rotationDue() {
+		return nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("periodic func", "cosmosdb-role", name, "rotating key", role.keyKind(role.inactiveKey(primarySecondaryKeys)))
+	return b.rotateCosmosDBRole(ctx, c, req.Storage, name, role)
+}
+
+func cosmosDBRoleData(role *cosmosDBRoleEntry) map[string]interface{} {
+	data := role.keyRotation.data()
+	data["cosmosdb_account_id"] = role.AccountID
+	data["account_name"] = role.AccountName
+	data["key_type"] = role.KeyType
+	data["sync_destinations"] = role.SyncDestinations
+	return data
+}
+
+func saveCosmosDBRole(ctx context.Context, s logical.Storage, role *cosmosDBRoleEntry, name string) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", cosmosDBRolesStoragePath, name), role)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getCosmosDBRole(ctx context.Context, name string, s logical.Storage) (*cosmosDBRoleEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", cosmosDBRolesStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading Cosmos DB role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(cosmosDBRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const cosmosDBRoleHelpSyn = "Manage the keys of Azure Cosmos DB accounts."
+const cosmosDBRoleHelpDesc = `
+This path allows you to read and write Cosmos DB roles. A Cosmos DB role manages
+either the primary and secondary read-write keys, or the primary and secondary
+read-only keys, of an existing Cosmos DB account, given by its resource ID. The
+configured identity needs permission to list and regenerate the keys of the
+account.
+
+As with storage roles, the keys are rotated when the role is created and then
+every rotation_period, alternating between the primary and secondary key. The
+previously active key stays valid until the next rotation.
+
+The active key and a connection string are read from "cosmosdb-creds/<name>".
+Deleting a Cosmos DB role stops the rotation but doesn't change the keys. Each
+key type of an account can only be managed by one Cosmos DB role.
+
+As with storage roles, the connection string of each rotated key can also be
+written to the Azure Key Vault secrets in sync_destinations.
+`
+
+const cosmosDBRoleListHelpSyn = `List existing Cosmos DB roles.`
+const cosmosDBRoleListHelpDesc = `List existing Cosmos DB roles by name.`
+
+const cosmosDBRoleRotateHelpSyn = `Rotate the keys of a Cosmos DB role.`
+const cosmosDBRoleRotateHelpDesc = `
+This path regenerates the inactive key of the Cosmos DB account of a role and
+makes it the active key, as the periodic rotation does.
+`
+
+const cosmosDBCredsHelpSyn = `Read the active key of a Cosmos DB account.`
+const cosmosDBCredsHelpDesc = `
+This path returns the active key of the Cosmos DB account of a role, along with
+the account endpoint, a connection string and the time of the last rotation. The
+credentials are not leased; they remain valid until the second rotation after
+they were read.
+`
@@ -0,0 +1,201 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const testCosmosDBAccountID = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.DocumentDB/databaseAccounts/fakecosmos"
+
+func TestCosmosDBRole(t *testing.T) {
+	t.Run("create and read", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testCosmosDBRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"cosmosdb_account_id": testCosmosDBAccountID,
+		})
+
+		resp := testCosmosDBRoleRead(t, b, s, "cosmosdb-roles/test_role")
+		lastRotated := resp.Data["last_rotated"].(time.Time)
+		if time.Since(lastRotated) > time.Minute {
+			t.Fatalf("expected the role to be rotated on create, last rotated: %v", lastRotated)
+		}
+		delete(resp.Data, "last_rotated")
+		equal(t, map[string]interface{}{
+			"cosmosdb_account_id": testCosmosDBAccountID,
+			"account_name":        "fakecosmos",
+			"key_type":            "read_write",
+			"rotation_period":     int64(86400),
+			"active_key":          "secondary",
+			"sync_destinations":   []*SyncDestination(nil),
+		}, resp.Data)
+
+		// Only the secondary read-write key is regenerated
+		mp := getMockProvider(t, b, s)
+		keys := mp.cosmosDBAccountKeys(testCosmosDBAccountID)
+		equal(t, "initial-primary", keys.PrimaryMasterKey)
+		equal(t, "initial-secondary-readonly", keys.SecondaryReadonlyMasterKey)
+
+		resp = testCosmosDBRoleRead(t, b, s, "cosmosdb-creds/test_role")
+		equal(t, "secondary", resp.Data["key_name"])
+		equal(t, keys.SecondaryMasterKey, resp.Data["key"])
+		equal(t, "AccountEndpoint=https://fakecosmos.documents.azure.com:443/;AccountKey="+keys.SecondaryMasterKey+";",
+			resp.Data["connection_string"])
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "cosmosdb-roles/",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		equal(t, []string{"test_role"}, resp.Data["keys"])
+	})
+
+	t.Run("read-only keys alternate", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testCosmosDBRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"cosmosdb_account_id": testCosmosDBAccountID,
+			"key_type":            "read_only",
+		})
+		mp := getMockProvider(t, b, s)
+
+		for _, keyName := range []string{"primary", "secondary"} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "cosmosdb-roles/test_role/rotate",
+				Storage:   s,
+			})
+			assertRespNoError(t, resp, err)
+			equal(t, keyName, resp.Data["active_key"])
+
+			keys := mp.cosmosDBAccountKeys(testCosmosDBAccountID)
+			resp = testCosmosDBRoleRead(t, b, s, "cosmosdb-creds/test_role")
+			if keyName == "primary" {
+				equal(t, keys.PrimaryReadonlyMasterKey, resp.Data["key"])
+			} else {
+				equal(t, keys.SecondaryReadonlyMasterKey, resp.Data["key"])
+			}
+			equal(t, "initial-primary", keys.PrimaryMasterKey)
+			equal(t, "initial-secondary", keys.SecondaryMasterKey)
+		}
+	})
+
+	t.Run("periodic rotation", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testCosmosDBRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"cosmosdb_account_id": testCosmosDBAccountID,
+			"rotation_period":     3600,
+		})
+
+		role, err := getCosmosDBRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		role.LastRotated = time.Now().Add(-2 * time.Hour)
+		assertErrorIsNil(t, saveCosmosDBRole(context.Background(), s, role, "test_role"))
+
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+
+		role, err = getCosmosDBRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, "primary", role.ActiveKey)
+		if time.Since(role.LastRotated) > time.Minute {
+			t.Fatalf("expected role to be rotated, last rotated: %v", role.LastRotated)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testCosmosDBRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"cosmosdb_account_id": testCosmosDBAccountID,
+		})
+
+		tests := map[string]struct {
+			name string
+			data map[string]interface{}
+			msg  string
+		}{
+			"missing account": {
+				name: "new_role",
+				data: map[string]interface{}{},
+				msg:  "cosmosdb_account_id is required",
+			},
+			"unknown account": {
+				name: "new_role",
+				data: map[string]interface{}{"cosmosdb_account_id": testCosmosDBAccountID + "-missing"},
+				msg:  "unable to look up Cosmos DB account",
+			},
+			"invalid key type": {
+				name: "new_role",
+				data: map[string]interface{}{"cosmosdb_account_id": testCosmosDBAccountID, "key_type": "write_only"},
+				msg:  "key_type must be",
+			},
+			"changed account": {
+				name: "test_role",
+				data: map[string]interface{}{"cosmosdb_account_id": testCosmosDBAccountID + "-other"},
+				msg:  "can't be changed",
+			},
+			"changed key type": {
+				name: "test_role",
+				data: map[string]interface{}{"key_type": "read_only"},
+				msg:  "can't be changed",
+			},
+			"managed account": {
+				name: "new_role",
+				data: map[string]interface{}{"cosmosdb_account_id": strings.ToUpper(testCosmosDBAccountID)},
+				msg:  `already managed by Cosmos DB role "test_role"`,
+			},
+		}
+
+		// The read-only keys of the account can be managed by another role
+		testCosmosDBRoleWrite(t, b, s, "read_only_role", logical.CreateOperation, map[string]interface{}{
+			"cosmosdb_account_id": testCosmosDBAccountID,
+			"key_type":            "read_only",
+		})
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.CreateOperation,
+					Path:      "cosmosdb-roles/" + tc.name,
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+}
+
+func testCosmosDBRoleWrite(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, op logical.Operation, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      "cosmosdb-roles/" + name,
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
+
+func testCosmosDBRoleRead(t *testing.T, b *azureSecretBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	if resp == nil {
+		t.Fatalf("expected a response from %s", path)
+	}
+
+	return resp
+}
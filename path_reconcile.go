@@ -0,0 +1,507 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-secrets-azure/api"
+)
+
+func pathRoleReconcile(b *azureSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/reconcile",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixAzure,
+			OperationSuffix: "role-drift",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role.",
+			},
+			"repair": {
+				Type:        framework.TypeBool,
+				Description: "Repair any drift that is detected. If not set, drift is only reported.",
+				Default:     false,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRoleReconcile,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb: "read",
+				},
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleReconcile,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb: "reconcile",
+				},
+			},
+		},
+		HelpSynopsis:    roleReconcileHelpSyn,
+		HelpDescription: roleReconcileHelpDesc,
+	}
+}
+
+// roleDrift describes the differences between the Azure objects recorded for a
+// persisted app role and those that actually exist.
+type roleDrift struct {
+	ApplicationMissing      bool
+	ServicePrincipalMissing bool
+	MissingRoleAssignments  []*AzureRole
+	ExtraRoleAssignments    []string
+	MissingGroupMemberships []string
+	ExtraGroupMemberships   []string
+
+	// assignmentIDs holds the IDs of the role assignments found for each of
+	// the role's Azure roles, or an empty string if one is missing.
+	assignmentIDs []string
+}
+
+func (d *roleDrift) detected() bool {
+	return d.ApplicationMissing || d.ServicePrincipalMissing ||
+		len(d.MissingRoleAssignments) > 0 || len(d.ExtraRoleAssignments) > 0 ||
+		len(d.MissingGroupMemberships) > 0 || len(d.ExtraGroupMemberships) > 0
+}
+
+func (d *roleDrift) responseData() map[string]interface{} {
+	return map[string]interface{}{
+		"drift_detected":            d.detected(),
+		"application_missing":       d.ApplicationMissing,
+		"service_principal_missing": d.ServicePrincipalMissing,
+		"missing_role_assignments":  d.MissingRoleAssignments,
+		"extra_role_assignments":    d.ExtraRoleAssignments,
+		"missing_group_memberships": d.MissingGroupMemberships,
+		"extra_group_memberships":   d.ExtraGroupMemberships,
+	}
+}
+
+func (b *azureSecretBackend) pathRoleReconcile(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	repair := req.Operation == logical.UpdateOperation && d.Get("repair").(bool)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("error reading role: %w", err)
+	}
+	if role == nil {
+		return logical.ErrorResponse("role %q does not exist", name), nil
+	}
+	if !role.PersistApp || role.ManagedApplicationObjectID == "" {
+		return logical.ErrorResponse("reconcile is only supported for roles with persist_app enabled"), nil
+	}
+
+	drift, err := b.reconcileRole(ctx, req, name, role, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: drift.responseData(),
+	}
+	resp.Data["repaired"] = repair && drift.detected()
+
+	return resp, nil
+}
+
+// reconcileRole detects drift for a persisted app role and, if requested,
+// repairs it. The caller must hold the role lock.
+func (b *azureSecretBackend) reconcileRole(ctx context.Context, req *logical.Request, name string, role *roleEntry, repair bool) (*roleDrift, error) {
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	drift, err := c.detectDrift(ctx, role)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting drift: %w", err)
+	}
+
+	if repair && drift.detected() {
+		if err := b.repairDrift(ctx, req, c, name, role, drift); err != nil {
+			return nil, fmt.Errorf("error repairing drift: %w", err)
+		}
+	}
+
+	return drift, nil
+}
+
+// detectDrift compares the application, service principal, role assignments
+// and group memberships recorded for a persisted app role with Azure.
+func (c *client) detectDrift(ctx context.Context, role *roleEntry) (*roleDrift, error) {
+	drift := &roleDrift{}
+
+	if _, err := c.provider.GetApplicationByObjectID(ctx, role.ManagedApplicationObjectID); err != nil {
+		if !api.IsNotFound(err) {
+			return nil, fmt.Errorf("error loading application: %w", err)
+		}
+		drift.ApplicationMissing = true
+	}
+
+	if _, err := c.provider.GetServicePrincipalByID(ctx, role.ServicePrincipalObjectID); err != nil {
+		if !api.IsNotFound(err) {
+			return nil, fmt.Errorf("error loading service principal: %w", err)
+		}
+		drift.ServicePrincipalMissing = true
+	}
+
+	// All grants are lost with the service principal.
+	if drift.ApplicationMissing || drift.ServicePrincipalMissing {
+		drift.MissingRoleAssignments = role.AzureRoles
+		drift.MissingGroupMemberships = groupObjectIDs(role.AzureGroups)
+		drift.assignmentIDs = make([]string, len(role.AzureRoles))
+		return drift, nil
+	}
+
+	assignments, err := c.listRoleAssignments(ctx, role.ServicePrincipalObjectID, role.AzureRoles)
+	if err != nil {
+		return nil, fmt.Errorf("error listing role assignments: %w", err)
+	}
+
+	matched := make(map[string]bool)
+	drift.assignmentIDs = make([]string, len(role.AzureRoles))
+	for i, azureRole := range role.AzureRoles {
+		var storedID string
+		if i < len(role.RoleAssignmentIDs) {
+			storedID = role.RoleAssignmentIDs[i]
+		}
+
+		// Prefer the recorded assignment, but accept an equivalent one that
+		// was recreated outside of Vault.
+		id := findRoleAssignment(assignments, matched, func(ra *armauthorization.RoleAssignment) bool {
+			return strings.EqualFold(*ra.ID, storedID)
+		})
+		if id == "" {
+			id = findRoleAssignment(assignments, matched, func(ra *armauthorization.RoleAssignment) bool {
+				return ra.Properties != nil && ra.Properties.RoleDefinitionID != nil && ra.Properties.Scope != nil &&
+					strings.EqualFold(*ra.Properties.RoleDefinitionID, azureRole.RoleID) &&
+					normalizeScope(*ra.Properties.Scope) == normalizeScope(azureRole.Scope)
+			})
+		}
+
+		if id == "" {
+			drift.MissingRoleAssignments = append(drift.MissingRoleAssignments, azureRole)
+		}
+		drift.assignmentIDs[i] = id
+	}
+
+	for _, ra := range assignments {
+		if !matched[strings.ToLower(*ra.ID)] {
+			drift.ExtraRoleAssignments = append(drift.ExtraRoleAssignments, *ra.ID)
+		}
+	}
+
+	groups, err := c.provider.ListServicePrincipalGroups(ctx, role.ServicePrincipalObjectID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing group memberships: %w", err)
+	}
+
+	actualGroups := make(map[string]bool)
+	for _, group := range groups {
+		actualGroups[strings.ToLower(group.ID)] = true
+	}
+
+	expectedGroups := make(map[string]bool)
+	for _, group := range role.AzureGroups {
+		expectedGroups[strings.ToLower(group.ObjectID)] = true
+		if !actualGroups[strings.ToLower(group.ObjectID)] {
+			drift.MissingGroupMemberships = append(drift.MissingGroupMemberships, group.ObjectID)
+		}
+	}
+
+	for _, group := range groups {
+		if !expectedGroups[strings.ToLower(group.ID)] {
+			drift.ExtraGroupMemberships = append(drift.ExtraGroupMemberships, group.ID)
+		}
+	}
+
+	return drift, nil
+}
+
+// findRoleAssignment returns the ID of the first unmatched assignment
+// satisfying match, and marks it as matched.
+func findRoleAssignment(assignments []*armauthorization.RoleAssignment, matched map[string]bool, match func(*armauthorization.RoleAssignment) bool) string {
+	for _, ra := range assignments {
+		key := strings.ToLower(*ra.ID)
+		if !matched[key] && match(ra) {
+			matched[key] = true
+			return *ra.ID
+		}
+	}
+	return ""
+}
+
+// listRoleAssignments lists the role assignments of a service principal in the
+// configured subscription and beneath the scopes of the given Azure roles.
+func (c *client) listRoleAssignments(ctx context.Context, spID string, roles []*AzureRole) ([]*armauthorization.RoleAssignment, error) {
+	var scopes []string
+	if c.settings != nil && c.settings.SubscriptionID != "" {
+		scopes = append(scopes, "/subscriptions/"+c.settings.SubscriptionID)
+	}
+	for _, role := range roles {
+		scopes = append(scopes, assignmentListScope(role.Scope))
+	}
+
+	filter := fmt.Sprintf("principalId eq '%s'", spID)
+
+	seenScopes := make(map[string]bool)
+	seenAssignments := make(map[string]bool)
+	var result []*armauthorization.RoleAssignment
+	for _, scope := range scopes {
+		if seenScopes[normalizeScope(scope)] {
+			continue
+		}
+		seenScopes[normalizeScope(scope)] = true
+
+		assignments, err := c.provider.ListRoleAssignments(ctx, scope, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, ra := range assignments {
+			if ra == nil || ra.ID == nil || seenAssignments[strings.ToLower(*ra.ID)] {
+				continue
+			}
+			seenAssignments[strings.ToLower(*ra.ID)] = true
+			result = append(result, ra)
+		}
+	}
+
+	return result, nil
+}
+
+// assignmentListScope returns the scope at which assignments beneath scope are
+// listed. Listing at a subscription includes all of its resource groups and
+// resources.
+func assignmentListScope(scope string) string {
+	parts := strings.Split(strings.Trim(scope, "/"), "/")
+	if len(parts) >= 2 && strings.EqualFold(parts[0], "subscriptions") {
+		return "/subscriptions/" + parts[1]
+	}
+	return scope
+}
+
+// repairDrift restores the Azure objects of a persisted app role to the state
+// recorded in the role and saves the role.
+func (b *azureSecretBackend) repairDrift(ctx context.Context, req *logical.Request, c *client, name string, role *roleEntry, drift *roleDrift) error {
+	if drift.ApplicationMissing || drift.ServicePrincipalMissing {
+		return b.recreatePersistedApp(ctx, req, c, name, role, drift)
+	}
+
+	spID := role.ServicePrincipalObjectID
+
+	// Azure roles that are missing are assigned again. A WAL entry ensures the
+	// new assignments are removed if the role can't be updated.
+	var missingRoles []*AzureRole
+	var missingIndexes []int
+	for i, id := range drift.assignmentIDs {
+		if id == "" {
+			missingRoles = append(missingRoles, role.AzureRoles[i])
+			missingIndexes = append(missingIndexes, i)
+		}
+	}
+
+	var walID string
+	if len(missingRoles) > 0 {
+		assignmentIDs, err := c.generateUUIDs(len(missingRoles))
+		if err != nil {
+			return fmt.Errorf("error generating assignment IDs; err=%w", err)
+		}
+
+		walID, err = framework.PutWAL(ctx, req.Storage, walAppRoleAssignment, &walAppRoleAssign{
+			SpID:          spID,
+			AssignmentIDs: assignmentIDs,
+			AzureRoles:    missingRoles,
+			Expiration:    time.Now().Add(maxWALAge),
+		})
+		if err != nil {
+			return fmt.Errorf("error writing WAL: %w", err)
+		}
+
+		raIDs, err := c.assignRoles(ctx, spID, missingRoles, assignmentIDs)
+		if err != nil {
+			return err
+		}
+		for j, i := range missingIndexes {
+			drift.assignmentIDs[i] = raIDs[j]
+		}
+	}
+
+	var merr *multierror.Error
+	if err := c.unassignRoles(ctx, drift.ExtraRoleAssignments); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	var missingGroups []*AzureGroup
+	for _, group := range role.AzureGroups {
+		for _, id := range drift.MissingGroupMemberships {
+			if group.ObjectID == id {
+				missingGroups = append(missingGroups, group)
+			}
+		}
+	}
+	if err := c.addGroupMemberships(ctx, spID, missingGroups); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := c.removeGroupMemberships(ctx, spID, drift.ExtraGroupMemberships); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	role.RoleAssignmentIDs = drift.assignmentIDs
+	role.GroupMembershipIDs = groupObjectIDs(role.AzureGroups)
+	if err := saveRole(ctx, req.Storage, role, name); err != nil {
+		return fmt.Errorf("error storing role: %w", err)
+	}
+
+	if walID != "" {
+		if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+			return fmt.Errorf("error deleting WAL: %w", err)
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// recreatePersistedApp replaces the missing application or service principal of
+// a persisted app role. If only the service principal is missing, a new one is
+// created for the existing application so its client ID is kept.
+func (b *azureSecretBackend) recreatePersistedApp(ctx context.Context, req *logical.Request, c *client, name string, role *roleEntry, drift *roleDrift) error {
+	// Assignments of a deleted service principal remain in Azure until they
+	// are removed. This is a clean-up operation so errors are only logged.
+	if err := c.unassignRoles(ctx, role.RoleAssignmentIDs); err != nil {
+		b.Logger().Warn("error removing role assignments of deleted service principal", "role", name, "err", err)
+	}
+	role.RoleAssignmentIDs = nil
+	role.GroupMembershipIDs = nil
+
+	if drift.ApplicationMissing {
+		role.ManagedApplicationObjectID = ""
+		role.ServicePrincipalObjectID = ""
+		if err := b.createPersistedApp(ctx, req, role, name); err != nil {
+			return err
+		}
+
+		if err := saveRole(ctx, req.Storage, role, name); err != nil {
+			return fmt.Errorf("error storing role: %w", err)
+		}
+		return nil
+	}
+
+	app, err := c.provider.GetApplicationByObjectID(ctx, role.ManagedApplicationObjectID)
+	if err != nil {
+		return fmt.Errorf("error loading application: %w", err)
+	}
+
+	spID, _, err := c.createSP(ctx, app, role.CustomSecurityAttributes, spExpiration)
+	if err != nil {
+		return err
+	}
+	role.ServicePrincipalObjectID = spID
+
+	// Nothing is granted to the new service principal yet, so all roles and
+	// groups are added.
+	changes, err := b.addPersistedAppGrants(ctx, req.Storage, c, role, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := saveRole(ctx, req.Storage, role, name); err != nil {
+		return fmt.Errorf("error storing role: %w", err)
+	}
+
+	return b.finishPersistedAppGrants(ctx, req.Storage, c, changes)
+}
+
+// reconcileRoles periodically detects, and optionally repairs, drift for all
+// persisted app roles. Errors for individual roles are collected so that one
+// role doesn't prevent the others from being reconciled.
+func (b *azureSecretBackend) reconcileRoles(ctx context.Context, req *logical.Request) error {
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if config == nil || config.ReconcileInterval == 0 {
+		return nil
+	}
+
+	if time.Since(b.lastReconcile) < config.ReconcileInterval {
+		return nil
+	}
+	b.lastReconcile = time.Now()
+
+	names, err := req.Storage.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return fmt.Errorf("error listing roles: %w", err)
+	}
+
+	var merr *multierror.Error
+	for _, name := range names {
+		if err := b.reconcileRoleByName(ctx, req, name, config.ReconcileRepair); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("error reconciling role %q: %w", name, err))
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+func (b *azureSecretBackend) reconcileRoleByName(ctx context.Context, req *logical.Request, name string, repair bool) error {
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return err
+	}
+	if role == nil || !role.PersistApp || role.ManagedApplicationObjectID == "" {
+		return nil
+	}
+
+	drift, err := b.reconcileRole(ctx, req, name, role, repair)
+	if err != nil {
+		return err
+	}
+
+	if drift.detected() {
+		b.Logger().Warn("drift detected for persisted app role", "role", name, "repaired", repair,
+			"application_missing", drift.ApplicationMissing,
+			"service_principal_missing", drift.ServicePrincipalMissing,
+			"missing_role_assignments", len(drift.MissingRoleAssignments),
+			"extra_role_assignments", len(drift.ExtraRoleAssignments),
+			"missing_group_memberships", len(drift.MissingGroupMemberships),
+			"extra_group_memberships", len(drift.ExtraGroupMemberships))
+	}
+
+	return nil
+}
+
+const roleReconcileHelpSyn = `Detect and repair drift of a persisted app role.`
+const roleReconcileHelpDesc = `
+Roles with persist_app enabled record the application, service principal, role
+assignments and group memberships they manage in Azure. Reading this endpoint
+compares the recorded state with Azure and reports any drift: a deleted
+application or service principal, missing or extra role assignments, and
+missing or extra group memberships.
+
+Writing to this endpoint with repair=true also repairs the drift. Missing grants
+are assigned again, extra grants are removed, and a deleted application or
+service principal is recreated.
+
+Drift can also be detected periodically by setting reconcile_interval in the
+config. Drift is then logged, and repaired if reconcile_repair is set.
+`
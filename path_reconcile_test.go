@@ -0,0 +1,225 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var testPersistedRole = map[string]interface{}{
+	"azure_roles": compactJSON(`[
+		{
+			"role_name": "Owner",
+			"role_id": "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+			"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"
+		},
+		{
+			"role_name": "Reader",
+			"role_id": "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Reader",
+			"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg2"
+		}]`),
+	"azure_groups": compactJSON(`[
+		{
+			"group_name": "foo",
+			"object_id": "239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-foo"
+		}]`),
+	"persist_app": true,
+}
+
+func TestRoleReconcile(t *testing.T) {
+	t.Run("no drift", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+
+		resp := testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, false, resp.Data["drift_detected"])
+		equal(t, false, resp.Data["repaired"])
+	})
+
+	t.Run("grants", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		mp := getMockProvider(t, b, s)
+		ctx := context.Background()
+
+		// Remove a role assignment and the group membership, and grant an
+		// extra role and group outside of Vault.
+		_, err = mp.DeleteRoleAssignmentByID(ctx, role.RoleAssignmentIDs[1])
+		assertErrorIsNil(t, err)
+		assertErrorIsNil(t, mp.RemoveGroupMember(ctx, role.AzureGroups[0].ObjectID, role.ServicePrincipalObjectID))
+
+		roleDefID := "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Contributor"
+		extra, err := mp.CreateRoleAssignment(ctx, "/subscriptions/FAKE_SUB_ID", generateUUID(),
+			armauthorization.RoleAssignmentCreateParameters{
+				Properties: &armauthorization.RoleAssignmentProperties{
+					RoleDefinitionID: &roleDefID,
+					PrincipalID:      &role.ServicePrincipalObjectID,
+				},
+			})
+		assertErrorIsNil(t, err)
+		assertErrorIsNil(t, mp.AddGroupMember(ctx, "extra-group", role.ServicePrincipalObjectID))
+
+		resp := testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, true, resp.Data["drift_detected"])
+		equal(t, []*AzureRole{role.AzureRoles[1]}, resp.Data["missing_role_assignments"])
+		equal(t, []string{*extra.ID}, resp.Data["extra_role_assignments"])
+		equal(t, []string{role.AzureGroups[0].ObjectID}, resp.Data["missing_group_memberships"])
+		equal(t, []string{"extra-group"}, resp.Data["extra_group_memberships"])
+
+		// Reading never repairs drift
+		resp = testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, true, resp.Data["drift_detected"])
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.UpdateOperation, map[string]interface{}{"repair": true})
+		equal(t, true, resp.Data["repaired"])
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, false, resp.Data["drift_detected"])
+
+		repaired, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, role.RoleAssignmentIDs[0], repaired.RoleAssignmentIDs[0])
+		if repaired.RoleAssignmentIDs[1] == role.RoleAssignmentIDs[1] {
+			t.Fatal("expected missing role assignment to be recreated")
+		}
+	})
+
+	t.Run("deleted application", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		mp := getMockProvider(t, b, s)
+		assertErrorIsNil(t, mp.DeleteApplication(context.Background(), role.ManagedApplicationObjectID, false))
+
+		resp := testRoleReconcile(t, b, s, "test_role", logical.UpdateOperation, nil)
+		equal(t, true, resp.Data["application_missing"])
+		equal(t, false, resp.Data["repaired"])
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.UpdateOperation, map[string]interface{}{"repair": true})
+		equal(t, true, resp.Data["repaired"])
+
+		recreated, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		if recreated.ManagedApplicationObjectID == role.ManagedApplicationObjectID {
+			t.Fatal("expected application to be recreated")
+		}
+		equal(t, recreated.ManagedApplicationObjectID, recreated.ApplicationObjectID)
+		equal(t, 2, len(recreated.RoleAssignmentIDs))
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, false, resp.Data["drift_detected"])
+	})
+
+	t.Run("deleted service principal", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		mp := getMockProvider(t, b, s)
+		assertErrorIsNil(t, mp.DeleteServicePrincipal(context.Background(), role.ServicePrincipalObjectID, false))
+
+		resp := testRoleReconcile(t, b, s, "test_role", logical.UpdateOperation, map[string]interface{}{"repair": true})
+		equal(t, true, resp.Data["service_principal_missing"])
+		equal(t, true, resp.Data["repaired"])
+
+		// The application, and its client ID, are kept
+		recreated, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, role.ManagedApplicationObjectID, recreated.ManagedApplicationObjectID)
+		equal(t, role.ApplicationID, recreated.ApplicationID)
+		if recreated.ServicePrincipalObjectID == role.ServicePrincipalObjectID {
+			t.Fatal("expected service principal to be recreated")
+		}
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, false, resp.Data["drift_detected"])
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+		testConfigUpdate(t, b, s, map[string]interface{}{
+			"reconcile_interval": "1h",
+			"reconcile_repair":   true,
+		})
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		mp := getMockProvider(t, b, s)
+		_, err = mp.DeleteRoleAssignmentByID(context.Background(), role.RoleAssignmentIDs[0])
+		assertErrorIsNil(t, err)
+
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+
+		resp := testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, false, resp.Data["drift_detected"])
+
+		// Roles aren't reconciled again before the interval has passed
+		repaired, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		_, err = mp.DeleteRoleAssignmentByID(context.Background(), repaired.RoleAssignmentIDs[0])
+		assertErrorIsNil(t, err)
+
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, true, resp.Data["drift_detected"])
+
+		b.lastReconcile = time.Time{}
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+
+		resp = testRoleReconcile(t, b, s, "test_role", logical.ReadOperation, nil)
+		equal(t, false, resp.Data["drift_detected"])
+	})
+
+	t.Run("not persisted", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testRole)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "roles/test_role/reconcile",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		msg := "reconcile is only supported for roles with persist_app enabled"
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), msg) {
+			t.Fatalf("expected to find: %s, got: %v", msg, resp)
+		}
+	})
+}
+
+func testRoleReconcile(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, op logical.Operation, d map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      "roles/" + name + "/reconcile",
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	return resp
+}
+
+func getMockProvider(t *testing.T, b *azureSecretBackend, s logical.Storage) *mockProvider {
+	t.Helper()
+	client, err := b.getClient(context.Background(), s)
+	assertErrorIsNil(t, err)
+
+	return client.provider.(*mockProvider)
+}
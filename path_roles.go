@@ -7,12 +7,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/google/uuid"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 
@@ -22,12 +28,26 @@ import (
 const (
 	rolesStoragePath = "roles"
 
-	credentialTypeSP = 0
+	// retiredAppsStoragePath holds managed apps that are no longer used by
+	// their role but still have outstanding leases.
+	retiredAppsStoragePath = "retired-apps"
+
+	credentialTypeSP              = 0
+	credentialTypeManagedIdentity = 1
+
+	// Azure limits application descriptions to 1024 characters.
+	maxAppDescriptionLength = 1024
 )
 
+// credentialTypeNames are the names of the credential types of roles.
+var credentialTypeNames = map[int]string{
+	credentialTypeSP:              "service_principal",
+	credentialTypeManagedIdentity: "managed_identity",
+}
+
 // roleEntry is a Vault role construct that maps to Azure roles or Applications
 type roleEntry struct {
-	CredentialType      int           `json:"credential_type"` // Reserved. Always SP at this time.
+	CredentialType      int           `json:"credential_type"`
 	AzureRoles          []*AzureRole  `json:"azure_roles"`
 	AzureGroups         []*AzureGroup `json:"azure_groups"`
 	ApplicationID       string        `json:"application_id"`
@@ -38,6 +58,33 @@ type roleEntry struct {
 	MaxTTL              time.Duration `json:"max_ttl"`
 	PermanentlyDelete   bool          `json:"permanently_delete"`
 	PersistApp          bool          `json:"persist_app"`
+	AllowedScopes       []string      `json:"allowed_scopes"`
+	NameTemplate        string        `json:"name_template"`
+
+	// Metadata describes the role to operators. Together with the description
+	// it is returned by detailed role lists, which can be filtered by it.
+	Metadata map[string]string `json:"metadata"`
+
+	// Limits on the credentials issued for the role. Zero means unlimited.
+	MaxActiveCredentials int `json:"max_active_credentials"`
+	MaxIssueRate         int `json:"max_issue_rate"`
+
+	// Properties of applications created by Vault. The description also
+	// describes the role itself.
+	Owners                     []string                     `json:"owners"`
+	Notes                      string                       `json:"notes"`
+	Description                string                       `json:"description"`
+	ServiceManagementReference string                       `json:"service_management_reference"`
+	CustomSecurityAttributes   api.CustomSecurityAttributes `json:"custom_security_attributes"`
+
+	// Resource group, and its location, that user-assigned managed identities
+	// are created in, and the federated credentials added to them.
+	ManagedIdentityResourceGroup string                 `json:"managed_identity_resource_group"`
+	ManagedIdentityLocation      string                 `json:"managed_identity_location"`
+	FederatedCredentials         []*FederatedCredential `json:"federated_credentials"`
+
+	// Key Vault secrets that the passwords issued for the role are written to
+	SyncDestinations []*SyncDestination `json:"sync_destinations"`
 
 	// Info for persisted apps
 	RoleAssignmentIDs          []string `json:"role_assignment_ids"`
@@ -60,9 +107,17 @@ type AzureRole struct {
 // GroupName and ObjectID are both traits of the group. ObjectID is the unique
 // identifier, but GroupName is more useful to a human (though it is not
 // unique).
+//
+// Instead of a single group, Filter may select any number of groups, up to
+// MaxMatches, with an OData filter that is evaluated when credentials are
+// generated. Relationship is how the service principal is added to the
+// groups, as a member or as an owner.
 type AzureGroup struct {
-	GroupName string `json:"group_name"` // e.g. MyGroup
-	ObjectID  string `json:"object_id"`  // e.g. 90820a30-352d-400f-89e5-2ca74ac14333
+	GroupName    string `json:"group_name"`             // e.g. MyGroup
+	ObjectID     string `json:"object_id"`              // e.g. 90820a30-352d-400f-89e5-2ca74ac14333
+	Filter       string `json:"filter,omitempty"`       // e.g. startswith(displayName,'team-a-')
+	MaxMatches   int    `json:"max_matches,omitempty"`  // e.g. 10
+	Relationship string `json:"relationship,omitempty"` // member or owner
 }
 
 func pathsRole(b *azureSecretBackend) []*framework.Path {
@@ -73,50 +128,7 @@ func pathsRole(b *azureSecretBackend) []*framework.Path {
 				OperationPrefix: operationPrefixAzure,
 				OperationSuffix: "role",
 			},
-			Fields: map[string]*framework.FieldSchema{
-				"name": {
-					Type:        framework.TypeLowerCaseString,
-					Description: "Name of the role.",
-				},
-				"application_object_id": {
-					Type:        framework.TypeString,
-					Description: "Application Object ID to use for static service principal credentials.",
-				},
-				"azure_roles": {
-					Type:        framework.TypeString,
-					Description: "JSON list of Azure roles to assign.",
-				},
-				"azure_groups": {
-					Type:        framework.TypeString,
-					Description: "JSON list of Azure groups to add the service principal to.",
-				},
-				"sign_in_audience": {
-					Type:        framework.TypeString,
-					Description: "Specifies the security principal types that are allowed to sign in to the application. Valid values are: AzureADMyOrg, AzureADMultipleOrgs, AzureADandPersonalMicrosoftAccount, PersonalMicrosoftAccount",
-				},
-				"tags": {
-					Type:        framework.TypeCommaStringSlice,
-					Description: "Azure tags to attach to an application.",
-				},
-				"ttl": {
-					Type:        framework.TypeDurationSecond,
-					Description: "Default lease for generated credentials. If not set or set to 0, will use system default.",
-				},
-				"max_ttl": {
-					Type:        framework.TypeDurationSecond,
-					Description: "Maximum time a service principal. If not set or set to 0, will use system default.",
-				},
-				"permanently_delete": {
-					Type:        framework.TypeBool,
-					Description: "Indicates whether new application objects should be permanently deleted. If not set, objects will not be permanently deleted.",
-					Default:     false,
-				},
-				"persist_app": {
-					Type:        framework.TypeBool,
-					Description: "Persist the app between generated credentials. Useful if the app needs to maintain owner ship of resources it creates",
-					Default:     false,
-				},
-			},
+			Fields: roleFields(),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.pathRoleRead,
 				logical.CreateOperation: b.pathRoleUpdate,
@@ -133,6 +145,21 @@ func pathsRole(b *azureSecretBackend) []*framework.Path {
 				OperationPrefix: operationPrefixAzure,
 				OperationSuffix: "roles",
 			},
+			Fields: map[string]*framework.FieldSchema{
+				"detailed": {
+					Type:        framework.TypeBool,
+					Description: "Return the credential mode, TTLs, scope count, persisted app, description and metadata of each role.",
+					Default:     false,
+				},
+				"metadata": {
+					Type:        framework.TypeKVPairs,
+					Description: "Only list roles with all of these metadata key/value pairs.",
+				},
+				"scope_prefix": {
+					Type:        framework.TypeString,
+					Description: "Only list roles with an Azure role scope starting with this prefix.",
+				},
+			},
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ListOperation: b.pathRoleList,
 			},
@@ -143,6 +170,116 @@ func pathsRole(b *azureSecretBackend) []*framework.Path {
 
 }
 
+// roleFields returns the fields of a role, which are also the fields of a role
+// definition that is imported.
+func roleFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeLowerCaseString,
+			Description: "Name of the role.",
+		},
+		"application_object_id": {
+			Type:        framework.TypeString,
+			Description: "Application Object ID to use for static service principal credentials.",
+		},
+		"credential_type": {
+			Type:        framework.TypeString,
+			Description: "Type of credentials issued for the role: service_principal or managed_identity. Defaults to service_principal.",
+		},
+		"managed_identity_resource_group": {
+			Type:        framework.TypeString,
+			Description: "Resource ID of the resource group that user-assigned managed identities are created in.",
+		},
+		"federated_credentials": {
+			Type:        framework.TypeString,
+			Description: "JSON list of federated credentials, by name, issuer, subject and audiences, to add to managed identities.",
+		},
+		"sync_destinations": {
+			Type:        framework.TypeString,
+			Description: "JSON list of Azure Key Vault secrets, by vault_url and secret_name_template, that passwords issued for an existing or persisted application are written to.",
+		},
+		"azure_roles": {
+			Type:        framework.TypeString,
+			Description: "JSON list of Azure roles to assign.",
+		},
+		"azure_groups": {
+			Type:        framework.TypeString,
+			Description: "JSON list of Azure groups to add the service principal to, by group_name, object_id or filter, with an optional relationship of member or owner.",
+		},
+		"sign_in_audience": {
+			Type:        framework.TypeString,
+			Description: "Specifies the security principal types that are allowed to sign in to the application. Valid values are: AzureADMyOrg, AzureADMultipleOrgs, AzureADandPersonalMicrosoftAccount, PersonalMicrosoftAccount",
+		},
+		"tags": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Azure tags to attach to an application.",
+		},
+		"ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Default lease for generated credentials. If not set or set to 0, will use system default.",
+		},
+		"max_ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Maximum time a service principal. If not set or set to 0, will use system default.",
+		},
+		"permanently_delete": {
+			Type:        framework.TypeBool,
+			Description: "Indicates whether new application objects should be permanently deleted. If not set, objects will not be permanently deleted.",
+			Default:     false,
+		},
+		"persist_app": {
+			Type:        framework.TypeBool,
+			Description: "Persist the app between generated credentials. Useful if the app needs to maintain owner ship of resources it creates",
+			Default:     false,
+		},
+		"allowed_scopes": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Glob patterns of scopes, beneath the scopes of the configured Azure roles, that may be requested when generating credentials.",
+		},
+		"name_template": {
+			Type:        framework.TypeString,
+			Description: "Template for the display name of applications created for this role. Overrides the name_template in the config.",
+		},
+		"owners": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Object IDs of the users or groups to set as owners of applications created for this role.",
+		},
+		"notes": {
+			Type:        framework.TypeString,
+			Description: "Notes to set on applications created for this role.",
+		},
+		"description": {
+			Type:        framework.TypeString,
+			Description: "Description of the role. It is also set on applications created for this role.",
+		},
+		"metadata": {
+			Type:        framework.TypeKVPairs,
+			Description: "Arbitrary key/value pairs describing the role. Roles can be listed by their metadata.",
+		},
+		"service_management_reference": {
+			Type:        framework.TypeString,
+			Description: "Service management reference to set on applications created for this role.",
+		},
+		"custom_security_attributes": {
+			Type:        framework.TypeString,
+			Description: "JSON object mapping attribute sets to the custom security attributes to assign to service principals created for this role.",
+		},
+		"max_active_credentials": {
+			Type:        framework.TypeInt,
+			Description: "Maximum number of outstanding leases for the role. If not set or 0, the number is unlimited.",
+		},
+		"max_issue_rate": {
+			Type:        framework.TypeInt,
+			Description: "Maximum number of credentials issued for the role per minute. If not set or 0, the rate is unlimited.",
+		},
+		"force": {
+			Type:        framework.TypeBool,
+			Description: "On delete, revoke the credentials of outstanding leases of the role instead of refusing to delete it.",
+			Default:     false,
+		},
+	}
+}
+
 // pathRoleUpdate creates or updates Vault roles.
 //
 // Basic validity check are made to verify that the provided fields meet requirements
@@ -163,6 +300,13 @@ func pathsRole(b *azureSecretBackend) []*framework.Path {
 //
 //	The provided Application Object ID is checked for existence.
 func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.updateRole(ctx, req, d, 0)
+}
+
+// updateRole creates or updates a role, and records the new version in its
+// history. rollbackVersion is the version of the role being rolled back to, if
+// any.
+func (b *azureSecretBackend) updateRole(ctx context.Context, req *logical.Request, d *framework.FieldData, rollbackVersion int) (*logical.Response, error) {
 	var resp *logical.Response
 
 	config, err := b.getConfig(ctx, req.Storage)
@@ -181,6 +325,11 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 
 	// load or create role
 	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
 	role, err := getRole(ctx, name, req.Storage)
 	if err != nil {
 		return nil, fmt.Errorf("error reading role: %w", err)
@@ -195,16 +344,143 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 		}
 	}
 
+	// Keep the role as it was before this update. The stored role assignment
+	// IDs of a persisted app correspond to the previous Azure roles.
+	prev := *role
+
+	if resp, err := b.updateRoleEntry(ctx, client, req.Operation, d, role); resp != nil || err != nil {
+		return resp, err
+	}
+
+	// Check that the roles can be assigned before anything is created in Azure
+	errResp, warnings := verifyRolePermissions(ctx, client, config, role)
+	if errResp != nil {
+		return errResp, nil
+	}
+	if len(warnings) > 0 {
+		resp = &logical.Response{
+			Warnings: warnings,
+		}
+	}
+
+	// A managed app that is no longer used by the role is retired. It is
+	// deleted once the outstanding leases for it have been revoked.
+	var retired *walAppRetirement
+	if prev.ManagedApplicationObjectID != "" && !role.PersistApp && role.ApplicationObjectID != prev.ManagedApplicationObjectID {
+		retired = &walAppRetirement{
+			RoleName:           name,
+			AppObjID:           prev.ManagedApplicationObjectID,
+			SpID:               prev.ServicePrincipalObjectID,
+			RoleAssignmentIDs:  prev.RoleAssignmentIDs,
+			GroupMembershipIDs: prev.GroupMembershipIDs,
+			PermanentlyDelete:  prev.PermanentlyDelete,
+			Expiration:         time.Now().Add(maxWALAge),
+		}
+	}
+
+	var retireWALID string
+	if retired != nil {
+		retireWALID, err = framework.PutWAL(ctx, req.Storage, walAppRetire, retired)
+		if err != nil {
+			return nil, fmt.Errorf("error writing WAL: %w", err)
+		}
+	}
+
+	// If persisted create the app, or update the grants of the existing one
+	var changes *grantChanges
+	if role.PersistApp {
+		if role.ManagedApplicationObjectID != "" {
+			changes, err = b.addPersistedAppGrants(ctx, req.Storage, client, role, prev.AzureRoles)
+			if err != nil {
+				return nil, fmt.Errorf("could not update persisted app: %w", err)
+			}
+		} else {
+			err := b.createPersistedApp(ctx, req, role, name)
+			if err != nil {
+				return nil, fmt.Errorf("could not create persisted app: %w", err)
+			}
+		}
+	}
+
+	// A managed app handed over as the application_object_id is kept, but the
+	// grants made for it are removed since the role no longer tracks them.
+	if prev.ManagedApplicationObjectID != "" && !role.PersistApp && role.ApplicationObjectID == prev.ManagedApplicationObjectID {
+		changes = handOffGrants(&prev)
+	}
+
+	// save role
+	err = saveRole(ctx, req.Storage, role, name)
+	if err != nil {
+		return nil, fmt.Errorf("error storing role: %w", err)
+	}
+
+	change := roleChangeUpdate
+	switch {
+	case rollbackVersion != 0:
+		change = roleChangeRollback
+	case req.Operation == logical.CreateOperation:
+		change = roleChangeCreate
+	}
+	if err := b.recordRoleVersion(ctx, req, name, role, change, rollbackVersion); err != nil {
+		if resp == nil {
+			resp = new(logical.Response)
+		}
+		resp.AddWarning(fmt.Sprintf("error recording role history: %s", err))
+	}
+
+	if changes != nil {
+		if resp == nil {
+			resp = new(logical.Response)
+		}
+		resp.Data = changes.responseData()
+		if err := b.finishPersistedAppGrants(ctx, req.Storage, client, changes); err != nil {
+			resp.AddWarning(err.Error())
+		}
+	}
+
+	if retired != nil {
+		// The WAL entry is kept if retiring the app fails so that it is retried.
+		deleted, err := b.retireApp(ctx, req.Storage, client, retired)
+		if err != nil {
+			if resp == nil {
+				resp = new(logical.Response)
+			}
+			resp.AddWarning(fmt.Sprintf("error retiring persisted app %q: %s", retired.AppObjID, err))
+			return resp, nil
+		}
+
+		if err := framework.DeleteWAL(ctx, req.Storage, retireWALID); err != nil {
+			return nil, fmt.Errorf("error deleting WAL: %w", err)
+		}
+
+		if !deleted {
+			if resp == nil {
+				resp = new(logical.Response)
+			}
+			resp.AddWarning(fmt.Sprintf("persisted app %q will be deleted once its outstanding leases have been revoked", retired.AppObjID))
+		}
+	}
+
+	return resp, nil
+}
+
+// updateRoleEntry updates the role with the fields provided in d and verifies
+// it, looking up its Azure roles and groups. It returns an error response if
+// the role is invalid. Nothing is created in Azure or written to storage, so
+// it can also be used to check a role without saving it.
+func (b *azureSecretBackend) updateRoleEntry(ctx context.Context, client *client, op logical.Operation, d *framework.FieldData, role *roleEntry) (*logical.Response, error) {
+	var err error
+
 	// load and validate TTLs
 	if ttlRaw, ok := d.GetOk("ttl"); ok {
 		role.TTL = time.Duration(ttlRaw.(int)) * time.Second
-	} else if req.Operation == logical.CreateOperation {
+	} else if op == logical.CreateOperation {
 		role.TTL = time.Duration(d.Get("ttl").(int)) * time.Second
 	}
 
 	if maxTTLRaw, ok := d.GetOk("max_ttl"); ok {
 		role.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
-	} else if req.Operation == logical.CreateOperation {
+	} else if op == logical.CreateOperation {
 		role.MaxTTL = time.Duration(d.Get("max_ttl").(int)) * time.Second
 	}
 
@@ -245,6 +521,31 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 		role.Tags = tagsList
 	}
 
+	// update and verify the name template if provided
+	if nameTemplate, ok := d.GetOk("name_template"); ok {
+		role.NameTemplate = nameTemplate.(string)
+		if role.NameTemplate != "" {
+			if err := validateNameTemplate(role.NameTemplate); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+	}
+
+	// update and verify the issuance limits if provided
+	if maxActive, ok := d.GetOk("max_active_credentials"); ok {
+		role.MaxActiveCredentials = maxActive.(int)
+		if role.MaxActiveCredentials < 0 {
+			return logical.ErrorResponse("max_active_credentials must not be negative"), nil
+		}
+	}
+
+	if maxRate, ok := d.GetOk("max_issue_rate"); ok {
+		role.MaxIssueRate = maxRate.(int)
+		if role.MaxIssueRate < 0 {
+			return logical.ErrorResponse("max_issue_rate must not be negative"), nil
+		}
+	}
+
 	// update and verify Application Object ID if provided
 	if appObjectID, ok := d.GetOk("application_object_id"); ok {
 		role.ApplicationObjectID = appObjectID.(string)
@@ -268,9 +569,67 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 		// set the applicationObjectID to the managedApplicationObjectID so that we can use the same SP logic as static.
 		if role.PersistApp {
 			role.ApplicationObjectID = role.ManagedApplicationObjectID
+		} else if role.ManagedApplicationObjectID != "" {
+			// The managed app is only handed off if it is explicitly given as
+			// the application_object_id. Otherwise it is retired below.
+			if _, ok := d.GetOk("application_object_id"); !ok {
+				role.ApplicationObjectID = ""
+				role.ApplicationID = ""
+			}
+			role.ManagedApplicationObjectID = ""
+			role.ServicePrincipalObjectID = ""
+			role.RoleAssignmentIDs = nil
+			role.GroupMembershipIDs = nil
+		}
+	}
+
+	// update and verify the properties of created applications if provided
+	if owners, ok := d.GetOk("owners"); ok {
+		role.Owners = strutil.RemoveDuplicatesStable(owners.([]string), true)
+		for _, owner := range role.Owners {
+			if _, err := uuid.Parse(owner); err != nil {
+				return logical.ErrorResponse("owner '%s' is not a valid object ID", owner), nil
+			}
+		}
+	}
+
+	if notes, ok := d.GetOk("notes"); ok {
+		role.Notes = notes.(string)
+	}
+
+	if description, ok := d.GetOk("description"); ok {
+		role.Description = description.(string)
+		if utf8.RuneCountInString(role.Description) > maxAppDescriptionLength {
+			return logical.ErrorResponse("description must not be longer than %d characters", maxAppDescriptionLength), nil
 		}
 	}
 
+	if metadata, ok := d.GetOk("metadata"); ok {
+		role.Metadata = metadata.(map[string]string)
+	}
+
+	if reference, ok := d.GetOk("service_management_reference"); ok {
+		role.ServiceManagementReference = reference.(string)
+	}
+
+	if attributes, ok := d.GetOk("custom_security_attributes"); ok {
+		var parsedAttributes api.CustomSecurityAttributes
+		if attributes.(string) != "" {
+			err := jsonutil.DecodeJSON([]byte(attributes.(string)), &parsedAttributes)
+			if err != nil {
+				return logical.ErrorResponse("error parsing custom security attributes '%s': %s", attributes.(string), err.Error()), nil
+			}
+			if err := parsedAttributes.Validate(); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+		role.CustomSecurityAttributes = parsedAttributes
+	}
+
+	if role.ApplicationObjectID != "" && !role.PersistApp && role.hasAppProperties() {
+		return logical.ErrorResponse("owners, notes, service_management_reference and custom_security_attributes can only be used with applications created by Vault"), nil
+	}
+
 	// Parse the Azure roles
 	if roles, ok := d.GetOk("azure_roles"); ok {
 		parsedRoles := make([]*AzureRole, 0) // non-nil to avoid a "missing roles" error later
@@ -296,33 +655,13 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 	// update and verify Azure roles, including looking up each role by ID or name.
 	roleSet := make(map[string]bool)
 	for _, r := range role.AzureRoles {
-		var roleDef armauthorization.RoleDefinition
-		if r.RoleID != "" {
-			roleDefResp, err := client.provider.GetRoleDefinitionByID(ctx, r.RoleID)
-			if err != nil {
-				if strings.Contains(err.Error(), "RoleDefinitionDoesNotExist") {
-					return logical.ErrorResponse("no role found for role_id: '%s'", r.RoleID), nil
-				}
-				return nil, fmt.Errorf("unable to lookup Azure role: %w", err)
-			}
-
-			roleDef = roleDefResp.RoleDefinition
-		} else {
-			defs, err := client.findRoles(ctx, r.RoleName)
-			if err != nil {
-				return nil, fmt.Errorf("unable to lookup Azure role: %w", err)
-			}
-			if l := len(defs); l == 0 {
-				return logical.ErrorResponse("no role found for role_name: '%s'", r.RoleName), nil
-			} else if l > 1 {
-				return logical.ErrorResponse("multiple matches found for role_name: '%s'. Specify role by ID instead.", r.RoleName), nil
-			}
-			roleDef = *defs[0]
+		if err := validateTemplate(r.Scope); err != nil {
+			return logical.ErrorResponse("invalid template in scope '%s': %s", r.Scope, err.Error()), nil
 		}
-		roleDefID := *roleDef.ID
-		roleDefName := *roleDef.Name
 
-		r.RoleName, r.RoleID = roleDefName, roleDefID
+		if resp, err := client.lookupAzureRole(ctx, r); resp != nil || err != nil {
+			return resp, err
+		}
 
 		rsKey := r.RoleID + "||" + r.Scope
 		if roleSet[rsKey] {
@@ -334,6 +673,60 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 	// update and verify Azure groups, including looking up each group by ID or name.
 	groupSet := make(map[string]bool)
 	for _, r := range role.AzureGroups {
+		switch r.Relationship {
+		case "", groupRelationshipMember:
+			r.Relationship = ""
+		case groupRelationshipOwner:
+		default:
+			return logical.ErrorResponse("invalid relationship '%s' for group; must be '%s' or '%s'", r.Relationship, groupRelationshipMember, groupRelationshipOwner), nil
+		}
+
+		// Groups selected by a filter are queried when credentials are
+		// generated. The filter is checked now, unless it is templated.
+		if r.Filter != "" {
+			if r.GroupName != "" || r.ObjectID != "" {
+				return logical.ErrorResponse("a group filter can't be combined with group_name or object_id"), nil
+			}
+			if r.MaxMatches < 0 || r.MaxMatches > maxGroupFilterMatches {
+				return logical.ErrorResponse("max_matches must not be negative or greater than %d", maxGroupFilterMatches), nil
+			}
+
+			if hasTemplate(r.Filter) {
+				if err := validateTemplate(r.Filter); err != nil {
+					return logical.ErrorResponse("invalid template in group filter '%s': %s", r.Filter, err.Error()), nil
+				}
+			} else if _, err := client.resolveGroupFilters(ctx, []*AzureGroup{r}); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+
+			key := "filter||" + r.Filter + "||" + r.Relationship
+			if groupSet[key] {
+				return logical.ErrorResponse("duplicate group filter '%s'", r.Filter), nil
+			}
+			groupSet[key] = true
+			continue
+		}
+		if r.MaxMatches != 0 {
+			return logical.ErrorResponse("max_matches can only be used with a group filter"), nil
+		}
+
+		// Templated groups can only be looked up once they are rendered for the
+		// requesting entity when credentials are generated.
+		if r.isTemplated() {
+			for _, ref := range []string{r.GroupName, r.ObjectID} {
+				if err := validateTemplate(ref); err != nil {
+					return logical.ErrorResponse("invalid template in group '%s': %s", ref, err.Error()), nil
+				}
+			}
+
+			key := r.GroupName + "||" + r.ObjectID + "||" + r.Relationship
+			if groupSet[key] {
+				return logical.ErrorResponse("duplicate templated group '%s'", key), nil
+			}
+			groupSet[key] = true
+			continue
+		}
+
 		var groupDef api.Group
 		if r.ObjectID != "" {
 			groupDef, err = client.provider.GetGroup(ctx, r.ObjectID)
@@ -363,32 +756,96 @@ func (b *azureSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Re
 		r.ObjectID = groupDef.ID
 		r.GroupName = groupDef.DisplayName
 
-		if groupSet[r.ObjectID] {
+		if groupSet[r.ObjectID+"||"+r.Relationship] {
 			return logical.ErrorResponse("duplicate object_id '%s'", r.ObjectID), nil
 		}
-		groupSet[r.ObjectID] = true
+		groupSet[r.ObjectID+"||"+r.Relationship] = true
 	}
 
-	if role.ApplicationObjectID == "" && len(role.AzureRoles) == 0 && len(role.AzureGroups) == 0 {
-		return logical.ErrorResponse("either Azure role definitions, group definitions, or an Application Object ID must be provided"), nil
+	if role.isTemplated() && (role.ApplicationObjectID != "" || role.PersistApp) {
+		return logical.ErrorResponse("identity templates can only be used with dynamic service principals"), nil
 	}
 
-	// If persisted create the app
-	if role.PersistApp {
-		err := b.createPersistedApp(ctx, req, role, name)
+	if role.hasDynamicOnlyGroups() && (role.ApplicationObjectID != "" || role.PersistApp) {
+		return logical.ErrorResponse("group filters and the owner relationship can only be used with dynamic service principals"), nil
+	}
+
+	// update and verify the allowed scopes if provided
+	if allowedScopes, ok := d.GetOk("allowed_scopes"); ok {
+		role.AllowedScopes = strutil.RemoveDuplicates(allowedScopes.([]string), false)
+	}
+
+	if err := validateAllowedScopes(role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// update and verify the credential type and managed identity settings if
+	// provided
+	if credentialType, ok := d.GetOk("credential_type"); ok {
+		found := false
+		for t, name := range credentialTypeNames {
+			if name == credentialType.(string) {
+				role.CredentialType, found = t, true
+			}
+		}
+		if !found {
+			return logical.ErrorResponse("invalid credential_type '%s'; must be '%s' or '%s'", credentialType.(string),
+				credentialTypeNames[credentialTypeSP], credentialTypeNames[credentialTypeManagedIdentity]), nil
+		}
+	}
+
+	if resourceGroup, ok := d.GetOk("managed_identity_resource_group"); ok {
+		if resourceGroup.(string) != role.ManagedIdentityResourceGroup {
+			role.ManagedIdentityLocation = ""
+		}
+		role.ManagedIdentityResourceGroup = resourceGroup.(string)
+	}
+
+	if credentials, ok := d.GetOk("federated_credentials"); ok {
+		parsedCredentials := make([]*FederatedCredential, 0)
+
+		err := jsonutil.DecodeJSON([]byte(credentials.(string)), &parsedCredentials)
 		if err != nil {
-			return nil, fmt.Errorf("could not create persisted app: %w", err)
+			return logical.ErrorResponse("error parsing federated credentials '%s': %s", credentials.(string), err.Error()), nil
+		}
+		role.FederatedCredentials = parsedCredentials
+	}
+
+	if role.CredentialType == credentialTypeManagedIdentity {
+		if err := validateManagedIdentityRole(role); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
 		}
 
+		// Identities are created in the location of their resource group
+		if role.ManagedIdentityLocation == "" {
+			group, err := client.provider.GetResourceGroup(ctx, role.ManagedIdentityResourceGroup)
+			if err != nil {
+				return logical.ErrorResponse("unable to look up resource group '%s': %s", role.ManagedIdentityResourceGroup, err.Error()), nil
+			}
+			role.ManagedIdentityLocation = group.Location
+		}
+	} else if role.ManagedIdentityResourceGroup != "" || len(role.FederatedCredentials) > 0 {
+		return logical.ErrorResponse("managed_identity_resource_group and federated_credentials can only be used with managed identities"), nil
 	}
 
-	// save role
-	err = saveRole(ctx, req.Storage, role, name)
-	if err != nil {
-		return nil, fmt.Errorf("error storing role: %w", err)
+	// update and verify the sync destinations if provided
+	if destinations, ok := d.GetOk("sync_destinations"); ok {
+		parsedDestinations, err := parseSyncDestinations(destinations.(string), client.settings.keyVault())
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		role.SyncDestinations = parsedDestinations
 	}
 
-	return resp, nil
+	if len(role.SyncDestinations) > 0 && role.ApplicationObjectID == "" && !role.PersistApp {
+		return logical.ErrorResponse("sync_destinations can only be used with an existing or persisted application"), nil
+	}
+
+	if role.ApplicationObjectID == "" && len(role.AzureRoles) == 0 && len(role.AzureGroups) == 0 {
+		return logical.ErrorResponse("either Azure role definitions, group definitions, or an Application Object ID must be provided"), nil
+	}
+
+	return nil, nil
 }
 
 func validateTags(tags interface{}) ([]string, error) {
@@ -416,40 +873,264 @@ func validateTags(tags interface{}) ([]string, error) {
 	return tagsList, nil
 }
 
-func (b *azureSecretBackend) createPersistedApp(ctx context.Context, req *logical.Request, role *roleEntry, name string) error {
+// hasAppProperties reports whether the role sets any properties of the
+// applications created for it. The description also describes the role, and
+// is allowed on roles that use an existing application.
+func (r *roleEntry) hasAppProperties() bool {
+	return len(r.Owners) > 0 || r.Notes != "" ||
+		r.ServiceManagementReference != "" || len(r.CustomSecurityAttributes) > 0
+}
 
-	c, err := b.getClient(ctx, req.Storage)
-	if err != nil {
-		return err
+// credentialMode returns how credentials are issued for the role: "dynamic"
+// for a new application per lease, "persisted" for an application created
+// and kept by Vault, "static" for an existing application, or
+// "managed_identity" for a new managed identity per lease.
+func (r *roleEntry) credentialMode() string {
+	switch {
+	case r.CredentialType == credentialTypeManagedIdentity:
+		return "managed_identity"
+	case r.PersistApp:
+		return "persisted"
+	case r.ApplicationObjectID != "":
+		return "static"
+	default:
+		return "dynamic"
 	}
+}
 
-	assignmentIDs, err := c.generateUUIDs(len(role.AzureRoles))
-	if err != nil {
-		return fmt.Errorf("error generating assginment IDs; err=%w", err)
+// scopeCount returns the number of distinct scopes of the role's Azure roles.
+func (r *roleEntry) scopeCount() int {
+	scopes := make(map[string]bool)
+	for _, azureRole := range r.AzureRoles {
+		scopes[strings.ToLower(azureRole.Scope)] = true
 	}
+	return len(scopes)
+}
 
-	if role.ManagedApplicationObjectID != "" {
-		removeRolesAndGroupMembership(ctx, c, role)
+// matchesListFilters reports whether the role has all of the metadata and, if
+// scopePrefix is set, an Azure role at a scope starting with it. Scopes are
+// compared case insensitively, as Azure does.
+func (r *roleEntry) matchesListFilters(metadata map[string]string, scopePrefix string) bool {
+	for k, v := range metadata {
+		if rv, ok := r.Metadata[k]; !ok || rv != v {
+			return false
+		}
+	}
 
-		spObjID := role.ServicePrincipalObjectID
+	if scopePrefix == "" {
+		return true
+	}
+	for _, azureRole := range r.AzureRoles {
+		if strings.HasPrefix(strings.ToLower(azureRole.Scope), strings.ToLower(scopePrefix)) {
+			return true
+		}
+	}
+	return false
+}
 
-		// Assign Azure roles to the new SP
-		raIDs, err := c.assignRoles(ctx, spObjID, role.AzureRoles, assignmentIDs)
-		if err != nil {
-			return err
+// isTemplated reports whether any of the role's scopes or groups contain
+// identity templates that must be rendered when credentials are generated.
+func (r *roleEntry) isTemplated() bool {
+	for _, azureRole := range r.AzureRoles {
+		if hasTemplate(azureRole.Scope) {
+			return true
+		}
+	}
+	for _, scope := range r.AllowedScopes {
+		if hasTemplate(scope) {
+			return true
+		}
+	}
+	for _, group := range r.AzureGroups {
+		if group.isTemplated() {
+			return true
+		}
+	}
+	return false
+}
+
+// isTemplated reports whether the group is referenced through an identity template.
+func (g *AzureGroup) isTemplated() bool {
+	return hasTemplate(g.GroupName) || hasTemplate(g.ObjectID) || hasTemplate(g.Filter)
+}
+
+// isOwner reports whether the service principal is added to the group as an
+// owner rather than as a member.
+func (g *AzureGroup) isOwner() bool {
+	return g.Relationship == groupRelationshipOwner
+}
+
+// hasGroupFilters reports whether any of the role's groups are selected by a
+// filter.
+func (r *roleEntry) hasGroupFilters() bool {
+	for _, group := range r.AzureGroups {
+		if group.Filter != "" {
+			return true
 		}
-		role.RoleAssignmentIDs = raIDs
+	}
+	return false
+}
 
-		// Assign Azure group memberships to the new SP
-		if err := c.addGroupMemberships(ctx, spObjID, role.AzureGroups); err != nil {
-			return err
+// hasDynamicOnlyGroups reports whether any of the role's groups are selected
+// by a filter or owned by the service principal, which is only supported for
+// dynamic service principals.
+func (r *roleEntry) hasDynamicOnlyGroups() bool {
+	for _, group := range r.AzureGroups {
+		if group.Filter != "" || group.isOwner() {
+			return true
 		}
-		role.GroupMembershipIDs = groupObjectIDs(role.AzureGroups)
+	}
+	return false
+}
+
+func hasTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
 
+// validateTemplate checks that any identity template directives in s are
+// well formed.
+func validateTemplate(s string) error {
+	_, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		String:            s,
+		Mode:              identitytpl.ACLTemplating,
+		ValidityCheckOnly: true,
+	})
+	return err
+}
+
+// validateAllowedScopes verifies that every allowed scope pattern is at or
+// beneath the scope of at least one of the role's Azure roles. Scope narrowing
+// is only supported for dynamic service principals.
+func validateAllowedScopes(role *roleEntry) error {
+	if len(role.AllowedScopes) == 0 {
 		return nil
 	}
 
-	app, err := c.createAppWithName(ctx, name, role.SignInAudience, role.Tags)
+	if role.ApplicationObjectID != "" || role.PersistApp {
+		return errors.New("allowed_scopes can only be used with dynamic service principals")
+	}
+
+	if len(role.AzureRoles) == 0 {
+		return errors.New("allowed_scopes requires at least one Azure role")
+	}
+
+	for _, pattern := range role.AllowedScopes {
+		if err := validateTemplate(pattern); err != nil {
+			return fmt.Errorf("invalid template in allowed scope %q: %w", pattern, err)
+		}
+
+		var found bool
+		for _, r := range role.AzureRoles {
+			if scopeContains(r.Scope, pattern) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("allowed scope %q is not beneath the scope of any Azure role", pattern)
+		}
+	}
+
+	return nil
+}
+
+// narrowAzureRoles returns a copy of the Azure roles assigned at each of the
+// requested scopes instead of their configured scope. Every requested scope
+// must match one of the role's allowed scopes and be beneath the configured
+// scope of at least one Azure role.
+func narrowAzureRoles(role *roleEntry, scopes []string) ([]*AzureRole, error) {
+	if len(role.AllowedScopes) == 0 {
+		return nil, errors.New("role does not allow requesting scopes")
+	}
+
+	allowed := make([]string, 0, len(role.AllowedScopes))
+	for _, pattern := range role.AllowedScopes {
+		allowed = append(allowed, normalizeScope(pattern))
+	}
+
+	var narrowed []*AzureRole
+	for _, scope := range strutil.RemoveDuplicatesStable(scopes, true) {
+		if err := validateScope(scope); err != nil {
+			return nil, err
+		}
+		if !strutil.StrListContainsGlob(allowed, normalizeScope(scope)) {
+			return nil, fmt.Errorf("scope %q is not allowed by the role", scope)
+		}
+
+		var matched bool
+		for _, r := range role.AzureRoles {
+			if !scopeContains(r.Scope, scope) {
+				continue
+			}
+			matched = true
+			narrowed = append(narrowed, &AzureRole{
+				RoleName: r.RoleName,
+				RoleID:   r.RoleID,
+				Scope:    scope,
+			})
+		}
+		if !matched {
+			return nil, fmt.Errorf("scope %q is not beneath the scope of any Azure role", scope)
+		}
+	}
+
+	if len(narrowed) == 0 {
+		return nil, errors.New("at least one scope must be requested")
+	}
+
+	return narrowed, nil
+}
+
+// validateScope checks that a requested scope is an ARM scope that can be
+// compared with the allowed scopes as is. Like the values templated into
+// scopes, its segments can't be empty nor navigate to another scope.
+func validateScope(scope string) error {
+	segments := strings.Split(strings.TrimPrefix(scope, "/"), "/")
+	for _, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err != nil || segment == "" || unescaped == "." || unescaped == ".." {
+			return fmt.Errorf(`invalid scope %q; its segments can't be empty, "." or ".."`, scope)
+		}
+	}
+
+	if _, err := arm.ParseResourceID(scope); err != nil {
+		return fmt.Errorf("invalid scope %q: %w", scope, err)
+	}
+	return nil
+}
+
+// scopeContains reports whether child is equal to, or beneath, the parent
+// scope. Azure resource IDs are case-insensitive.
+func scopeContains(parent, child string) bool {
+	parent, child = normalizeScope(parent), normalizeScope(child)
+	if parent == "" || child == "" {
+		return false
+	}
+
+	return parent == child || strings.HasPrefix(child, parent+"/")
+}
+
+func normalizeScope(scope string) string {
+	return strings.ToLower(strings.TrimRight(strings.TrimSpace(scope), "/"))
+}
+
+func (b *azureSecretBackend) createPersistedApp(ctx context.Context, req *logical.Request, role *roleEntry, name string) error {
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	assignmentIDs, err := c.generateUUIDs(len(role.AzureRoles))
+	if err != nil {
+		return fmt.Errorf("error generating assginment IDs; err=%w", err)
+	}
+
+	params, err := b.newApplication(ctx, req, name, role)
+	if err != nil {
+		return err
+	}
+
+	app, err := c.createApp(ctx, params)
 	if err != nil {
 		return err
 	}
@@ -466,7 +1147,7 @@ func (b *azureSecretBackend) createPersistedApp(ctx context.Context, req *logica
 	}
 
 	// TODO: should we expire the PW?
-	spObjID, _, err := c.createSP(ctx, app, spExpiration)
+	spObjID, _, err := c.createSP(ctx, app, role.CustomSecurityAttributes, spExpiration)
 	if err != nil {
 		return err
 	}
@@ -497,6 +1178,281 @@ func (b *azureSecretBackend) createPersistedApp(ctx context.Context, req *logica
 	return nil
 }
 
+// grantChanges describes the role assignments and group memberships changed
+// by an update of a persisted app role.
+type grantChanges struct {
+	// spID is the service principal the grants are made to.
+	spID string
+
+	addedRoles    []*AzureRole
+	removedRoles  []*AzureRole
+	addedGroups   []string
+	removedGroups []string
+
+	// removedAssignmentIDs holds the role assignment IDs of removedRoles.
+	removedAssignmentIDs []string
+
+	// walIDs are the WAL entries that roll back the added grants until the
+	// role has been saved.
+	walIDs []string
+}
+
+func (g *grantChanges) responseData() map[string]interface{} {
+	return map[string]interface{}{
+		"added_role_assignments":    g.addedRoles,
+		"removed_role_assignments":  g.removedRoles,
+		"added_group_memberships":   g.addedGroups,
+		"removed_group_memberships": g.removedGroups,
+	}
+}
+
+// addPersistedAppGrants compares the Azure roles and groups of a persisted app
+// role with those previously granted to its service principal, and grants only
+// the new ones. Each grant is protected by a WAL entry until the role has been
+// saved. Grants that are no longer needed are recorded, but not removed until
+// finishPersistedAppGrants is called. role.RoleAssignmentIDs and
+// role.GroupMembershipIDs are updated to match the new grants.
+func (b *azureSecretBackend) addPersistedAppGrants(ctx context.Context, s logical.Storage, c *client, role *roleEntry, prevRoles []*AzureRole) (*grantChanges, error) {
+	spID := role.ServicePrincipalObjectID
+	changes := &grantChanges{spID: spID}
+
+	assigned := make(map[string]string)
+	for i, r := range prevRoles {
+		if i < len(role.RoleAssignmentIDs) && role.RoleAssignmentIDs[i] != "" {
+			assigned[azureRoleKey(r)] = role.RoleAssignmentIDs[i]
+		}
+	}
+
+	kept := make(map[string]bool)
+	raIDs := make([]string, len(role.AzureRoles))
+	for i, r := range role.AzureRoles {
+		key := azureRoleKey(r)
+		if id, ok := assigned[key]; ok && !kept[key] {
+			kept[key] = true
+			raIDs[i] = id
+			continue
+		}
+
+		assignmentIDs, err := c.generateUUIDs(1)
+		if err != nil {
+			return nil, fmt.Errorf("error generating assignment IDs; err=%w", err)
+		}
+
+		walID, err := framework.PutWAL(ctx, s, walAppRoleAssignment, &walAppRoleAssign{
+			SpID:          spID,
+			AssignmentIDs: assignmentIDs,
+			AzureRoles:    []*AzureRole{r},
+			Expiration:    time.Now().Add(maxWALAge),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error writing WAL: %w", err)
+		}
+		changes.walIDs = append(changes.walIDs, walID)
+
+		ids, err := c.assignRoles(ctx, spID, []*AzureRole{r}, assignmentIDs)
+		if err != nil {
+			return nil, err
+		}
+		raIDs[i] = ids[0]
+		changes.addedRoles = append(changes.addedRoles, r)
+	}
+
+	for i, r := range prevRoles {
+		if kept[azureRoleKey(r)] || i >= len(role.RoleAssignmentIDs) || role.RoleAssignmentIDs[i] == "" {
+			continue
+		}
+		changes.removedRoles = append(changes.removedRoles, r)
+		changes.removedAssignmentIDs = append(changes.removedAssignmentIDs, role.RoleAssignmentIDs[i])
+	}
+
+	prevGroups := make(map[string]bool)
+	for _, id := range role.GroupMembershipIDs {
+		prevGroups[strings.ToLower(id)] = true
+	}
+
+	newGroups := make(map[string]bool)
+	for _, group := range role.AzureGroups {
+		newGroups[strings.ToLower(group.ObjectID)] = true
+		if prevGroups[strings.ToLower(group.ObjectID)] {
+			continue
+		}
+
+		walID, err := framework.PutWAL(ctx, s, walGroupMembership, &walGroupMember{
+			SpID:       spID,
+			GroupID:    group.ObjectID,
+			Expiration: time.Now().Add(maxWALAge),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error writing WAL: %w", err)
+		}
+		changes.walIDs = append(changes.walIDs, walID)
+
+		if err := c.addGroupMemberships(ctx, spID, []*AzureGroup{group}); err != nil {
+			return nil, err
+		}
+		changes.addedGroups = append(changes.addedGroups, group.ObjectID)
+	}
+
+	for _, id := range role.GroupMembershipIDs {
+		if !newGroups[strings.ToLower(id)] {
+			changes.removedGroups = append(changes.removedGroups, id)
+		}
+	}
+
+	role.RoleAssignmentIDs = raIDs
+	role.GroupMembershipIDs = groupObjectIDs(role.AzureGroups)
+
+	return changes, nil
+}
+
+// handOffGrants records the role assignments and group memberships of a
+// managed app that is handed over to its role as the application_object_id.
+// The role no longer tracks them, so they are removed by
+// finishPersistedAppGrants.
+func handOffGrants(prev *roleEntry) *grantChanges {
+	changes := &grantChanges{
+		spID:          prev.ServicePrincipalObjectID,
+		removedGroups: prev.GroupMembershipIDs,
+	}
+	for i, r := range prev.AzureRoles {
+		if i < len(prev.RoleAssignmentIDs) && prev.RoleAssignmentIDs[i] != "" {
+			changes.removedRoles = append(changes.removedRoles, r)
+			changes.removedAssignmentIDs = append(changes.removedAssignmentIDs, prev.RoleAssignmentIDs[i])
+		}
+	}
+	return changes
+}
+
+// finishPersistedAppGrants must be called once the role updated by
+// addPersistedAppGrants or handOffGrants has been saved. It removes the WAL
+// entries of the added grants and then removes the grants that are no longer
+// needed. Each removal is protected by a WAL entry so that it is retried if it
+// fails.
+func (b *azureSecretBackend) finishPersistedAppGrants(ctx context.Context, s logical.Storage, c *client, changes *grantChanges) error {
+	for _, walID := range changes.walIDs {
+		if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+			return fmt.Errorf("error deleting WAL: %w", err)
+		}
+	}
+
+	var merr *multierror.Error
+	removals := make([]*walGrantRemove, 0, len(changes.removedAssignmentIDs)+len(changes.removedGroups))
+	for _, id := range changes.removedAssignmentIDs {
+		removals = append(removals, &walGrantRemove{
+			SpID:             changes.spID,
+			RoleAssignmentID: id,
+		})
+	}
+	for _, id := range changes.removedGroups {
+		removals = append(removals, &walGrantRemove{
+			SpID:    changes.spID,
+			GroupID: id,
+		})
+	}
+
+	for _, removal := range removals {
+		removal.Expiration = time.Now().Add(maxWALAge)
+		walID, err := framework.PutWAL(ctx, s, walGrantRemoval, removal)
+		if err != nil {
+			return fmt.Errorf("error writing WAL: %w", err)
+		}
+
+		// The WAL entry is kept if the removal fails so that it is retried.
+		if err := removal.remove(ctx, c); err != nil {
+			merr = multierror.Append(merr, err)
+			continue
+		}
+
+		if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+			return fmt.Errorf("error deleting WAL: %w", err)
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// retireApp deletes a managed app that is no longer used by its role, together
+// with its service principal, role assignments and group memberships. If
+// passwords issued for outstanding leases remain on the app, it is recorded as
+// retired instead, and deleted by cleanupRetiredApp once the last lease has
+// been revoked. It reports whether the app was deleted.
+func (b *azureSecretBackend) retireApp(ctx context.Context, s logical.Storage, c *client, r *walAppRetirement) (bool, error) {
+	lock := locksutil.LockForKey(b.appLocks, r.AppObjID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return b.retireAppLocked(ctx, s, c, r)
+}
+
+// retireAppLocked is retireApp for callers that hold the app lock.
+func (b *azureSecretBackend) retireAppLocked(ctx context.Context, s logical.Storage, c *client, r *walAppRetirement) (bool, error) {
+	app, err := c.provider.GetApplicationByObjectID(ctx, r.AppObjID)
+	if err != nil && !api.IsNotFound(err) {
+		return false, fmt.Errorf("error loading application: %w", err)
+	}
+
+	if err == nil && len(app.PasswordCredentials) > 0 {
+		entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", retiredAppsStoragePath, r.AppObjID), r)
+		if err != nil {
+			return false, err
+		}
+		return false, s.Put(ctx, entry)
+	}
+
+	if err := c.unassignRoles(ctx, r.RoleAssignmentIDs); err != nil {
+		return false, err
+	}
+
+	if r.SpID != "" {
+		if err := c.removeGroupMemberships(ctx, r.SpID, r.GroupMembershipIDs); err != nil {
+			return false, err
+		}
+
+		if err := c.deleteServicePrincipal(ctx, r.SpID, r.PermanentlyDelete); err != nil && !api.IsNotFound(err) {
+			return false, fmt.Errorf("error deleting service principal: %w", err)
+		}
+	}
+
+	if err := c.deleteApp(ctx, r.AppObjID, r.PermanentlyDelete); err != nil && !api.IsNotFound(err) {
+		return false, fmt.Errorf("error deleting application: %w", err)
+	}
+
+	b.sendEvent(ctx, eventAppDelete,
+		logical.EventMetadataOperation, "delete",
+		logical.EventMetadataModified, "true",
+		"role", r.RoleName,
+		"app_object_id", r.AppObjID,
+		"sp_object_id", r.SpID,
+	)
+
+	return true, s.Delete(ctx, fmt.Sprintf("%s/%s", retiredAppsStoragePath, r.AppObjID))
+}
+
+// cleanupRetiredApp deletes a retired app once no passwords remain on it.
+// Callers must hold the app lock.
+func (b *azureSecretBackend) cleanupRetiredApp(ctx context.Context, s logical.Storage, c *client, appObjID string) error {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", retiredAppsStoragePath, appObjID))
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+
+	var r walAppRetirement
+	if err := entry.DecodeJSON(&r); err != nil {
+		return err
+	}
+
+	_, err = b.retireAppLocked(ctx, s, c, &r)
+	return err
+}
+
+// azureRoleKey identifies an Azure role assignment by role and scope.
+func azureRoleKey(r *AzureRole) string {
+	return strings.ToLower(r.RoleID) + "||" + normalizeScope(r.Scope)
+}
+
 func (b *azureSecretBackend) pathRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	name := d.Get("name").(string)
 
@@ -518,20 +1474,38 @@ func (b *azureSecretBackend) pathRoleRead(ctx context.Context, req *logical.Requ
 		return nil, nil
 	}
 
-	resp := &logical.Response{
-		Data: map[string]interface{}{
-			"ttl":                   r.TTL / time.Second,
-			"max_ttl":               r.MaxTTL / time.Second,
-			"azure_roles":           r.AzureRoles,
-			"azure_groups":          r.AzureGroups,
-			"application_object_id": r.ApplicationObjectID,
-			"permanently_delete":    r.PermanentlyDelete,
-			"persist_app":           r.PersistApp,
-			"sign_in_audience":      r.SignInAudience,
-			"tags":                  r.Tags,
-		},
+	return &logical.Response{
+		Data: roleData(r),
+	}, nil
+}
+
+// roleData returns the writable fields of a role.
+func roleData(r *roleEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"ttl":                             r.TTL / time.Second,
+		"max_ttl":                         r.MaxTTL / time.Second,
+		"azure_roles":                     r.AzureRoles,
+		"azure_groups":                    r.AzureGroups,
+		"application_object_id":           r.ApplicationObjectID,
+		"permanently_delete":              r.PermanentlyDelete,
+		"persist_app":                     r.PersistApp,
+		"sign_in_audience":                r.SignInAudience,
+		"tags":                            r.Tags,
+		"allowed_scopes":                  r.AllowedScopes,
+		"name_template":                   r.NameTemplate,
+		"max_active_credentials":          r.MaxActiveCredentials,
+		"max_issue_rate":                  r.MaxIssueRate,
+		"owners":                          r.Owners,
+		"notes":                           r.Notes,
+		"description":                     r.Description,
+		"metadata":                        r.Metadata,
+		"service_management_reference":    r.ServiceManagementReference,
+		"custom_security_attributes":      r.CustomSecurityAttributes,
+		"credential_type":                 credentialTypeNames[r.CredentialType],
+		"managed_identity_resource_group": r.ManagedIdentityResourceGroup,
+		"federated_credentials":           r.FederatedCredentials,
+		"sync_destinations":               r.SyncDestinations,
 	}
-	return resp, nil
 }
 
 func (b *azureSecretBackend) pathRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -540,18 +1514,74 @@ func (b *azureSecretBackend) pathRoleList(ctx context.Context, req *logical.Requ
 		return nil, fmt.Errorf("error listing roles: %w", err)
 	}
 
-	return logical.ListResponse(roles), nil
+	detailed := d.Get("detailed").(bool)
+	metadata := d.Get("metadata").(map[string]string)
+	scopePrefix := d.Get("scope_prefix").(string)
+	if !detailed && len(metadata) == 0 && scopePrefix == "" {
+		return logical.ListResponse(roles), nil
+	}
+
+	keys := make([]string, 0, len(roles))
+	keyInfo := make(map[string]interface{})
+	for _, name := range roles {
+		role, err := getRole(ctx, name, req.Storage)
+		if err != nil {
+			return nil, fmt.Errorf("error reading role %q: %w", name, err)
+		}
+		// The role may have been deleted since it was listed
+		if role == nil || !role.matchesListFilters(metadata, scopePrefix) {
+			continue
+		}
+
+		keys = append(keys, name)
+		if detailed {
+			keyInfo[name] = map[string]interface{}{
+				"credential_mode":         role.credentialMode(),
+				"ttl":                     int64(role.TTL / time.Second),
+				"max_ttl":                 int64(role.MaxTTL / time.Second),
+				"scope_count":             role.scopeCount(),
+				"persisted_app_object_id": role.ManagedApplicationObjectID,
+				"description":             role.Description,
+				"metadata":                role.Metadata,
+			}
+		}
+	}
+
+	if !detailed {
+		return logical.ListResponse(keys), nil
+	}
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
 }
 
 func (b *azureSecretBackend) pathRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	var resp *logical.Response
 
 	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
 	role, err := getRole(ctx, name, req.Storage)
 	if err != nil {
 		return nil, fmt.Errorf("error getting role: %w", err)
 	}
 
+	leaseIDs, err := roleLeaseIDs(ctx, req.Storage, name)
+	if err != nil {
+		return nil, fmt.Errorf("error listing leases: %w", err)
+	}
+
+	if len(leaseIDs) > 0 {
+		if !d.Get("force").(bool) {
+			return logical.ErrorResponse("role %q has %d outstanding leases; revoke them or set force to true", name, len(leaseIDs)), nil
+		}
+
+		if err := b.revokeRoleLeases(ctx, req.Storage, name); err != nil {
+			return nil, fmt.Errorf("error revoking leases: %w", err)
+		}
+	}
+
 	if role != nil && role.PersistApp {
 		c, err := b.getClient(ctx, req.Storage)
 		if err != nil {
@@ -576,6 +1606,17 @@ func (b *azureSecretBackend) pathRoleDelete(ctx context.Context, req *logical.Re
 		return nil, fmt.Errorf("error deleting role: %w", err)
 	}
 
+	b.issueLimiters.Delete(name)
+
+	if role != nil {
+		if err := b.recordRoleVersion(ctx, req, name, nil, roleChangeDelete, 0); err != nil {
+			if resp == nil {
+				resp = new(logical.Response)
+			}
+			resp.AddWarning(fmt.Sprintf("error recording role history: %s", err))
+		}
+	}
+
 	return resp, nil
 }
 
@@ -648,6 +1689,85 @@ password will be created for the Application if an Application Object ID was
 configured. Otherwise, a new service principal will be created and the
 configured set of Azure roles are assigned to it and it will be added to the
 configured groups.
+
+Roles for dynamic service principals may also define allowed_scopes, a list of
+glob patterns beneath the scopes of the configured Azure roles. Callers can then
+write a list of matching scopes to "azure/creds/my_role" and the Azure roles will
+only be assigned at those scopes.
+
+Scopes, allowed scopes and group references of dynamic service principal roles
+may contain identity templates, such as
+"{{identity.entity.metadata.resource_group}}". These are rendered from the
+requesting entity when credentials are generated.
+
+Groups of dynamic service principal roles may also be selected with an OData
+filter, such as "startswith(displayName,'team-a-')", instead of a name or object
+ID. The filter is evaluated when credentials are generated, and the request
+fails if it matches more than max_matches groups (10 by default, at most 100).
+Groups of dynamic service principal roles may also set relationship to "owner"
+to make the service principal an owner of the group instead of a member, for
+example to let it manage the membership of the group itself.
+
+Applications created by Vault can be given owners, notes, a description, a
+service management reference and, on their service principals, custom security
+attributes. Vault also tags every application it creates with the accessor of
+the secrets engine mount and the requesting entity ID. These properties are set when
+the application is created; they are not applied to existing applications.
+
+Disabling persist_app on a role retires the application created for it, together
+with its service principal, role assignments and group memberships. The
+application is deleted once the outstanding leases for it have been revoked. To
+keep the application instead, set application_object_id to its object ID in the
+same request; the role then uses it like any other existing application, and
+the role assignments and group memberships made for it are removed.
+Enabling persist_app creates a new application for the role.
+
+Roles with credential_type set to "managed_identity" create a user-assigned
+managed identity in managed_identity_resource_group for each lease instead of an
+application, for tenants that don't allow app registrations. The Azure roles and
+groups of the role are assigned to the identity, and the federated credentials
+of the role are added to it so that workloads can sign in as it. The identity
+is deleted when the lease is revoked.
+
+Roles that use an existing or persisted application can write each password
+they issue to Azure Key Vault secrets, given in sync_destinations by vault URL
+and a template for the secret name, such as "{{ .RoleName }}-secret". Each
+password is written as a new version of the secrets, which App Service and
+Functions can read through Key Vault references. The version is disabled when
+the lease is revoked.
+
+Roles can be given a description and metadata, arbitrary key/value pairs, to
+document them. Both are returned when roles are listed with detailed set to
+true, and roles can be listed by their metadata.
+
+Every write of a role is recorded in its history, which can be read from
+"roles/<name>/history". A role can be rolled back to a version in its history
+with "roles/<name>/rollback".
+
+Roles may limit the credentials issued for them with max_active_credentials, the
+number of outstanding leases, and max_issue_rate, the number of credentials
+issued per minute. Requests over either limit are rejected.
+
+A role can't be deleted while leases issued from it are outstanding. Deleting it
+with force set to true first revokes the credentials of those leases.
+
+When the Azure roles or groups of a role with persist_app enabled are updated,
+only the role assignments and group memberships that changed are added to or
+removed from the persisted service principal. The response lists the changes.
+
+When a role is written, the effective permissions of the configured identity at
+the scope of each Azure role are checked for the role assignments write action
+and for conditions that limit the roles it may assign. Depending on the
+verify_role_permissions config, roles that can't be assigned are reported as
+warnings or fail the write.
 `
 const roleListHelpSyn = `List existing roles.`
-const roleListHelpDesc = `List existing roles by name.`
+const roleListHelpDesc = `
+List existing roles by name.
+
+With detailed set to true, the response also holds the credential mode, TTLs,
+number of scopes, persisted app object ID, description and metadata of each
+role. Roles can be filtered by metadata, matching all of the given key/value
+pairs, and by scope_prefix, matching roles with an Azure role at a scope that
+starts with the prefix.
+`
@@ -0,0 +1,275 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// roleHistoryStoragePath holds the history of each role, keyed by role
+	// name. The history is kept when a role is deleted.
+	roleHistoryStoragePath = "role-history"
+
+	// defaultRoleHistoryVersions is the number of versions kept for each role
+	// unless role_history_versions is configured.
+	defaultRoleHistoryVersions = 10
+
+	// Changes recorded in the history of a role
+	roleChangeCreate   = "create"
+	roleChangeUpdate   = "update"
+	roleChangeRollback = "rollback"
+	roleChangeDelete   = "delete"
+)
+
+// roleHistory is the history of a role, oldest version first.
+type roleHistory struct {
+	// LastVersion is the number of the latest version. Version numbers keep
+	// increasing when old versions are dropped.
+	LastVersion int            `json:"last_version"`
+	Versions    []*roleVersion `json:"versions"`
+}
+
+// roleVersion is a version of a role, as it was saved, and the change that
+// led to it. The role of a deletion is nil.
+type roleVersion struct {
+	Version         int        `json:"version"`
+	Role            *roleEntry `json:"role"`
+	Change          string     `json:"change"`
+	RollbackVersion int        `json:"rollback_version,omitempty"`
+	Time            time.Time  `json:"time"`
+	EntityID        string     `json:"entity_id"`
+	DisplayName     string     `json:"display_name"`
+}
+
+func pathRoleHistory(b *azureSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/history",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixAzure,
+			OperationVerb:   "read",
+			OperationSuffix: "role-history",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRoleHistoryRead,
+			},
+		},
+		HelpSynopsis:    roleHistoryHelpSyn,
+		HelpDescription: roleHistoryHelpDesc,
+	}
+}
+
+func pathRoleRollback(b *azureSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/rollback",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixAzure,
+			OperationVerb:   "rollback",
+			OperationSuffix: "role",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role.",
+			},
+			"version": {
+				Type:        framework.TypeInt,
+				Description: "Version of the role to roll back to.",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleRollback,
+			},
+		},
+		HelpSynopsis:    roleRollbackHelpSyn,
+		HelpDescription: roleRollbackHelpDesc,
+	}
+}
+
+func (b *azureSecretBackend) pathRoleHistoryRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	history, err := getRoleHistory(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if history == nil {
+		return nil, nil
+	}
+
+	versions := make([]map[string]interface{}, 0, len(history.Versions))
+	for _, v := range history.Versions {
+		version := map[string]interface{}{
+			"version":      v.Version,
+			"change":       v.Change,
+			"time":         v.Time,
+			"entity_id":    v.EntityID,
+			"display_name": v.DisplayName,
+			"role":         nil,
+		}
+		if v.RollbackVersion != 0 {
+			version["rollback_version"] = v.RollbackVersion
+		}
+		if v.Role != nil {
+			version["role"] = roleData(v.Role)
+		}
+		versions = append(versions, version)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"current_version": history.LastVersion,
+			"versions":        versions,
+		},
+	}, nil
+}
+
+func (b *azureSecretBackend) pathRoleRollback(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	version := d.Get("version").(int)
+
+	history, err := getRoleHistory(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *roleVersion
+	if history != nil {
+		for _, v := range history.Versions {
+			if v.Version == version {
+				target = v
+				break
+			}
+		}
+	}
+	if target == nil {
+		return logical.ErrorResponse("version %d of role %q not found", version, name), nil
+	}
+	if target.Role == nil {
+		return logical.ErrorResponse("version %d of role %q is a deletion and can't be rolled back to", version, name), nil
+	}
+
+	// The version is written like an imported role, so that it is validated,
+	// and persisted app grants are updated, as on any role write. It replaces
+	// the role, so that fields the version doesn't have are cleared.
+	definition, err := json.Marshal(exportRoleData(target.Role))
+	if err != nil {
+		return nil, err
+	}
+	fields, err := decodeRoleDefinition(name, string(definition), true)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := b.pathRoleExistenceCheck(ctx, req, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	roleReq := *req
+	roleReq.Path = "roles/" + name
+	roleReq.Operation = logical.CreateOperation
+	if exists {
+		roleReq.Operation = logical.UpdateOperation
+	}
+
+	return b.updateRole(ctx, &roleReq, fields, version)
+}
+
+// recordRoleVersion adds a version of the role to its history, dropping the
+// oldest versions beyond the configured role_history_versions. Callers must
+// hold the lock of the role. The role is nil for a deletion.
+func (b *azureSecretBackend) recordRoleVersion(ctx context.Context, req *logical.Request, name string, role *roleEntry, change string, rollbackVersion int) error {
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	maxVersions := defaultRoleHistoryVersions
+	if config != nil && config.RoleHistoryVersions > 0 {
+		maxVersions = config.RoleHistoryVersions
+	}
+
+	history, err := getRoleHistory(ctx, req.Storage, name)
+	if err != nil {
+		return err
+	}
+	if history == nil {
+		history = new(roleHistory)
+	}
+
+	history.LastVersion++
+	history.Versions = append(history.Versions, &roleVersion{
+		Version:         history.LastVersion,
+		Role:            role,
+		Change:          change,
+		RollbackVersion: rollbackVersion,
+		Time:            time.Now().UTC(),
+		EntityID:        req.EntityID,
+		DisplayName:     req.DisplayName,
+	})
+	if l := len(history.Versions); l > maxVersions {
+		history.Versions = history.Versions[l-maxVersions:]
+	}
+
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", roleHistoryStoragePath, name), history)
+	if err != nil {
+		return err
+	}
+
+	return req.Storage.Put(ctx, entry)
+}
+
+func getRoleHistory(ctx context.Context, s logical.Storage, name string) (*roleHistory, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", roleHistoryStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading role history: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	history := new(roleHistory)
+	if err := entry.DecodeJSON(history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+const roleHistoryHelpSyn = `Read the history of a role.`
+const roleHistoryHelpDesc = `
+This path returns the last versions of a role, including versions from before
+it was deleted. Each version holds the role as it was saved, with the IDs its
+Azure roles and groups were resolved to, the change that led to it, and the
+time of the change and the entity and display name of the token that made it.
+
+Up to role_history_versions versions, 10 by default, are kept for each role.
+`
+
+const roleRollbackHelpSyn = `Roll back a role to a previous version.`
+const roleRollbackHelpDesc = `
+This path writes a version from the history of a role back to the role. The
+version replaces the role, so fields that were unset in the version are cleared.
+It is validated as any role write is, and the role assignments and group
+memberships of a persisted app are updated to match it. The rollback is recorded
+as a new version of the role.
+
+As when a role is imported, a new application is created if the version has
+persist_app enabled but the role no longer has a persisted app.
+`
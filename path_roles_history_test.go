@@ -0,0 +1,211 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleHistory(t *testing.T) {
+	t.Run("versions", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testRole)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:   logical.UpdateOperation,
+			Path:        "roles/test_role",
+			Data:        map[string]interface{}{"ttl": 60},
+			Storage:     s,
+			EntityID:    "test-entity",
+			DisplayName: "test-token",
+		})
+		assertRespNoError(t, resp, err)
+
+		resp = testRoleHistory(t, b, s, "test_role")
+		equal(t, 2, resp.Data["current_version"])
+		versions := resp.Data["versions"].([]map[string]interface{})
+		equal(t, 2, len(versions))
+		equal(t, roleChangeCreate, versions[0]["change"])
+		equal(t, roleChangeUpdate, versions[1]["change"])
+		equal(t, "test-entity", versions[1]["entity_id"])
+		equal(t, "test-token", versions[1]["display_name"])
+
+		// Versions hold the resolved Azure roles
+		roles := versions[0]["role"].(map[string]interface{})["azure_roles"].([]*AzureRole)
+		equal(t, "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner", roles[0].RoleID)
+
+		// Deletions are recorded and the history is kept
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		resp = testRoleHistory(t, b, s, "test_role")
+		versions = resp.Data["versions"].([]map[string]interface{})
+		equal(t, 3, len(versions))
+		equal(t, roleChangeDelete, versions[2]["change"])
+		if versions[2]["role"] != nil {
+			t.Fatal("expected no role for a deletion")
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testRole)
+		for i := 0; i < defaultRoleHistoryVersions+2; i++ {
+			testRoleCreate(t, b, s, "test_role", map[string]interface{}{"ttl": i})
+		}
+
+		resp := testRoleHistory(t, b, s, "test_role")
+		equal(t, defaultRoleHistoryVersions+3, resp.Data["current_version"])
+		versions := resp.Data["versions"].([]map[string]interface{})
+		equal(t, defaultRoleHistoryVersions, len(versions))
+		equal(t, 4, versions[0]["version"])
+	})
+
+	t.Run("configured limit", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testConfigUpdate(t, b, s, map[string]interface{}{"role_history_versions": 3})
+		testRoleCreate(t, b, s, "test_role", testRole)
+		for i := 0; i < 4; i++ {
+			testRoleCreate(t, b, s, "test_role", map[string]interface{}{"ttl": i})
+		}
+
+		resp := testRoleHistory(t, b, s, "test_role")
+		equal(t, 5, resp.Data["current_version"])
+		versions := resp.Data["versions"].([]map[string]interface{})
+		equal(t, 3, len(versions))
+		equal(t, 3, versions[0]["version"])
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+		original, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"ttl": 60,
+			"azure_roles": compactJSON(`[
+				{
+					"role_name": "Owner",
+					"role_id": "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+					"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"
+				}]`),
+		})
+
+		resp := testRoleRollback(t, b, s, "test_role", 1)
+		assertRespNoError(t, resp, nil)
+		equal(t, []*AzureRole{original.AzureRoles[1]}, resp.Data["added_role_assignments"])
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, original.TTL, role.TTL)
+		equal(t, original.AzureRoles, role.AzureRoles)
+		equal(t, original.ManagedApplicationObjectID, role.ManagedApplicationObjectID)
+		equal(t, 2, len(role.RoleAssignmentIDs))
+
+		resp = testRoleHistory(t, b, s, "test_role")
+		versions := resp.Data["versions"].([]map[string]interface{})
+		equal(t, 3, len(versions))
+		equal(t, roleChangeRollback, versions[2]["change"])
+		equal(t, 1, versions[2]["rollback_version"])
+	})
+
+	t.Run("rollback clears fields", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"azure_roles": testPersistedRole["azure_roles"],
+			"persist_app": true,
+		})
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"azure_groups": testPersistedRole["azure_groups"],
+			"tags":         []string{"team:a"},
+			"metadata":     map[string]string{"team": "a"},
+		})
+
+		groupID := "239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-foo"
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		mp := getMockProvider(t, b, s)
+		equal(t, true, mp.isGroupMember(groupID, role.ServicePrincipalObjectID))
+
+		// The fields that version 1 doesn't have are cleared, and the group
+		// membership of the persisted app is removed
+		resp := testRoleRollback(t, b, s, "test_role", 1)
+		assertRespNoError(t, resp, nil)
+
+		role, err = getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, 0, len(role.AzureGroups))
+		equal(t, 0, len(role.GroupMembershipIDs))
+		equal(t, 0, len(role.Tags))
+		equal(t, 0, len(role.Metadata))
+		equal(t, 2, len(role.AzureRoles))
+		equal(t, true, role.PersistApp)
+		equal(t, false, mp.isGroupMember(groupID, role.ServicePrincipalObjectID))
+	})
+
+	t.Run("rollback after delete", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testRole)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		for version, msg := range map[int]string{
+			2: "is a deletion",
+			5: "not found",
+		} {
+			resp = testRoleRollback(t, b, s, "test_role", version)
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), msg) {
+				t.Fatalf("expected error containing %q, got: %v", msg, resp)
+			}
+		}
+
+		// Rolling back to a version from before the deletion recreates the role
+		resp = testRoleRollback(t, b, s, "test_role", 1)
+		assertRespNoError(t, resp, nil)
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		if role == nil {
+			t.Fatal("expected role to be recreated")
+		}
+	})
+}
+
+func testRoleHistory(t *testing.T, b *azureSecretBackend, s logical.Storage, name string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + name + "/history",
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	return resp
+}
+
+func testRoleRollback(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, version int) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.UpdateOperation,
+		Path:        "roles/" + name + "/rollback",
+		Data:        map[string]interface{}{"version": version},
+		Storage:     s,
+		EntityID:    "test-entity",
+		DisplayName: "test-token",
+	})
+	assertErrorIsNil(t, err)
+
+	return resp
+}
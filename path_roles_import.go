@@ -0,0 +1,373 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	roleDefinitionFormatJSON = "json"
+	roleDefinitionFormatHCL  = "hcl"
+)
+
+func pathRoleExport(b *azureSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/export",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixAzure,
+			OperationVerb:   "export",
+			OperationSuffix: "role",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role.",
+			},
+			"format": {
+				Type:          framework.TypeString,
+				Description:   `Format of the role definition. Either "json" or "hcl".`,
+				Default:       roleDefinitionFormatJSON,
+				AllowedValues: []interface{}{roleDefinitionFormatJSON, roleDefinitionFormatHCL},
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRoleExport,
+			},
+		},
+		HelpSynopsis:    roleExportHelpSyn,
+		HelpDescription: roleExportHelpDesc,
+	}
+}
+
+func pathRoleImport(b *azureSecretBackend) *framework.Path {
+	return &framework.Path{
+		// The path is outside of roles/ so that it can't collide with a role
+		// named "import".
+		Pattern: "roles-import",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixAzure,
+			OperationVerb:   "import",
+			OperationSuffix: "role",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role to create or update.",
+				Required:    true,
+			},
+			"definition": {
+				Type:        framework.TypeString,
+				Description: "Role definition in JSON or HCL, as returned by the export endpoint.",
+				Required:    true,
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Validate the role definition and report how its Azure roles and groups resolve, without saving the role.",
+				Default:     false,
+			},
+			"replace": {
+				Type:        framework.TypeBool,
+				Description: "Replace an existing role with the definition. Fields that are not in the definition are reset instead of left unchanged.",
+				Default:     false,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleImport,
+			},
+		},
+		HelpSynopsis:    roleImportHelpSyn,
+		HelpDescription: roleImportHelpDesc,
+	}
+}
+
+func (b *azureSecretBackend) pathRoleExport(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	format := d.Get("format").(string)
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("error reading role: %w", err)
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	data := exportRoleData(role)
+
+	var definition string
+	switch format {
+	case roleDefinitionFormatJSON:
+		out, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		definition = string(out)
+	case roleDefinitionFormatHCL:
+		definition, err = encodeHCLRoleDefinition(data)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return logical.ErrorResponse("unsupported format %q", format), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":       name,
+			"format":     format,
+			"definition": definition,
+		},
+	}, nil
+}
+
+func (b *azureSecretBackend) pathRoleImport(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("name is required"), nil
+	}
+
+	fields, err := decodeRoleDefinition(name, d.Get("definition").(string), d.Get("replace").(bool))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := fields.Validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if d.Get("dry_run").(bool) {
+		return b.validateRole(ctx, req.Storage, name, fields)
+	}
+
+	exists, err := b.pathRoleExistenceCheck(ctx, req, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	roleReq := *req
+	roleReq.Path = "roles/" + name
+	roleReq.Operation = logical.CreateOperation
+	if exists {
+		roleReq.Operation = logical.UpdateOperation
+	}
+
+	return b.pathRoleUpdate(ctx, &roleReq, fields)
+}
+
+// exportRoleData returns the fields of a role definition. The application of
+// a persisted app role is managed by Vault, and is left out so that the
+// persisted app of the role that the definition is written to is used, or a
+// new one is created. An unset sign-in audience is left out as well, since it
+// can't be written.
+func exportRoleData(role *roleEntry) map[string]interface{} {
+	data := roleData(role)
+	if role.PersistApp {
+		data["application_object_id"] = ""
+	}
+	if role.SignInAudience == "" {
+		delete(data, "sign_in_audience")
+	}
+	return data
+}
+
+// decodeRoleDefinition decodes a JSON or HCL role definition into the field
+// data of a role write. Azure roles, groups, custom security attributes,
+// federated credentials and sync destinations may be given as objects and are
+// encoded as the JSON strings the role fields expect. Fields that are missing
+// or null are left unchanged, unless replace is set, in which case they are
+// written with the value of a new role.
+func decodeRoleDefinition(name, definition string, replace bool) (*framework.FieldData, error) {
+	var def map[string]interface{}
+	if strings.HasPrefix(strings.TrimSpace(definition), "{") {
+		if err := jsonutil.DecodeJSON([]byte(definition), &def); err != nil {
+			return nil, fmt.Errorf("error parsing JSON role definition: %w", err)
+		}
+	} else {
+		if err := hcl.Decode(&def, definition); err != nil {
+			return nil, fmt.Errorf("error parsing HCL role definition: %w", err)
+		}
+	}
+
+	schema := roleFields()
+	raw := map[string]interface{}{
+		"name": name,
+	}
+	for k, v := range def {
+		if _, ok := schema[k]; !ok || k == "name" || k == "force" {
+			return nil, fmt.Errorf("unknown field %q in role definition", k)
+		}
+		if v == nil {
+			continue
+		}
+
+		switch k {
+		case "azure_roles", "azure_groups", "custom_security_attributes", "federated_credentials", "sync_destinations":
+			if _, ok := v.(string); !ok {
+				encoded, err := json.Marshal(v)
+				if err != nil {
+					return nil, fmt.Errorf("error encoding %s: %w", k, err)
+				}
+				v = string(encoded)
+			}
+		}
+		raw[k] = v
+	}
+
+	if replace {
+		for k, field := range schema {
+			if _, ok := raw[k]; ok {
+				continue
+			}
+			if v, ok := newRoleFieldValue(k, field); ok {
+				raw[k] = v
+			}
+		}
+	}
+
+	return &framework.FieldData{
+		Raw:    raw,
+		Schema: schema,
+	}, nil
+}
+
+// newRoleFieldValue returns the value of a field of a new role, which a role
+// definition that replaces a role writes for the fields it doesn't have. The
+// sign-in audience can't be unset, so it is left unchanged.
+func newRoleFieldValue(k string, field *framework.FieldSchema) (interface{}, bool) {
+	switch k {
+	case "name", "force", "sign_in_audience":
+		return nil, false
+	case "credential_type":
+		return credentialTypeNames[credentialTypeSP], true
+	case "azure_roles", "azure_groups", "federated_credentials", "sync_destinations":
+		return "[]", true
+	}
+	return field.DefaultOrZero(), true
+}
+
+// encodeHCLRoleDefinition encodes the fields of a role as HCL. Azure roles and
+// groups are written as blocks, metadata as an object and custom security
+// attributes as a JSON string. Fields without a value are omitted.
+func encodeHCLRoleDefinition(data map[string]interface{}) (string, error) {
+	// Round trip through JSON to only deal with JSON types below
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	var generic map[string]interface{}
+	if err := jsonutil.DecodeJSON(encoded, &generic); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, k := range sortedKeys(generic) {
+		switch v := generic[k].(type) {
+		case nil:
+		case map[string]interface{}:
+			if k == "metadata" {
+				if len(v) == 0 {
+					continue
+				}
+				fmt.Fprintf(&sb, "%s = {\n", k)
+				for _, mk := range sortedKeys(v) {
+					fmt.Fprintf(&sb, "  %s = %s\n", strconv.Quote(mk), hclValue(v[mk]))
+				}
+				sb.WriteString("}\n")
+				continue
+			}
+			attr, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&sb, "%s = %s\n", k, strconv.Quote(string(attr)))
+		case []interface{}:
+			if len(v) > 0 && isObjectList(v) {
+				for _, item := range v {
+					obj := item.(map[string]interface{})
+					fmt.Fprintf(&sb, "%s {\n", k)
+					for _, ik := range sortedKeys(obj) {
+						fmt.Fprintf(&sb, "  %s = %s\n", ik, hclValue(obj[ik]))
+					}
+					sb.WriteString("}\n")
+				}
+				continue
+			}
+			fmt.Fprintf(&sb, "%s = %s\n", k, hclValue(v))
+		default:
+			fmt.Fprintf(&sb, "%s = %s\n", k, hclValue(v))
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func hclValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, hclValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func isObjectList(l []interface{}) bool {
+	for _, item := range l {
+		if _, ok := item.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+const roleExportHelpSyn = `Export a role definition.`
+const roleExportHelpDesc = `
+This path returns the definition of a role in JSON or HCL. The definition holds
+the fields of the role, such as its Azure roles, groups, sign-in audience, tags
+and TTLs, and can be imported with the "roles-import" path, for example on
+another mount or cluster.
+
+The application of a role with persist_app enabled is not exported; a new one
+is created when the role is imported.
+`
+
+const roleImportHelpSyn = `Import a role definition.`
+const roleImportHelpDesc = `
+This path creates or updates a role from a definition in JSON or HCL, as
+returned by the "roles/<name>/export" path. The definition is validated exactly
+as a role write is. Fields that are not in the definition are left unchanged
+when an existing role is updated, unless replace is set to true, in which case
+they are reset as they are on a new role.
+
+With dry_run set to true the role is not saved. Instead the response reports
+the Azure roles and groups of the definition as they resolve in this tenant,
+including the IDs their names were looked up to, as the "roles/<name>/validate"
+path does.
+`
@@ -0,0 +1,228 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleExportImport(t *testing.T) {
+	role := map[string]interface{}{
+		"azure_roles": compactJSON(`[
+			{
+				"role_name": "Owner",
+				"role_id": "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+				"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"
+			}]`),
+		"azure_groups": compactJSON(`[
+			{
+				"group_name": "foo",
+				"object_id": "239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-foo"
+			}]`),
+		"sign_in_audience":           "AzureADMultipleOrgs",
+		"tags":                       []string{"team:a", "env:dev"},
+		"ttl":                        300,
+		"max_ttl":                    3000,
+		"description":                `Role "a"`,
+		"metadata":                   map[string]string{"team": "a", "cost-center": "42"},
+		"custom_security_attributes": `{"Engineering":{"Project":"Baker"}}`,
+	}
+
+	for _, format := range []string{"json", "hcl"} {
+		t.Run(format, func(t *testing.T) {
+			b, s := getTestBackendMocked(t, true)
+			testRoleCreate(t, b, s, "source", role)
+
+			exported := testRoleExport(t, b, s, "source", format)
+			equal(t, format, exported.Data["format"])
+
+			resp := testRoleImport(t, b, s, map[string]interface{}{
+				"name":       "target",
+				"definition": exported.Data["definition"],
+			})
+			assertRespNoError(t, resp, nil)
+
+			source, err := testRoleRead(t, b, s, "source")
+			assertErrorIsNil(t, err)
+			target, err := testRoleRead(t, b, s, "target")
+			assertErrorIsNil(t, err)
+			equal(t, source.Data, target.Data)
+		})
+	}
+
+	t.Run("role named import", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "source", role)
+
+		// The import path doesn't shadow a role named "import"
+		resp := testRoleImport(t, b, s, map[string]interface{}{
+			"name":       "import",
+			"definition": testRoleExport(t, b, s, "source", "json").Data["definition"],
+		})
+		assertRespNoError(t, resp, nil)
+
+		imported, err := testRoleRead(t, b, s, "import")
+		assertErrorIsNil(t, err)
+		equal(t, time.Duration(300), imported.Data["ttl"])
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/import",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		deleted, err := getRole(context.Background(), "import", s)
+		assertErrorIsNil(t, err)
+		if deleted != nil {
+			t.Fatal("expected the role named import to be deleted")
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "target", role)
+
+		definition := `{"azure_roles": [{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"}], "tags": null}`
+
+		// Fields missing from the definition are left unchanged by default
+		resp := testRoleImport(t, b, s, map[string]interface{}{
+			"name":       "target",
+			"definition": definition,
+		})
+		assertRespNoError(t, resp, nil)
+		target, err := testRoleRead(t, b, s, "target")
+		assertErrorIsNil(t, err)
+		equal(t, []string{"env:dev", "team:a"}, target.Data["tags"])
+		equal(t, 1, len(target.Data["azure_groups"].([]*AzureGroup)))
+
+		// and reset when the definition replaces the role
+		resp = testRoleImport(t, b, s, map[string]interface{}{
+			"name":       "target",
+			"definition": definition,
+			"replace":    true,
+		})
+		assertRespNoError(t, resp, nil)
+		target, err = testRoleRead(t, b, s, "target")
+		assertErrorIsNil(t, err)
+		equal(t, []string{}, target.Data["tags"])
+		equal(t, 0, len(target.Data["azure_groups"].([]*AzureGroup)))
+		equal(t, map[string]string{}, target.Data["metadata"])
+		equal(t, "", target.Data["description"])
+		equal(t, time.Duration(0), target.Data["ttl"])
+		equal(t, "AzureADMultipleOrgs", target.Data["sign_in_audience"])
+	})
+
+	t.Run("persisted app", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "source", testPersistedRole)
+
+		exported := testRoleExport(t, b, s, "source", "json")
+		var definition map[string]interface{}
+		assertErrorIsNil(t, json.Unmarshal([]byte(exported.Data["definition"].(string)), &definition))
+		equal(t, "", definition["application_object_id"])
+
+		resp := testRoleImport(t, b, s, map[string]interface{}{
+			"name":       "target",
+			"definition": exported.Data["definition"],
+		})
+		assertRespNoError(t, resp, nil)
+
+		source, err := getRole(context.Background(), "source", s)
+		assertErrorIsNil(t, err)
+		target, err := getRole(context.Background(), "target", s)
+		assertErrorIsNil(t, err)
+		if target.ManagedApplicationObjectID == "" || target.ManagedApplicationObjectID == source.ManagedApplicationObjectID {
+			t.Fatal("expected a new persisted app to be created for the imported role")
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		definition := `
+ttl = "1h"
+azure_roles {
+  role_name = "Contributor"
+  scope = "/subscriptions/FAKE_SUB_ID"
+}
+azure_groups {
+  group_name = "bar"
+}
+`
+		resp := testRoleImport(t, b, s, map[string]interface{}{
+			"name":       "target",
+			"definition": definition,
+			"dry_run":    true,
+		})
+		assertRespNoError(t, resp, nil)
+
+		equal(t, false, resp.Data["exists"])
+		roles := resp.Data["azure_roles"].([]*AzureRole)
+		equal(t, 1, len(roles))
+		equal(t, "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Contributor", roles[0].RoleID)
+		groups := resp.Data["azure_groups"].([]*AzureGroup)
+		equal(t, 1, len(groups))
+		equal(t, "00000000-1111-2222-3333-444444444444FAKE_GROUP-bar", groups[0].ObjectID)
+
+		// The role isn't saved
+		role, err := getRole(context.Background(), "target", s)
+		assertErrorIsNil(t, err)
+		if role != nil {
+			t.Fatal("expected role not to be saved on a dry run")
+		}
+	})
+
+	t.Run("invalid definitions", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		for name, definition := range map[string]string{
+			"unknown field":  `{"azure_roles": [], "unknown": true}`,
+			"missing roles":  `{"ttl": 60}`,
+			"invalid ttl":    `{"ttl": 120, "max_ttl": 60, "azure_roles": [{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]}`,
+			"malformed json": `{"ttl": `,
+			"malformed hcl":  `ttl = `,
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp := testRoleImport(t, b, s, map[string]interface{}{
+					"name":       "target",
+					"definition": definition,
+				})
+				if !resp.IsError() {
+					t.Fatalf("expected error response, got: %v", resp)
+				}
+			})
+		}
+	})
+}
+
+func testRoleExport(t *testing.T, b *azureSecretBackend, s logical.Storage, name, format string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + name + "/export",
+		Data:      map[string]interface{}{"format": format},
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+
+	return resp
+}
+
+func testRoleImport(t *testing.T, b *azureSecretBackend, s logical.Storage, d map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles-import",
+		Data:      d,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	return resp
+}
@@ -11,7 +11,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-secrets-azure/api"
 )
 
 func TestRoleCreate(t *testing.T) {
@@ -39,13 +42,27 @@ func TestRoleCreate(t *testing.T) {
 			"group_name": "bar",
 			"object_id": "31c5bf7e-e1e8-42c8-882c-856f776290afFAKE_GROUP-bar"
 		}]`),
-			"ttl":                   int64(0),
-			"max_ttl":               int64(0),
-			"application_object_id": "",
-			"permanently_delete":    true,
-			"persist_app":           false,
-			"sign_in_audience":      "AzureADMyOrg",
-			"tags":                  []string{"project:vault_test"},
+			"ttl":                             int64(0),
+			"max_ttl":                         int64(0),
+			"application_object_id":           "",
+			"permanently_delete":              true,
+			"persist_app":                     false,
+			"sign_in_audience":                "AzureADMyOrg",
+			"tags":                            []string{"project:vault_test"},
+			"allowed_scopes":                  []string{},
+			"name_template":                   "",
+			"max_active_credentials":          0,
+			"max_issue_rate":                  0,
+			"owners":                          []string{},
+			"notes":                           "",
+			"description":                     "",
+			"metadata":                        map[string]string{},
+			"service_management_reference":    "",
+			"custom_security_attributes":      "{}",
+			"credential_type":                 "service_principal",
+			"managed_identity_resource_group": "",
+			"federated_credentials":           "[]",
+			"sync_destinations":               "[]",
 		}
 
 		spRole2 := map[string]interface{}{
@@ -69,13 +86,27 @@ func TestRoleCreate(t *testing.T) {
 			"group_name": "bam",
 			"object_id": "a6a834a6-36c3-4575-8e2b-05095963d603FAKE_GROUP-bam"
 		}]`),
-			"ttl":                   int64(300),
-			"max_ttl":               int64(3000),
-			"application_object_id": "",
-			"permanently_delete":    true,
-			"persist_app":           false,
-			"sign_in_audience":      "AzureADMultipleOrgs",
-			"tags":                  []string{"project:vault_test"},
+			"ttl":                             int64(300),
+			"max_ttl":                         int64(3000),
+			"application_object_id":           "",
+			"permanently_delete":              true,
+			"persist_app":                     false,
+			"sign_in_audience":                "AzureADMultipleOrgs",
+			"tags":                            []string{"project:vault_test"},
+			"allowed_scopes":                  []string{},
+			"name_template":                   "",
+			"max_active_credentials":          0,
+			"max_issue_rate":                  0,
+			"owners":                          []string{},
+			"notes":                           "",
+			"description":                     "",
+			"metadata":                        map[string]string{},
+			"service_management_reference":    "",
+			"custom_security_attributes":      "{}",
+			"credential_type":                 "service_principal",
+			"managed_identity_resource_group": "",
+			"federated_credentials":           "[]",
+			"sync_destinations":               "[]",
 		}
 
 		// Verify basic updates of the name role
@@ -192,15 +223,29 @@ func TestRoleCreate(t *testing.T) {
 
 	t.Run("Static SP role", func(t *testing.T) {
 		spRole1 := map[string]interface{}{
-			"application_object_id": "00000000-0000-0000-0000-000000000000",
-			"ttl":                   int64(300),
-			"max_ttl":               int64(3000),
-			"azure_roles":           "[]",
-			"azure_groups":          "[]",
-			"sign_in_audience":      "PersonalMicrosoftAccount",
-			"tags":                  []string{"environment:production"},
-			"permanently_delete":    false,
-			"persist_app":           false,
+			"application_object_id":           "00000000-0000-0000-0000-000000000000",
+			"ttl":                             int64(300),
+			"max_ttl":                         int64(3000),
+			"azure_roles":                     "[]",
+			"azure_groups":                    "[]",
+			"sign_in_audience":                "PersonalMicrosoftAccount",
+			"tags":                            []string{"environment:production"},
+			"permanently_delete":              false,
+			"persist_app":                     false,
+			"allowed_scopes":                  []string{},
+			"name_template":                   "",
+			"max_active_credentials":          0,
+			"max_issue_rate":                  0,
+			"owners":                          []string{},
+			"notes":                           "",
+			"description":                     "",
+			"metadata":                        map[string]string{},
+			"service_management_reference":    "",
+			"custom_security_attributes":      "{}",
+			"credential_type":                 "service_principal",
+			"managed_identity_resource_group": "",
+			"federated_credentials":           "[]",
+			"sync_destinations":               "[]",
 		}
 
 		name := generateUUID()
@@ -237,6 +282,20 @@ func TestRoleCreate(t *testing.T) {
 		testRole["ttl"] = int64(0)
 		testRole["max_ttl"] = int64(0)
 		testRole["permanently_delete"] = false
+		testRole["allowed_scopes"] = []string(nil)
+		testRole["name_template"] = ""
+		testRole["max_active_credentials"] = 0
+		testRole["max_issue_rate"] = 0
+		testRole["owners"] = []string(nil)
+		testRole["notes"] = ""
+		testRole["description"] = ""
+		testRole["metadata"] = map[string]string(nil)
+		testRole["service_management_reference"] = ""
+		testRole["custom_security_attributes"] = api.CustomSecurityAttributes(nil)
+		testRole["credential_type"] = "service_principal"
+		testRole["managed_identity_resource_group"] = ""
+		testRole["federated_credentials"] = []*FederatedCredential(nil)
+		testRole["sync_destinations"] = []*SyncDestination(nil)
 
 		resp, err := testRoleRead(t, b, s, name)
 		assertErrorIsNil(t, err)
@@ -548,13 +607,114 @@ func TestRoleCreateBad(t *testing.T) {
 		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
 	}
 
-	// invalid signInAudience
-	role = map[string]interface{}{"sign_in_audience": "asdfg"}
+	// allowed_scopes outside of the Azure role scopes
+	role = map[string]interface{}{
+		"azure_roles":    compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"}]`),
+		"allowed_scopes": "/subscriptions/FAKE_SUB_ID/resourceGroups/*",
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "is not beneath the scope of any Azure role"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// allowed_scopes with a persisted app
+	role = map[string]interface{}{
+		"azure_roles":    compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+		"allowed_scopes": "/subscriptions/FAKE_SUB_ID/resourceGroups/*",
+		"persist_app":    true,
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "allowed_scopes can only be used with dynamic service principals"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// identity templates with a static application
+	role = map[string]interface{}{
+		"azure_roles":           compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/{{identity.entity.name}}"}]`),
+		"application_object_id": testStaticSPAppObjID,
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "identity templates can only be used with dynamic service principals"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// unbalanced identity template
+	role = map[string]interface{}{
+		"azure_roles": compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/{{identity.entity.name"}]`),
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "invalid template in scope"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// invalid name_template
+	role = map[string]interface{}{
+		"azure_roles":   compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+		"name_template": "vault-{{ .RoleName ",
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "invalid name_template"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// invalid owner
+	role = map[string]interface{}{
+		"azure_roles": compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+		"owners":      "not-an-object-id",
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "owner 'not-an-object-id' is not a valid object ID"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// description too long
+	role = map[string]interface{}{
+		"azure_roles": compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+		"description": strings.Repeat("a", 1025),
+	}
 	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
-	msg = "Invalid value for sign_in_audience field. Valid values are: AzureADMyOrg, AzureADMultipleOrgs, AzureADandPersonalMicrosoftAccount, PersonalMicrosoftAccount"
+	msg = "description must not be longer than 1024 characters"
 	if !strings.Contains(resp.Error().Error(), msg) {
 		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
 	}
+
+	// invalid custom security attributes
+	role = map[string]interface{}{
+		"azure_roles":                compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+		"custom_security_attributes": `{"Engineering": {"Level": 1.5}}`,
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = `invalid value for custom security attribute "Level" in set "Engineering"`
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// application properties with an existing application
+	role = map[string]interface{}{
+		"application_object_id": "00000000-0000-0000-0000-000000000000",
+		"notes":                 "managed by vault",
+	}
+	resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+	msg = "can only be used with applications created by Vault"
+	if !strings.Contains(resp.Error().Error(), msg) {
+		t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+	}
+
+	// invalid signInAudience
+	for _, audience := range []string{"asdfg", ""} {
+		role = map[string]interface{}{"sign_in_audience": audience}
+		resp = testRoleCreateBasic(t, b, s, "test_role_1", role)
+		msg = "Invalid value for sign_in_audience field. Valid values are: AzureADMyOrg, AzureADMultipleOrgs, AzureADandPersonalMicrosoftAccount, PersonalMicrosoftAccount"
+		if !strings.Contains(resp.Error().Error(), msg) {
+			t.Fatalf("expected to find: %s, got: %s", msg, resp.Error().Error())
+		}
+	}
 }
 
 func TestValidateTags(t *testing.T) {
@@ -622,6 +782,280 @@ func TestRoleUpdateError(t *testing.T) {
 	}
 }
 
+func TestRolePersistedAppUpdate(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	testRoleCreate(t, b, s, "test_role", testPersistedRole)
+
+	role, err := getRole(context.Background(), "test_role", s)
+	assertErrorIsNil(t, err)
+
+	// Keep the Owner assignment, replace the Reader assignment and the group
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test_role",
+		Data: map[string]interface{}{
+			"azure_roles": compactJSON(`[
+				{
+					"role_name": "Owner",
+					"role_id": "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+					"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"
+				},
+				{
+					"role_name": "Contributor",
+					"role_id": "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Contributor",
+					"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg3"
+				}]`),
+			"azure_groups": compactJSON(`[
+				{
+					"group_name": "bar",
+					"object_id": "239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-bar"
+				}]`),
+		},
+		Storage: s,
+	})
+	assertRespNoError(t, resp, err)
+
+	added := resp.Data["added_role_assignments"].([]*AzureRole)
+	removed := resp.Data["removed_role_assignments"].([]*AzureRole)
+	equal(t, 1, len(added))
+	equal(t, 1, len(removed))
+	equal(t, "/subscriptions/FAKE_SUB_ID/resourceGroups/rg3", added[0].Scope)
+	equal(t, "/subscriptions/FAKE_SUB_ID/resourceGroups/rg2", removed[0].Scope)
+	equal(t, []string{"239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-bar"}, resp.Data["added_group_memberships"])
+	equal(t, []string{role.AzureGroups[0].ObjectID}, resp.Data["removed_group_memberships"])
+
+	updated, err := getRole(context.Background(), "test_role", s)
+	assertErrorIsNil(t, err)
+	equal(t, role.ManagedApplicationObjectID, updated.ManagedApplicationObjectID)
+	equal(t, role.ServicePrincipalObjectID, updated.ServicePrincipalObjectID)
+	equal(t, role.RoleAssignmentIDs[0], updated.RoleAssignmentIDs[0])
+	equal(t, []string{"239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-bar"}, updated.GroupMembershipIDs)
+
+	// Only the changed grants were applied in Azure
+	mp := getMockProvider(t, b, s)
+	if _, ok := mp.roleAssignments[role.RoleAssignmentIDs[0]]; !ok {
+		t.Fatal("expected unchanged role assignment to be kept")
+	}
+	if _, ok := mp.roleAssignments[role.RoleAssignmentIDs[1]]; ok {
+		t.Fatal("expected removed role assignment to be deleted")
+	}
+	if _, ok := mp.roleAssignments[updated.RoleAssignmentIDs[1]]; !ok {
+		t.Fatal("expected added role assignment to exist")
+	}
+	equal(t, 2, len(mp.roleAssignments))
+	equal(t, false, mp.groupMembers[role.AzureGroups[0].ObjectID][role.ServicePrincipalObjectID])
+	equal(t, true, mp.groupMembers["239b11fe-6adf-409a-b231-08b918e9de23FAKE_GROUP-bar"][role.ServicePrincipalObjectID])
+
+	// No WAL entries are left behind
+	walIDs, err := framework.ListWAL(context.Background(), s)
+	assertErrorIsNil(t, err)
+	equal(t, 0, len(walIDs))
+
+	// An update without grant changes doesn't touch Azure
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test_role",
+		Data:      map[string]interface{}{"ttl": 3600},
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	equal(t, 0, len(resp.Data["added_role_assignments"].([]*AzureRole)))
+	equal(t, 0, len(resp.Data["removed_role_assignments"].([]*AzureRole)))
+
+	again, err := getRole(context.Background(), "test_role", s)
+	assertErrorIsNil(t, err)
+	equal(t, updated.RoleAssignmentIDs, again.RoleAssignmentIDs)
+}
+
+func TestRolePersistAppTransition(t *testing.T) {
+	getCreds := func(t *testing.T, b *azureSecretBackend, s logical.Storage) *logical.Secret {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		fakeSaveLoad(resp.Secret)
+		return resp.Secret
+	}
+
+	revoke := func(t *testing.T, b *azureSecretBackend, s logical.Storage, secret *logical.Secret) {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		if resp != nil && len(resp.Warnings) > 0 {
+			t.Fatalf("unexpected warnings: %v", resp.Warnings)
+		}
+	}
+
+	updateRole := func(t *testing.T, b *azureSecretBackend, s logical.Storage, d map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/test_role",
+			Data:      d,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		return resp
+	}
+
+	t.Run("disable retires app", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+		mp := getMockProvider(t, b, s)
+
+		persisted, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		secret := getCreds(t, b, s)
+
+		resp := updateRole(t, b, s, map[string]interface{}{"persist_app": false})
+		if resp == nil || len(resp.Warnings) != 1 {
+			t.Fatalf("expected a warning about the outstanding lease, got: %v", resp)
+		}
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, "", role.ApplicationObjectID)
+		equal(t, "", role.ManagedApplicationObjectID)
+		equal(t, "", role.ServicePrincipalObjectID)
+		equal(t, 0, len(role.RoleAssignmentIDs))
+
+		// The outstanding lease keeps working until it is revoked
+		if !mp.appExists(persisted.ManagedApplicationObjectID) {
+			t.Fatal("expected app with outstanding lease to be kept")
+		}
+		equal(t, 2, len(mp.roleAssignments))
+
+		// New credentials use dynamic service principals
+		dynamic := getCreds(t, b, s)
+		if dynamic.InternalData["app_object_id"] == persisted.ManagedApplicationObjectID {
+			t.Fatal("expected credentials for a new application")
+		}
+
+		revoke(t, b, s, secret)
+		if mp.appExists(persisted.ManagedApplicationObjectID) {
+			t.Fatal("expected retired app to be deleted after its last lease was revoked")
+		}
+		for _, id := range persisted.RoleAssignmentIDs {
+			if _, ok := mp.roleAssignments[id]; ok {
+				t.Fatal("expected role assignments of retired app to be deleted")
+			}
+		}
+		equal(t, false, mp.groupMembers[persisted.AzureGroups[0].ObjectID][persisted.ServicePrincipalObjectID])
+
+		entries, err := s.List(context.Background(), retiredAppsStoragePath+"/")
+		assertErrorIsNil(t, err)
+		equal(t, 0, len(entries))
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		assertErrorIsNil(t, err)
+		equal(t, 0, len(walIDs))
+	})
+
+	t.Run("disable without leases", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+		mp := getMockProvider(t, b, s)
+
+		persisted, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+
+		resp := updateRole(t, b, s, map[string]interface{}{"persist_app": false})
+		if resp != nil && len(resp.Warnings) > 0 {
+			t.Fatalf("unexpected warnings: %v", resp.Warnings)
+		}
+		if mp.appExists(persisted.ManagedApplicationObjectID) {
+			t.Fatal("expected retired app to be deleted")
+		}
+		equal(t, 0, len(mp.roleAssignments))
+	})
+
+	t.Run("disable hands off app", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+		mp := getMockProvider(t, b, s)
+
+		persisted, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		secret := getCreds(t, b, s)
+
+		resp := updateRole(t, b, s, map[string]interface{}{
+			"persist_app":           false,
+			"application_object_id": persisted.ManagedApplicationObjectID,
+		})
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, persisted.ManagedApplicationObjectID, role.ApplicationObjectID)
+		equal(t, persisted.ApplicationID, role.ApplicationID)
+		equal(t, "", role.ManagedApplicationObjectID)
+
+		// The grants the role no longer tracks are removed
+		equal(t, persisted.AzureRoles, resp.Data["removed_role_assignments"])
+		equal(t, persisted.GroupMembershipIDs, resp.Data["removed_group_memberships"])
+		equal(t, 0, len(mp.roleAssignments))
+		equal(t, false, mp.groupMembers[persisted.AzureGroups[0].ObjectID][persisted.ServicePrincipalObjectID])
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		assertErrorIsNil(t, err)
+		equal(t, 0, len(walIDs))
+
+		// The app is kept when the lease is revoked
+		revoke(t, b, s, secret)
+		if !mp.appExists(persisted.ManagedApplicationObjectID) {
+			t.Fatal("expected handed off app to be kept")
+		}
+
+		// A role that was handed the app doesn't delete it
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/test_role",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !mp.appExists(persisted.ManagedApplicationObjectID) {
+			t.Fatal("expected handed off app to be kept")
+		}
+	})
+
+	t.Run("enable creates app", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		role := map[string]interface{}{}
+		for k, v := range testPersistedRole {
+			role[k] = v
+		}
+		role["persist_app"] = false
+		testRoleCreate(t, b, s, "test_role", role)
+
+		secret := getCreds(t, b, s)
+
+		updateRole(t, b, s, map[string]interface{}{"persist_app": true})
+
+		persisted, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		if persisted.ManagedApplicationObjectID == "" {
+			t.Fatal("expected persisted app to be created")
+		}
+		equal(t, persisted.ManagedApplicationObjectID, persisted.ApplicationObjectID)
+
+		// The dynamic service principal of the outstanding lease is unaffected
+		mp := getMockProvider(t, b, s)
+		if !mp.appExists(secret.InternalData["app_object_id"].(string)) {
+			t.Fatal("expected app of outstanding lease to be kept")
+		}
+		revoke(t, b, s, secret)
+		if !mp.appExists(persisted.ManagedApplicationObjectID) {
+			t.Fatal("expected persisted app to be kept")
+		}
+	})
+}
+
 func TestRoleList(t *testing.T) {
 	b, s := getTestBackendMocked(t, true)
 
@@ -678,6 +1112,79 @@ func TestRoleList(t *testing.T) {
 	equal(t, exp, resp.Data["keys"])
 }
 
+func TestRoleListDetailed(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+
+	testRoleCreate(t, b, s, "r1", map[string]interface{}{
+		"azure_roles": compactJSON(`[
+			{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"},
+			{"role_name": "Reader", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/RG1"}]`),
+		"ttl":         300,
+		"description": "Team a",
+		"metadata":    []string{"team=a", "env=dev"},
+	})
+	testRoleCreate(t, b, s, "r2", map[string]interface{}{
+		"azure_roles": compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID/resourceGroups/rg2"}]`),
+		"metadata":    map[string]string{"team": "b", "env": "dev"},
+		"persist_app": true,
+	})
+	testRoleCreate(t, b, s, "r3", map[string]interface{}{
+		"application_object_id": "00000000-0000-0000-0000-000000000000",
+	})
+
+	list := func(t *testing.T, d map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "roles/",
+			Data:      d,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		if keys, ok := resp.Data["keys"].([]string); ok {
+			sort.Strings(keys)
+		}
+		return resp
+	}
+
+	resp := list(t, map[string]interface{}{"detailed": true})
+	equal(t, []string{"r1", "r2", "r3"}, resp.Data["keys"])
+
+	r2, err := getRole(context.Background(), "r2", s)
+	assertErrorIsNil(t, err)
+	keyInfo := resp.Data["key_info"].(map[string]interface{})
+	equal(t, map[string]interface{}{
+		"credential_mode":         "dynamic",
+		"ttl":                     int64(300),
+		"max_ttl":                 int64(0),
+		"scope_count":             1,
+		"persisted_app_object_id": "",
+		"description":             "Team a",
+		"metadata":                map[string]string{"team": "a", "env": "dev"},
+	}, keyInfo["r1"])
+	equal(t, "persisted", keyInfo["r2"].(map[string]interface{})["credential_mode"])
+	equal(t, r2.ManagedApplicationObjectID, keyInfo["r2"].(map[string]interface{})["persisted_app_object_id"])
+	equal(t, "static", keyInfo["r3"].(map[string]interface{})["credential_mode"])
+	equal(t, 0, keyInfo["r3"].(map[string]interface{})["scope_count"])
+
+	resp = list(t, map[string]interface{}{"metadata": "env=dev"})
+	equal(t, []string{"r1", "r2"}, resp.Data["keys"])
+	if _, ok := resp.Data["key_info"]; ok {
+		t.Fatal("expected no key info without detailed")
+	}
+
+	resp = list(t, map[string]interface{}{"metadata": []string{"env=dev", "team=b"}})
+	equal(t, []string{"r2"}, resp.Data["keys"])
+
+	resp = list(t, map[string]interface{}{"scope_prefix": "/subscriptions/fake_sub_id/resourceGroups/rg1"})
+	equal(t, []string{"r1"}, resp.Data["keys"])
+
+	resp = list(t, map[string]interface{}{"scope_prefix": "/subscriptions/FAKE_SUB_ID/resourceGroups/rg3"})
+	if resp.Data["keys"] != nil {
+		t.Fatalf("expected no roles, got: %v", resp.Data["keys"])
+	}
+}
+
 func TestRoleDelete(t *testing.T) {
 	b, s := getTestBackendMocked(t, true)
 	name := "test_role"
@@ -721,6 +1228,233 @@ func TestRoleDelete(t *testing.T) {
 	}
 }
 
+func TestRoleDeleteWithLeases(t *testing.T) {
+	deleteRole := func(t *testing.T, b *azureSecretBackend, s logical.Storage, d map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/test_role",
+			Data:      d,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		return resp
+	}
+
+	for name, role := range map[string]map[string]interface{}{
+		"dynamic":   testRole,
+		"persisted": testPersistedRole,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackendMocked(t, true)
+			testRoleCreate(t, b, s, "test_role", role)
+			mp := getMockProvider(t, b, s)
+
+			var secrets []*logical.Secret
+			for i := 0; i < 2; i++ {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.ReadOperation,
+					Path:      "creds/test_role",
+					Storage:   s,
+				})
+				assertRespNoError(t, resp, err)
+				fakeSaveLoad(resp.Secret)
+				secrets = append(secrets, resp.Secret)
+			}
+
+			// Revoking a lease stops tracking it
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.RevokeOperation,
+				Secret:    secrets[0],
+				Storage:   s,
+			})
+			assertRespNoError(t, resp, err)
+
+			ids, err := roleLeaseIDs(context.Background(), s, "test_role")
+			assertErrorIsNil(t, err)
+			equal(t, 1, len(ids))
+
+			// Deletion is refused while a lease is outstanding
+			resp = deleteRole(t, b, s, nil)
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), "1 outstanding leases") {
+				t.Fatalf("expected error about outstanding leases, got: %v", resp)
+			}
+			r, err := getRole(context.Background(), "test_role", s)
+			assertErrorIsNil(t, err)
+			if r == nil {
+				t.Fatal("expected role to be kept")
+			}
+
+			// Forcing deletion revokes the credentials of the lease first
+			resp = deleteRole(t, b, s, map[string]interface{}{"force": true})
+			assertRespNoError(t, resp, nil)
+
+			r, err = getRole(context.Background(), "test_role", s)
+			assertErrorIsNil(t, err)
+			if r != nil {
+				t.Fatal("expected role to be deleted")
+			}
+
+			ids, err = roleLeaseIDs(context.Background(), s, "test_role")
+			assertErrorIsNil(t, err)
+			equal(t, 0, len(ids))
+
+			appObjID := secrets[1].InternalData["app_object_id"].(string)
+			if keyID, ok := secrets[1].InternalData["key_id"].(string); ok {
+				if mp.passwordExists(keyID) {
+					t.Fatal("expected password of outstanding lease to be deleted")
+				}
+			}
+			if mp.appExists(appObjID) {
+				t.Fatal("expected app of outstanding lease to be deleted")
+			}
+
+			// Renewing the lease fails, and revoking it is a no-op
+			_, err = b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.RenewOperation,
+				Secret:    secrets[1],
+				Storage:   s,
+			})
+			if err == nil {
+				t.Fatal("expected error renewing lease of deleted role")
+			}
+
+			resp, err = b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.RevokeOperation,
+				Secret:    secrets[1],
+				Storage:   s,
+			})
+			assertRespNoError(t, resp, err)
+		})
+	}
+}
+
+func TestRoleVerifyPermissions(t *testing.T) {
+	const scope = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"
+	role := map[string]interface{}{
+		"azure_roles": compactJSON(`[
+			{
+				"role_name": "Owner",
+				"scope":  "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1"
+			}]`),
+	}
+
+	for name, tc := range map[string]struct {
+		permissions []Permission
+		mode        string
+		wantErr     bool
+		warnings    int
+	}{
+		"allowed": {
+			permissions: []Permission{{Actions: []string{"Microsoft.Authorization/*/Write"}}},
+		},
+		"denied": {
+			permissions: []Permission{{Actions: []string{"*"}, NotActions: []string{"Microsoft.Authorization/*"}}},
+			warnings:    1,
+		},
+		"denied fail": {
+			permissions: []Permission{{Actions: []string{"*/read"}}},
+			mode:        verifyRolePermissionsFail,
+			wantErr:     true,
+		},
+		"denied skip": {
+			permissions: []Permission{{Actions: []string{"*/read"}}},
+			mode:        verifyRolePermissionsSkip,
+		},
+		"condition allows role": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "@Request[Microsoft.Authorization/roleAssignments:RoleDefinitionId] ForAnyOfAnyValues:GuidEquals {FAKE_ROLE-Owner}",
+			}},
+			mode: verifyRolePermissionsFail,
+		},
+		"condition denies role": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "@Request[Microsoft.Authorization/roleAssignments:RoleDefinitionId] ForAnyOfAnyValues:GuidEquals {FAKE_ROLE-Reader}",
+			}},
+			mode:    verifyRolePermissionsFail,
+			wantErr: true,
+		},
+		"condition lists role with other roles": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "((!(ActionMatches{'Microsoft.Authorization/roleAssignments/write'})) OR (@Request[Microsoft.Authorization/roleAssignments:RoleDefinitionId] ForAnyOfAnyValues:GuidEquals {FAKE_ROLE-Reader, FAKE_ROLE-Owner}))",
+			}},
+			mode: verifyRolePermissionsFail,
+		},
+		"not equals condition names role": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "@Request[Microsoft.Authorization/roleAssignments:RoleDefinitionId] ForAnyOfAnyValues:GuidNotEquals {FAKE_ROLE-Owner}",
+			}},
+			mode:     verifyRolePermissionsFail,
+			warnings: 1,
+		},
+		"not equals condition names other role": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "@Request[Microsoft.Authorization/roleAssignments:RoleDefinitionId] ForAnyOfAnyValues:GuidNotEquals {FAKE_ROLE-Reader}",
+			}},
+			mode:     verifyRolePermissionsFail,
+			warnings: 1,
+		},
+		"negated allow list": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "!(@Request[Microsoft.Authorization/roleAssignments:RoleDefinitionId] ForAnyOfAnyValues:GuidEquals {FAKE_ROLE-Owner})",
+			}},
+			mode:     verifyRolePermissionsFail,
+			warnings: 1,
+		},
+		"unknown condition": {
+			permissions: []Permission{{
+				Actions:   []string{"Microsoft.Authorization/roleAssignments/write"},
+				Condition: "@Request[Microsoft.Authorization/roleAssignments:PrincipalType] StringEqualsIgnoreCase 'ServicePrincipal'",
+			}},
+			mode:     verifyRolePermissionsFail,
+			warnings: 1,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackendMocked(t, true)
+			if tc.mode != "" {
+				testConfigUpdate(t, b, s, map[string]interface{}{
+					"verify_role_permissions": tc.mode,
+				})
+			}
+			mp := getMockProvider(t, b, s)
+			mp.permissions[scope] = tc.permissions
+
+			resp := testRoleCreateBasic(t, b, s, "test_role", role)
+
+			r, err := getRole(context.Background(), "test_role", s)
+			assertErrorIsNil(t, err)
+			if tc.wantErr {
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), "Owner") {
+					t.Fatalf("expected error about role Owner, got: %v", resp)
+				}
+				if r != nil {
+					t.Fatal("expected role not to be saved")
+				}
+				return
+			}
+
+			if resp != nil && resp.IsError() {
+				t.Fatal(resp.Error())
+			}
+			if r == nil {
+				t.Fatal("expected role to be saved")
+			}
+			var warnings []string
+			if resp != nil {
+				warnings = resp.Warnings
+			}
+			equal(t, tc.warnings, len(warnings))
+		})
+	}
+}
+
 // Utility function to create a role and fail on errors
 func testRoleCreate(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, d map[string]interface{}) {
 	t.Helper()
@@ -776,6 +1510,15 @@ func convertRespTypes(data map[string]interface{}) {
 	if data["azure_groups"] != nil {
 		data["azure_groups"] = encodeJSON(data["azure_groups"])
 	}
+	if credentials, ok := data["federated_credentials"].([]*FederatedCredential); ok && credentials != nil {
+		data["federated_credentials"] = encodeJSON(credentials)
+	}
+	if destinations, ok := data["sync_destinations"].([]*SyncDestination); ok && destinations != nil {
+		data["sync_destinations"] = encodeJSON(destinations)
+	}
+	if attributes, ok := data["custom_security_attributes"].(api.CustomSecurityAttributes); ok && attributes != nil {
+		data["custom_security_attributes"] = encodeJSON(attributes)
+	}
 	data["ttl"] = int64(data["ttl"].(time.Duration))
 	data["max_ttl"] = int64(data["max_ttl"].(time.Duration))
 }
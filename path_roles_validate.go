@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathRoleValidate(b *azureSecretBackend) *framework.Path {
+	fields := roleFields()
+	delete(fields, "force")
+
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/validate",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixAzure,
+			OperationVerb:   "validate",
+			OperationSuffix: "role",
+		},
+		Fields: fields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleValidate,
+			},
+		},
+		HelpSynopsis:    roleValidateHelpSyn,
+		HelpDescription: roleValidateHelpDesc,
+	}
+}
+
+func (b *azureSecretBackend) pathRoleValidate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.validateRole(ctx, req.Storage, d.Get("name").(string), d)
+}
+
+// validateRole runs the checks of a role write with the fields in d, without
+// saving the role or creating anything in Azure. The response reports the
+// resolved Azure roles and groups, and warnings about the role.
+func (b *azureSecretBackend) validateRole(ctx context.Context, s logical.Storage, name string, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	role, err := getRole(ctx, name, s)
+	if err != nil {
+		return nil, fmt.Errorf("error reading role: %w", err)
+	}
+
+	var op logical.Operation = logical.UpdateOperation
+	if role == nil {
+		op = logical.CreateOperation
+		role = &roleEntry{
+			CredentialType: credentialTypeSP,
+		}
+	}
+	prev := *role
+
+	if resp, err := b.updateRoleEntry(ctx, client, op, d, role); resp != nil || err != nil {
+		return resp, err
+	}
+
+	errResp, warnings := verifyRolePermissions(ctx, client, config, role)
+	if errResp != nil {
+		return errResp, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":           name,
+			"exists":         op == logical.UpdateOperation,
+			"azure_roles":    role.AzureRoles,
+			"azure_groups":   role.AzureGroups,
+			"application_id": role.ApplicationID,
+		},
+	}
+
+	if role.ApplicationObjectID != "" && !role.PersistApp && (len(role.AzureRoles) > 0 || len(role.AzureGroups) > 0) {
+		resp.AddWarning("azure_roles and azure_groups are not assigned to the existing application of application_object_id")
+	}
+	if role.isTemplated() {
+		resp.AddWarning("identity templates in scopes and groups are only resolved when credentials are generated")
+	}
+	if role.PersistApp && prev.ManagedApplicationObjectID == "" {
+		resp.AddWarning("a persisted app would be created for the role")
+	}
+	if prev.ManagedApplicationObjectID != "" && !role.PersistApp && role.ApplicationObjectID != prev.ManagedApplicationObjectID {
+		resp.AddWarning(fmt.Sprintf("persisted app %q would be retired", prev.ManagedApplicationObjectID))
+	}
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	return resp, nil
+}
+
+const roleValidateHelpSyn = `Validate a role without saving it.`
+const roleValidateHelpDesc = `
+This path takes the same fields as "roles/<name>" and runs every check of a role
+write, including looking up the Azure roles and groups, without saving the role
+or creating a persisted app. If the role exists, the fields are validated as an
+update of it.
+
+The response reports the Azure roles and groups as they resolve, including the
+IDs their names were looked up to, and warnings about the role. As on a role
+write, the permissions of the configured identity to assign the Azure roles are
+checked according to the verify_role_permissions config.
+`
@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleValidate(t *testing.T) {
+	t.Run("valid role", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		mp := getMockProvider(t, b, s)
+		apps := len(mp.applications)
+
+		resp := testRoleValidate(t, b, s, "test_role", map[string]interface{}{
+			"azure_roles": compactJSON(`[
+				{
+					"role_name": "Owner",
+					"scope":  "/subscriptions/FAKE_SUB_ID"
+				}]`),
+			"azure_groups": compactJSON(`[{"group_name": "foo"}]`),
+			"persist_app":  true,
+		})
+		assertRespNoError(t, resp, nil)
+
+		equal(t, false, resp.Data["exists"])
+		roles := resp.Data["azure_roles"].([]*AzureRole)
+		equal(t, "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner", roles[0].RoleID)
+		groups := resp.Data["azure_groups"].([]*AzureGroup)
+		equal(t, "00000000-1111-2222-3333-444444444444FAKE_GROUP-foo", groups[0].ObjectID)
+		equal(t, []string{"a persisted app would be created for the role"}, resp.Warnings)
+
+		// Nothing is saved or created
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		if role != nil {
+			t.Fatal("expected role not to be saved")
+		}
+		equal(t, apps, len(mp.applications))
+	})
+
+	t.Run("existing role", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testRoleCreate(t, b, s, "test_role", testPersistedRole)
+
+		role, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+
+		resp := testRoleValidate(t, b, s, "test_role", map[string]interface{}{
+			"persist_app": false,
+		})
+		assertRespNoError(t, resp, nil)
+		equal(t, true, resp.Data["exists"])
+		equal(t, 2, len(resp.Data["azure_roles"].([]*AzureRole)))
+		equal(t, []string{`persisted app "` + role.ManagedApplicationObjectID + `" would be retired`}, resp.Warnings)
+
+		// The role and its app are unchanged
+		unchanged, err := getRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, role, unchanged)
+		if !getMockProvider(t, b, s).appExists(role.ManagedApplicationObjectID) {
+			t.Fatal("expected persisted app to be kept")
+		}
+	})
+
+	t.Run("invalid role", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		for name, tc := range map[string]struct {
+			data map[string]interface{}
+			msg  string
+		}{
+			"ambiguous role": {
+				data: map[string]interface{}{
+					"azure_roles": compactJSON(`[{"role_name": "multiple", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+				},
+				msg: "multiple matches found for role_name",
+			},
+			"ambiguous group": {
+				data: map[string]interface{}{
+					"azure_groups": compactJSON(`[{"group_name": "multiple"}]`),
+				},
+				msg: "multiple matches found for group_name",
+			},
+			"duplicate role": {
+				data: map[string]interface{}{
+					"azure_roles": compactJSON(`[
+						{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"},
+						{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+				},
+				msg: "duplicate role_id and scope",
+			},
+			"ttl": {
+				data: map[string]interface{}{
+					"azure_roles": compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+					"ttl":         120,
+					"max_ttl":     60,
+				},
+				msg: "ttl cannot be greater than max_ttl",
+			},
+			"audience": {
+				data: map[string]interface{}{
+					"azure_roles":      compactJSON(`[{"role_name": "Owner", "scope": "/subscriptions/FAKE_SUB_ID"}]`),
+					"sign_in_audience": "Everyone",
+				},
+				msg: "Invalid value for sign_in_audience field",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp := testRoleValidate(t, b, s, "test_role", tc.data)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+}
+
+func testRoleValidate(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, d map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/" + name + "/validate",
+		Data:      d,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	return resp
+}
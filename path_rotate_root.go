@@ -105,6 +105,13 @@ func (b *azureSecretBackend) pathRotateRoot(ctx context.Context, req *logical.Re
 
 	b.updatePassword = true
 
+	b.sendEvent(ctx, eventRotateRoot,
+		logical.EventMetadataOperation, "rotate",
+		logical.EventMetadataModified, "true",
+		"app_object_id", app.AppObjectID,
+		"client_id", config.ClientID,
+	)
+
 	err = framework.DeleteWAL(ctx, req.Storage, walID)
 	if err != nil {
 		b.Logger().Error("rotate root", "delete wal", err)
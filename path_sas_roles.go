@@ -0,0 +1,521 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	sasRolesStoragePath = "sas-roles"
+
+	// Values of sas_type
+	sasTypeAccount        = "account"
+	sasTypeUserDelegation = "user_delegation"
+
+	defaultSASTTL = time.Hour
+
+	// maxUserDelegationTTL is the longest a user delegation key, and so a user
+	// delegation SAS, can be valid.
+	maxUserDelegationTTL = 7 * 24 * time.Hour
+
+	// sasClockSkew is how long before the request SAS tokens are valid from,
+	// to allow for clock skew between Vault and Azure.
+	sasClockSkew = 5 * time.Minute
+)
+
+// sasRoleEntry is a role that issues SAS tokens for a storage account.
+type sasRoleEntry struct {
+	StorageAccountID string        `json:"storage_account_id"`
+	AccountName      string        `json:"account_name"`
+	BlobEndpoint     string        `json:"blob_endpoint"`
+	SASType          string        `json:"sas_type"`
+	Services         []string      `json:"services"`
+	ResourceTypes    []string      `json:"resource_types"`
+	Container        string        `json:"container"`
+	Permissions      string        `json:"permissions"`
+	IPRanges         []string      `json:"ip_ranges"`
+	SigningKey       string        `json:"signing_key"`
+	TTL              time.Duration `json:"ttl"`
+}
+
+func pathsSASRole(b *azureSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "sas-roles/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "sas-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the SAS role.",
+				},
+				"storage_account_id": {
+					Type:        framework.TypeString,
+					Description: "Resource ID of the storage account that SAS tokens are issued for.",
+				},
+				"sas_type": {
+					Type:          framework.TypeString,
+					Description:   `Type of SAS tokens to issue. Either "account", signed with an account key, or "user_delegation", signed with a user delegation key of the configured identity. Defaults to "account".`,
+					AllowedValues: []interface{}{sasTypeAccount, sasTypeUserDelegation},
+				},
+				"services": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Services an account SAS grants access to: blob, file, queue or table. Defaults to blob.",
+				},
+				"resource_types": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Resource types an account SAS grants access to: service, container or object.",
+				},
+				"container": {
+					Type:        framework.TypeString,
+					Description: "Blob container a user delegation SAS grants access to.",
+				},
+				"permissions": {
+					Type:        framework.TypeString,
+					Description: `Permissions granted by the SAS, as the letters of the storage SAS permissions, for example "rl".`,
+				},
+				"ip_ranges": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: `IPv4 addresses or ranges, such as "10.0.0.1-10.0.0.255", that SAS tokens may be used from. A token is limited to one of them.`,
+				},
+				"signing_key": {
+					Type:          framework.TypeString,
+					Description:   `Account key that account SAS tokens are signed with. Either "key1" or "key2". Defaults to "key1".`,
+					AllowedValues: []interface{}{storageKey1, storageKey2},
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum time SAS tokens are valid for. Defaults to 1 hour. User delegation SAS tokens are valid for at most 7 days.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathSASRoleRead,
+				logical.CreateOperation: b.pathSASRoleUpdate,
+				logical.UpdateOperation: b.pathSASRoleUpdate,
+				logical.DeleteOperation: b.pathSASRoleDelete,
+			},
+			HelpSynopsis:    sasRoleHelpSyn,
+			HelpDescription: sasRoleHelpDesc,
+			ExistenceCheck:  b.pathSASRoleExistenceCheck,
+		},
+		{
+			Pattern: "sas-roles/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "sas-roles",
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathSASRoleList,
+			},
+			HelpSynopsis:    sasRoleListHelpSyn,
+			HelpDescription: sasRoleListHelpDesc,
+		},
+		{
+			Pattern: "sas/" + framework.GenericNameRegex("role"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "request",
+				OperationSuffix: "sas-token",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the SAS role.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time the SAS token is valid for. Defaults to, and may not exceed, the ttl of the role.",
+				},
+				"ip_range": {
+					Type:        framework.TypeString,
+					Description: "IPv4 address or range the SAS token may be used from. Must be within one of the ip_ranges of the role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathSASRead,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathSASRead,
+				},
+			},
+			HelpSynopsis:    sasHelpSyn,
+			HelpDescription: sasHelpDesc,
+		},
+	}
+}
+
+func (b *azureSecretBackend) pathSASRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getSASRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *azureSecretBackend) pathSASRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getSASRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"storage_account_id": role.StorageAccountID,
+			"account_name":       role.AccountName,
+			"sas_type":           role.SASType,
+			"services":           role.Services,
+			"resource_types":     role.ResourceTypes,
+			"container":          role.Container,
+			"permissions":        role.Permissions,
+			"ip_ranges":          role.IPRanges,
+			"signing_key":        role.SigningKey,
+			"ttl":                int64(role.TTL.Seconds()),
+		},
+	}, nil
+}
+
+func (b *azureSecretBackend) pathSASRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, sasRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getSASRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, fmt.Errorf("SAS role entry not found during update operation")
+		}
+		role = &sasRoleEntry{
+			SASType:    sasTypeAccount,
+			SigningKey: storageKey1,
+			TTL:        defaultSASTTL,
+		}
+	}
+
+	if sasType, ok := d.GetOk("sas_type"); ok {
+		role.SASType = sasType.(string)
+	}
+	if services, ok := d.GetOk("services"); ok {
+		role.Services = services.([]string)
+	}
+	if resourceTypes, ok := d.GetOk("resource_types"); ok {
+		role.ResourceTypes = resourceTypes.([]string)
+	}
+	if container, ok := d.GetOk("container"); ok {
+		role.Container = container.(string)
+	}
+	if permissions, ok := d.GetOk("permissions"); ok {
+		role.Permissions = permissions.(string)
+	}
+	if ipRanges, ok := d.GetOk("ip_ranges"); ok {
+		role.IPRanges = ipRanges.([]string)
+	}
+	if signingKey, ok := d.GetOk("signing_key"); ok {
+		role.SigningKey = signingKey.(string)
+	}
+	if ttl, ok := d.GetOk("ttl"); ok {
+		role.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if role.SASType == sasTypeAccount && len(role.Services) == 0 {
+		role.Services = []string{"blob"}
+	}
+
+	if err := validateSASRole(role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	accountID := d.Get("storage_account_id").(string)
+	if accountID == "" && role.StorageAccountID == "" {
+		return logical.ErrorResponse("storage_account_id is required"), nil
+	}
+	if accountID != "" && accountID != role.StorageAccountID {
+		c, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		account, err := c.provider.GetStorageAccount(ctx, accountID)
+		if err != nil {
+			return logical.ErrorResponse("unable to look up storage account %q: %s", accountID, err), nil
+		}
+		if account.Name == nil || account.Properties == nil || account.Properties.PrimaryEndpoints == nil ||
+			account.Properties.PrimaryEndpoints.Blob == nil {
+			return logical.ErrorResponse("storage account %q has no blob endpoint", accountID), nil
+		}
+		role.StorageAccountID = accountID
+		role.AccountName = *account.Name
+		role.BlobEndpoint = *account.Properties.PrimaryEndpoints.Blob
+	}
+
+	if err := saveSASRole(ctx, req.Storage, role, name); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// validateSASRole checks that the fields of the role are valid for its type
+// of SAS, and normalizes its permissions.
+func validateSASRole(role *sasRoleEntry) error {
+	var allowedPermissions string
+	switch role.SASType {
+	case sasTypeAccount:
+		if _, err := sasLetters(role.Services, sasServices, sasServiceOrder); err != nil {
+			return fmt.Errorf("invalid services: %w", err)
+		}
+		if len(role.ResourceTypes) == 0 {
+			return fmt.Errorf("resource_types is required for account SAS roles")
+		}
+		if _, err := sasLetters(role.ResourceTypes, sasResourceTypes, sasResourceTypeOrder); err != nil {
+			return fmt.Errorf("invalid resource_types: %w", err)
+		}
+		if role.Container != "" {
+			return fmt.Errorf("container can only be used with user delegation SAS roles")
+		}
+		if role.SigningKey != storageKey1 && role.SigningKey != storageKey2 {
+			return fmt.Errorf("signing_key must be %q or %q", storageKey1, storageKey2)
+		}
+		allowedPermissions = accountSASPermissions
+	case sasTypeUserDelegation:
+		if role.Container == "" {
+			return fmt.Errorf("container is required for user delegation SAS roles")
+		}
+		if len(role.ResourceTypes) > 0 {
+			return fmt.Errorf("resource_types can only be used with account SAS roles")
+		}
+		for _, s := range role.Services {
+			if !strings.EqualFold(s, "blob") {
+				return fmt.Errorf("user delegation SAS roles only support the blob service")
+			}
+		}
+		if role.TTL > maxUserDelegationTTL {
+			return fmt.Errorf("ttl of user delegation SAS roles can't exceed %s", maxUserDelegationTTL)
+		}
+		allowedPermissions = containerSASPermissions
+	default:
+		return fmt.Errorf("sas_type must be %q or %q", sasTypeAccount, sasTypeUserDelegation)
+	}
+
+	permissions, err := normalizeSASPermissions(role.Permissions, allowedPermissions)
+	if err != nil {
+		return err
+	}
+	role.Permissions = permissions
+
+	for _, r := range role.IPRanges {
+		if _, _, err := parseSASIPRange(r); err != nil {
+			return fmt.Errorf("invalid ip_ranges: %w", err)
+		}
+	}
+
+	if role.TTL <= 0 {
+		return fmt.Errorf("ttl must be greater than 0")
+	}
+
+	return nil
+}
+
+func (b *azureSecretBackend) pathSASRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", sasRolesStoragePath, name)); err != nil {
+		return nil, fmt.Errorf("error deleting SAS role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathSASRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, sasRolesStoragePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing SAS roles: %w", err)
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+// pathSASRead issues a SAS token for a SAS role. The token is not leased; it
+// is valid until it expires.
+func (b *azureSecretBackend) pathSASRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("role").(string)
+
+	role, err := getSASRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("SAS role %q does not exist", name), nil
+	}
+
+	ttl := role.TTL
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		ttl = time.Duration(ttlRaw.(int)) * time.Second
+		if ttl <= 0 || ttl > role.TTL {
+			return logical.ErrorResponse("ttl must be greater than 0 and no more than the ttl of the role, %s", role.TTL), nil
+		}
+	}
+
+	ipRange, err := sasIPRange(role, d.Get("ip_range").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	token := sasToken{
+		Permissions: role.Permissions,
+		Start:       now.Add(-sasClockSkew),
+		Expiry:      now.Add(ttl),
+		IPRange:     ipRange,
+	}
+
+	data := map[string]interface{}{
+		"account_name": role.AccountName,
+		"sas_type":     role.SASType,
+		"expiration":   token.Expiry,
+	}
+
+	switch role.SASType {
+	case sasTypeUserDelegation:
+		key, err := c.provider.GetUserDelegationKey(ctx, role.BlobEndpoint, token.Start, token.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("error getting user delegation key of storage account %q: %w", role.StorageAccountID, err)
+		}
+		sas, err := signUserDelegationSAS(role.AccountName, role.Container, key, token)
+		if err != nil {
+			return nil, err
+		}
+		data["sas_token"] = sas
+		data["url"] = strings.TrimSuffix(role.BlobEndpoint, "/") + "/" + role.Container + "?" + sas
+	default:
+		keys, err := c.provider.ListStorageAccountKeys(ctx, role.StorageAccountID)
+		if err != nil {
+			return nil, fmt.Errorf("error listing keys of storage account %q: %w", role.StorageAccountID, err)
+		}
+		key := findStorageAccountKey(keys, role.SigningKey)
+		if key == "" {
+			return nil, fmt.Errorf("key %q of storage account %q not found", role.SigningKey, role.StorageAccountID)
+		}
+		sas, err := signAccountSAS(role.AccountName, key, role.Services, role.ResourceTypes, token)
+		if err != nil {
+			return nil, err
+		}
+		data["sas_token"] = sas
+	}
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+// sasIPRange returns the IP range of a SAS token. The requested range must be
+// within one of the ranges of the role. If none is requested, the single range
+// of the role is used.
+func sasIPRange(role *sasRoleEntry, requested string) (string, error) {
+	if requested == "" {
+		switch len(role.IPRanges) {
+		case 0:
+			return "", nil
+		case 1:
+			return role.IPRanges[0], nil
+		default:
+			return "", fmt.Errorf("ip_range is required, as the role allows several IP ranges")
+		}
+	}
+
+	if _, _, err := parseSASIPRange(requested); err != nil {
+		return "", err
+	}
+	if len(role.IPRanges) == 0 {
+		return requested, nil
+	}
+	for _, r := range role.IPRanges {
+		if sasIPRangeWithin(requested, r) {
+			return requested, nil
+		}
+	}
+
+	return "", fmt.Errorf("ip_range %q is not within the ip_ranges of the role", requested)
+}
+
+func saveSASRole(ctx context.Context, s logical.Storage, role *sasRoleEntry, name string) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", sasRolesStoragePath, name), role)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getSASRole(ctx context.Context, name string, s logical.Storage) (*sasRoleEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", sasRolesStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading SAS role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(sasRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const sasRoleHelpSyn = "Manage the roles used to issue storage SAS tokens."
+const sasRoleHelpDesc = `
+This path allows you to read and write SAS roles. A SAS role defines the shared
+access signatures (SAS) that are issued for a storage account from "sas/<role>":
+their type, the services, resource types or container they grant access to,
+their permissions, the IP ranges they may be used from, and their maximum ttl.
+
+Account SAS tokens are signed with an access key of the account, given by
+signing_key. They are invalidated when that key is regenerated, including by a
+storage role that manages the keys of the account.
+
+User delegation SAS tokens grant access to a blob container and are signed with
+a user delegation key of the configured identity, which needs permission to
+generate user delegation keys and to access the data that the tokens grant
+access to. They are valid for at most 7 days.
+`
+
+const sasRoleListHelpSyn = `List existing SAS roles.`
+const sasRoleListHelpDesc = `List existing SAS roles by name.`
+
+const sasHelpSyn = `Issue a storage SAS token.`
+const sasHelpDesc = `
+This path issues a SAS token for the storage account of a SAS role, with the
+services, resource types or container and the permissions of the role. Tokens
+only allow HTTPS and are valid from a few minutes before the request, to allow
+for clock skew, until the requested ttl, which can't exceed the ttl of the role.
+
+If the role has IP ranges, the token is limited to the requested ip_range, which
+must be within one of them, or to the single IP range of the role.
+
+The token is not leased and can't be revoked before it expires.
+`
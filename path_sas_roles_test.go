@@ -0,0 +1,307 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testUserDelegationKey is the base64 encoded user delegation key of the mock
+// provider.
+const testUserDelegationKey = "dXNlci1kZWxlZ2F0aW9uLWtleQ=="
+
+func TestSASRole(t *testing.T) {
+	t.Run("account SAS", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testSASRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"services":           "queue,blob",
+			"resource_types":     "object,container",
+			"permissions":        "lr",
+			"ttl":                1800,
+		})
+
+		resp := testSASRoleRead(t, b, s, "sas-roles/test_role")
+		equal(t, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"account_name":       "fakestorage",
+			"sas_type":           "account",
+			"services":           []string{"queue", "blob"},
+			"resource_types":     []string{"object", "container"},
+			"container":          "",
+			"permissions":        "rl",
+			"ip_ranges":          []string(nil),
+			"signing_key":        "key1",
+			"ttl":                int64(1800),
+		}, resp.Data)
+
+		resp = testSASRoleRead(t, b, s, "sas/test_role")
+		q := parseSASToken(t, resp)
+		equal(t, "bq", q.Get("ss"))
+		equal(t, "co", q.Get("srt"))
+		equal(t, "rl", q.Get("sp"))
+		equal(t, "https", q.Get("spr"))
+		equal(t, "", q.Get("sip"))
+		assertSASExpiry(t, q, resp, 30*time.Minute)
+
+		stringToSign := strings.Join([]string{
+			"fakestorage", "rl", "bq", "co", q.Get("st"), q.Get("se"), "", "https", sasVersion, "", "",
+		}, "\n")
+		equal(t, testSASSignature(t, testStorageKey1, stringToSign), q.Get("sig"))
+	})
+
+	t.Run("user delegation SAS", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testSASRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"sas_type":           "user_delegation",
+			"container":          "pipeline",
+			"permissions":        "wr",
+			"ip_ranges":          "10.0.0.0-10.0.0.255",
+		})
+
+		resp := testSASRoleRead(t, b, s, "sas/test_role")
+		q := parseSASToken(t, resp)
+		equal(t, "c", q.Get("sr"))
+		equal(t, "rw", q.Get("sp"))
+		equal(t, "10.0.0.0-10.0.0.255", q.Get("sip"))
+		equal(t, "FAKE_OID", q.Get("skoid"))
+		equal(t, "FAKE_TID", q.Get("sktid"))
+		assertSASExpiry(t, q, resp, time.Hour)
+		if !strings.HasPrefix(resp.Data["url"].(string), "https://fakestorage.blob.core.windows.net/pipeline?") {
+			t.Fatalf("unexpected url: %s", resp.Data["url"])
+		}
+
+		stringToSign := strings.Join([]string{
+			"rw", q.Get("st"), q.Get("se"), "/blob/fakestorage/pipeline", "FAKE_OID", "FAKE_TID",
+			q.Get("skt"), q.Get("ske"), "b", storageServiceVersion, "", "", "",
+			"10.0.0.0-10.0.0.255", "https", sasVersion, "c", "", "", "", "", "", "", "",
+		}, "\n")
+		equal(t, testSASSignature(t, testUserDelegationKey, stringToSign), q.Get("sig"))
+	})
+
+	t.Run("token ttl and ip range", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testSASRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"resource_types":     "object",
+			"permissions":        "r",
+			"ip_ranges":          "10.0.0.0-10.0.0.255,192.168.1.10",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sas/test_role",
+			Data: map[string]interface{}{
+				"ttl":      600,
+				"ip_range": "10.0.0.5-10.0.0.10",
+			},
+			Storage: s,
+		})
+		assertRespNoError(t, resp, err)
+		q := parseSASToken(t, resp)
+		equal(t, "10.0.0.5-10.0.0.10", q.Get("sip"))
+		assertSASExpiry(t, q, resp, 10*time.Minute)
+
+		for name, tc := range map[string]struct {
+			data map[string]interface{}
+			msg  string
+		}{
+			"ttl above role": {
+				data: map[string]interface{}{"ttl": 7200, "ip_range": "192.168.1.10"},
+				msg:  "no more than the ttl of the role",
+			},
+			"ip range required": {
+				data: map[string]interface{}{},
+				msg:  "ip_range is required",
+			},
+			"ip range outside role": {
+				data: map[string]interface{}{"ip_range": "10.0.0.200-10.0.1.10"},
+				msg:  "not within the ip_ranges of the role",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.UpdateOperation,
+					Path:      "sas/test_role",
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+
+	t.Run("invalid roles", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		for name, tc := range map[string]struct {
+			data map[string]interface{}
+			msg  string
+		}{
+			"missing account": {
+				data: map[string]interface{}{"resource_types": "object", "permissions": "r"},
+				msg:  "storage_account_id is required",
+			},
+			"unknown account": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID + "-missing", "resource_types": "object", "permissions": "r"},
+				msg:  "unable to look up storage account",
+			},
+			"missing resource types": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "permissions": "r"},
+				msg:  "resource_types is required",
+			},
+			"unknown service": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "services": "blob,disk", "resource_types": "object", "permissions": "r"},
+				msg:  `unknown value "disk"`,
+			},
+			"invalid permission": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "resource_types": "object", "permissions": "rm"},
+				msg:  "invalid permission",
+			},
+			"missing permissions": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "resource_types": "object"},
+				msg:  "permissions are required",
+			},
+			"invalid ip range": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "resource_types": "object", "permissions": "r", "ip_ranges": "10.0.0.10-10.0.0.1"},
+				msg:  "start is after end",
+			},
+			"container with account SAS": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "resource_types": "object", "permissions": "r", "container": "c"},
+				msg:  "container can only be used",
+			},
+			"user delegation without container": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "sas_type": "user_delegation", "permissions": "r"},
+				msg:  "container is required",
+			},
+			"user delegation with other services": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "sas_type": "user_delegation", "container": "c", "services": "file", "permissions": "r"},
+				msg:  "only support the blob service",
+			},
+			"user delegation ttl": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "sas_type": "user_delegation", "container": "c", "permissions": "r", "ttl": "200h"},
+				msg:  "can't exceed",
+			},
+			"invalid sas type": {
+				data: map[string]interface{}{"storage_account_id": testStorageAccountID, "sas_type": "service", "permissions": "r"},
+				msg:  "sas_type must be",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.CreateOperation,
+					Path:      "sas-roles/test_role",
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+
+	t.Run("list and delete", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testSASRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"resource_types":     "object",
+			"permissions":        "r",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "sas-roles/",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		equal(t, []string{"test_role"}, resp.Data["keys"])
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "sas-roles/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "sas/test_role",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected error for a deleted SAS role, got: %v", resp)
+		}
+	})
+}
+
+func testSASRoleWrite(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "sas-roles/" + name,
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
+
+func testSASRoleRead(t *testing.T, b *azureSecretBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	if resp == nil {
+		t.Fatalf("expected a response from %s", path)
+	}
+
+	return resp
+}
+
+func parseSASToken(t *testing.T, resp *logical.Response) url.Values {
+	t.Helper()
+	q, err := url.ParseQuery(resp.Data["sas_token"].(string))
+	assertErrorIsNil(t, err)
+	equal(t, sasVersion, q.Get("sv"))
+
+	return q
+}
+
+func assertSASExpiry(t *testing.T, q url.Values, resp *logical.Response, ttl time.Duration) {
+	t.Helper()
+	expiry, err := time.Parse(sasTimeFormat, q.Get("se"))
+	assertErrorIsNil(t, err)
+	equal(t, expiry, resp.Data["expiration"].(time.Time))
+	if d := time.Until(expiry); d > ttl || d < ttl-time.Minute {
+		t.Fatalf("expected the token to expire in %s, expires in %s", ttl, d)
+	}
+}
+
+func testSASSignature(t *testing.T, key, stringToSign string) string {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	assertErrorIsNil(t, err)
+	h := hmac.New(sha256.New, decoded)
+	h.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -7,11 +7,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
 	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-secrets-azure/api"
 )
 
 const (
@@ -26,7 +32,7 @@ func secretServicePrincipal(b *azureSecretBackend) *framework.Secret {
 	return &framework.Secret{
 		Type:   SecretTypeSP,
 		Renew:  b.spRenew,
-		Revoke: b.spRevoke,
+		Revoke: measureRevoke(b.spRevoke),
 	}
 }
 
@@ -34,7 +40,7 @@ func secretStaticServicePrincipal(b *azureSecretBackend) *framework.Secret {
 	return &framework.Secret{
 		Type:   SecretTypeStaticSP,
 		Renew:  b.spRenew,
-		Revoke: b.staticSPRevoke,
+		Revoke: measureRevoke(b.staticSPRevoke),
 	}
 }
 
@@ -51,10 +57,19 @@ func pathServicePrincipal(b *azureSecretBackend) *framework.Path {
 				Type:        framework.TypeLowerCaseString,
 				Description: "Name of the Vault role",
 			},
+			"scopes": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Scopes to assign the role's Azure roles at instead of their configured scopes. Each scope must match one of the role's allowed_scopes.",
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
-				Callback:                    b.pathSPRead,
+				Callback:                    measureIssue(b.pathSPRead),
+				ForwardPerformanceSecondary: true,
+				ForwardPerformanceStandby:   true,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    measureIssue(b.pathSPRead),
 				ForwardPerformanceSecondary: true,
 				ForwardPerformanceStandby:   true,
 			},
@@ -74,6 +89,12 @@ func (b *azureSecretBackend) pathSPRead(ctx context.Context, req *logical.Reques
 
 	roleName := d.Get("role").(string)
 
+	// Hold the role lock so the role can't be deleted before the lease is
+	// tracked.
+	lock := locksutil.LockForKey(b.roleLocks, roleName)
+	lock.RLock()
+	defer lock.RUnlock()
+
 	role, err := getRole(ctx, roleName, req.Storage)
 	if err != nil {
 		return nil, err
@@ -83,29 +104,95 @@ func (b *azureSecretBackend) pathSPRead(ctx context.Context, req *logical.Reques
 		return logical.ErrorResponse(fmt.Sprintf("role '%s' does not exist", roleName)), nil
 	}
 
+	// Render any identity templates for the requesting entity. The role is not
+	// saved, so the rendered scopes and groups only apply to this secret.
+	if role.isTemplated() {
+		if err := b.renderRoleTemplates(ctx, client, req.EntityID, role); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	// Select the groups that match the group filters of the role, if any.
+	if role.hasGroupFilters() {
+		groups, err := client.resolveGroupFilters(ctx, role.AzureGroups)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		role.AzureGroups = groups
+	}
+
+	// Narrow the Azure role assignments to the requested scopes, if any.
+	if scopes, ok := d.GetOk("scopes"); ok {
+		if role.ApplicationObjectID != "" {
+			return logical.ErrorResponse("scopes can only be requested for dynamic service principals"), nil
+		}
+
+		narrowed, err := narrowAzureRoles(role, scopes.([]string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		role.AzureRoles = narrowed
+	}
+
+	// Serialize issuing credentials for the role so the number of active
+	// credentials can't be exceeded by concurrent requests.
+	if role.MaxActiveCredentials > 0 {
+		issueLock := locksutil.LockForKey(b.issueLocks, roleName)
+		issueLock.Lock()
+		defer issueLock.Unlock()
+	}
+
+	if err := b.checkIssueLimits(ctx, req.Storage, roleName, role); err != nil {
+		if errors.Is(err, errIssueLimit) {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
 	var resp *logical.Response
 
-	if role.ApplicationObjectID != "" {
+	switch {
+	case role.CredentialType == credentialTypeManagedIdentity:
+		resp, err = b.createManagedIdentitySecret(ctx, req, client, roleName, role)
+	case role.ApplicationObjectID != "":
 		resp, err = b.createStaticSPSecret(ctx, client, roleName, role)
-	} else {
-		resp, err = b.createSPSecret(ctx, req.Storage, client, roleName, role)
+	default:
+		resp, err = b.createSPSecret(ctx, req, client, roleName, role, SecretTypeSP)
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err := trackLease(ctx, req.Storage, roleName, resp); err != nil {
+		err = fmt.Errorf("error tracking lease: %w", err)
+		if revokeErr := b.revokeUntrackedSecret(ctx, req.Storage, resp.Secret); revokeErr != nil {
+			err = multierror.Append(err, fmt.Errorf("error revoking credentials: %w", revokeErr))
+		}
+		return nil, err
+	}
+
+	b.sendSecretEvent(ctx, eventCredsCreate, "create", resp.Secret)
+
 	resp.Secret.TTL = role.TTL
 	resp.Secret.MaxTTL = role.MaxTTL
 	return resp, nil
 }
 
-// createSPSecret generates a new App/Service Principal.
-func (b *azureSecretBackend) createSPSecret(ctx context.Context, s logical.Storage, c *client, roleName string, role *roleEntry) (*logical.Response, error) {
+// createSPSecret generates a new App/Service Principal, returned as a secret
+// of the given type. Secrets of every type are revoked by spRevoke.
+func (b *azureSecretBackend) createSPSecret(ctx context.Context, req *logical.Request, c *client, roleName string, role *roleEntry, secretType string) (*logical.Response, error) {
+	s := req.Storage
+
+	params, err := b.newApplication(ctx, req, roleName, role)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create the App, which is the top level object to be tracked in the secret
 	// and deleted upon revocation. If any subsequent step fails, the App will be
 	// deleted as part of WAL rollback.
-	app, err := c.createApp(ctx, role.SignInAudience, role.Tags)
+	app, err := c.createApp(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -123,7 +210,7 @@ func (b *azureSecretBackend) createSPSecret(ctx context.Context, s logical.Stora
 	}
 
 	// Create a service principal associated with the new App
-	spID, password, err := c.createSP(ctx, app, spExpiration)
+	spID, password, err := c.createSP(ctx, app, role.CustomSecurityAttributes, spExpiration)
 	if err != nil {
 		return nil, err
 	}
@@ -173,11 +260,177 @@ func (b *azureSecretBackend) createSPSecret(ctx context.Context, s logical.Stora
 		"sp_object_id":         spID,
 		"role_assignment_ids":  raIDs,
 		"group_membership_ids": groupObjectIDs(role.AzureGroups),
+		"group_owner_ids":      groupOwnerObjectIDs(role.AzureGroups),
+		"scopes":               roleScopes(role.AzureRoles),
 		"role":                 roleName,
 		"permanently_delete":   role.PermanentlyDelete,
 	}
 
-	return b.Secret(SecretTypeSP).Response(data, internalData), nil
+	return b.Secret(secretType).Response(data, internalData), nil
+}
+
+// renderRoleTemplates renders the identity templates in the role's scopes,
+// allowed scopes and groups using the requesting entity. Templated groups are
+// then looked up by ID or name, as is done for other groups when the role is
+// written.
+func (b *azureSecretBackend) renderRoleTemplates(ctx context.Context, c *client, entityID string, role *roleEntry) error {
+	if entityID == "" {
+		return errors.New("role uses identity templates but the request has no entity")
+	}
+
+	entity, err := b.System().EntityInfo(entityID)
+	if err != nil {
+		return fmt.Errorf("error loading entity: %w", err)
+	}
+	if entity == nil {
+		return fmt.Errorf("entity %q not found", entityID)
+	}
+
+	groups, err := b.System().GroupsForEntity(entityID)
+	if err != nil {
+		return fmt.Errorf("error loading groups for entity: %w", err)
+	}
+
+	// Each directive is rendered on its own, so that its value can be checked
+	// or escaped for where it is used before it is put in the string.
+	render := func(s string, value func(string) (string, error)) (string, error) {
+		if !hasTemplate(s) {
+			return s, nil
+		}
+
+		var renderErr error
+		rendered := templateDirectiveRegex.ReplaceAllStringFunc(s, func(directive string) string {
+			if renderErr != nil {
+				return ""
+			}
+
+			_, v, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+				String:      directive,
+				Mode:        identitytpl.ACLTemplating,
+				Entity:      entity,
+				Groups:      groups,
+				NamespaceID: entity.NamespaceID,
+			})
+			if err == nil {
+				v, err = value(v)
+			}
+			if err != nil {
+				renderErr = fmt.Errorf("error rendering template %q: %w", s, err)
+			}
+			return v
+		})
+		if renderErr != nil {
+			return "", renderErr
+		}
+		return rendered, nil
+	}
+
+	azureRoles := make([]*AzureRole, 0, len(role.AzureRoles))
+	for _, r := range role.AzureRoles {
+		scope, err := render(r.Scope, scopeSegment)
+		if err != nil {
+			return err
+		}
+		azureRoles = append(azureRoles, &AzureRole{
+			RoleName: r.RoleName,
+			RoleID:   r.RoleID,
+			Scope:    scope,
+		})
+	}
+	role.AzureRoles = azureRoles
+
+	allowedScopes := make([]string, 0, len(role.AllowedScopes))
+	for _, pattern := range role.AllowedScopes {
+		rendered, err := render(pattern, scopeSegment)
+		if err != nil {
+			return err
+		}
+		allowedScopes = append(allowedScopes, rendered)
+	}
+	role.AllowedScopes = allowedScopes
+
+	azureGroups := make([]*AzureGroup, 0, len(role.AzureGroups))
+	for _, g := range role.AzureGroups {
+		if !g.isTemplated() {
+			azureGroups = append(azureGroups, g)
+			continue
+		}
+
+		// Filters are only rendered here, and queried once all groups are
+		// rendered.
+		if g.Filter != "" {
+			filter, err := render(g.Filter, odataStringValue)
+			if err != nil {
+				return err
+			}
+			azureGroups = append(azureGroups, &AzureGroup{
+				Filter:       filter,
+				MaxMatches:   g.MaxMatches,
+				Relationship: g.Relationship,
+			})
+			continue
+		}
+
+		groupName, err := render(g.GroupName, verbatim)
+		if err != nil {
+			return err
+		}
+		objectID, err := render(g.ObjectID, verbatim)
+		if err != nil {
+			return err
+		}
+
+		group, err := c.lookupGroup(ctx, groupName, objectID)
+		if err != nil {
+			return err
+		}
+		azureGroups = append(azureGroups, &AzureGroup{
+			GroupName:    group.DisplayName,
+			ObjectID:     group.ID,
+			Relationship: g.Relationship,
+		})
+	}
+	role.AzureGroups = azureGroups
+
+	return nil
+}
+
+// templateDirectiveRegex matches an identity template directive.
+var templateDirectiveRegex = regexp.MustCompile(`{{[^{}]*}}`)
+
+// scopeSegment checks that a value rendered in a scope is a single path
+// segment, so that it can't change which resource the scope refers to.
+func scopeSegment(v string) (string, error) {
+	if v == "" || strings.Contains(v, "/") || strings.Contains(v, "..") {
+		return "", fmt.Errorf("value %q can't be used in a scope; it must be a non-empty path segment", v)
+	}
+	return v, nil
+}
+
+// odataStringValue escapes a value rendered in an OData filter, so that it
+// can only be used within a string literal of the filter.
+func odataStringValue(v string) (string, error) {
+	return escapeODataString(v), nil
+}
+
+// verbatim uses a rendered value as is.
+func verbatim(v string) (string, error) {
+	return v, nil
+}
+
+// roleScopes returns the unique scopes that the Azure roles are assigned at.
+func roleScopes(roles []*AzureRole) []string {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, r := range roles {
+		key := strings.ToLower(r.Scope)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		scopes = append(scopes, r.Scope)
+	}
+	return scopes
 }
 
 // createStaticSPSecret adds a new password to the App associated with the role.
@@ -201,7 +454,22 @@ func (b *azureSecretBackend) createStaticSPSecret(ctx context.Context, c *client
 		"role":          roleName,
 	}
 
-	return b.Secret(SecretTypeStaticSP).Response(data, internalData), nil
+	// Writing the password to the sync destinations doesn't fail issuing it, as
+	// the password is returned to the requester either way.
+	var syncErr error
+	if len(role.SyncDestinations) > 0 {
+		var secretIDs []string
+		secretIDs, syncErr = c.syncSecret(ctx, roleName, role.SyncDestinations, password, syncContentTypeClientSecret, map[string]string{
+			"client_id": role.ApplicationID,
+		})
+		internalData["synced_secret_ids"] = secretIDs
+	}
+
+	resp := b.Secret(SecretTypeStaticSP).Response(data, internalData)
+	if syncErr != nil {
+		resp.AddWarning(fmt.Sprintf("error syncing password to key vault: %s", syncErr))
+	}
+	return resp, nil
 }
 
 func (b *azureSecretBackend) spRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -216,13 +484,15 @@ func (b *azureSecretBackend) spRenew(ctx context.Context, req *logical.Request,
 	}
 
 	if role == nil {
-		return nil, nil
+		return nil, fmt.Errorf("role %q has been deleted", roleRaw.(string))
 	}
 
 	resp := &logical.Response{Secret: req.Secret}
 	resp.Secret.TTL = role.TTL
 	resp.Secret.MaxTTL = role.MaxTTL
 
+	b.sendSecretEvent(ctx, eventCredsRenew, "renew", req.Secret)
+
 	return resp, nil
 }
 
@@ -264,7 +534,14 @@ func (b *azureSecretBackend) spRevoke(ctx context.Context, req *logical.Request,
 		}
 	}
 
-	if len(gmIDs) != 0 && spObjectID == "" {
+	var goIDs []string
+	if req.Secret.InternalData["group_owner_ids"] != nil {
+		for _, v := range req.Secret.InternalData["group_owner_ids"].([]interface{}) {
+			goIDs = append(goIDs, v.(string))
+		}
+	}
+
+	if (len(gmIDs) != 0 || len(goIDs) != 0) && spObjectID == "" {
 		return nil, errors.New("internal data 'sp_object_id' not found")
 	}
 
@@ -286,6 +563,10 @@ func (b *azureSecretBackend) spRevoke(ctx context.Context, req *logical.Request,
 		resp.AddWarning(err.Error())
 	}
 
+	if err := c.removeGroupOwnerships(ctx, spObjectID, goIDs); err != nil {
+		resp.AddWarning(err.Error())
+	}
+
 	// removing the service principal is effectively a garbage collection
 	// operation. Errors will be noted but won't fail the revocation process.
 	// Deleting the app, however, *is* required to consider the secret revoked.
@@ -293,8 +574,19 @@ func (b *azureSecretBackend) spRevoke(ctx context.Context, req *logical.Request,
 		resp.AddWarning(err.Error())
 	}
 
-	err = c.deleteApp(ctx, appObjectID, permanentlyDelete)
-	return resp, err
+	// The app may already have been deleted if the leases of the role were
+	// revoked when the role was deleted.
+	if err := c.deleteApp(ctx, appObjectID, permanentlyDelete); err != nil && !api.IsNotFound(err) {
+		return resp, err
+	}
+
+	b.sendSecretEvent(ctx, eventCredsRevoke, "revoke", req.Secret)
+
+	if err := untrackLease(ctx, req.Storage, req.Secret); err != nil {
+		resp.AddWarning(fmt.Sprintf("error removing lease record: %s", err))
+	}
+
+	return resp, nil
 }
 
 func (b *azureSecretBackend) staticSPRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -319,7 +611,48 @@ func (b *azureSecretBackend) staticSPRevoke(ctx context.Context, req *logical.Re
 	lock.Lock()
 	defer lock.Unlock()
 
-	return nil, c.deleteAppPassword(ctx, appObjectID, keyIDRaw.(string))
+	// The app may already have been deleted if the leases of the role were
+	// revoked when the role was deleted.
+	if err := c.deleteAppPassword(ctx, appObjectID, keyIDRaw.(string)); err != nil && !api.IsNotFound(err) {
+		return nil, err
+	}
+
+	b.sendSecretEvent(ctx, eventCredsRevoke, "revoke", req.Secret)
+
+	var secretIDs []string
+	if req.Secret.InternalData["synced_secret_ids"] != nil {
+		for _, v := range req.Secret.InternalData["synced_secret_ids"].([]interface{}) {
+			secretIDs = append(secretIDs, v.(string))
+		}
+	}
+
+	var resp *logical.Response
+
+	// The synced secrets hold the deleted password, so disabling them is a
+	// clean-up operation. Errors will be noted but won't fail the revocation
+	// process.
+	if err := c.disableSyncedSecrets(ctx, secretIDs); err != nil {
+		resp = new(logical.Response)
+		resp.AddWarning(err.Error())
+	}
+
+	if err := untrackLease(ctx, req.Storage, req.Secret); err != nil {
+		if resp == nil {
+			resp = new(logical.Response)
+		}
+		resp.AddWarning(fmt.Sprintf("error removing lease record: %s", err))
+	}
+
+	// Deleting a retired persisted app is a clean-up operation. Errors will be
+	// noted but won't fail the revocation process.
+	if err := b.cleanupRetiredApp(ctx, req.Storage, c, appObjectID); err != nil {
+		if resp == nil {
+			resp = new(logical.Response)
+		}
+		resp.AddWarning(fmt.Sprintf("error deleting retired persisted app: %s", err))
+	}
+
+	return resp, nil
 }
 
 const pathServicePrincipalHelpSyn = `
@@ -331,4 +664,15 @@ This path creates or updates dynamic Service Principal credentials.
 The associated role can be configured to create a new App/Service Principal,
 or add a new password to an existing App. The Service Principal or password
 will be automatically deleted when the lease has expired.
+
+Passwords added to an existing App are also written to the Key Vault secrets
+in the role's sync_destinations, and those secret versions are disabled when
+the lease has expired.
+
+If the role defines allowed_scopes, a list of scopes may be written to this
+path. The role's Azure roles will then only be assigned at those scopes.
+
+Roles with the managed_identity credential type create a user-assigned managed
+identity instead, and return its client ID and principal ID. The identity is
+deleted when the lease has expired.
 `
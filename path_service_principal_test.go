@@ -5,6 +5,7 @@ package azuresecrets
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -282,6 +283,70 @@ func TestSPRead(t *testing.T) {
 		assertClientSecret(t, resp.Data)
 	})
 
+	// verify the application name is rendered from the role's name_template
+	t.Run("Name template", func(t *testing.T) {
+		role := map[string]interface{}{
+			"azure_roles":   testRole["azure_roles"],
+			"name_template": "vault-{{ .RoleName }}-{{ .DisplayName }}",
+		}
+		testRoleCreate(t, b, s, "templated", role)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:   logical.ReadOperation,
+			Path:        "creds/templated",
+			Storage:     s,
+			DisplayName: "token-user",
+		})
+		assertRespNoError(t, resp, err)
+
+		appObjID := resp.Secret.InternalData["app_object_id"].(string)
+		client, err := b.getClient(context.Background(), s)
+		assertErrorIsNil(t, err)
+
+		equal(t, "vault-templated-token-user", client.provider.(*mockProvider).appName(appObjID))
+	})
+
+	t.Run("Application properties", func(t *testing.T) {
+		owner := generateUUID()
+		role := map[string]interface{}{
+			"azure_roles":                  testRole["azure_roles"],
+			"tags":                         "team:platform",
+			"owners":                       owner,
+			"notes":                        "Created by Vault",
+			"description":                  "Deployment pipeline",
+			"service_management_reference": "CHG0001",
+			"custom_security_attributes":   `{"Engineering": {"Project": ["Baker", "Cascade"], "Level": 3, "Active": true}}`,
+		}
+		testRoleCreate(t, b, s, "properties", role)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:           logical.ReadOperation,
+			Path:                "creds/properties",
+			Storage:             s,
+			ClientTokenAccessor: "test-accessor",
+			MountAccessor:       "test-mount-accessor",
+			EntityID:            "test-entity",
+		})
+		assertRespNoError(t, resp, err)
+
+		appObjID := resp.Secret.InternalData["app_object_id"].(string)
+		spObjID := resp.Secret.InternalData["sp_object_id"].(string)
+		client, err := b.getClient(context.Background(), s)
+		assertErrorIsNil(t, err)
+		mp := client.provider.(*mockProvider)
+
+		app := mp.createdApp(appObjID)
+		equal(t, []string{owner}, app.Owners)
+		equal(t, "Created by Vault", app.Notes)
+		equal(t, "Deployment pipeline", app.Description)
+		equal(t, "CHG0001", app.ServiceManagementReference)
+		// The token accessor is never written to tags readable in the tenant
+		equal(t, []string{"team:platform", "vault_mount_accessor:test-mount-accessor", "vault_entity_id:test-entity"}, app.Tags)
+
+		attributes := mp.servicePrincipalAttributes(spObjID)
+		equal(t, 3, len(attributes["Engineering"]))
+	})
+
 	// verify role TTLs are reflected in secret
 	t.Run("TTLs", func(t *testing.T) {
 		name := generateUUID()
@@ -317,6 +382,445 @@ func TestSPRead(t *testing.T) {
 	})
 }
 
+func TestSPReadScopes(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+
+	role := map[string]interface{}{
+		"azure_roles": encodeJSON([]AzureRole{
+			{
+				RoleName: "Owner",
+				RoleID:   "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+				Scope:    "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b",
+			},
+		}),
+		"allowed_scopes": []string{"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-*"},
+	}
+	testRoleCreate(t, b, s, "test_role", role)
+
+	t.Run("Allowed scopes", func(t *testing.T) {
+		scopes := []string{
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a",
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/TEAM-b",
+		}
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/test_role",
+			Data:      map[string]interface{}{"scopes": scopes},
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		raIDs := resp.Secret.InternalData["role_assignment_ids"].([]string)
+		equal(t, 2, len(raIDs))
+		for i, raID := range raIDs {
+			if !strings.HasPrefix(raID, scopes[i]+"/") {
+				t.Fatalf("expected role assignment %q to be at scope %q", raID, scopes[i])
+			}
+		}
+	})
+
+	t.Run("Disallowed scope", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/test_role",
+			Data:      map[string]interface{}{"scopes": "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/other"},
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatal("expected error response for disallowed scope")
+		}
+	})
+
+	t.Run("Invalid scope", func(t *testing.T) {
+		// Each of these matches the allowed scope and is beneath the scope
+		// of the Azure role when compared as a string
+		for _, scope := range []string{
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a/../other",
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a/%2e%2e/other",
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a/./providers",
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a//b",
+			"/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a/b",
+		} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "creds/test_role",
+				Data:      map[string]interface{}{"scopes": scope},
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), "invalid scope") {
+				t.Fatalf("expected an invalid scope error for %q, got: %v", scope, resp)
+			}
+		}
+	})
+
+	t.Run("Role without allowed scopes", func(t *testing.T) {
+		testRoleCreate(t, b, s, "test_role_no_scopes", testRole)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/test_role_no_scopes",
+			Data:      map[string]interface{}{"scopes": "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a"},
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatal("expected error response for role without allowed_scopes")
+		}
+	})
+}
+
+func TestSPReadLimits(t *testing.T) {
+	readCreds := func(t *testing.T, b *azureSecretBackend, s logical.Storage, name string) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		return resp
+	}
+
+	t.Run("Active credentials", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		role := map[string]interface{}{
+			"max_active_credentials": 2,
+		}
+		for k, v := range testRole {
+			role[k] = v
+		}
+		testRoleCreate(t, b, s, "test_role", role)
+
+		var secrets []*logical.Secret
+		for i := 0; i < 2; i++ {
+			resp := readCreds(t, b, s, "test_role")
+			assertRespNoError(t, resp, nil)
+			fakeSaveLoad(resp.Secret)
+			secrets = append(secrets, resp.Secret)
+		}
+
+		resp := readCreds(t, b, s, "test_role")
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "limit of 2 active credentials") {
+			t.Fatalf("expected error about active credentials, got: %v", resp)
+		}
+
+		// Revoking a lease makes room for a new one
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    secrets[0],
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		resp = readCreds(t, b, s, "test_role")
+		assertRespNoError(t, resp, nil)
+	})
+
+	t.Run("Issue rate", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		role := map[string]interface{}{
+			"max_issue_rate": 1,
+		}
+		for k, v := range testRole {
+			role[k] = v
+		}
+		testRoleCreate(t, b, s, "test_role", role)
+
+		resp := readCreds(t, b, s, "test_role")
+		assertRespNoError(t, resp, nil)
+
+		resp = readCreds(t, b, s, "test_role")
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "limit of 1 credentials issued per minute") {
+			t.Fatalf("expected error about issue rate, got: %v", resp)
+		}
+
+		// Raising the limit replaces the rate limiter
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{"max_issue_rate": 2})
+		resp = readCreds(t, b, s, "test_role")
+		assertRespNoError(t, resp, nil)
+	})
+
+	t.Run("Negative limits", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		for _, field := range []string{"max_active_credentials", "max_issue_rate"} {
+			role := map[string]interface{}{
+				field: -1,
+			}
+			for k, v := range testRole {
+				role[k] = v
+			}
+			resp := testRoleCreateBasic(t, b, s, "test_role", role)
+			if !resp.IsError() {
+				t.Fatalf("expected error for negative %s", field)
+			}
+		}
+	})
+}
+
+func TestSPReadTemplated(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+
+	b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+		ID:   "test-entity",
+		Name: "test-entity",
+		Metadata: map[string]string{
+			"resource_group": "team-a",
+			"team":           "devs",
+		},
+	}
+
+	role := map[string]interface{}{
+		"azure_roles": encodeJSON([]AzureRole{
+			{
+				RoleName: "Owner",
+				RoleID:   "/subscriptions/FAKE_SUB_ID/providers/Microsoft.Authorization/roleDefinitions/FAKE_ROLE-Owner",
+				Scope:    "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/{{identity.entity.metadata.resource_group}}",
+			},
+		}),
+		"azure_groups": encodeJSON([]AzureGroup{
+			{
+				GroupName: "{{identity.entity.metadata.team}}",
+			},
+		}),
+	}
+	testRoleCreate(t, b, s, "test_role", role)
+
+	t.Run("Rendered for entity", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+			EntityID:  "test-entity",
+		})
+		assertRespNoError(t, resp, err)
+
+		expScope := "/subscriptions/ce7d1612-67c1-4dc6-8d81-4e0a432e696b/resourceGroups/team-a"
+		equal(t, []string{expScope}, resp.Secret.InternalData["scopes"])
+
+		raIDs := resp.Secret.InternalData["role_assignment_ids"].([]string)
+		equal(t, 1, len(raIDs))
+		if !strings.HasPrefix(raIDs[0], expScope+"/") {
+			t.Fatalf("expected role assignment %q to be at scope %q", raIDs[0], expScope)
+		}
+
+		equal(t, []string{"00000000-1111-2222-3333-444444444444FAKE_GROUP-devs"}, resp.Secret.InternalData["group_membership_ids"])
+	})
+
+	t.Run("No entity", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatal("expected error response for request without an entity")
+		}
+	})
+
+	t.Run("Invalid scope value", func(t *testing.T) {
+		entity := b.System().(*logical.StaticSystemView).EntityVal
+		defer func() {
+			b.System().(*logical.StaticSystemView).EntityVal = entity
+		}()
+
+		// Values that aren't a single path segment would assign the role at a
+		// different scope, such as the parent of the resource group.
+		for _, value := range []string{"", "team-a/providers/x", "..", "team-a/.."} {
+			b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+				ID: "test-entity",
+				Metadata: map[string]string{
+					"resource_group": value,
+					"team":           "devs",
+				},
+			}
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/test_role",
+				Storage:   s,
+				EntityID:  "test-entity",
+			})
+			assertErrorIsNil(t, err)
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), "can't be used in a scope") {
+				t.Fatalf("expected error for scope value %q, got: %v", value, resp)
+			}
+		}
+	})
+}
+
+func TestSPReadGroupFilters(t *testing.T) {
+	t.Run("filter and owner", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+			ID:       "test-entity",
+			Metadata: map[string]string{"team": "team-b"},
+		}
+
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"azure_groups": encodeJSON([]AzureGroup{
+				{Filter: "startswith(displayName,'team-a-')"},
+				{Filter: "startswith(displayName,'{{identity.entity.metadata.team}}-')", Relationship: "owner"},
+				{GroupName: "foo", Relationship: "owner"},
+				{GroupName: "team-a-readers"},
+			}),
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+			EntityID:  "test-entity",
+		})
+		assertRespNoError(t, resp, err)
+
+		// Groups selected more than once are only added once
+		equal(t, []string{
+			"00000000-1111-2222-3333-444444444444FAKE_GROUP-team-a-readers",
+			"00000000-1111-2222-3333-444444444444FAKE_GROUP-team-a-writers",
+		}, resp.Secret.InternalData["group_membership_ids"])
+		equal(t, []string{
+			"00000000-1111-2222-3333-444444444444FAKE_GROUP-team-b-readers",
+			"00000000-1111-2222-3333-444444444444FAKE_GROUP-foo",
+		}, resp.Secret.InternalData["group_owner_ids"])
+
+		mp := getMockProvider(t, b, s)
+		spID := resp.Secret.InternalData["sp_object_id"].(string)
+		if !mp.isGroupMember("00000000-1111-2222-3333-444444444444FAKE_GROUP-team-a-writers", spID) {
+			t.Fatal("expected service principal to be a member of the filtered group")
+		}
+		if !mp.isGroupOwner("00000000-1111-2222-3333-444444444444FAKE_GROUP-foo", spID) {
+			t.Fatal("expected service principal to be an owner of the group")
+		}
+		if mp.isGroupMember("00000000-1111-2222-3333-444444444444FAKE_GROUP-foo", spID) {
+			t.Fatal("expected service principal not to be a member of the owned group")
+		}
+
+		fakeSaveLoad(resp.Secret)
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		if mp.isGroupOwner("00000000-1111-2222-3333-444444444444FAKE_GROUP-foo", spID) {
+			t.Fatal("expected group ownership to be removed")
+		}
+	})
+
+	t.Run("quoted metadata", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		// Unescaped, the metadata would select every group starting with
+		// "team-a" instead of the groups of the entity's team.
+		b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+			ID:       "test-entity",
+			Metadata: map[string]string{"team": "x') or startswith(displayName,'team-a"},
+		}
+
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"azure_groups": encodeJSON([]AzureGroup{
+				{Filter: "startswith(displayName,'{{identity.entity.metadata.team}}-')", Relationship: "owner"},
+			}),
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+			EntityID:  "test-entity",
+		})
+		assertRespNoError(t, resp, err)
+		equal(t, []string{}, resp.Secret.InternalData["group_owner_ids"])
+		equal(t, []string{}, resp.Secret.InternalData["group_membership_ids"])
+	})
+
+	t.Run("too many matches", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+			ID:       "test-entity",
+			Metadata: map[string]string{"prefix": "team-"},
+		}
+
+		// Filters are checked when the role is written, unless templated
+		resp := testRoleCreateBasic(t, b, s, "test_role", map[string]interface{}{
+			"azure_groups": encodeJSON([]AzureGroup{{Filter: "startswith(displayName,'team-')", MaxMatches: 2}}),
+		})
+		msg := "matches more than 2 groups"
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), msg) {
+			t.Fatalf("expected to find: %s, got: %v", msg, resp)
+		}
+
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"azure_groups": encodeJSON([]AzureGroup{{Filter: "startswith(displayName,'{{identity.entity.metadata.prefix}}')", MaxMatches: 2}}),
+		})
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+			EntityID:  "test-entity",
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), msg) {
+			t.Fatalf("expected to find: %s, got: %v", msg, resp)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+
+		for name, tc := range map[string]struct {
+			role map[string]interface{}
+			msg  string
+		}{
+			"unsupported filter": {
+				role: map[string]interface{}{
+					"azure_groups": encodeJSON([]AzureGroup{{Filter: "bad filter"}}),
+				},
+				msg: "unable to query Azure groups",
+			},
+			"filter and name": {
+				role: map[string]interface{}{
+					"azure_groups": encodeJSON([]AzureGroup{{Filter: "startswith(displayName,'team-')", GroupName: "foo"}}),
+				},
+				msg: "can't be combined",
+			},
+			"max matches without filter": {
+				role: map[string]interface{}{
+					"azure_groups": encodeJSON([]AzureGroup{{GroupName: "foo", MaxMatches: 2}}),
+				},
+				msg: "max_matches can only be used",
+			},
+			"invalid relationship": {
+				role: map[string]interface{}{
+					"azure_groups": encodeJSON([]AzureGroup{{GroupName: "foo", Relationship: "admin"}}),
+				},
+				msg: "invalid relationship",
+			},
+			"persisted app": {
+				role: map[string]interface{}{
+					"azure_groups": encodeJSON([]AzureGroup{{GroupName: "foo", Relationship: "owner"}}),
+					"persist_app":  true,
+				},
+				msg: "can only be used with dynamic service principals",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp := testRoleCreateBasic(t, b, s, "test_role", tc.role)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected to find: %s, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+}
+
 func TestStaticSPRead(t *testing.T) {
 	b, s := getTestBackendMocked(t, true)
 
@@ -675,6 +1179,46 @@ func TestCredentialReadProviderError(t *testing.T) {
 	}
 }
 
+// failPutStorage fails writing the entries under a prefix.
+type failPutStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s failPutStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return errors.New("put failed")
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestSPReadTrackLeaseError(t *testing.T) {
+	b, s := getTestBackendMocked(t, true)
+	testRoleCreate(t, b, s, "test_role", testRole)
+	mp := getMockProvider(t, b, s)
+	apps := len(mp.applications)
+
+	// The WALs are deleted before the lease is tracked, so the created
+	// objects are revoked rather than left in Azure.
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   failPutStorage{Storage: s, prefix: roleLeasesStoragePath + "/"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "error tracking lease") {
+		t.Fatalf("expected an error tracking the lease, got: %v", err)
+	}
+
+	equal(t, 2, len(mp.deletedObjects))
+	equal(t, apps, len(mp.applications))
+	equal(t, 0, len(mp.servicePrincipals))
+	equal(t, 0, len(mp.roleAssignments))
+
+	walIDs, err := framework.ListWAL(context.Background(), s)
+	assertErrorIsNil(t, err)
+	equal(t, 0, len(walIDs))
+}
+
 // TestRoleAssignmentWALRollback tests rolling back any
 // role assignments that may have taken place prior to
 // a subsequent failure resulting in the need to rollback
@@ -768,7 +1312,7 @@ func TestRoleAssignmentWALRollback(t *testing.T) {
 		// Use the underlying provider to access clients directly for testing
 		client, err := b.getClient(context.Background(), s)
 		assertErrorIsNil(t, err)
-		provider := client.provider.(*provider)
+		provider := client.provider.(*instrumentedProvider).next.(*provider)
 		spObjID := findServicePrincipalID(t, provider.spClient, appID)
 
 		assertServicePrincipalExistence(t, provider.spClient, spObjID, true)
@@ -983,7 +1527,7 @@ func TestCredentialInteg_msgraph(t *testing.T) {
 		// Use the underlying provider to access clients directly for testing
 		client, err := b.getClient(context.Background(), s)
 		assertErrorIsNil(t, err)
-		provider := client.provider.(*provider)
+		provider := client.provider.(*instrumentedProvider).next.(*provider)
 		spObjID := findServicePrincipalID(t, provider.spClient, appID)
 
 		assertServicePrincipalExistence(t, provider.spClient, spObjID, true)
@@ -0,0 +1,452 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const serviceBusRolesStoragePath = "servicebus-roles"
+
+// serviceBusRoleEntry is a role that manages the keys of a Service Bus or
+// Event Hubs authorization rule. The key values are not stored; they are read
+// from Azure when credentials are requested.
+type serviceBusRoleEntry struct {
+	AuthorizationRuleID string `json:"authorization_rule_id"`
+	keyRotation
+	keySync
+}
+
+// regenerateKeyType returns the key type of the regenerateKeys action for the
+// primary or secondary key.
+func regenerateKeyType(keyName string) string {
+	if keyName == keySecondary {
+		return "SecondaryKey"
+	}
+	return "PrimaryKey"
+}
+
+// authorizationRuleKey returns the primary or secondary key and connection
+// string of the rule.
+func authorizationRuleKey(keys AuthorizationRuleKeys, keyName string) (key, connectionString string) {
+	if keyName == keySecondary {
+		return keys.SecondaryKey, keys.SecondaryConnectionString
+	}
+	return keys.PrimaryKey, keys.PrimaryConnectionString
+}
+
+func pathsServiceBusRole(b *azureSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "servicebus-roles/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "servicebus-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the Service Bus role.",
+				},
+				"authorization_rule_id": {
+					Type:        framework.TypeString,
+					Description: "Resource ID of the Service Bus or Event Hubs authorization rule whose keys are managed by the role. The rule may be of a namespace, or of a queue, topic or event hub.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How often the keys are rotated. Set to 0 to only rotate through the rotate endpoint. Defaults to 24 hours.",
+				},
+				"sync_destinations": {
+					Type:        framework.TypeString,
+					Description: "JSON list of Azure Key Vault secrets, by vault_url and secret_name_template, that the connection string of each rotated key is written to.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathServiceBusRoleRead,
+				logical.CreateOperation: b.pathServiceBusRoleUpdate,
+				logical.UpdateOperation: b.pathServiceBusRoleUpdate,
+				logical.DeleteOperation: b.pathServiceBusRoleDelete,
+			},
+			HelpSynopsis:    serviceBusRoleHelpSyn,
+			HelpDescription: serviceBusRoleHelpDesc,
+			ExistenceCheck:  b.pathServiceBusRoleExistenceCheck,
+		},
+		{
+			Pattern: "servicebus-roles/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "servicebus-roles",
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathServiceBusRoleList,
+			},
+			HelpSynopsis:    serviceBusRoleListHelpSyn,
+			HelpDescription: serviceBusRoleListHelpDesc,
+		},
+		{
+			Pattern: "servicebus-roles/" + framework.GenericNameRegex("name") + "/rotate",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "rotate",
+				OperationSuffix: "servicebus-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the Service Bus role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathServiceBusRoleRotate,
+				},
+			},
+			HelpSynopsis:    serviceBusRoleRotateHelpSyn,
+			HelpDescription: serviceBusRoleRotateHelpDesc,
+		},
+		{
+			Pattern: "servicebus-creds/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "request",
+				OperationSuffix: "servicebus-credentials",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the Service Bus role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathServiceBusCredsRead,
+				},
+			},
+			HelpSynopsis:    serviceBusCredsHelpSyn,
+			HelpDescription: serviceBusCredsHelpDesc,
+		},
+	}
+}
+
+func (b *azureSecretBackend) pathServiceBusRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getServiceBusRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *azureSecretBackend) pathServiceBusRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getServiceBusRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: serviceBusRoleData(role),
+	}, nil
+}
+
+func (b *azureSecretBackend) pathServiceBusRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, serviceBusRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getServiceBusRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, fmt.Errorf("Service Bus role entry not found during update operation")
+		}
+		role = &serviceBusRoleEntry{
+			keyRotation: keyRotation{
+				RotationPeriod: defaultKeyRotationPeriod,
+			},
+		}
+	}
+
+	if rotationPeriod, ok := d.GetOk("rotation_period"); ok {
+		role.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if destinations, ok := d.GetOk("sync_destinations"); ok {
+		c, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		role.SyncDestinations, err = parseSyncDestinations(destinations.(string), c.settings.keyVault())
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	ruleID := d.Get("authorization_rule_id").(string)
+	switch {
+	case role.AuthorizationRuleID == "" && ruleID == "":
+		return logical.ErrorResponse("authorization_rule_id is required"), nil
+	case role.AuthorizationRuleID != "" && ruleID != "" && !strings.EqualFold(ruleID, role.AuthorizationRuleID):
+		return logical.ErrorResponse("authorization_rule_id can't be changed; create a new Service Bus role instead"), nil
+	}
+
+	if role.AuthorizationRuleID != "" {
+		if err := saveServiceBusRole(ctx, req.Storage, role, name); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	resourceLock := locksutil.LockForKey(b.resourceLocks, strings.ToLower(ruleID))
+	resourceLock.Lock()
+	defer resourceLock.Unlock()
+
+	other, err := resourceRoleName(ctx, req.Storage, serviceBusRolesStoragePath, name, func(r *serviceBusRoleEntry) bool {
+		return strings.EqualFold(r.AuthorizationRuleID, ruleID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if other != "" {
+		return logical.ErrorResponse("authorization rule %q is already managed by Service Bus role %q", ruleID, other), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.provider.ListAuthorizationRuleKeys(ctx, ruleID); err != nil {
+		return logical.ErrorResponse("unable to look up authorization rule %q: %s", ruleID, err), nil
+	}
+	role.AuthorizationRuleID = ruleID
+
+	// As with storage roles, Vault takes over the keys by rotating as soon as
+	// the role is created.
+	if err := b.rotateServiceBusRole(ctx, c, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathServiceBusRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, serviceBusRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", serviceBusRolesStoragePath, name)); err != nil {
+		return nil, fmt.Errorf("error deleting Service Bus role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathServiceBusRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, serviceBusRolesStoragePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing Service Bus roles: %w", err)
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+func (b *azureSecretBackend) pathServiceBusRoleRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, serviceBusRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getServiceBusRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("Service Bus role %q does not exist", name), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.rotateServiceBusRole(ctx, c, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: serviceBusRoleData(role),
+	}, nil
+}
+
+func (b *azureSecretBackend) pathServiceBusCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getServiceBusRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("Service Bus role %q does not exist", name), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := c.provider.ListAuthorizationRuleKeys(ctx, role.AuthorizationRuleID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys of authorization rule %q: %w", role.AuthorizationRuleID, err)
+	}
+	key, connectionString := authorizationRuleKey(keys, role.ActiveKey)
+	if key == "" {
+		return nil, fmt.Errorf("%s key of authorization rule %q not found", role.ActiveKey, role.AuthorizationRuleID)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"shared_access_key_name": keys.KeyName,
+			"key_name":               role.ActiveKey,
+			"key":                    key,
+			"connection_string":      connectionString,
+			"last_rotated":           role.LastRotated,
+		},
+	}, nil
+}
+
+// rotateServiceBusRole regenerates the inactive key of the authorization rule
+// and makes it the active key, as rotateStorageRole does for storage accounts.
+// Callers must hold the lock of the role.
+func (b *azureSecretBackend) rotateServiceBusRole(ctx context.Context, c *client, s logical.Storage, name string, role *serviceBusRoleEntry) error {
+	keyName := role.inactiveKey(primarySecondaryKeys)
+
+	keys, err := c.provider.RegenerateAuthorizationRuleKey(ctx, role.AuthorizationRuleID, regenerateKeyType(keyName))
+	if err != nil {
+		return fmt.Errorf("error regenerating %s key of authorization rule %q: %w", keyName, role.AuthorizationRuleID, err)
+	}
+	key, connectionString := authorizationRuleKey(keys, keyName)
+	if key == "" {
+		return fmt.Errorf("%s key of authorization rule %q not found", keyName, role.AuthorizationRuleID)
+	}
+
+	role.rotated(keyName)
+	b.syncRotatedKey(ctx, c, "servicebus", name, &role.keySync, keyName, connectionString)
+
+	return saveServiceBusRole(ctx, s, role, name)
+}
+
+// rotateServiceBusRoles rotates the keys of the Service Bus roles whose
+// rotation period has passed since their last rotation.
+func (b *azureSecretBackend) rotateServiceBusRoles(ctx context.Context, req *logical.Request) error {
+	return rotateDueRoles(ctx, req, serviceBusRolesStoragePath, "Service Bus", b.rotateServiceBusRoleIfDue)
+}
+
+func (b *azureSecretBackend) rotateServiceBusRoleIfDue(ctx context.Context, req *logical.Request, name string) error {
+	lock := locksutil.LockForKey(b.storageRoleLocks, serviceBusRolesStoragePath+"/"+name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getServiceBusRole(ctx, name, req.Storage)
+	if err != nil {
+		return err
+	}
+	if role == nil || !role.rotationDue() {
+		return nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("periodic func", "servicebus-role", name, "rotating key", role.inactiveKey(primarySecondaryKeys))
+	return b.rotateServiceBusRole(ctx, c, req.Storage, name, role)
+}
+
+func serviceBusRoleData(role *serviceBusRoleEntry) map[string]interface{} {
+	data := role.keyRotation.data()
+	data["authorization_rule_id"] = role.AuthorizationRuleID
+	data["sync_destinations"] = role.SyncDestinations
+	return data
+}
+
+func saveServiceBusRole(ctx context.Context, s logical.Storage, role *serviceBusRoleEntry, name string) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", serviceBusRolesStoragePath, name), role)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getServiceBusRole(ctx context.Context, name string, s logical.Storage) (*serviceBusRoleEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", serviceBusRolesStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading Service Bus role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(serviceBusRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const serviceBusRoleHelpSyn = "Manage the keys of Azure Service Bus and Event Hubs authorization rules."
+const serviceBusRoleHelpDesc = `
+This path allows you to read and write Service Bus roles. A Service Bus role
+manages the primary and secondary keys of an existing shared access
+authorization rule, given by its resource ID. The rule may belong to a Service
+Bus namespace, queue or topic, or to an Event Hubs namespace or event hub. The
+configured identity needs permission to list and regenerate the keys of the
+rule.
+
+As with storage roles, the keys are rotated when the role is created and then
+every rotation_period, alternating between the primary and secondary key. The
+previously active key stays valid until the next rotation.
+
+The active key and a connection string are read from "servicebus-creds/<name>".
+Deleting a Service Bus role stops the rotation but doesn't change the keys. An
+authorization rule can only be managed by one Service Bus role.
+
+As with storage roles, the connection string of each rotated key can also be
+written to the Azure Key Vault secrets in sync_destinations.
+`
+
+const serviceBusRoleListHelpSyn = `List existing Service Bus roles.`
+const serviceBusRoleListHelpDesc = `List existing Service Bus roles by name.`
+
+const serviceBusRoleRotateHelpSyn = `Rotate the keys of a Service Bus role.`
+const serviceBusRoleRotateHelpDesc = `
+This path regenerates the inactive key of the authorization rule of a role and
+makes it the active key, as the periodic rotation does.
+`
+
+const serviceBusCredsHelpSyn = `Read the active key of a Service Bus or Event Hubs authorization rule.`
+const serviceBusCredsHelpDesc = `
+This path returns the active key of the authorization rule of a role, along with
+the name of the rule, a connection string and the time of the last rotation. The
+credentials are not leased; they remain valid until the second rotation after
+they were read.
+`
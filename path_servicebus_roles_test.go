@@ -0,0 +1,185 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	testServiceBusRuleID = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.ServiceBus/namespaces/fakenamespace/queues/orders/authorizationRules/sender"
+	testEventHubsRuleID  = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.EventHub/namespaces/fakenamespace/authorizationRules/listener"
+)
+
+func TestServiceBusRole(t *testing.T) {
+	for name, ruleID := range map[string]string{
+		"service bus": testServiceBusRuleID,
+		"event hubs":  testEventHubsRuleID,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackendMocked(t, true)
+			testServiceBusRoleWrite(t, b, s, "test_role", map[string]interface{}{
+				"authorization_rule_id": ruleID,
+			})
+
+			resp := testServiceBusRoleRead(t, b, s, "servicebus-roles/test_role")
+			delete(resp.Data, "last_rotated")
+			equal(t, map[string]interface{}{
+				"authorization_rule_id": ruleID,
+				"rotation_period":       int64(86400),
+				"active_key":            "secondary",
+				"sync_destinations":     []*SyncDestination(nil),
+			}, resp.Data)
+
+			mp := getMockProvider(t, b, s)
+			for _, keyName := range []string{"secondary", "primary", "secondary"} {
+				keys := mp.authorizationRuleKeysOf(ruleID)
+				key, connectionString := authorizationRuleKey(keys, keyName)
+				other, _ := authorizationRuleKey(keys, map[string]string{"primary": "secondary", "secondary": "primary"}[keyName])
+
+				resp = testServiceBusRoleRead(t, b, s, "servicebus-creds/test_role")
+				equal(t, ruleID[strings.LastIndex(ruleID, "/")+1:], resp.Data["shared_access_key_name"])
+				equal(t, keyName, resp.Data["key_name"])
+				equal(t, key, resp.Data["key"])
+				equal(t, connectionString, resp.Data["connection_string"])
+
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.UpdateOperation,
+					Path:      "servicebus-roles/test_role/rotate",
+					Storage:   s,
+				})
+				assertRespNoError(t, resp, err)
+
+				// The active key stays valid while the other key is regenerated
+				keys = mp.authorizationRuleKeysOf(ruleID)
+				current, _ := authorizationRuleKey(keys, keyName)
+				equal(t, key, current)
+				if regenerated, _ := authorizationRuleKey(keys, resp.Data["active_key"].(string)); regenerated == other {
+					t.Fatalf("expected the %s key to be regenerated", resp.Data["active_key"])
+				}
+			}
+		})
+	}
+
+	t.Run("periodic rotation", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testServiceBusRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"authorization_rule_id": testServiceBusRuleID,
+			"rotation_period":       3600,
+		})
+
+		role, err := getServiceBusRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		role.LastRotated = time.Now().Add(-2 * time.Hour)
+		assertErrorIsNil(t, saveServiceBusRole(context.Background(), s, role, "test_role"))
+
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+
+		role, err = getServiceBusRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		equal(t, "primary", role.ActiveKey)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testServiceBusRoleWrite(t, b, s, "test_role", map[string]interface{}{
+			"authorization_rule_id": testServiceBusRuleID,
+		})
+
+		tests := map[string]struct {
+			name string
+			data map[string]interface{}
+			msg  string
+		}{
+			"missing rule": {
+				name: "new_role",
+				data: map[string]interface{}{},
+				msg:  "authorization_rule_id is required",
+			},
+			"unknown rule": {
+				name: "new_role",
+				data: map[string]interface{}{"authorization_rule_id": testServiceBusRuleID + "-missing"},
+				msg:  "unable to look up authorization rule",
+			},
+			"changed rule": {
+				name: "test_role",
+				data: map[string]interface{}{"authorization_rule_id": testEventHubsRuleID},
+				msg:  "can't be changed",
+			},
+			"managed rule": {
+				name: "new_role",
+				data: map[string]interface{}{"authorization_rule_id": strings.ToUpper(testServiceBusRuleID)},
+				msg:  `already managed by Service Bus role "test_role"`,
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.CreateOperation,
+					Path:      "servicebus-roles/" + tc.name,
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+	})
+}
+
+func TestAuthorizationRuleAPIVersion(t *testing.T) {
+	for id, expected := range map[string]string{
+		testServiceBusRuleID: serviceBusAPIVersion,
+		testEventHubsRuleID:  eventHubsAPIVersion,
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.EventHub/namespaces/ns/eventhubs/hub/authorizationRules/r": eventHubsAPIVersion,
+	} {
+		apiVersion, err := authorizationRuleAPIVersion(id)
+		assertErrorIsNil(t, err)
+		equal(t, expected, apiVersion)
+	}
+
+	for _, id := range []string{
+		testStorageAccountID,
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Relay/namespaces/ns/authorizationRules/r",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ServiceBus/namespaces/ns",
+	} {
+		if _, err := authorizationRuleAPIVersion(id); err == nil {
+			t.Fatalf("expected an error for %q", id)
+		}
+	}
+}
+
+func testServiceBusRoleWrite(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "servicebus-roles/" + name,
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
+
+func testServiceBusRoleRead(t *testing.T, b *azureSecretBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	if resp == nil {
+		t.Fatalf("expected a response from %s", path)
+	}
+
+	return resp
+}
@@ -0,0 +1,495 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	storageRolesStoragePath = "storage-roles"
+
+	// The two access keys of a storage account
+	storageKey1 = "key1"
+	storageKey2 = "key2"
+
+	defaultStorageEndpointSuffix = "core.windows.net"
+)
+
+// storageRoleEntry is a role that manages the access keys of a storage
+// account. The key values are not stored; they are read from Azure when
+// credentials are requested.
+type storageRoleEntry struct {
+	StorageAccountID string `json:"storage_account_id"`
+	AccountName      string `json:"account_name"`
+	EndpointSuffix   string `json:"endpoint_suffix"`
+	keyRotation
+	keySync
+}
+
+// connectionString returns a connection string for the account with the key.
+func (r *storageRoleEntry) connectionString(key string) string {
+	return fmt.Sprintf("DefaultEndpointsProtocol=https;AccountName=%s;AccountKey=%s;EndpointSuffix=%s",
+		r.AccountName, key, r.EndpointSuffix)
+}
+
+func pathsStorageRole(b *azureSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "storage-roles/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "storage-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the storage role.",
+				},
+				"storage_account_id": {
+					Type:        framework.TypeString,
+					Description: "Resource ID of the storage account whose access keys are managed by the role.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How often the access keys are rotated. Set to 0 to only rotate through the rotate endpoint. Defaults to 24 hours.",
+				},
+				"sync_destinations": {
+					Type:        framework.TypeString,
+					Description: "JSON list of Azure Key Vault secrets, by vault_url and secret_name_template, that the connection string of each rotated key is written to.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathStorageRoleRead,
+				logical.CreateOperation: b.pathStorageRoleUpdate,
+				logical.UpdateOperation: b.pathStorageRoleUpdate,
+				logical.DeleteOperation: b.pathStorageRoleDelete,
+			},
+			HelpSynopsis:    storageRoleHelpSyn,
+			HelpDescription: storageRoleHelpDesc,
+			ExistenceCheck:  b.pathStorageRoleExistenceCheck,
+		},
+		{
+			Pattern: "storage-roles/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationSuffix: "storage-roles",
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathStorageRoleList,
+			},
+			HelpSynopsis:    storageRoleListHelpSyn,
+			HelpDescription: storageRoleListHelpDesc,
+		},
+		{
+			Pattern: "storage-roles/" + framework.GenericNameRegex("name") + "/rotate",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "rotate",
+				OperationSuffix: "storage-role",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the storage role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStorageRoleRotate,
+				},
+			},
+			HelpSynopsis:    storageRoleRotateHelpSyn,
+			HelpDescription: storageRoleRotateHelpDesc,
+		},
+		{
+			Pattern: "storage-creds/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixAzure,
+				OperationVerb:   "request",
+				OperationSuffix: "storage-credentials",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the storage role.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStorageCredsRead,
+				},
+			},
+			HelpSynopsis:    storageCredsHelpSyn,
+			HelpDescription: storageCredsHelpDesc,
+		},
+	}
+}
+
+func (b *azureSecretBackend) pathStorageRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := getStorageRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *azureSecretBackend) pathStorageRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getStorageRole(ctx, d.Get("name").(string), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: storageRoleData(role),
+	}, nil
+}
+
+func (b *azureSecretBackend) pathStorageRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getStorageRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, fmt.Errorf("storage role entry not found during update operation")
+		}
+		role = &storageRoleEntry{
+			keyRotation: keyRotation{
+				RotationPeriod: defaultKeyRotationPeriod,
+			},
+		}
+	}
+
+	if rotationPeriod, ok := d.GetOk("rotation_period"); ok {
+		role.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if destinations, ok := d.GetOk("sync_destinations"); ok {
+		c, err := b.getClient(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		role.SyncDestinations, err = parseSyncDestinations(destinations.(string), c.settings.keyVault())
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	accountID := d.Get("storage_account_id").(string)
+	switch {
+	case role.StorageAccountID == "" && accountID == "":
+		return logical.ErrorResponse("storage_account_id is required"), nil
+	case role.StorageAccountID != "" && accountID != "" && !strings.EqualFold(accountID, role.StorageAccountID):
+		return logical.ErrorResponse("storage_account_id can't be changed; create a new storage role instead"), nil
+	}
+
+	if role.StorageAccountID != "" {
+		if err := saveStorageRole(ctx, req.Storage, role, name); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	resourceLock := locksutil.LockForKey(b.resourceLocks, strings.ToLower(accountID))
+	resourceLock.Lock()
+	defer resourceLock.Unlock()
+
+	other, err := resourceRoleName(ctx, req.Storage, storageRolesStoragePath, name, func(r *storageRoleEntry) bool {
+		return strings.EqualFold(r.StorageAccountID, accountID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if other != "" {
+		return logical.ErrorResponse("storage account %q is already managed by storage role %q", accountID, other), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := c.provider.GetStorageAccount(ctx, accountID)
+	if err != nil {
+		return logical.ErrorResponse("unable to look up storage account %q: %s", accountID, err), nil
+	}
+	role.StorageAccountID = accountID
+	role.AccountName = accountID[strings.LastIndex(accountID, "/")+1:]
+	if account.Name != nil {
+		role.AccountName = *account.Name
+	}
+	role.EndpointSuffix = storageEndpointSuffix(account.Account)
+
+	// Vault takes over the keys of the account by rotating as soon as the role
+	// is created. The key that was active until now stays valid until the next
+	// rotation.
+	if err := b.rotateStorageRole(ctx, c, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathStorageRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", storageRolesStoragePath, name)); err != nil {
+		return nil, fmt.Errorf("error deleting storage role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *azureSecretBackend) pathStorageRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, storageRolesStoragePath+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing storage roles: %w", err)
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+func (b *azureSecretBackend) pathStorageRoleRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.storageRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getStorageRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("storage role %q does not exist", name), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.rotateStorageRole(ctx, c, req.Storage, name, role); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: storageRoleData(role),
+	}, nil
+}
+
+func (b *azureSecretBackend) pathStorageCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getStorageRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("storage role %q does not exist", name), nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := c.provider.ListStorageAccountKeys(ctx, role.StorageAccountID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys of storage account %q: %w", role.StorageAccountID, err)
+	}
+	key := findStorageAccountKey(keys, role.ActiveKey)
+	if key == "" {
+		return nil, fmt.Errorf("key %q of storage account %q not found", role.ActiveKey, role.StorageAccountID)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"account_name":      role.AccountName,
+			"key_name":          role.ActiveKey,
+			"key":               key,
+			"connection_string": role.connectionString(key),
+			"last_rotated":      role.LastRotated,
+		},
+	}, nil
+}
+
+// rotateStorageRole regenerates the inactive key of the storage account and
+// makes it the active key. The previously active key stays valid until the
+// next rotation, so consumers always have a valid key while they pick up the
+// new one. Callers must hold the lock of the storage role.
+func (b *azureSecretBackend) rotateStorageRole(ctx context.Context, c *client, s logical.Storage, name string, role *storageRoleEntry) error {
+	keyName := role.inactiveKey(storageKeys)
+
+	keys, err := c.provider.RegenerateStorageAccountKey(ctx, role.StorageAccountID, keyName)
+	if err != nil {
+		return fmt.Errorf("error regenerating key %q of storage account %q: %w", keyName, role.StorageAccountID, err)
+	}
+	key := findStorageAccountKey(keys, keyName)
+	if key == "" {
+		return fmt.Errorf("key %q of storage account %q not found", keyName, role.StorageAccountID)
+	}
+
+	role.rotated(keyName)
+	b.syncRotatedKey(ctx, c, "storage", name, &role.keySync, keyName, role.connectionString(key))
+
+	return saveStorageRole(ctx, s, role, name)
+}
+
+// rotateStorageRoles rotates the keys of the storage roles whose rotation
+// period has passed since their last rotation.
+func (b *azureSecretBackend) rotateStorageRoles(ctx context.Context, req *logical.Request) error {
+	return rotateDueRoles(ctx, req, storageRolesStoragePath, "storage", b.rotateStorageRoleIfDue)
+}
+
+func (b *azureSecretBackend) rotateStorageRoleIfDue(ctx context.Context, req *logical.Request, name string) error {
+	lock := locksutil.LockForKey(b.storageRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getStorageRole(ctx, name, req.Storage)
+	if err != nil {
+		return err
+	}
+	if role == nil || !role.rotationDue() {
+		return nil
+	}
+
+	c, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("periodic func", "storage-role", name, "rotating key", role.inactiveKey(storageKeys))
+	return b.rotateStorageRole(ctx, c, req.Storage, name, role)
+}
+
+func storageRoleData(role *storageRoleEntry) map[string]interface{} {
+	data := role.keyRotation.data()
+	data["storage_account_id"] = role.StorageAccountID
+	data["account_name"] = role.AccountName
+	data["sync_destinations"] = role.SyncDestinations
+	return data
+}
+
+// storageEndpointSuffix returns the DNS suffix of the endpoints of the storage
+// account, which differs between Azure clouds.
+func storageEndpointSuffix(account armstorage.Account) string {
+	if account.Name == nil || account.Properties == nil || account.Properties.PrimaryEndpoints == nil ||
+		account.Properties.PrimaryEndpoints.Blob == nil {
+		return defaultStorageEndpointSuffix
+	}
+
+	u, err := url.Parse(*account.Properties.PrimaryEndpoints.Blob)
+	if err != nil {
+		return defaultStorageEndpointSuffix
+	}
+
+	prefix := strings.ToLower(*account.Name) + ".blob."
+	host := strings.ToLower(u.Hostname())
+	if !strings.HasPrefix(host, prefix) || host == prefix {
+		return defaultStorageEndpointSuffix
+	}
+
+	return strings.TrimPrefix(host, prefix)
+}
+
+func findStorageAccountKey(keys []*armstorage.AccountKey, keyName string) string {
+	for _, k := range keys {
+		if k != nil && k.KeyName != nil && k.Value != nil && strings.EqualFold(*k.KeyName, keyName) {
+			return *k.Value
+		}
+	}
+	return ""
+}
+
+func saveStorageRole(ctx context.Context, s logical.Storage, role *storageRoleEntry, name string) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", storageRolesStoragePath, name), role)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getStorageRole(ctx context.Context, name string, s logical.Storage) (*storageRoleEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", storageRolesStoragePath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage role: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	role := new(storageRoleEntry)
+	if err := entry.DecodeJSON(role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+const storageRoleHelpSyn = "Manage the access keys of Azure storage accounts."
+const storageRoleHelpDesc = `
+This path allows you to read and write storage roles. A storage role manages the
+two access keys, key1 and key2, of an existing storage account, given by its
+resource ID. The configured identity needs permission to list and regenerate the
+keys of the account.
+
+The keys are rotated when the role is created, and then every rotation_period.
+Each rotation regenerates the key that is not handed out, and makes it the active
+key. The previously active key stays valid until the next rotation, so consumers
+have a full rotation period to pick up the new key. The rotation_period should be
+longer than the time consumers take to read new credentials.
+
+The active key and a connection string are read from "storage-creds/<name>".
+Deleting a storage role stops the rotation but doesn't change the keys. A
+storage account can only be managed by one storage role.
+
+The connection string of each rotated key can also be written to Azure Key Vault
+secrets, given in sync_destinations by vault URL and a template for the secret
+name. Each rotation adds a new version of the secrets, and disables the versions
+that held the key it regenerated. Changes to sync_destinations apply from the
+next rotation.
+`
+
+const storageRoleListHelpSyn = `List existing storage roles.`
+const storageRoleListHelpDesc = `List existing storage roles by name.`
+
+const storageRoleRotateHelpSyn = `Rotate the access keys of a storage role.`
+const storageRoleRotateHelpDesc = `
+This path regenerates the inactive key of the storage account of a role and
+makes it the active key, as the periodic rotation does.
+`
+
+const storageCredsHelpSyn = `Read the active access key of a storage account.`
+const storageCredsHelpDesc = `
+This path returns the name and value of the active access key of the storage
+account of a storage role, along with a connection string for the account and
+the time of the last rotation. The credentials are not leased; they remain valid
+until the second rotation after they were read.
+`
@@ -0,0 +1,254 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	testStorageAccountID = "/subscriptions/FAKE_SUB_ID/resourceGroups/rg1/providers/Microsoft.Storage/storageAccounts/fakestorage"
+
+	// Storage keys are base64 encoded
+	testStorageKey1 = "aW5pdGlhbC1rZXkx"
+	testStorageKey2 = "aW5pdGlhbC1rZXky"
+)
+
+func TestStorageRole(t *testing.T) {
+	t.Run("create and read", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testStorageRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+		})
+
+		resp := testStorageRoleRead(t, b, s, "storage-roles/test_role")
+		lastRotated := resp.Data["last_rotated"].(time.Time)
+		if time.Since(lastRotated) > time.Minute {
+			t.Fatalf("expected the role to be rotated on create, last rotated: %v", lastRotated)
+		}
+		delete(resp.Data, "last_rotated")
+		equal(t, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"account_name":       "fakestorage",
+			"rotation_period":    int64(86400),
+			"active_key":         "key2",
+			"sync_destinations":  []*SyncDestination(nil),
+		}, resp.Data)
+
+		// The key that was in use before the role was created is still valid
+		mp := getMockProvider(t, b, s)
+		equal(t, testStorageKey1, mp.storageAccountKey(testStorageAccountID, "key1"))
+
+		resp = testStorageRoleRead(t, b, s, "storage-creds/test_role")
+		key := mp.storageAccountKey(testStorageAccountID, "key2")
+		equal(t, "fakestorage", resp.Data["account_name"])
+		equal(t, "key2", resp.Data["key_name"])
+		equal(t, key, resp.Data["key"])
+		equal(t, "DefaultEndpointsProtocol=https;AccountName=fakestorage;AccountKey="+key+";EndpointSuffix=core.windows.net",
+			resp.Data["connection_string"])
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "storage-roles/",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+		equal(t, []string{"test_role"}, resp.Data["keys"])
+	})
+
+	t.Run("rotation alternates keys", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testStorageRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+		})
+		mp := getMockProvider(t, b, s)
+
+		for _, keyName := range []string{"key1", "key2", "key1"} {
+			other := mp.storageAccountKey(testStorageAccountID, map[string]string{"key1": "key2", "key2": "key1"}[keyName])
+			previous := mp.storageAccountKey(testStorageAccountID, keyName)
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "storage-roles/test_role/rotate",
+				Storage:   s,
+			})
+			assertRespNoError(t, resp, err)
+			equal(t, keyName, resp.Data["active_key"])
+
+			// Only the inactive key is regenerated
+			current := mp.storageAccountKey(testStorageAccountID, keyName)
+			if current == previous {
+				t.Fatalf("expected %s to be regenerated", keyName)
+			}
+			equal(t, other, mp.storageAccountKey(testStorageAccountID, map[string]string{"key1": "key2", "key2": "key1"}[keyName]))
+
+			resp = testStorageRoleRead(t, b, s, "storage-creds/test_role")
+			equal(t, current, resp.Data["key"])
+		}
+	})
+
+	t.Run("periodic rotation", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testStorageRoleWrite(t, b, s, "due", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+			"rotation_period":    3600,
+		})
+		otherAccountID := testStorageAccountID + "2"
+		getMockProvider(t, b, s).storageAccountKeys[otherAccountID] = map[string]string{
+			"key1": testStorageKey1,
+			"key2": testStorageKey2,
+		}
+		testStorageRoleWrite(t, b, s, "manual", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": otherAccountID,
+			"rotation_period":    0,
+		})
+
+		role, err := getStorageRole(context.Background(), "due", s)
+		assertErrorIsNil(t, err)
+		role.LastRotated = time.Now().Add(-2 * time.Hour)
+		assertErrorIsNil(t, saveStorageRole(context.Background(), s, role, "due"))
+
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+
+		role, err = getStorageRole(context.Background(), "due", s)
+		assertErrorIsNil(t, err)
+		equal(t, "key1", role.ActiveKey)
+		if time.Since(role.LastRotated) > time.Minute {
+			t.Fatalf("expected role to be rotated, last rotated: %v", role.LastRotated)
+		}
+
+		role, err = getStorageRole(context.Background(), "manual", s)
+		assertErrorIsNil(t, err)
+		equal(t, "key2", role.ActiveKey)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testStorageRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+		})
+		testStorageRoleWrite(t, b, s, "test_role", logical.UpdateOperation, map[string]interface{}{
+			"rotation_period": 7200,
+		})
+
+		resp := testStorageRoleRead(t, b, s, "storage-roles/test_role")
+		equal(t, int64(7200), resp.Data["rotation_period"])
+		equal(t, "key2", resp.Data["active_key"])
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testStorageRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+		})
+
+		tests := map[string]struct {
+			name string
+			data map[string]interface{}
+			msg  string
+		}{
+			"missing account": {
+				name: "new_role",
+				data: map[string]interface{}{},
+				msg:  "storage_account_id is required",
+			},
+			"unknown account": {
+				name: "new_role",
+				data: map[string]interface{}{
+					"storage_account_id": testStorageAccountID + "-missing",
+				},
+				msg: "unable to look up storage account",
+			},
+			"changed account": {
+				name: "test_role",
+				data: map[string]interface{}{
+					"storage_account_id": testStorageAccountID + "-other",
+				},
+				msg: "can't be changed",
+			},
+			"managed account": {
+				name: "new_role",
+				data: map[string]interface{}{
+					"storage_account_id": strings.ToUpper(testStorageAccountID),
+				},
+				msg: `already managed by storage role "test_role"`,
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.CreateOperation,
+					Path:      "storage-roles/" + tc.name,
+					Data:      tc.data,
+					Storage:   s,
+				})
+				assertErrorIsNil(t, err)
+				if !resp.IsError() || !strings.Contains(resp.Error().Error(), tc.msg) {
+					t.Fatalf("expected error containing %q, got: %v", tc.msg, resp)
+				}
+			})
+		}
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "storage-creds/missing",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected error for a missing storage role, got: %v", resp)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		b, s := getTestBackendMocked(t, true)
+		testStorageRoleWrite(t, b, s, "test_role", logical.CreateOperation, map[string]interface{}{
+			"storage_account_id": testStorageAccountID,
+		})
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "storage-roles/test_role",
+			Storage:   s,
+		})
+		assertRespNoError(t, resp, err)
+
+		role, err := getStorageRole(context.Background(), "test_role", s)
+		assertErrorIsNil(t, err)
+		if role != nil {
+			t.Fatal("expected storage role to be deleted")
+		}
+	})
+}
+
+func testStorageRoleWrite(t *testing.T, b *azureSecretBackend, s logical.Storage, name string, op logical.Operation, d map[string]interface{}) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      "storage-roles/" + name,
+		Data:      d,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+}
+
+func testStorageRoleRead(t *testing.T, b *azureSecretBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	assertRespNoError(t, resp, err)
+	if resp == nil {
+		t.Fatalf("expected a response from %s", path)
+	}
+
+	return resp
+}
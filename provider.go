@@ -5,18 +5,27 @@ package azuresecrets
 
 import (
 	"context"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/vault/sdk/logical"
+	khttp "github.com/microsoft/kiota-http-go"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerregistry/armcontainerregistry"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
 
 	"github.com/hashicorp/vault/sdk/helper/useragent"
 
@@ -37,8 +46,165 @@ type AzureProvider interface {
 		roleAssignmentName string,
 		parameters armauthorization.RoleAssignmentCreateParameters) (armauthorization.RoleAssignmentsClientCreateResponse, error)
 	DeleteRoleAssignmentByID(ctx context.Context, roleID string) (armauthorization.RoleAssignmentsClientDeleteByIDResponse, error)
+	ListRoleAssignments(ctx context.Context, scope string, filter string) ([]*armauthorization.RoleAssignment, error)
 	ListRoleDefinitions(ctx context.Context, scope string, filter string) (result []*armauthorization.RoleDefinition, err error)
 	GetRoleDefinitionByID(ctx context.Context, roleID string) (result armauthorization.RoleDefinitionsClientGetByIDResponse, err error)
+	ListPermissions(ctx context.Context, scope string) ([]Permission, error)
+
+	GetStorageAccount(ctx context.Context, accountID string) (armstorage.AccountsClientGetPropertiesResponse, error)
+	ListStorageAccountKeys(ctx context.Context, accountID string) ([]*armstorage.AccountKey, error)
+	RegenerateStorageAccountKey(ctx context.Context, accountID string, keyName string) ([]*armstorage.AccountKey, error)
+	GetUserDelegationKey(ctx context.Context, blobEndpoint string, start time.Time, expiry time.Time) (UserDelegationKey, error)
+
+	GetContainerRegistry(ctx context.Context, registryID string) (armcontainerregistry.RegistriesClientGetResponse, error)
+	CreateScopeMap(ctx context.Context, registryID string, name string, scopeMap armcontainerregistry.ScopeMap) (armcontainerregistry.ScopeMap, error)
+	DeleteScopeMap(ctx context.Context, registryID string, name string) error
+	CreateRegistryToken(ctx context.Context, registryID string, name string, token armcontainerregistry.Token) (armcontainerregistry.Token, error)
+	DeleteRegistryToken(ctx context.Context, registryID string, name string) error
+	GenerateRegistryCredentials(ctx context.Context, registryID string, params armcontainerregistry.GenerateCredentialsParameters) (armcontainerregistry.GenerateCredentialsResult, error)
+
+	GetCosmosDBAccount(ctx context.Context, accountID string) (CosmosDBAccount, error)
+	ListCosmosDBKeys(ctx context.Context, accountID string) (CosmosDBKeys, error)
+	RegenerateCosmosDBKey(ctx context.Context, accountID string, keyKind string) error
+	ListAuthorizationRuleKeys(ctx context.Context, ruleID string) (AuthorizationRuleKeys, error)
+	RegenerateAuthorizationRuleKey(ctx context.Context, ruleID string, keyType string) (AuthorizationRuleKeys, error)
+
+	GetManagedCluster(ctx context.Context, clusterID string) (ManagedCluster, error)
+	GetClusterUserKubeconfig(ctx context.Context, clusterID string) ([]byte, error)
+
+	GetResourceGroup(ctx context.Context, resourceGroupID string) (ResourceGroup, error)
+	CreateUserAssignedIdentity(ctx context.Context, identityID string, location string, tags map[string]string) (UserAssignedIdentity, error)
+	DeleteUserAssignedIdentity(ctx context.Context, identityID string) error
+	CreateFederatedIdentityCredential(ctx context.Context, identityID string, credential *FederatedCredential) error
+
+	SetKeyVaultSecret(ctx context.Context, vaultURL string, name string, value string, contentType string, tags map[string]string) (string, error)
+	DisableKeyVaultSecret(ctx context.Context, secretID string) error
+}
+
+// permissionsAPIVersion is the version of the ARM permissions API. It is the
+// first version to return the conditions of role assignments.
+const permissionsAPIVersion = "2022-04-01"
+
+// Permission is a set of actions the caller is allowed at a scope, as
+// returned by the ARM permissions API. The actions are only allowed if the
+// condition, if any, is met.
+type Permission struct {
+	Actions          []string `json:"actions"`
+	NotActions       []string `json:"notActions"`
+	Condition        string   `json:"condition"`
+	ConditionVersion string   `json:"conditionVersion"`
+}
+
+const (
+	// registryResourceType is the resource type of container registries.
+	registryResourceType = "Microsoft.ContainerRegistry/registries"
+
+	// armPollFrequency is how often long-running ARM operations are polled.
+	armPollFrequency = 2 * time.Second
+
+	// storageServiceVersion is the version of the storage REST API used to get
+	// user delegation keys.
+	storageServiceVersion = "2021-12-02"
+
+	// storageScope is the scope of tokens for the storage services. It is the
+	// same in every Azure cloud.
+	storageScope = "https://storage.azure.com/.default"
+
+	// keyVaultAPIVersion is the version of the Key Vault REST API used to
+	// write secrets.
+	keyVaultAPIVersion = "7.4"
+)
+
+// UserDelegationKey is a key to sign user delegation SAS tokens, as returned
+// by the blob service. The value is base64 encoded.
+type UserDelegationKey struct {
+	SignedOID     string    `xml:"SignedOid"`
+	SignedTID     string    `xml:"SignedTid"`
+	SignedStart   time.Time `xml:"SignedStart"`
+	SignedExpiry  time.Time `xml:"SignedExpiry"`
+	SignedService string    `xml:"SignedService"`
+	SignedVersion string    `xml:"SignedVersion"`
+	Value         string    `xml:"Value"`
+}
+
+// Resources without an SDK client in this module are managed with the generic
+// ARM client, at these versions of their APIs.
+const (
+	cosmosDBAPIVersion   = "2024-05-15"
+	serviceBusAPIVersion = "2021-11-01"
+	eventHubsAPIVersion  = "2024-01-01"
+
+	cosmosDBResourceType = "Microsoft.DocumentDB/databaseAccounts"
+
+	managedClustersAPIVersion  = "2024-02-01"
+	managedClusterResourceType = "Microsoft.ContainerService/managedClusters"
+
+	resourceGroupsAPIVersion  = "2021-04-01"
+	resourceGroupResourceType = "Microsoft.Resources/resourceGroups"
+
+	managedIdentityAPIVersion        = "2023-01-31"
+	userAssignedIdentityResourceType = "Microsoft.ManagedIdentity/userAssignedIdentities"
+)
+
+// CosmosDBAccount is a Cosmos DB account, as returned by ARM.
+type CosmosDBAccount struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		DocumentEndpoint string `json:"documentEndpoint"`
+	} `json:"properties"`
+}
+
+// CosmosDBKeys are the keys of a Cosmos DB account.
+type CosmosDBKeys struct {
+	PrimaryMasterKey           string `json:"primaryMasterKey"`
+	SecondaryMasterKey         string `json:"secondaryMasterKey"`
+	PrimaryReadonlyMasterKey   string `json:"primaryReadonlyMasterKey"`
+	SecondaryReadonlyMasterKey string `json:"secondaryReadonlyMasterKey"`
+}
+
+// AuthorizationRuleKeys are the keys of a Service Bus or Event Hubs
+// authorization rule.
+type AuthorizationRuleKeys struct {
+	KeyName                   string `json:"keyName"`
+	PrimaryKey                string `json:"primaryKey"`
+	SecondaryKey              string `json:"secondaryKey"`
+	PrimaryConnectionString   string `json:"primaryConnectionString"`
+	SecondaryConnectionString string `json:"secondaryConnectionString"`
+}
+
+// ManagedCluster is an AKS cluster, as returned by ARM.
+type ManagedCluster struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		Fqdn       string                    `json:"fqdn"`
+		AADProfile *ManagedClusterAADProfile `json:"aadProfile"`
+	} `json:"properties"`
+}
+
+// ManagedClusterAADProfile is the Azure AD integration of an AKS cluster.
+type ManagedClusterAADProfile struct {
+	Managed         bool `json:"managed"`
+	EnableAzureRBAC bool `json:"enableAzureRBAC"`
+}
+
+// ResourceGroup is a resource group, as returned by ARM.
+type ResourceGroup struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+// UserAssignedIdentity is a user-assigned managed identity, as returned by ARM.
+type UserAssignedIdentity struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		ClientID    string `json:"clientId"`
+		PrincipalID string `json:"principalId"`
+		TenantID    string `json:"tenantId"`
+	} `json:"properties"`
 }
 
 var _ AzureProvider = (*provider)(nil)
@@ -54,6 +220,21 @@ type provider struct {
 	groupsClient api.GroupsClient
 	raClient     *armauthorization.RoleAssignmentsClient
 	rdClient     *armauthorization.RoleDefinitionsClient
+	armClient    *arm.Client
+
+	// Storage accounts and container registries may be in any subscription,
+	// so their clients are created for each request from the credential and
+	// options.
+	cred       azcore.TokenCredential
+	armOptions *arm.ClientOptions
+
+	// storagePipeline sends requests to the storage services of any account.
+	storagePipeline runtime.Pipeline
+
+	// keyVaultPipeline sends requests to any key vault of the configured
+	// cloud, whose Key Vault service is keyVault.
+	keyVault         cloud.ServiceConfiguration
+	keyVaultPipeline runtime.Pipeline
 }
 
 // newAzureProvider creates an azureProvider, backed by Azure client objects for underlying services.
@@ -65,7 +246,10 @@ func newAzureProvider(settings *clientSettings) (AzureProvider, error) {
 		return nil, err
 	}
 
-	msGraphAppClient, err := api.NewMSGraphClient(settings.GraphURI, cred)
+	// Graph requests are sent through the middleware of the Graph SDK rather
+	// than an Azure SDK pipeline, so its attempts are recorded separately.
+	graphTransport := attemptTransport{next: khttp.GetDefaultTransport()}
+	msGraphAppClient, err := api.NewMSGraphClient(settings.GraphURI, cred, graphTransport)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MS graph client: %w", err)
 	}
@@ -82,15 +266,34 @@ func newAzureProvider(settings *clientSettings) (AzureProvider, error) {
 		return nil, err
 	}
 
+	// Permissions, and the resources the SDK clients in use don't cover, are
+	// requested with a generic ARM client. The SDK's permissions client doesn't
+	// support every scope, nor return conditions. The client isn't specific to
+	// any SDK module, so it is created under the plugin's name without the SDK
+	// telemetry, which the transporter replaces with the plugin's user agent.
+	genericOpts := *opts
+	genericOpts.Telemetry.Disabled = true
+	armClient, err := arm.NewClient(userAgentPluginName, "", cred, &genericOpts)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &provider{
 		appClient:    msGraphAppClient,
 		spClient:     msGraphAppClient,
 		groupsClient: msGraphAppClient,
 		raClient:     raClient,
 		rdClient:     rdClient,
+		armClient:    armClient,
+		cred:         cred,
+		armOptions:   opts,
+
+		storagePipeline:  newStoragePipeline(cred, opts),
+		keyVault:         settings.keyVault(),
+		keyVaultPipeline: newKeyVaultPipeline(cred, opts, settings.keyVault()),
 	}
 
-	return p, nil
+	return newInstrumentedProvider(p, settings.Logger), nil
 }
 
 func getTokenCredential(s *clientSettings) (azcore.TokenCredential, error) {
@@ -139,7 +342,7 @@ func (tp transporter) Do(req *http.Request) (*http.Response, error) {
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		return http.ErrUseLastResponse
 	}
-	resp, err := client.Do(req)
+	resp, err := sendAttempt(req, client.Do)
 	if err != nil {
 		return nil, err
 	}
@@ -159,14 +362,18 @@ func getClientOptions(s *clientSettings, httpClient *http.Client) *arm.ClientOpt
 }
 
 // CreateApplication create a new Azure application object.
-func (p *provider) CreateApplication(ctx context.Context, displayName string, signInAudience string, tags []string) (result api.Application, err error) {
-	return p.appClient.CreateApplication(ctx, displayName, signInAudience, tags)
+func (p *provider) CreateApplication(ctx context.Context, app api.Application) (result api.Application, err error) {
+	return p.appClient.CreateApplication(ctx, app)
 }
 
 func (p *provider) GetApplication(ctx context.Context, applicationObjectID string) (result api.Application, err error) {
 	return p.appClient.GetApplication(ctx, applicationObjectID)
 }
 
+func (p *provider) GetApplicationByObjectID(ctx context.Context, applicationObjectID string) (result api.Application, err error) {
+	return p.appClient.GetApplicationByObjectID(ctx, applicationObjectID)
+}
+
 func (p *provider) ListApplications(ctx context.Context, filter string) ([]api.Application, error) {
 	return p.appClient.ListApplications(ctx, filter)
 }
@@ -187,14 +394,23 @@ func (p *provider) RemoveApplicationPassword(ctx context.Context, applicationObj
 
 // CreateServicePrincipal creates a new Azure service principal.
 // An Application must be created prior to calling this and pass in parameters.
-func (p *provider) CreateServicePrincipal(ctx context.Context, appID string, startDate time.Time, endDate time.Time) (id string, password string, err error) {
-	return p.spClient.CreateServicePrincipal(ctx, appID, startDate, endDate)
+func (p *provider) CreateServicePrincipal(ctx context.Context, appID string, attributes api.CustomSecurityAttributes, startDate time.Time, endDate time.Time) (id string, password string, err error) {
+	return p.spClient.CreateServicePrincipal(ctx, appID, attributes, startDate, endDate)
 }
 
 func (p *provider) DeleteServicePrincipal(ctx context.Context, spObjectID string, permanentlyDelete bool) error {
 	return p.spClient.DeleteServicePrincipal(ctx, spObjectID, permanentlyDelete)
 }
 
+func (p *provider) GetServicePrincipalByID(ctx context.Context, spObjectID string) (api.ServicePrincipal, error) {
+	return p.spClient.GetServicePrincipalByID(ctx, spObjectID)
+}
+
+// ListServicePrincipalGroups lists the groups a service principal is a direct member of.
+func (p *provider) ListServicePrincipalGroups(ctx context.Context, spObjectID string) ([]api.Group, error) {
+	return p.spClient.ListServicePrincipalGroups(ctx, spObjectID)
+}
+
 // ListRoles like all Azure roles with a scope (often subscription).
 func (p *provider) ListRoleDefinitions(ctx context.Context, scope string, filter string) (result []*armauthorization.RoleDefinition, err error) {
 	options := armauthorization.RoleDefinitionsClientListOptions{
@@ -229,6 +445,626 @@ func (p *provider) DeleteRoleAssignmentByID(ctx context.Context, roleAssignmentI
 	return p.raClient.DeleteByID(ctx, roleAssignmentID, nil)
 }
 
+// ListRoleAssignments lists the role assignments at, above and below a scope
+// that match the filter.
+func (p *provider) ListRoleAssignments(ctx context.Context, scope string, filter string) ([]*armauthorization.RoleAssignment, error) {
+	options := armauthorization.RoleAssignmentsClientListForScopeOptions{
+		Filter: &filter,
+	}
+
+	var result []*armauthorization.RoleAssignment
+	pager := p.raClient.NewListForScopePager(scope, &options)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, page.Value...)
+	}
+
+	return result, nil
+}
+
+// ListPermissions lists the permissions the caller has at a scope.
+func (p *provider) ListPermissions(ctx context.Context, scope string) ([]Permission, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodGet,
+		runtime.JoinPaths(p.armClient.Endpoint(), scope, "/providers/Microsoft.Authorization/permissions"))
+	if err != nil {
+		return nil, err
+	}
+	q := req.Raw().URL.Query()
+	q.Set("api-version", permissionsAPIVersion)
+	req.Raw().URL.RawQuery = q.Encode()
+
+	var result []Permission
+	for {
+		resp, err := p.armClient.Pipeline().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if !runtime.HasStatusCode(resp, http.StatusOK) {
+			return nil, runtime.NewResponseError(resp)
+		}
+
+		var page struct {
+			Value    []Permission `json:"value"`
+			NextLink string       `json:"nextLink"`
+		}
+		if err := runtime.UnmarshalAsJSON(resp, &page); err != nil {
+			return nil, err
+		}
+		result = append(result, page.Value...)
+
+		if page.NextLink == "" {
+			return result, nil
+		}
+		req, err = runtime.NewRequest(ctx, http.MethodGet, page.NextLink)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// GetStorageAccount gets the properties of the storage account with the given
+// resource ID.
+func (p *provider) GetStorageAccount(ctx context.Context, accountID string) (armstorage.AccountsClientGetPropertiesResponse, error) {
+	client, id, err := p.storageAccountsClient(accountID)
+	if err != nil {
+		return armstorage.AccountsClientGetPropertiesResponse{}, err
+	}
+	return client.GetProperties(ctx, id.ResourceGroupName, id.Name, nil)
+}
+
+// ListStorageAccountKeys lists the access keys of the storage account with the
+// given resource ID.
+func (p *provider) ListStorageAccountKeys(ctx context.Context, accountID string) ([]*armstorage.AccountKey, error) {
+	client, id, err := p.storageAccountsClient(accountID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.ListKeys(ctx, id.ResourceGroupName, id.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// RegenerateStorageAccountKey regenerates an access key of the storage account
+// with the given resource ID, and returns the keys of the account.
+func (p *provider) RegenerateStorageAccountKey(ctx context.Context, accountID string, keyName string) ([]*armstorage.AccountKey, error) {
+	client, id, err := p.storageAccountsClient(accountID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.RegenerateKey(ctx, id.ResourceGroupName, id.Name, armstorage.AccountRegenerateKeyParameters{
+		KeyName: &keyName,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+func (p *provider) storageAccountsClient(accountID string) (*armstorage.AccountsClient, *arm.ResourceID, error) {
+	id, err := parseResourceID(accountID, "Microsoft.Storage/storageAccounts")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := armstorage.NewAccountsClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, id, nil
+}
+
+// GetUserDelegationKey gets a key to sign user delegation SAS tokens for the
+// blob service at blobEndpoint. The key is valid from start until expiry.
+func (p *provider) GetUserDelegationKey(ctx context.Context, blobEndpoint string, start time.Time, expiry time.Time) (UserDelegationKey, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodPost, blobEndpoint)
+	if err != nil {
+		return UserDelegationKey{}, err
+	}
+	q := req.Raw().URL.Query()
+	q.Set("restype", "service")
+	q.Set("comp", "userdelegationkey")
+	req.Raw().URL.RawQuery = q.Encode()
+	req.Raw().Header.Set("x-ms-version", storageServiceVersion)
+
+	keyInfo := struct {
+		XMLName xml.Name `xml:"KeyInfo"`
+		Start   string   `xml:"Start"`
+		Expiry  string   `xml:"Expiry"`
+	}{
+		Start:  start.UTC().Format(sasTimeFormat),
+		Expiry: expiry.UTC().Format(sasTimeFormat),
+	}
+	if err := runtime.MarshalAsXML(req, keyInfo); err != nil {
+		return UserDelegationKey{}, err
+	}
+
+	resp, err := p.storagePipeline.Do(req)
+	if err != nil {
+		return UserDelegationKey{}, err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return UserDelegationKey{}, runtime.NewResponseError(resp)
+	}
+
+	var key UserDelegationKey
+	if err := runtime.UnmarshalAsXML(resp, &key); err != nil {
+		return UserDelegationKey{}, err
+	}
+	return key, nil
+}
+
+// GetContainerRegistry gets the container registry with the given resource ID.
+func (p *provider) GetContainerRegistry(ctx context.Context, registryID string) (armcontainerregistry.RegistriesClientGetResponse, error) {
+	id, err := parseResourceID(registryID, registryResourceType)
+	if err != nil {
+		return armcontainerregistry.RegistriesClientGetResponse{}, err
+	}
+	client, err := armcontainerregistry.NewRegistriesClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return armcontainerregistry.RegistriesClientGetResponse{}, err
+	}
+	return client.Get(ctx, id.ResourceGroupName, id.Name, nil)
+}
+
+// CreateScopeMap creates or updates a scope map of the container registry with
+// the given resource ID, and waits for the operation to complete.
+func (p *provider) CreateScopeMap(ctx context.Context, registryID string, name string, scopeMap armcontainerregistry.ScopeMap) (armcontainerregistry.ScopeMap, error) {
+	id, err := parseResourceID(registryID, registryResourceType)
+	if err != nil {
+		return armcontainerregistry.ScopeMap{}, err
+	}
+	client, err := armcontainerregistry.NewScopeMapsClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return armcontainerregistry.ScopeMap{}, err
+	}
+	poller, err := client.BeginCreate(ctx, id.ResourceGroupName, id.Name, name, scopeMap, nil)
+	if err != nil {
+		return armcontainerregistry.ScopeMap{}, err
+	}
+	resp, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: armPollFrequency})
+	if err != nil {
+		return armcontainerregistry.ScopeMap{}, err
+	}
+	return resp.ScopeMap, nil
+}
+
+// DeleteScopeMap deletes a scope map of the container registry with the given
+// resource ID, and waits for the operation to complete.
+func (p *provider) DeleteScopeMap(ctx context.Context, registryID string, name string) error {
+	id, err := parseResourceID(registryID, registryResourceType)
+	if err != nil {
+		return err
+	}
+	client, err := armcontainerregistry.NewScopeMapsClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return err
+	}
+	poller, err := client.BeginDelete(ctx, id.ResourceGroupName, id.Name, name, nil)
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: armPollFrequency})
+	return err
+}
+
+// CreateRegistryToken creates or updates a token of the container registry
+// with the given resource ID, and waits for the operation to complete.
+func (p *provider) CreateRegistryToken(ctx context.Context, registryID string, name string, token armcontainerregistry.Token) (armcontainerregistry.Token, error) {
+	id, err := parseResourceID(registryID, registryResourceType)
+	if err != nil {
+		return armcontainerregistry.Token{}, err
+	}
+	client, err := armcontainerregistry.NewTokensClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return armcontainerregistry.Token{}, err
+	}
+	poller, err := client.BeginCreate(ctx, id.ResourceGroupName, id.Name, name, token, nil)
+	if err != nil {
+		return armcontainerregistry.Token{}, err
+	}
+	resp, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: armPollFrequency})
+	if err != nil {
+		return armcontainerregistry.Token{}, err
+	}
+	return resp.Token, nil
+}
+
+// DeleteRegistryToken deletes a token of the container registry with the given
+// resource ID, and waits for the operation to complete.
+func (p *provider) DeleteRegistryToken(ctx context.Context, registryID string, name string) error {
+	id, err := parseResourceID(registryID, registryResourceType)
+	if err != nil {
+		return err
+	}
+	client, err := armcontainerregistry.NewTokensClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return err
+	}
+	poller, err := client.BeginDelete(ctx, id.ResourceGroupName, id.Name, name, nil)
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: armPollFrequency})
+	return err
+}
+
+// GenerateRegistryCredentials generates a password for a token of the
+// container registry with the given resource ID.
+func (p *provider) GenerateRegistryCredentials(ctx context.Context, registryID string, params armcontainerregistry.GenerateCredentialsParameters) (armcontainerregistry.GenerateCredentialsResult, error) {
+	id, err := parseResourceID(registryID, registryResourceType)
+	if err != nil {
+		return armcontainerregistry.GenerateCredentialsResult{}, err
+	}
+	client, err := armcontainerregistry.NewRegistriesClient(id.SubscriptionID, p.cred, p.armOptions)
+	if err != nil {
+		return armcontainerregistry.GenerateCredentialsResult{}, err
+	}
+	poller, err := client.BeginGenerateCredentials(ctx, id.ResourceGroupName, id.Name, params, nil)
+	if err != nil {
+		return armcontainerregistry.GenerateCredentialsResult{}, err
+	}
+	resp, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: armPollFrequency})
+	if err != nil {
+		return armcontainerregistry.GenerateCredentialsResult{}, err
+	}
+	return resp.GenerateCredentialsResult, nil
+}
+
+// GetCosmosDBAccount gets the Cosmos DB account with the given resource ID.
+func (p *provider) GetCosmosDBAccount(ctx context.Context, accountID string) (CosmosDBAccount, error) {
+	var account CosmosDBAccount
+	if _, err := parseResourceID(accountID, cosmosDBResourceType); err != nil {
+		return account, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodGet, accountID, cosmosDBAPIVersion, nil)
+	if err != nil {
+		return account, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &account)
+	return account, err
+}
+
+// ListCosmosDBKeys lists the keys of the Cosmos DB account with the given
+// resource ID.
+func (p *provider) ListCosmosDBKeys(ctx context.Context, accountID string) (CosmosDBKeys, error) {
+	var keys CosmosDBKeys
+	if _, err := parseResourceID(accountID, cosmosDBResourceType); err != nil {
+		return keys, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodPost, accountID+"/listKeys", cosmosDBAPIVersion, nil)
+	if err != nil {
+		return keys, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &keys)
+	return keys, err
+}
+
+// RegenerateCosmosDBKey regenerates a key of the Cosmos DB account with the
+// given resource ID, and waits for the operation to complete.
+func (p *provider) RegenerateCosmosDBKey(ctx context.Context, accountID string, keyKind string) error {
+	if _, err := parseResourceID(accountID, cosmosDBResourceType); err != nil {
+		return err
+	}
+	resp, err := p.armRequest(ctx, http.MethodPost, accountID+"/regenerateKey", cosmosDBAPIVersion,
+		map[string]string{"keyKind": keyKind})
+	if err != nil {
+		return err
+	}
+	poller, err := runtime.NewPoller[struct{}](resp, p.armClient.Pipeline(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: armPollFrequency})
+	return err
+}
+
+// ListAuthorizationRuleKeys lists the keys of the Service Bus or Event Hubs
+// authorization rule with the given resource ID.
+func (p *provider) ListAuthorizationRuleKeys(ctx context.Context, ruleID string) (AuthorizationRuleKeys, error) {
+	var keys AuthorizationRuleKeys
+	apiVersion, err := authorizationRuleAPIVersion(ruleID)
+	if err != nil {
+		return keys, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodPost, ruleID+"/listKeys", apiVersion, nil)
+	if err != nil {
+		return keys, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &keys)
+	return keys, err
+}
+
+// RegenerateAuthorizationRuleKey regenerates the primary or secondary key of
+// the Service Bus or Event Hubs authorization rule with the given resource ID.
+func (p *provider) RegenerateAuthorizationRuleKey(ctx context.Context, ruleID string, keyType string) (AuthorizationRuleKeys, error) {
+	var keys AuthorizationRuleKeys
+	apiVersion, err := authorizationRuleAPIVersion(ruleID)
+	if err != nil {
+		return keys, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodPost, ruleID+"/regenerateKeys", apiVersion,
+		map[string]string{"keyType": keyType})
+	if err != nil {
+		return keys, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &keys)
+	return keys, err
+}
+
+// GetManagedCluster gets the AKS cluster with the given resource ID.
+func (p *provider) GetManagedCluster(ctx context.Context, clusterID string) (ManagedCluster, error) {
+	var cluster ManagedCluster
+	if _, err := parseResourceID(clusterID, managedClusterResourceType); err != nil {
+		return cluster, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodGet, clusterID, managedClustersAPIVersion, nil)
+	if err != nil {
+		return cluster, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &cluster)
+	return cluster, err
+}
+
+// GetClusterUserKubeconfig gets the user kubeconfig of the AKS cluster with the
+// given resource ID, which has the server and CA of the cluster.
+func (p *provider) GetClusterUserKubeconfig(ctx context.Context, clusterID string) ([]byte, error) {
+	if _, err := parseResourceID(clusterID, managedClusterResourceType); err != nil {
+		return nil, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodPost, clusterID+"/listClusterUserCredential", managedClustersAPIVersion, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Kubeconfigs []struct {
+			Name  string `json:"name"`
+			Value []byte `json:"value"`
+		} `json:"kubeconfigs"`
+	}
+	if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Kubeconfigs) == 0 {
+		return nil, fmt.Errorf("no user credentials returned for cluster %q", clusterID)
+	}
+	return result.Kubeconfigs[0].Value, nil
+}
+
+// GetResourceGroup gets the resource group with the given resource ID.
+func (p *provider) GetResourceGroup(ctx context.Context, resourceGroupID string) (ResourceGroup, error) {
+	var group ResourceGroup
+	if _, err := parseResourceID(resourceGroupID, resourceGroupResourceType); err != nil {
+		return group, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodGet, resourceGroupID, resourceGroupsAPIVersion, nil)
+	if err != nil {
+		return group, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &group)
+	return group, err
+}
+
+// CreateUserAssignedIdentity creates a user-assigned managed identity with the
+// given resource ID in the location.
+func (p *provider) CreateUserAssignedIdentity(ctx context.Context, identityID string, location string, tags map[string]string) (UserAssignedIdentity, error) {
+	var identity UserAssignedIdentity
+	if _, err := parseResourceID(identityID, userAssignedIdentityResourceType); err != nil {
+		return identity, err
+	}
+	resp, err := p.armRequest(ctx, http.MethodPut, identityID, managedIdentityAPIVersion, map[string]interface{}{
+		"location": location,
+		"tags":     tags,
+	})
+	if err != nil {
+		return identity, err
+	}
+	err = runtime.UnmarshalAsJSON(resp, &identity)
+	return identity, err
+}
+
+// DeleteUserAssignedIdentity deletes the user-assigned managed identity with
+// the given resource ID, along with its federated credentials.
+func (p *provider) DeleteUserAssignedIdentity(ctx context.Context, identityID string) error {
+	if _, err := parseResourceID(identityID, userAssignedIdentityResourceType); err != nil {
+		return err
+	}
+	_, err := p.armRequest(ctx, http.MethodDelete, identityID, managedIdentityAPIVersion, nil)
+	return err
+}
+
+// CreateFederatedIdentityCredential creates or updates a federated credential
+// of the user-assigned managed identity with the given resource ID.
+func (p *provider) CreateFederatedIdentityCredential(ctx context.Context, identityID string, credential *FederatedCredential) error {
+	if _, err := parseResourceID(identityID, userAssignedIdentityResourceType); err != nil {
+		return err
+	}
+	_, err := p.armRequest(ctx, http.MethodPut, identityID+"/federatedIdentityCredentials/"+credential.Name, managedIdentityAPIVersion, map[string]interface{}{
+		"properties": map[string]interface{}{
+			"issuer":    credential.Issuer,
+			"subject":   credential.Subject,
+			"audiences": credential.Audiences,
+		},
+	})
+	return err
+}
+
+// SetKeyVaultSecret sets the value of the secret with the given name in the
+// key vault at vaultURL, which adds a new version of the secret, and returns
+// the ID of that version.
+func (p *provider) SetKeyVaultSecret(ctx context.Context, vaultURL string, name string, value string, contentType string, tags map[string]string) (string, error) {
+	resp, err := p.keyVaultRequest(ctx, http.MethodPut, runtime.JoinPaths(vaultURL, "secrets", name), map[string]interface{}{
+		"value":       value,
+		"contentType": contentType,
+		"tags":        tags,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		ID string `json:"id"`
+	}
+	if err := runtime.UnmarshalAsJSON(resp, &secret); err != nil {
+		return "", err
+	}
+	return secret.ID, nil
+}
+
+// DisableKeyVaultSecret disables the version of a Key Vault secret with the
+// given ID, so it can no longer be read.
+func (p *provider) DisableKeyVaultSecret(ctx context.Context, secretID string) error {
+	_, err := p.keyVaultRequest(ctx, http.MethodPatch, secretID, map[string]interface{}{
+		"attributes": map[string]interface{}{
+			"enabled": false,
+		},
+	})
+	return err
+}
+
+// keyVaultRequest sends a request to the data plane of a key vault. Key vaults
+// may be in any subscription, but must be in the configured cloud.
+func (p *provider) keyVaultRequest(ctx context.Context, method, rawURL string, body interface{}) (*http.Response, error) {
+	if _, err := keyVaultScope(rawURL, p.keyVault); err != nil {
+		return nil, err
+	}
+
+	req, err := runtime.NewRequest(ctx, method, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := req.Raw().URL.Query()
+	q.Set("api-version", keyVaultAPIVersion)
+	req.Raw().URL.RawQuery = q.Encode()
+	if err := runtime.MarshalAsJSON(req, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := p.keyVaultPipeline.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return nil, runtime.NewResponseError(resp)
+	}
+	return resp, nil
+}
+
+// keyVaultScope returns the scope of tokens for the key vault of the URL,
+// which must be under the DNS suffix of the key vaults of the cloud, such as
+// vault.azure.net.
+func keyVaultScope(rawURL string, keyVault cloud.ServiceConfiguration) (string, error) {
+	if keyVault.Endpoint == "" {
+		return "", errors.New("key vaults are not supported in the configured cloud")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid key vault URL %q: %w", rawURL, err)
+	}
+	host, suffix := strings.ToLower(u.Hostname()), "."+keyVault.Endpoint
+	name := strings.TrimSuffix(host, suffix)
+	if u.Scheme != "https" || !strings.HasSuffix(host, suffix) || name == "" || strings.Contains(name, ".") {
+		return "", fmt.Errorf("invalid key vault URL %q; key vaults of the configured cloud are under %s", rawURL, keyVault.Endpoint)
+	}
+	return keyVault.Audience + "/.default", nil
+}
+
+// armRequest sends a request for the resource with the generic ARM client. A
+// non-nil body is sent as JSON. Responses other than 200 OK, 201 Created, 202
+// Accepted and 204 No Content are returned as errors.
+func (p *provider) armRequest(ctx context.Context, method, resourcePath, apiVersion string, body interface{}) (*http.Response, error) {
+	req, err := runtime.NewRequest(ctx, method, runtime.JoinPaths(p.armClient.Endpoint(), resourcePath))
+	if err != nil {
+		return nil, err
+	}
+	q := req.Raw().URL.Query()
+	q.Set("api-version", apiVersion)
+	req.Raw().URL.RawQuery = q.Encode()
+	if body != nil {
+		if err := runtime.MarshalAsJSON(req, body); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := p.armClient.Pipeline().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent) {
+		return nil, runtime.NewResponseError(resp)
+	}
+	return resp, nil
+}
+
+// authorizationRuleAPIVersion checks that the ID is of a Service Bus or Event
+// Hubs authorization rule, of a namespace or an entity in it, and returns the
+// API version of its service.
+func authorizationRuleAPIVersion(ruleID string) (string, error) {
+	id, err := arm.ParseResourceID(ruleID)
+	if err != nil {
+		return "", fmt.Errorf("invalid resource ID %q: %w", ruleID, err)
+	}
+	types := id.ResourceType.Types
+	if len(types) == 0 || !strings.EqualFold(types[0], "namespaces") || !strings.EqualFold(types[len(types)-1], "authorizationRules") {
+		return "", fmt.Errorf("%q is not an authorization rule resource ID", ruleID)
+	}
+
+	switch strings.ToLower(id.ResourceType.Namespace) {
+	case "microsoft.servicebus":
+		return serviceBusAPIVersion, nil
+	case "microsoft.eventhub":
+		return eventHubsAPIVersion, nil
+	default:
+		return "", fmt.Errorf("%q is not a Service Bus or Event Hubs resource ID", ruleID)
+	}
+}
+
+// parseResourceID parses an ARM resource ID and checks that it is of the
+// given resource type.
+func parseResourceID(resourceID, resourceType string) (*arm.ResourceID, error) {
+	id, err := arm.ParseResourceID(resourceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource ID %q: %w", resourceID, err)
+	}
+	if !strings.EqualFold(id.ResourceType.String(), resourceType) {
+		return nil, fmt.Errorf("%q is not a %s resource ID", resourceID, resourceType)
+	}
+	return id, nil
+}
+
+// isResourceNotFound reports whether err is an ARM response error for a
+// resource that doesn't exist.
+func isResourceNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// newStoragePipeline creates a pipeline for requests to the storage services,
+// authorized with tokens for the storage scope.
+func newStoragePipeline(cred azcore.TokenCredential, opts *arm.ClientOptions) runtime.Pipeline {
+	return runtime.NewPipeline(userAgentPluginName, "", runtime.PipelineOptions{
+		PerRetry: []policy.Policy{
+			runtime.NewBearerTokenPolicy(cred, []string{storageScope}, nil),
+		},
+	}, &opts.ClientOptions)
+}
+
+// newKeyVaultPipeline creates a pipeline for requests to the key vaults of the
+// cloud, authorized with tokens for the Key Vault scope of the cloud.
+func newKeyVaultPipeline(cred azcore.TokenCredential, opts *arm.ClientOptions, keyVault cloud.ServiceConfiguration) runtime.Pipeline {
+	return runtime.NewPipeline(userAgentPluginName, "", runtime.PipelineOptions{
+		PerRetry: []policy.Policy{
+			runtime.NewBearerTokenPolicy(cred, []string{keyVault.Audience + "/.default"}, nil),
+		},
+	}, &opts.ClientOptions)
+}
+
 // AddGroupMember adds a member to a Group.
 func (p *provider) AddGroupMember(ctx context.Context, groupObjectID string, memberObjectID string) (err error) {
 	return p.groupsClient.AddGroupMember(ctx, groupObjectID, memberObjectID)
@@ -239,6 +1075,16 @@ func (p *provider) RemoveGroupMember(ctx context.Context, groupObjectID, memberO
 	return p.groupsClient.RemoveGroupMember(ctx, groupObjectID, memberObjectID)
 }
 
+// AddGroupOwner adds an owner to a Group.
+func (p *provider) AddGroupOwner(ctx context.Context, groupObjectID string, ownerObjectID string) (err error) {
+	return p.groupsClient.AddGroupOwner(ctx, groupObjectID, ownerObjectID)
+}
+
+// RemoveGroupOwner removes an owner from a Group.
+func (p *provider) RemoveGroupOwner(ctx context.Context, groupObjectID, ownerObjectID string) (err error) {
+	return p.groupsClient.RemoveGroupOwner(ctx, groupObjectID, ownerObjectID)
+}
+
 // GetGroup gets group information from the directory.
 func (p *provider) GetGroup(ctx context.Context, objectID string) (result api.Group, err error) {
 	return p.groupsClient.GetGroup(ctx, objectID)
@@ -248,3 +1094,8 @@ func (p *provider) GetGroup(ctx context.Context, objectID string) (result api.Gr
 func (p *provider) ListGroups(ctx context.Context, filter string) (result []api.Group, err error) {
 	return p.groupsClient.ListGroups(ctx, filter)
 }
+
+// QueryGroups gets up to limit groups of the current tenant that match the filter.
+func (p *provider) QueryGroups(ctx context.Context, filter string, limit int) (result []api.Group, err error) {
+	return p.groupsClient.QueryGroups(ctx, filter, limit)
+}
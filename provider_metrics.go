@@ -0,0 +1,322 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerregistry/armcontainerregistry"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/hashicorp/vault-plugin-secrets-azure/api"
+)
+
+var _ AzureProvider = (*instrumentedProvider)(nil)
+
+// instrumentedProvider emits metrics for each call of an AzureProvider, so
+// that slow requests can be traced to Graph or ARM and to the operation. The
+// request IDs of failed calls are written to the logger.
+type instrumentedProvider struct {
+	next   AzureProvider
+	logger hclog.Logger
+}
+
+func newInstrumentedProvider(next AzureProvider, logger hclog.Logger) *instrumentedProvider {
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	return &instrumentedProvider{next: next, logger: logger}
+}
+
+func (p *instrumentedProvider) GetApplication(ctx context.Context, clientID string) (api.Application, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "GetApplication", func(ctx context.Context) (api.Application, error) {
+		return p.next.GetApplication(ctx, clientID)
+	})
+}
+
+func (p *instrumentedProvider) GetApplicationByObjectID(ctx context.Context, applicationObjectID string) (api.Application, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "GetApplicationByObjectID", func(ctx context.Context) (api.Application, error) {
+		return p.next.GetApplicationByObjectID(ctx, applicationObjectID)
+	})
+}
+
+func (p *instrumentedProvider) CreateApplication(ctx context.Context, app api.Application) (api.Application, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "CreateApplication", func(ctx context.Context) (api.Application, error) {
+		return p.next.CreateApplication(ctx, app)
+	})
+}
+
+func (p *instrumentedProvider) DeleteApplication(ctx context.Context, applicationObjectID string, permanentlyDelete bool) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "DeleteApplication", func(ctx context.Context) error {
+		return p.next.DeleteApplication(ctx, applicationObjectID, permanentlyDelete)
+	})
+}
+
+func (p *instrumentedProvider) ListApplications(ctx context.Context, filter string) ([]api.Application, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "ListApplications", func(ctx context.Context) ([]api.Application, error) {
+		return p.next.ListApplications(ctx, filter)
+	})
+}
+
+func (p *instrumentedProvider) AddApplicationPassword(ctx context.Context, applicationObjectID string, displayName string, endDateTime time.Time) (api.PasswordCredential, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "AddApplicationPassword", func(ctx context.Context) (api.PasswordCredential, error) {
+		return p.next.AddApplicationPassword(ctx, applicationObjectID, displayName, endDateTime)
+	})
+}
+
+func (p *instrumentedProvider) RemoveApplicationPassword(ctx context.Context, applicationObjectID string, keyID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "RemoveApplicationPassword", func(ctx context.Context) error {
+		return p.next.RemoveApplicationPassword(ctx, applicationObjectID, keyID)
+	})
+}
+
+func (p *instrumentedProvider) AddGroupMember(ctx context.Context, groupObjectID string, memberObjectID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "AddGroupMember", func(ctx context.Context) error {
+		return p.next.AddGroupMember(ctx, groupObjectID, memberObjectID)
+	})
+}
+
+func (p *instrumentedProvider) RemoveGroupMember(ctx context.Context, groupObjectID, memberObjectID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "RemoveGroupMember", func(ctx context.Context) error {
+		return p.next.RemoveGroupMember(ctx, groupObjectID, memberObjectID)
+	})
+}
+
+func (p *instrumentedProvider) AddGroupOwner(ctx context.Context, groupObjectID string, ownerObjectID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "AddGroupOwner", func(ctx context.Context) error {
+		return p.next.AddGroupOwner(ctx, groupObjectID, ownerObjectID)
+	})
+}
+
+func (p *instrumentedProvider) RemoveGroupOwner(ctx context.Context, groupObjectID, ownerObjectID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "RemoveGroupOwner", func(ctx context.Context) error {
+		return p.next.RemoveGroupOwner(ctx, groupObjectID, ownerObjectID)
+	})
+}
+
+func (p *instrumentedProvider) GetGroup(ctx context.Context, objectID string) (api.Group, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "GetGroup", func(ctx context.Context) (api.Group, error) {
+		return p.next.GetGroup(ctx, objectID)
+	})
+}
+
+func (p *instrumentedProvider) ListGroups(ctx context.Context, filter string) ([]api.Group, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "ListGroups", func(ctx context.Context) ([]api.Group, error) {
+		return p.next.ListGroups(ctx, filter)
+	})
+}
+
+func (p *instrumentedProvider) QueryGroups(ctx context.Context, filter string, limit int) ([]api.Group, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "QueryGroups", func(ctx context.Context) ([]api.Group, error) {
+		return p.next.QueryGroups(ctx, filter, limit)
+	})
+}
+
+func (p *instrumentedProvider) CreateServicePrincipal(ctx context.Context, appID string, attributes api.CustomSecurityAttributes, startDate time.Time, endDate time.Time) (string, string, error) {
+	type idPass struct {
+		ID       string
+		Password string
+	}
+
+	result, err := measureProviderCall(ctx, p.logger, serviceGraph, "CreateServicePrincipal", func(ctx context.Context) (idPass, error) {
+		id, password, err := p.next.CreateServicePrincipal(ctx, appID, attributes, startDate, endDate)
+		return idPass{ID: id, Password: password}, err
+	})
+	return result.ID, result.Password, err
+}
+
+func (p *instrumentedProvider) DeleteServicePrincipal(ctx context.Context, spObjectID string, permanentlyDelete bool) error {
+	return measureProviderCallErr(ctx, p.logger, serviceGraph, "DeleteServicePrincipal", func(ctx context.Context) error {
+		return p.next.DeleteServicePrincipal(ctx, spObjectID, permanentlyDelete)
+	})
+}
+
+func (p *instrumentedProvider) GetServicePrincipalByID(ctx context.Context, spObjectID string) (api.ServicePrincipal, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "GetServicePrincipalByID", func(ctx context.Context) (api.ServicePrincipal, error) {
+		return p.next.GetServicePrincipalByID(ctx, spObjectID)
+	})
+}
+
+func (p *instrumentedProvider) ListServicePrincipalGroups(ctx context.Context, spObjectID string) ([]api.Group, error) {
+	return measureProviderCall(ctx, p.logger, serviceGraph, "ListServicePrincipalGroups", func(ctx context.Context) ([]api.Group, error) {
+		return p.next.ListServicePrincipalGroups(ctx, spObjectID)
+	})
+}
+
+func (p *instrumentedProvider) CreateRoleAssignment(ctx context.Context, scope string, roleAssignmentName string, parameters armauthorization.RoleAssignmentCreateParameters) (armauthorization.RoleAssignmentsClientCreateResponse, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "CreateRoleAssignment", func(ctx context.Context) (armauthorization.RoleAssignmentsClientCreateResponse, error) {
+		return p.next.CreateRoleAssignment(ctx, scope, roleAssignmentName, parameters)
+	})
+}
+
+func (p *instrumentedProvider) DeleteRoleAssignmentByID(ctx context.Context, roleID string) (armauthorization.RoleAssignmentsClientDeleteByIDResponse, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "DeleteRoleAssignmentByID", func(ctx context.Context) (armauthorization.RoleAssignmentsClientDeleteByIDResponse, error) {
+		return p.next.DeleteRoleAssignmentByID(ctx, roleID)
+	})
+}
+
+func (p *instrumentedProvider) ListRoleAssignments(ctx context.Context, scope string, filter string) ([]*armauthorization.RoleAssignment, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "ListRoleAssignments", func(ctx context.Context) ([]*armauthorization.RoleAssignment, error) {
+		return p.next.ListRoleAssignments(ctx, scope, filter)
+	})
+}
+
+func (p *instrumentedProvider) ListRoleDefinitions(ctx context.Context, scope string, filter string) ([]*armauthorization.RoleDefinition, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "ListRoleDefinitions", func(ctx context.Context) ([]*armauthorization.RoleDefinition, error) {
+		return p.next.ListRoleDefinitions(ctx, scope, filter)
+	})
+}
+
+func (p *instrumentedProvider) GetRoleDefinitionByID(ctx context.Context, roleID string) (armauthorization.RoleDefinitionsClientGetByIDResponse, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetRoleDefinitionByID", func(ctx context.Context) (armauthorization.RoleDefinitionsClientGetByIDResponse, error) {
+		return p.next.GetRoleDefinitionByID(ctx, roleID)
+	})
+}
+
+func (p *instrumentedProvider) ListPermissions(ctx context.Context, scope string) ([]Permission, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "ListPermissions", func(ctx context.Context) ([]Permission, error) {
+		return p.next.ListPermissions(ctx, scope)
+	})
+}
+
+func (p *instrumentedProvider) GetStorageAccount(ctx context.Context, accountID string) (armstorage.AccountsClientGetPropertiesResponse, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetStorageAccount", func(ctx context.Context) (armstorage.AccountsClientGetPropertiesResponse, error) {
+		return p.next.GetStorageAccount(ctx, accountID)
+	})
+}
+
+func (p *instrumentedProvider) ListStorageAccountKeys(ctx context.Context, accountID string) ([]*armstorage.AccountKey, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "ListStorageAccountKeys", func(ctx context.Context) ([]*armstorage.AccountKey, error) {
+		return p.next.ListStorageAccountKeys(ctx, accountID)
+	})
+}
+
+func (p *instrumentedProvider) RegenerateStorageAccountKey(ctx context.Context, accountID string, keyName string) ([]*armstorage.AccountKey, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "RegenerateStorageAccountKey", func(ctx context.Context) ([]*armstorage.AccountKey, error) {
+		return p.next.RegenerateStorageAccountKey(ctx, accountID, keyName)
+	})
+}
+
+func (p *instrumentedProvider) GetUserDelegationKey(ctx context.Context, blobEndpoint string, start time.Time, expiry time.Time) (UserDelegationKey, error) {
+	return measureProviderCall(ctx, p.logger, serviceStorage, "GetUserDelegationKey", func(ctx context.Context) (UserDelegationKey, error) {
+		return p.next.GetUserDelegationKey(ctx, blobEndpoint, start, expiry)
+	})
+}
+
+func (p *instrumentedProvider) GetContainerRegistry(ctx context.Context, registryID string) (armcontainerregistry.RegistriesClientGetResponse, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetContainerRegistry", func(ctx context.Context) (armcontainerregistry.RegistriesClientGetResponse, error) {
+		return p.next.GetContainerRegistry(ctx, registryID)
+	})
+}
+
+func (p *instrumentedProvider) CreateScopeMap(ctx context.Context, registryID string, name string, scopeMap armcontainerregistry.ScopeMap) (armcontainerregistry.ScopeMap, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "CreateScopeMap", func(ctx context.Context) (armcontainerregistry.ScopeMap, error) {
+		return p.next.CreateScopeMap(ctx, registryID, name, scopeMap)
+	})
+}
+
+func (p *instrumentedProvider) DeleteScopeMap(ctx context.Context, registryID string, name string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceARM, "DeleteScopeMap", func(ctx context.Context) error {
+		return p.next.DeleteScopeMap(ctx, registryID, name)
+	})
+}
+
+func (p *instrumentedProvider) CreateRegistryToken(ctx context.Context, registryID string, name string, token armcontainerregistry.Token) (armcontainerregistry.Token, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "CreateRegistryToken", func(ctx context.Context) (armcontainerregistry.Token, error) {
+		return p.next.CreateRegistryToken(ctx, registryID, name, token)
+	})
+}
+
+func (p *instrumentedProvider) DeleteRegistryToken(ctx context.Context, registryID string, name string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceARM, "DeleteRegistryToken", func(ctx context.Context) error {
+		return p.next.DeleteRegistryToken(ctx, registryID, name)
+	})
+}
+
+func (p *instrumentedProvider) GenerateRegistryCredentials(ctx context.Context, registryID string, params armcontainerregistry.GenerateCredentialsParameters) (armcontainerregistry.GenerateCredentialsResult, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GenerateRegistryCredentials", func(ctx context.Context) (armcontainerregistry.GenerateCredentialsResult, error) {
+		return p.next.GenerateRegistryCredentials(ctx, registryID, params)
+	})
+}
+
+func (p *instrumentedProvider) GetCosmosDBAccount(ctx context.Context, accountID string) (CosmosDBAccount, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetCosmosDBAccount", func(ctx context.Context) (CosmosDBAccount, error) {
+		return p.next.GetCosmosDBAccount(ctx, accountID)
+	})
+}
+
+func (p *instrumentedProvider) ListCosmosDBKeys(ctx context.Context, accountID string) (CosmosDBKeys, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "ListCosmosDBKeys", func(ctx context.Context) (CosmosDBKeys, error) {
+		return p.next.ListCosmosDBKeys(ctx, accountID)
+	})
+}
+
+func (p *instrumentedProvider) RegenerateCosmosDBKey(ctx context.Context, accountID string, keyKind string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceARM, "RegenerateCosmosDBKey", func(ctx context.Context) error {
+		return p.next.RegenerateCosmosDBKey(ctx, accountID, keyKind)
+	})
+}
+
+func (p *instrumentedProvider) ListAuthorizationRuleKeys(ctx context.Context, ruleID string) (AuthorizationRuleKeys, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "ListAuthorizationRuleKeys", func(ctx context.Context) (AuthorizationRuleKeys, error) {
+		return p.next.ListAuthorizationRuleKeys(ctx, ruleID)
+	})
+}
+
+func (p *instrumentedProvider) RegenerateAuthorizationRuleKey(ctx context.Context, ruleID string, keyType string) (AuthorizationRuleKeys, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "RegenerateAuthorizationRuleKey", func(ctx context.Context) (AuthorizationRuleKeys, error) {
+		return p.next.RegenerateAuthorizationRuleKey(ctx, ruleID, keyType)
+	})
+}
+
+func (p *instrumentedProvider) GetManagedCluster(ctx context.Context, clusterID string) (ManagedCluster, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetManagedCluster", func(ctx context.Context) (ManagedCluster, error) {
+		return p.next.GetManagedCluster(ctx, clusterID)
+	})
+}
+
+func (p *instrumentedProvider) GetClusterUserKubeconfig(ctx context.Context, clusterID string) ([]byte, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetClusterUserKubeconfig", func(ctx context.Context) ([]byte, error) {
+		return p.next.GetClusterUserKubeconfig(ctx, clusterID)
+	})
+}
+
+func (p *instrumentedProvider) GetResourceGroup(ctx context.Context, resourceGroupID string) (ResourceGroup, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "GetResourceGroup", func(ctx context.Context) (ResourceGroup, error) {
+		return p.next.GetResourceGroup(ctx, resourceGroupID)
+	})
+}
+
+func (p *instrumentedProvider) CreateUserAssignedIdentity(ctx context.Context, identityID string, location string, tags map[string]string) (UserAssignedIdentity, error) {
+	return measureProviderCall(ctx, p.logger, serviceARM, "CreateUserAssignedIdentity", func(ctx context.Context) (UserAssignedIdentity, error) {
+		return p.next.CreateUserAssignedIdentity(ctx, identityID, location, tags)
+	})
+}
+
+func (p *instrumentedProvider) DeleteUserAssignedIdentity(ctx context.Context, identityID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceARM, "DeleteUserAssignedIdentity", func(ctx context.Context) error {
+		return p.next.DeleteUserAssignedIdentity(ctx, identityID)
+	})
+}
+
+func (p *instrumentedProvider) CreateFederatedIdentityCredential(ctx context.Context, identityID string, credential *FederatedCredential) error {
+	return measureProviderCallErr(ctx, p.logger, serviceARM, "CreateFederatedIdentityCredential", func(ctx context.Context) error {
+		return p.next.CreateFederatedIdentityCredential(ctx, identityID, credential)
+	})
+}
+
+func (p *instrumentedProvider) SetKeyVaultSecret(ctx context.Context, vaultURL string, name string, value string, contentType string, tags map[string]string) (string, error) {
+	return measureProviderCall(ctx, p.logger, serviceKeyVault, "SetKeyVaultSecret", func(ctx context.Context) (string, error) {
+		return p.next.SetKeyVaultSecret(ctx, vaultURL, name, value, contentType, tags)
+	})
+}
+
+func (p *instrumentedProvider) DisableKeyVaultSecret(ctx context.Context, secretID string) error {
+	return measureProviderCallErr(ctx, p.logger, serviceKeyVault, "DisableKeyVaultSecret", func(ctx context.Context) error {
+		return p.next.DisableKeyVaultSecret(ctx, secretID)
+	})
+}
@@ -5,6 +5,7 @@ package azuresecrets
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"regexp"
@@ -13,6 +14,8 @@ import (
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerregistry/armcontainerregistry"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
 	"github.com/google/uuid"
 
 	"github.com/hashicorp/vault-plugin-secrets-azure/api"
@@ -21,10 +24,28 @@ import (
 // mockProvider is a Provider that provides stubs and simple, deterministic responses.
 type mockProvider struct {
 	applications              map[string]string
+	createdApplications       map[string]api.Application
 	servicePrincipals         map[string]bool
+	spAttributes              map[string]api.CustomSecurityAttributes
+	roleAssignments           map[string]armauthorization.RoleAssignment
+	groupMembers              map[string]map[string]bool
+	groupOwners               map[string]map[string]bool
 	deletedObjects            map[string]bool
 	passwords                 map[string]string
+	passwordApps              map[string]string
+	permissions               map[string][]Permission
+	storageAccountKeys        map[string]map[string]string
+	scopeMaps                 map[string]armcontainerregistry.ScopeMap
+	registryTokens            map[string]armcontainerregistry.Token
+	cosmosDBKeys              map[string]*CosmosDBKeys
+	authorizationRuleKeys     map[string]*AuthorizationRuleKeys
+	managedClusters           map[string]ManagedCluster
+	managedIdentities         map[string]UserAssignedIdentity
+	managedIdentityTags       map[string]map[string]string
+	federatedCredentials      map[string][]FederatedCredential
+	keyVaultSecrets           map[string][]*mockKeyVaultSecret
 	failNextCreateApplication bool
+	failNextListCosmosDBKeys  bool
 	ctxTimeout                time.Duration
 	lock                      sync.Mutex
 }
@@ -37,10 +58,57 @@ func newMockProvider() AzureProvider {
 			// not called and the test expects an app to exist.
 			testStaticSPAppObjID: testStaticSPAppObjID,
 		},
-		servicePrincipals: make(map[string]bool),
-		deletedObjects:    make(map[string]bool),
-		passwords:         make(map[string]string),
+		createdApplications: make(map[string]api.Application),
+		servicePrincipals:   make(map[string]bool),
+		spAttributes:        make(map[string]api.CustomSecurityAttributes),
+		roleAssignments:     make(map[string]armauthorization.RoleAssignment),
+		groupMembers:        make(map[string]map[string]bool),
+		groupOwners:         make(map[string]map[string]bool),
+		deletedObjects:      make(map[string]bool),
+		passwords:           make(map[string]string),
+		passwordApps:        make(map[string]string),
+		permissions:         make(map[string][]Permission),
+		storageAccountKeys: map[string]map[string]string{
+			testStorageAccountID: {
+				"key1": testStorageKey1,
+				"key2": testStorageKey2,
+			},
+		},
+		scopeMaps:      make(map[string]armcontainerregistry.ScopeMap),
+		registryTokens: make(map[string]armcontainerregistry.Token),
+		cosmosDBKeys: map[string]*CosmosDBKeys{
+			testCosmosDBAccountID: {
+				PrimaryMasterKey:           "initial-primary",
+				SecondaryMasterKey:         "initial-secondary",
+				PrimaryReadonlyMasterKey:   "initial-primary-readonly",
+				SecondaryReadonlyMasterKey: "initial-secondary-readonly",
+			},
+		},
+		authorizationRuleKeys: map[string]*AuthorizationRuleKeys{
+			testServiceBusRuleID: newMockAuthorizationRuleKeys(testServiceBusRuleID),
+			testEventHubsRuleID:  newMockAuthorizationRuleKeys(testEventHubsRuleID),
+		},
+		managedClusters: map[string]ManagedCluster{
+			testAKSClusterID:      newMockManagedCluster(testAKSClusterID, true),
+			testAKSLocalClusterID: newMockManagedCluster(testAKSLocalClusterID, false),
+		},
+		managedIdentities:    make(map[string]UserAssignedIdentity),
+		managedIdentityTags:  make(map[string]map[string]string),
+		federatedCredentials: make(map[string][]FederatedCredential),
+		keyVaultSecrets:      make(map[string][]*mockKeyVaultSecret),
+	}
+}
+
+// ListPermissions returns the permissions set for the scope, or permission to
+// do everything if none are set.
+func (m *mockProvider) ListPermissions(_ context.Context, scope string) ([]Permission, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.permissions[scope]; ok {
+		return p, nil
 	}
+	return []Permission{{Actions: []string{"*"}}}, nil
 }
 
 // ListRoles returns a single fake role based on the inbound filter
@@ -99,7 +167,11 @@ func (m *mockProvider) GetRoleDefinitionByID(_ context.Context, roleID string) (
 	}, nil
 }
 
-func (m *mockProvider) CreateServicePrincipal(_ context.Context, _ string, _ time.Time, _ time.Time) (spID string, password string, err error) {
+func (m *mockProvider) CreateServicePrincipal(_ context.Context, _ string, attributes api.CustomSecurityAttributes, _ time.Time, _ time.Time) (spID string, password string, err error) {
+	if err := attributes.Validate(); err != nil {
+		return "", "", err
+	}
+
 	id := generateUUID()
 	pass := generateUUID()
 
@@ -107,11 +179,12 @@ func (m *mockProvider) CreateServicePrincipal(_ context.Context, _ string, _ tim
 	defer m.lock.Unlock()
 
 	m.servicePrincipals[id] = true
+	m.spAttributes[id] = attributes
 
 	return id, pass, nil
 }
 
-func (m *mockProvider) CreateApplication(_ context.Context, _ string, _ string, _ []string) (api.Application, error) {
+func (m *mockProvider) CreateApplication(_ context.Context, app api.Application) (api.Application, error) {
 	if m.ctxTimeout != 0 {
 		// simulate a context deadline error by sleeping for timeout period
 		time.Sleep(m.ctxTimeout)
@@ -127,12 +200,12 @@ func (m *mockProvider) CreateApplication(_ context.Context, _ string, _ string,
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	app.AppID = appID
+	app.AppObjectID = appObjID
 	m.applications[appObjID] = appID
+	m.createdApplications[appObjID] = app
 
-	return api.Application{
-		AppID:       appID,
-		AppObjectID: appObjID,
-	}, nil
+	return app, nil
 }
 
 func (m *mockProvider) GetApplication(_ context.Context, clientID string) (api.Application, error) {
@@ -147,6 +220,29 @@ func (m *mockProvider) GetApplication(_ context.Context, clientID string) (api.A
 	}, nil
 }
 
+func (m *mockProvider) GetApplicationByObjectID(_ context.Context, applicationObjectID string) (api.Application, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	appID, ok := m.applications[applicationObjectID]
+	if !ok {
+		return api.Application{}, errors.New("Mock: Request_ResourceNotFound")
+	}
+
+	var passwords []api.PasswordCredential
+	for keyID, objID := range m.passwordApps {
+		if objID == applicationObjectID {
+			passwords = append(passwords, api.PasswordCredential{KeyID: keyID})
+		}
+	}
+
+	return api.Application{
+		AppID:               appID,
+		AppObjectID:         applicationObjectID,
+		PasswordCredentials: passwords,
+	}, nil
+}
+
 func (m *mockProvider) ListApplications(_ context.Context, _ string) ([]api.Application, error) {
 	return nil, nil
 }
@@ -161,6 +257,32 @@ func (m *mockProvider) DeleteApplication(_ context.Context, applicationObjectID
 	return nil
 }
 
+func (m *mockProvider) GetServicePrincipalByID(_ context.Context, spObjectID string) (api.ServicePrincipal, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.servicePrincipals[spObjectID] {
+		return api.ServicePrincipal{}, errors.New("Mock: Request_ResourceNotFound")
+	}
+
+	return api.ServicePrincipal{
+		ID: spObjectID,
+	}, nil
+}
+
+func (m *mockProvider) ListServicePrincipalGroups(_ context.Context, spObjectID string) ([]api.Group, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var groups []api.Group
+	for groupID, members := range m.groupMembers {
+		if members[spObjectID] {
+			groups = append(groups, api.Group{ID: groupID})
+		}
+	}
+	return groups, nil
+}
+
 func (m *mockProvider) DeleteServicePrincipal(_ context.Context, spObjectID string, permanentlyDelete bool) error {
 	delete(m.servicePrincipals, spObjectID)
 	m.deletedObjects[spObjectID] = true
@@ -171,13 +293,14 @@ func (m *mockProvider) DeleteServicePrincipal(_ context.Context, spObjectID stri
 	return nil
 }
 
-func (m *mockProvider) AddApplicationPassword(_ context.Context, _ string, _ string, _ time.Time) (result api.PasswordCredential, err error) {
+func (m *mockProvider) AddApplicationPassword(_ context.Context, applicationObjectID string, _ string, _ time.Time) (result api.PasswordCredential, err error) {
 	keyID := uuid.New().String()
 	pass := uuid.New().String()
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	m.passwords[keyID] = pass
+	m.passwordApps[keyID] = applicationObjectID
 
 	return api.PasswordCredential{
 		KeyID:      keyID,
@@ -190,6 +313,7 @@ func (m *mockProvider) RemoveApplicationPassword(_ context.Context, _ string, ke
 	defer m.lock.Unlock()
 
 	delete(m.passwords, keyID)
+	delete(m.passwordApps, keyID)
 
 	return nil
 }
@@ -198,6 +322,24 @@ func (m *mockProvider) deletedObjectExists(s string) bool {
 	return m.deletedObjects[s]
 }
 
+func (m *mockProvider) appName(s string) string {
+	return m.createdApp(s).DisplayName
+}
+
+func (m *mockProvider) createdApp(s string) api.Application {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.createdApplications[s]
+}
+
+func (m *mockProvider) servicePrincipalAttributes(s string) api.CustomSecurityAttributes {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.spAttributes[s]
+}
+
 func (m *mockProvider) appExists(s string) bool {
 	_, ok := m.applications[s]
 	return ok
@@ -212,31 +354,118 @@ func (m *mockProvider) passwordExists(s string) bool {
 }
 
 func (m *mockProvider) CreateRoleAssignment(_ context.Context, scope string, name string, params armauthorization.RoleAssignmentCreateParameters) (armauthorization.RoleAssignmentsClientCreateResponse, error) {
-	return armauthorization.RoleAssignmentsClientCreateResponse{
-		RoleAssignment: armauthorization.RoleAssignment{
-			Properties: &armauthorization.RoleAssignmentProperties{
-				Scope: &scope,
-			},
-			Name: &name,
-			ID:   params.Properties.RoleDefinitionID,
+	id := fmt.Sprintf("%s/providers/Microsoft.Authorization/roleAssignments/%s", scope, name)
+	ra := armauthorization.RoleAssignment{
+		Properties: &armauthorization.RoleAssignmentProperties{
+			Scope:            &scope,
+			RoleDefinitionID: params.Properties.RoleDefinitionID,
+			PrincipalID:      params.Properties.PrincipalID,
 		},
+		Name: &name,
+		ID:   &id,
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.roleAssignments[id] = ra
+
+	return armauthorization.RoleAssignmentsClientCreateResponse{
+		RoleAssignment: ra,
 	}, nil
 }
 
-func (m *mockProvider) DeleteRoleAssignmentByID(_ context.Context, _ string) (armauthorization.RoleAssignmentsClientDeleteByIDResponse, error) {
+func (m *mockProvider) DeleteRoleAssignmentByID(_ context.Context, roleAssignmentID string) (armauthorization.RoleAssignmentsClientDeleteByIDResponse, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.roleAssignments, roleAssignmentID)
+
 	return armauthorization.RoleAssignmentsClientDeleteByIDResponse{}, nil
 }
 
+// ListRoleAssignments returns the role assignments of the principal in the
+// filter, regardless of the scope.
+func (m *mockProvider) ListRoleAssignments(_ context.Context, _ string, filter string) ([]*armauthorization.RoleAssignment, error) {
+	rePrincipalID := regexp.MustCompile("principalId eq '(.*)'")
+	match := rePrincipalID.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, fmt.Errorf("Mock: unsupported filter %q", filter)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result []*armauthorization.RoleAssignment
+	for _, ra := range m.roleAssignments {
+		if *ra.Properties.PrincipalID == match[1] {
+			ra := ra
+			result = append(result, &ra)
+		}
+	}
+	return result, nil
+}
+
 // AddGroupMember adds a member to a Group.
-func (m *mockProvider) AddGroupMember(_ context.Context, _ string, _ string) error {
+func (m *mockProvider) AddGroupMember(_ context.Context, groupObjectID string, memberObjectID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.groupMembers[groupObjectID] == nil {
+		m.groupMembers[groupObjectID] = make(map[string]bool)
+	}
+	m.groupMembers[groupObjectID][memberObjectID] = true
+
 	return nil
 }
 
 // RemoveGroupMember removes a member from a Group.
-func (m *mockProvider) RemoveGroupMember(_ context.Context, _ string, _ string) error {
+func (m *mockProvider) RemoveGroupMember(_ context.Context, groupObjectID string, memberObjectID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.groupMembers[groupObjectID], memberObjectID)
+
+	return nil
+}
+
+// AddGroupOwner adds an owner to a Group.
+func (m *mockProvider) AddGroupOwner(_ context.Context, groupObjectID string, ownerObjectID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.groupOwners[groupObjectID] == nil {
+		m.groupOwners[groupObjectID] = make(map[string]bool)
+	}
+	m.groupOwners[groupObjectID][ownerObjectID] = true
+
+	return nil
+}
+
+// RemoveGroupOwner removes an owner from a Group.
+func (m *mockProvider) RemoveGroupOwner(_ context.Context, groupObjectID string, ownerObjectID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.groupOwners[groupObjectID], ownerObjectID)
+
 	return nil
 }
 
+func (m *mockProvider) isGroupMember(groupObjectID, memberObjectID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.groupMembers[groupObjectID][memberObjectID]
+}
+
+func (m *mockProvider) isGroupOwner(groupObjectID, ownerObjectID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.groupOwners[groupObjectID][ownerObjectID]
+}
+
 // GetGroup gets group information from the directory.
 func (m *mockProvider) GetGroup(_ context.Context, objectID string) (api.Group, error) {
 	var groupName string
@@ -283,3 +512,530 @@ func (m *mockProvider) ListGroups(_ context.Context, filter string) ([]api.Group
 	return []api.Group{}, nil
 
 }
+
+// mockQueryGroupNames are the groups that QueryGroups selects from.
+var mockQueryGroupNames = []string{"team-a-readers", "team-a-writers", "team-b-readers"}
+
+// QueryGroups supports startswith filters on the display name, and selects
+// from mockQueryGroupNames. Other filters are rejected.
+func (m *mockProvider) QueryGroups(_ context.Context, filter string, limit int) ([]api.Group, error) {
+	match := regexp.MustCompile(`^startswith\(displayName,\s*'((?:[^']|'')*)'\)$`).FindStringSubmatch(filter)
+	if match == nil {
+		return nil, fmt.Errorf("Request_UnsupportedQuery: unsupported filter %q", filter)
+	}
+	match[1] = strings.ReplaceAll(match[1], "''", "'")
+
+	var groups []api.Group
+	for _, name := range mockQueryGroupNames {
+		if strings.HasPrefix(name, match[1]) && len(groups) < limit {
+			groups = append(groups, api.Group{
+				ID:          fmt.Sprintf("00000000-1111-2222-3333-444444444444FAKE_GROUP-%s", name),
+				DisplayName: name,
+			})
+		}
+	}
+
+	return groups, nil
+}
+
+// GetStorageAccount returns a storage account with the name of the last
+// segment of the ID, if the account exists.
+func (m *mockProvider) GetStorageAccount(_ context.Context, accountID string) (armstorage.AccountsClientGetPropertiesResponse, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.storageAccountKeys[accountID]; !ok {
+		return armstorage.AccountsClientGetPropertiesResponse{}, fmt.Errorf("storage account %q not found", accountID)
+	}
+
+	name := accountID[strings.LastIndex(accountID, "/")+1:]
+	blob := fmt.Sprintf("https://%s.blob.core.windows.net/", name)
+	return armstorage.AccountsClientGetPropertiesResponse{
+		Account: armstorage.Account{
+			ID:   &accountID,
+			Name: &name,
+			Properties: &armstorage.AccountProperties{
+				PrimaryEndpoints: &armstorage.Endpoints{
+					Blob: &blob,
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *mockProvider) ListStorageAccountKeys(_ context.Context, accountID string) ([]*armstorage.AccountKey, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.storageAccountKeysLocked(accountID)
+}
+
+// RegenerateStorageAccountKey replaces the value of the key with a random one.
+func (m *mockProvider) RegenerateStorageAccountKey(_ context.Context, accountID string, keyName string) ([]*armstorage.AccountKey, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys, ok := m.storageAccountKeys[accountID]
+	if !ok {
+		return nil, fmt.Errorf("storage account %q not found", accountID)
+	}
+	if _, ok := keys[keyName]; !ok {
+		return nil, fmt.Errorf("invalid key name %q", keyName)
+	}
+	keys[keyName] = base64.StdEncoding.EncodeToString([]byte(keyName + "-" + uuid.New().String()))
+
+	return m.storageAccountKeysLocked(accountID)
+}
+
+func (m *mockProvider) storageAccountKeysLocked(accountID string) ([]*armstorage.AccountKey, error) {
+	keys, ok := m.storageAccountKeys[accountID]
+	if !ok {
+		return nil, fmt.Errorf("storage account %q not found", accountID)
+	}
+
+	var result []*armstorage.AccountKey
+	for _, name := range []string{"key1", "key2"} {
+		name, value := name, keys[name]
+		result = append(result, &armstorage.AccountKey{
+			KeyName: &name,
+			Value:   &value,
+		})
+	}
+	return result, nil
+}
+
+func (m *mockProvider) storageAccountKey(accountID, keyName string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.storageAccountKeys[accountID][keyName]
+}
+
+// GetUserDelegationKey returns a fixed key for the requested validity.
+func (m *mockProvider) GetUserDelegationKey(_ context.Context, _ string, start time.Time, expiry time.Time) (UserDelegationKey, error) {
+	return UserDelegationKey{
+		SignedOID:     "FAKE_OID",
+		SignedTID:     "FAKE_TID",
+		SignedStart:   start,
+		SignedExpiry:  expiry,
+		SignedService: "b",
+		SignedVersion: storageServiceVersion,
+		Value:         testUserDelegationKey,
+	}, nil
+}
+
+// GetContainerRegistry returns testRegistryID with a login server named after
+// the last segment of the ID. Other registries don't exist.
+func (m *mockProvider) GetContainerRegistry(_ context.Context, registryID string) (armcontainerregistry.RegistriesClientGetResponse, error) {
+	if registryID != testRegistryID {
+		return armcontainerregistry.RegistriesClientGetResponse{}, fmt.Errorf("container registry %q not found", registryID)
+	}
+
+	name := registryID[strings.LastIndex(registryID, "/")+1:]
+	loginServer := name + ".azurecr.io"
+	return armcontainerregistry.RegistriesClientGetResponse{
+		Registry: armcontainerregistry.Registry{
+			ID:   &registryID,
+			Name: &name,
+			Properties: &armcontainerregistry.RegistryProperties{
+				LoginServer: &loginServer,
+			},
+		},
+	}, nil
+}
+
+func (m *mockProvider) CreateScopeMap(_ context.Context, registryID string, name string, scopeMap armcontainerregistry.ScopeMap) (armcontainerregistry.ScopeMap, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id := registryID + "/scopeMaps/" + name
+	scopeMap.ID = &id
+	scopeMap.Name = &name
+	m.scopeMaps[id] = scopeMap
+	return scopeMap, nil
+}
+
+func (m *mockProvider) DeleteScopeMap(_ context.Context, registryID string, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.scopeMaps, registryID+"/scopeMaps/"+name)
+	return nil
+}
+
+// CreateRegistryToken fails if the scope map of the token doesn't exist.
+func (m *mockProvider) CreateRegistryToken(_ context.Context, registryID string, name string, token armcontainerregistry.Token) (armcontainerregistry.Token, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if token.Properties == nil || token.Properties.ScopeMapID == nil {
+		return armcontainerregistry.Token{}, errors.New("scope map ID is required")
+	}
+	if _, ok := m.scopeMaps[*token.Properties.ScopeMapID]; !ok {
+		return armcontainerregistry.Token{}, fmt.Errorf("scope map %q not found", *token.Properties.ScopeMapID)
+	}
+
+	id := registryID + "/tokens/" + name
+	token.ID = &id
+	token.Name = &name
+	m.registryTokens[id] = token
+	return token, nil
+}
+
+func (m *mockProvider) DeleteRegistryToken(_ context.Context, registryID string, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.registryTokens, registryID+"/tokens/"+name)
+	return nil
+}
+
+func (m *mockProvider) GenerateRegistryCredentials(_ context.Context, _ string, params armcontainerregistry.GenerateCredentialsParameters) (armcontainerregistry.GenerateCredentialsResult, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if params.TokenID == nil {
+		return armcontainerregistry.GenerateCredentialsResult{}, errors.New("token ID is required")
+	}
+	if _, ok := m.registryTokens[*params.TokenID]; !ok {
+		return armcontainerregistry.GenerateCredentialsResult{}, fmt.Errorf("token %q not found", *params.TokenID)
+	}
+
+	username := *params.TokenID
+	username = username[strings.LastIndex(username, "/")+1:]
+	value := uuid.New().String()
+	return armcontainerregistry.GenerateCredentialsResult{
+		Username: &username,
+		Passwords: []*armcontainerregistry.TokenPassword{
+			{
+				Name:   params.Name,
+				Value:  &value,
+				Expiry: params.Expiry,
+			},
+		},
+	}, nil
+}
+
+func (m *mockProvider) scopeMap(registryID, name string) (armcontainerregistry.ScopeMap, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	scopeMap, ok := m.scopeMaps[registryID+"/scopeMaps/"+name]
+	return scopeMap, ok
+}
+
+func (m *mockProvider) registryTokenExists(registryID, name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.registryTokens[registryID+"/tokens/"+name]
+	return ok
+}
+
+// GetCosmosDBAccount returns a Cosmos DB account with the name of the last
+// segment of the ID, if the account exists.
+func (m *mockProvider) GetCosmosDBAccount(_ context.Context, accountID string) (CosmosDBAccount, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.cosmosDBKeys[accountID]; !ok {
+		return CosmosDBAccount{}, fmt.Errorf("Cosmos DB account %q not found", accountID)
+	}
+
+	account := CosmosDBAccount{
+		ID:   accountID,
+		Name: accountID[strings.LastIndex(accountID, "/")+1:],
+	}
+	account.Properties.DocumentEndpoint = fmt.Sprintf("https://%s.documents.azure.com:443/", account.Name)
+	return account, nil
+}
+
+func (m *mockProvider) ListCosmosDBKeys(_ context.Context, accountID string) (CosmosDBKeys, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.failNextListCosmosDBKeys {
+		m.failNextListCosmosDBKeys = false
+		return CosmosDBKeys{}, errors.New("Mock: fail to list Cosmos DB keys")
+	}
+	keys, ok := m.cosmosDBKeys[accountID]
+	if !ok {
+		return CosmosDBKeys{}, fmt.Errorf("Cosmos DB account %q not found", accountID)
+	}
+	return *keys, nil
+}
+
+// RegenerateCosmosDBKey replaces the value of the key with a random one.
+func (m *mockProvider) RegenerateCosmosDBKey(_ context.Context, accountID string, keyKind string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys, ok := m.cosmosDBKeys[accountID]
+	if !ok {
+		return fmt.Errorf("Cosmos DB account %q not found", accountID)
+	}
+
+	value := keyKind + "-" + uuid.New().String()
+	switch keyKind {
+	case "primary":
+		keys.PrimaryMasterKey = value
+	case "secondary":
+		keys.SecondaryMasterKey = value
+	case "primaryReadonly":
+		keys.PrimaryReadonlyMasterKey = value
+	case "secondaryReadonly":
+		keys.SecondaryReadonlyMasterKey = value
+	default:
+		return fmt.Errorf("invalid key kind %q", keyKind)
+	}
+	return nil
+}
+
+func (m *mockProvider) ListAuthorizationRuleKeys(_ context.Context, ruleID string) (AuthorizationRuleKeys, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys, ok := m.authorizationRuleKeys[ruleID]
+	if !ok {
+		return AuthorizationRuleKeys{}, fmt.Errorf("authorization rule %q not found", ruleID)
+	}
+	return *keys, nil
+}
+
+// RegenerateAuthorizationRuleKey replaces the value of the key with a random
+// one, and updates its connection string.
+func (m *mockProvider) RegenerateAuthorizationRuleKey(_ context.Context, ruleID string, keyType string) (AuthorizationRuleKeys, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys, ok := m.authorizationRuleKeys[ruleID]
+	if !ok {
+		return AuthorizationRuleKeys{}, fmt.Errorf("authorization rule %q not found", ruleID)
+	}
+
+	value := keyType + "-" + uuid.New().String()
+	switch keyType {
+	case "PrimaryKey":
+		keys.PrimaryKey = value
+		keys.PrimaryConnectionString = mockConnectionString(keys.KeyName, value)
+	case "SecondaryKey":
+		keys.SecondaryKey = value
+		keys.SecondaryConnectionString = mockConnectionString(keys.KeyName, value)
+	default:
+		return AuthorizationRuleKeys{}, fmt.Errorf("invalid key type %q", keyType)
+	}
+	return *keys, nil
+}
+
+func (m *mockProvider) cosmosDBAccountKeys(accountID string) CosmosDBKeys {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return *m.cosmosDBKeys[accountID]
+}
+
+func (m *mockProvider) authorizationRuleKeysOf(ruleID string) AuthorizationRuleKeys {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return *m.authorizationRuleKeys[ruleID]
+}
+
+func newMockAuthorizationRuleKeys(ruleID string) *AuthorizationRuleKeys {
+	name := ruleID[strings.LastIndex(ruleID, "/")+1:]
+	return &AuthorizationRuleKeys{
+		KeyName:                   name,
+		PrimaryKey:                "initial-primary",
+		SecondaryKey:              "initial-secondary",
+		PrimaryConnectionString:   mockConnectionString(name, "initial-primary"),
+		SecondaryConnectionString: mockConnectionString(name, "initial-secondary"),
+	}
+}
+
+func mockConnectionString(keyName, key string) string {
+	return fmt.Sprintf("Endpoint=sb://fakenamespace.servicebus.windows.net/;SharedAccessKeyName=%s;SharedAccessKey=%s", keyName, key)
+}
+
+func (m *mockProvider) GetManagedCluster(_ context.Context, clusterID string) (ManagedCluster, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cluster, ok := m.managedClusters[clusterID]
+	if !ok {
+		return ManagedCluster{}, fmt.Errorf("AKS cluster %q not found", clusterID)
+	}
+	return cluster, nil
+}
+
+// GetClusterUserKubeconfig returns a kubeconfig for the cluster that
+// authenticates with kubelogin, as AKS does for clusters with AAD integration.
+func (m *mockProvider) GetClusterUserKubeconfig(_ context.Context, clusterID string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cluster, ok := m.managedClusters[clusterID]
+	if !ok {
+		return nil, fmt.Errorf("AKS cluster %q not found", clusterID)
+	}
+
+	return []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: %[1]s
+  cluster:
+    server: https://%[2]s:443
+    certificate-authority-data: %[3]s
+contexts:
+- name: %[1]s
+  context:
+    cluster: %[1]s
+    user: clusterUser_%[1]s
+current-context: %[1]s
+users:
+- name: clusterUser_%[1]s
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: kubelogin
+      args: [get-token, --login, devicecode]
+`, cluster.Name, cluster.Properties.Fqdn, testAKSClusterCA)), nil
+}
+
+func newMockManagedCluster(clusterID string, azureRBAC bool) ManagedCluster {
+	cluster := ManagedCluster{
+		ID:   clusterID,
+		Name: clusterID[strings.LastIndex(clusterID, "/")+1:],
+	}
+	cluster.Properties.Fqdn = cluster.Name + "-dns.hcp.eastus.azmk8s.io"
+	if azureRBAC {
+		cluster.Properties.AADProfile = &ManagedClusterAADProfile{
+			Managed:         true,
+			EnableAzureRBAC: true,
+		}
+	}
+	return cluster
+}
+
+// GetResourceGroup returns a resource group in eastus for the test resource
+// group ID.
+func (m *mockProvider) GetResourceGroup(_ context.Context, resourceGroupID string) (ResourceGroup, error) {
+	if resourceGroupID != testResourceGroupID {
+		return ResourceGroup{}, fmt.Errorf("resource group %q not found", resourceGroupID)
+	}
+	return ResourceGroup{
+		ID:       resourceGroupID,
+		Name:     resourceGroupID[strings.LastIndex(resourceGroupID, "/")+1:],
+		Location: "eastus",
+	}, nil
+}
+
+func (m *mockProvider) CreateUserAssignedIdentity(_ context.Context, identityID string, location string, tags map[string]string) (UserAssignedIdentity, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if location == "" {
+		return UserAssignedIdentity{}, errors.New("location is required")
+	}
+
+	identity := UserAssignedIdentity{
+		ID:   identityID,
+		Name: identityID[strings.LastIndex(identityID, "/")+1:],
+	}
+	identity.Properties.ClientID = uuid.New().String()
+	identity.Properties.PrincipalID = uuid.New().String()
+	identity.Properties.TenantID = "FAKE_TENANT_ID"
+	m.managedIdentities[identityID] = identity
+	m.managedIdentityTags[identityID] = tags
+	return identity, nil
+}
+
+func (m *mockProvider) DeleteUserAssignedIdentity(_ context.Context, identityID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.managedIdentities, identityID)
+	delete(m.federatedCredentials, identityID)
+	return nil
+}
+
+func (m *mockProvider) CreateFederatedIdentityCredential(_ context.Context, identityID string, credential *FederatedCredential) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.managedIdentities[identityID]; !ok {
+		return fmt.Errorf("managed identity %q not found", identityID)
+	}
+	m.federatedCredentials[identityID] = append(m.federatedCredentials[identityID], *credential)
+	return nil
+}
+
+func (m *mockProvider) managedIdentity(identityID string) (UserAssignedIdentity, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	identity, ok := m.managedIdentities[identityID]
+	return identity, ok
+}
+
+func (m *mockProvider) federatedCredentialsOf(identityID string) []FederatedCredential {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.federatedCredentials[identityID]
+}
+
+// mockKeyVaultSecret is a version of a Key Vault secret.
+type mockKeyVaultSecret struct {
+	ID          string
+	Value       string
+	ContentType string
+	Tags        map[string]string
+	Enabled     bool
+}
+
+func (m *mockProvider) SetKeyVaultSecret(_ context.Context, vaultURL string, name string, value string, contentType string, tags map[string]string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if strings.HasPrefix(vaultURL, testUnreachableVaultURL) {
+		return "", fmt.Errorf("key vault %q is unreachable", vaultURL)
+	}
+	secretURL := strings.TrimSuffix(vaultURL, "/") + "/secrets/" + name
+	secret := &mockKeyVaultSecret{
+		ID:          fmt.Sprintf("%s/%d", secretURL, len(m.keyVaultSecrets[secretURL])+1),
+		Value:       value,
+		ContentType: contentType,
+		Tags:        tags,
+		Enabled:     true,
+	}
+	m.keyVaultSecrets[secretURL] = append(m.keyVaultSecrets[secretURL], secret)
+	return secret.ID, nil
+}
+
+func (m *mockProvider) DisableKeyVaultSecret(_ context.Context, secretID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, versions := range m.keyVaultSecrets {
+		for _, secret := range versions {
+			if secret.ID == secretID {
+				secret.Enabled = false
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("secret %q not found", secretID)
+}
+
+// keyVaultSecretVersions returns the versions of the secret with the given
+// name, oldest first.
+func (m *mockProvider) keyVaultSecretVersions(vaultURL, name string) []mockKeyVaultSecret {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var versions []mockKeyVaultSecret
+	for _, secret := range m.keyVaultSecrets[vaultURL+"/secrets/"+name] {
+		versions = append(versions, *secret)
+	}
+	return versions
+}
@@ -0,0 +1,869 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerregistry/armcontainerregistry"
+
+	"github.com/hashicorp/vault-plugin-secrets-azure/api"
+)
+
+type staticTokenCredential struct{}
+
+func (staticTokenCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "fake-token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// TestProviderStorageAccounts checks the storage account requests of the
+// provider against a fake ARM server.
+func TestProviderStorageAccounts(t *testing.T) {
+	keys := map[string]string{"key1": "value1", "key2": "value2"}
+	keysResponse := func(w http.ResponseWriter) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]interface{}{
+				{"keyName": "key1", "value": keys["key1"], "permissions": "FULL"},
+				{"keyName": "key2", "value": keys["key2"], "permissions": "FULL"},
+			},
+		})
+	}
+
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/storageAccounts/acct"):
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":   strings.TrimPrefix(r.URL.Path, "/"),
+				"name": "acct",
+				"properties": map[string]interface{}{
+					"primaryEndpoints": map[string]interface{}{
+						"blob": "https://acct.blob.core.usgovcloudapi.net/",
+					},
+				},
+			})
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/listKeys"):
+			keysResponse(w)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/regenerateKey"):
+			var body struct {
+				KeyName string `json:"keyName"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			keys[body.KeyName] = "regenerated-" + body.KeyName
+			keysResponse(w)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := &provider{
+		cred: staticTokenCredential{},
+		armOptions: &arm.ClientOptions{
+			ClientOptions: policy.ClientOptions{
+				Cloud: cloud.Configuration{
+					Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+						cloud.ResourceManager: {
+							Endpoint: srv.URL,
+							Audience: srv.URL,
+						},
+					},
+				},
+				Transport: srv.Client(),
+				Retry: policy.RetryOptions{
+					MaxRetries: -1,
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	accountID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.Storage/storageAccounts/acct"
+
+	account, err := p.GetStorageAccount(ctx, accountID)
+	assertErrorIsNil(t, err)
+	equal(t, "acct", *account.Name)
+	equal(t, "core.usgovcloudapi.net", storageEndpointSuffix(account.Account))
+
+	result, err := p.RegenerateStorageAccountKey(ctx, accountID, "key2")
+	assertErrorIsNil(t, err)
+	equal(t, "regenerated-key2", findStorageAccountKey(result, "key2"))
+
+	result, err = p.ListStorageAccountKeys(ctx, accountID)
+	assertErrorIsNil(t, err)
+	equal(t, "value1", findStorageAccountKey(result, "key1"))
+	equal(t, "regenerated-key2", findStorageAccountKey(result, "key2"))
+
+	equal(t, []string{
+		"GET " + accountID,
+		"POST " + accountID + "/regenerateKey",
+		"POST " + accountID + "/listKeys",
+	}, requests)
+
+	if _, err := p.GetStorageAccount(ctx, accountID+"-missing"); err == nil {
+		t.Fatal("expected an error for a missing storage account")
+	}
+	if _, err := p.ListStorageAccountKeys(ctx, "/subscriptions/sub1/resourceGroups/rg1"); err == nil {
+		t.Fatal("expected an error for an ID that is not a storage account")
+	}
+}
+
+// TestProviderUserDelegationKey checks the user delegation key request of the
+// provider against a fake blob service.
+func TestProviderUserDelegationKey(t *testing.T) {
+	var body string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" || r.Method != http.MethodPost ||
+			r.URL.Query().Get("restype") != "service" || r.URL.Query().Get("comp") != "userdelegationkey" ||
+			r.Header.Get("x-ms-version") != storageServiceVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<UserDelegationKey>
+  <SignedOid>oid</SignedOid>
+  <SignedTid>tid</SignedTid>
+  <SignedStart>2024-01-01T00:00:00Z</SignedStart>
+  <SignedExpiry>2024-01-01T01:00:00Z</SignedExpiry>
+  <SignedService>b</SignedService>
+  <SignedVersion>2021-12-02</SignedVersion>
+  <Value>a2V5</Value>
+</UserDelegationKey>`))
+	}))
+	defer srv.Close()
+
+	p := &provider{
+		storagePipeline: newStoragePipeline(staticTokenCredential{}, &arm.ClientOptions{
+			ClientOptions: policy.ClientOptions{
+				Transport: srv.Client(),
+				Retry: policy.RetryOptions{
+					MaxRetries: -1,
+				},
+			},
+		}),
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	key, err := p.GetUserDelegationKey(context.Background(), srv.URL+"/", start, start.Add(time.Hour))
+	assertErrorIsNil(t, err)
+	equal(t, xml.Header+"<KeyInfo><Start>2024-01-01T00:00:00Z</Start><Expiry>2024-01-01T01:00:00Z</Expiry></KeyInfo>", body)
+	equal(t, UserDelegationKey{
+		SignedOID:     "oid",
+		SignedTID:     "tid",
+		SignedStart:   start,
+		SignedExpiry:  start.Add(time.Hour),
+		SignedService: "b",
+		SignedVersion: "2021-12-02",
+		Value:         "a2V5",
+	}, key)
+}
+
+// TestProviderContainerRegistry checks the container registry requests of the
+// provider against a fake ARM server.
+func TestProviderContainerRegistry(t *testing.T) {
+	registryID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.ContainerRegistry/registries/reg"
+
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == registryID:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":   registryID,
+				"name": "reg",
+				"properties": map[string]interface{}{
+					"loginServer": "reg.azurecr.io",
+				},
+			})
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, registryID+"/"):
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body["id"] = r.URL.Path
+			json.NewEncoder(w).Encode(body)
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/tokens/missing"):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/generateCredentials"):
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"username": "vault-token",
+				"passwords": []map[string]interface{}{
+					{"name": "password1", "value": "secret"},
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := &provider{
+		cred: staticTokenCredential{},
+		armOptions: &arm.ClientOptions{
+			ClientOptions: policy.ClientOptions{
+				Cloud: cloud.Configuration{
+					Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+						cloud.ResourceManager: {
+							Endpoint: srv.URL,
+							Audience: srv.URL,
+						},
+					},
+				},
+				Transport: srv.Client(),
+				Retry: policy.RetryOptions{
+					MaxRetries: -1,
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+
+	registry, err := p.GetContainerRegistry(ctx, registryID)
+	assertErrorIsNil(t, err)
+	equal(t, "reg.azurecr.io", *registry.Properties.LoginServer)
+
+	action := "repositories/app/content/read"
+	scopeMap, err := p.CreateScopeMap(ctx, registryID, "vault-token", armcontainerregistry.ScopeMap{
+		Properties: &armcontainerregistry.ScopeMapProperties{
+			Actions: []*string{&action},
+		},
+	})
+	assertErrorIsNil(t, err)
+	equal(t, registryID+"/scopeMaps/vault-token", *scopeMap.ID)
+
+	token, err := p.CreateRegistryToken(ctx, registryID, "vault-token", armcontainerregistry.Token{
+		Properties: &armcontainerregistry.TokenProperties{
+			ScopeMapID: scopeMap.ID,
+		},
+	})
+	assertErrorIsNil(t, err)
+	equal(t, registryID+"/tokens/vault-token", *token.ID)
+
+	creds, err := p.GenerateRegistryCredentials(ctx, registryID, armcontainerregistry.GenerateCredentialsParameters{
+		TokenID: token.ID,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, "vault-token", *creds.Username)
+	equal(t, "secret", *creds.Passwords[0].Value)
+
+	assertErrorIsNil(t, p.DeleteRegistryToken(ctx, registryID, "vault-token"))
+	assertErrorIsNil(t, p.DeleteScopeMap(ctx, registryID, "vault-token"))
+
+	equal(t, []string{
+		"GET " + registryID,
+		"PUT " + registryID + "/scopeMaps/vault-token",
+		"PUT " + registryID + "/tokens/vault-token",
+		"POST " + registryID + "/generateCredentials",
+		"DELETE " + registryID + "/tokens/vault-token",
+		"DELETE " + registryID + "/scopeMaps/vault-token",
+	}, requests)
+
+	err = p.DeleteRegistryToken(ctx, registryID, "missing")
+	if !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if _, err := p.GetContainerRegistry(ctx, testStorageAccountID); err == nil {
+		t.Fatal("expected an error for an ID that is not a container registry")
+	}
+}
+
+// TestProviderKeyRotation checks the Cosmos DB and authorization rule key
+// requests of the provider against a fake ARM server, including polling of
+// the long-running Cosmos DB key regeneration.
+func TestProviderKeyRotation(t *testing.T) {
+	accountID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.DocumentDB/databaseAccounts/cosmos"
+	ruleID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.EventHub/namespaces/ns/eventhubs/hub/authorizationRules/rule"
+
+	var requests []string
+	var srvURL string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]string
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+"?api-version="+r.URL.Query().Get("api-version")+" "+body["keyKind"]+body["keyType"])
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == accountID:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":   accountID,
+				"name": "cosmos",
+				"properties": map[string]interface{}{
+					"documentEndpoint": "https://cosmos.documents.azure.com:443/",
+				},
+			})
+		case r.Method == http.MethodPost && r.URL.Path == accountID+"/listKeys":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"primaryMasterKey":           "pk",
+				"secondaryReadonlyMasterKey": "srk",
+			})
+		case r.Method == http.MethodPost && r.URL.Path == accountID+"/regenerateKey":
+			w.Header().Set("Location", srvURL+"/operations/1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodGet && r.URL.Path == "/operations/1":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, ruleID+"/"):
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keyName":      "rule",
+				"primaryKey":   "p",
+				"secondaryKey": "s",
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	opts := &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Endpoint: srv.URL,
+						Audience: srv.URL,
+					},
+				},
+			},
+			Transport: srv.Client(),
+			Retry: policy.RetryOptions{
+				MaxRetries: -1,
+			},
+		},
+	}
+	armClient, err := arm.NewClient("test", "v0.0.0", staticTokenCredential{}, opts)
+	assertErrorIsNil(t, err)
+	p := &provider{armClient: armClient}
+
+	ctx := context.Background()
+
+	account, err := p.GetCosmosDBAccount(ctx, accountID)
+	assertErrorIsNil(t, err)
+	equal(t, "https://cosmos.documents.azure.com:443/", account.Properties.DocumentEndpoint)
+
+	keys, err := p.ListCosmosDBKeys(ctx, accountID)
+	assertErrorIsNil(t, err)
+	equal(t, CosmosDBKeys{PrimaryMasterKey: "pk", SecondaryReadonlyMasterKey: "srk"}, keys)
+
+	assertErrorIsNil(t, p.RegenerateCosmosDBKey(ctx, accountID, "secondaryReadonly"))
+
+	ruleKeys, err := p.RegenerateAuthorizationRuleKey(ctx, ruleID, "SecondaryKey")
+	assertErrorIsNil(t, err)
+	equal(t, AuthorizationRuleKeys{KeyName: "rule", PrimaryKey: "p", SecondaryKey: "s"}, ruleKeys)
+
+	_, err = p.ListAuthorizationRuleKeys(ctx, ruleID)
+	assertErrorIsNil(t, err)
+
+	equal(t, []string{
+		"GET " + accountID + "?api-version=" + cosmosDBAPIVersion + " ",
+		"POST " + accountID + "/listKeys?api-version=" + cosmosDBAPIVersion + " ",
+		"POST " + accountID + "/regenerateKey?api-version=" + cosmosDBAPIVersion + " secondaryReadonly",
+		"GET /operations/1?api-version= ",
+		"POST " + ruleID + "/regenerateKeys?api-version=" + eventHubsAPIVersion + " SecondaryKey",
+		"POST " + ruleID + "/listKeys?api-version=" + eventHubsAPIVersion + " ",
+	}, requests)
+
+	if _, err := p.GetCosmosDBAccount(ctx, accountID+"-missing"); !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if _, err := p.ListCosmosDBKeys(ctx, testStorageAccountID); err == nil {
+		t.Fatal("expected an error for an ID that is not a Cosmos DB account")
+	}
+}
+
+// TestProviderManagedCluster checks the AKS requests of the provider against a
+// fake ARM server.
+func TestProviderManagedCluster(t *testing.T) {
+	clusterID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.ContainerService/managedClusters/aks"
+	userKubeconfig := []byte("apiVersion: v1\nkind: Config\n")
+
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+"?api-version="+r.URL.Query().Get("api-version"))
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == clusterID:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":   clusterID,
+				"name": "aks",
+				"properties": map[string]interface{}{
+					"fqdn": "aks-dns.hcp.eastus.azmk8s.io",
+					"aadProfile": map[string]interface{}{
+						"managed":         true,
+						"enableAzureRBAC": true,
+					},
+				},
+			})
+		case r.Method == http.MethodPost && r.URL.Path == clusterID+"/listClusterUserCredential":
+			// Kubeconfigs are base64 encoded, as []byte is in JSON
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"kubeconfigs": []map[string]interface{}{
+					{"name": "clusterUser", "value": userKubeconfig},
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	opts := &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Endpoint: srv.URL,
+						Audience: srv.URL,
+					},
+				},
+			},
+			Transport: srv.Client(),
+			Retry: policy.RetryOptions{
+				MaxRetries: -1,
+			},
+		},
+	}
+	armClient, err := arm.NewClient("test", "v0.0.0", staticTokenCredential{}, opts)
+	assertErrorIsNil(t, err)
+	p := &provider{armClient: armClient}
+
+	ctx := context.Background()
+
+	cluster, err := p.GetManagedCluster(ctx, clusterID)
+	assertErrorIsNil(t, err)
+	equal(t, "aks", cluster.Name)
+	equal(t, "aks-dns.hcp.eastus.azmk8s.io", cluster.Properties.Fqdn)
+	equal(t, &ManagedClusterAADProfile{Managed: true, EnableAzureRBAC: true}, cluster.Properties.AADProfile)
+
+	config, err := p.GetClusterUserKubeconfig(ctx, clusterID)
+	assertErrorIsNil(t, err)
+	equal(t, userKubeconfig, config)
+
+	equal(t, []string{
+		"GET " + clusterID + "?api-version=" + managedClustersAPIVersion,
+		"POST " + clusterID + "/listClusterUserCredential?api-version=" + managedClustersAPIVersion,
+	}, requests)
+
+	if _, err := p.GetManagedCluster(ctx, clusterID+"-missing"); !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if _, err := p.GetClusterUserKubeconfig(ctx, testStorageAccountID); err == nil {
+		t.Fatal("expected an error for an ID that is not an AKS cluster")
+	}
+}
+
+// TestProviderManagedIdentity checks the managed identity requests of the
+// provider against a fake ARM server.
+func TestProviderManagedIdentity(t *testing.T) {
+	groupID := "/subscriptions/sub1/resourceGroups/identities"
+	identityID := groupID + "/providers/Microsoft.ManagedIdentity/userAssignedIdentities/vault-1"
+
+	var requests []string
+	var bodies []map[string]interface{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+"?api-version="+r.URL.Query().Get("api-version"))
+		var body map[string]interface{}
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+		if body != nil {
+			bodies = append(bodies, body)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == groupID:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":       groupID,
+				"name":     "identities",
+				"location": "westeurope",
+			})
+		case r.Method == http.MethodPut && r.URL.Path == identityID:
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":   identityID,
+				"name": "vault-1",
+				"properties": map[string]interface{}{
+					"clientId":    "client",
+					"principalId": "principal",
+					"tenantId":    "tenant",
+				},
+			})
+		case r.Method == http.MethodPut && r.URL.Path == identityID+"/federatedIdentityCredentials/fc":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodDelete && r.URL.Path == identityID:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	opts := &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Endpoint: srv.URL,
+						Audience: srv.URL,
+					},
+				},
+			},
+			Transport: srv.Client(),
+			Retry: policy.RetryOptions{
+				MaxRetries: -1,
+			},
+		},
+	}
+	armClient, err := arm.NewClient("test", "v0.0.0", staticTokenCredential{}, opts)
+	assertErrorIsNil(t, err)
+	p := &provider{armClient: armClient}
+
+	ctx := context.Background()
+
+	group, err := p.GetResourceGroup(ctx, groupID)
+	assertErrorIsNil(t, err)
+	equal(t, "westeurope", group.Location)
+
+	identity, err := p.CreateUserAssignedIdentity(ctx, identityID, "westeurope", map[string]string{"vault_role": "test"})
+	assertErrorIsNil(t, err)
+	equal(t, "client", identity.Properties.ClientID)
+	equal(t, "principal", identity.Properties.PrincipalID)
+	equal(t, "tenant", identity.Properties.TenantID)
+
+	assertErrorIsNil(t, p.CreateFederatedIdentityCredential(ctx, identityID, &FederatedCredential{
+		Name:      "fc",
+		Issuer:    "https://issuer.example.com",
+		Subject:   "subject",
+		Audiences: []string{defaultFederatedCredentialAudience},
+	}))
+
+	assertErrorIsNil(t, p.DeleteUserAssignedIdentity(ctx, identityID))
+
+	equal(t, []string{
+		"GET " + groupID + "?api-version=" + resourceGroupsAPIVersion,
+		"PUT " + identityID + "?api-version=" + managedIdentityAPIVersion,
+		"PUT " + identityID + "/federatedIdentityCredentials/fc?api-version=" + managedIdentityAPIVersion,
+		"DELETE " + identityID + "?api-version=" + managedIdentityAPIVersion,
+	}, requests)
+	equal(t, []map[string]interface{}{
+		{
+			"location": "westeurope",
+			"tags":     map[string]interface{}{"vault_role": "test"},
+		},
+		{
+			"properties": map[string]interface{}{
+				"issuer":    "https://issuer.example.com",
+				"subject":   "subject",
+				"audiences": []interface{}{defaultFederatedCredentialAudience},
+			},
+		},
+	}, bodies)
+
+	if err := p.DeleteUserAssignedIdentity(ctx, identityID+"-missing"); !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if _, err := p.GetResourceGroup(ctx, identityID); err == nil {
+		t.Fatal("expected an error for an ID that is not a resource group")
+	}
+}
+
+func TestProviderServicePrincipalGroups(t *testing.T) {
+	var paths []string
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		// Graph returns the groups in pages linked by @odata.nextLink
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("page") == "2" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"value": []map[string]interface{}{{"id": "group-3"}},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"value":           []map[string]interface{}{{"id": "group-1"}, {"id": "group-2"}},
+			"@odata.nextLink": srv.URL + r.URL.Path + "?page=2",
+		})
+	}))
+	defer srv.Close()
+
+	graphClient, err := api.NewMSGraphClient(srv.URL, staticTokenCredential{}, srv.Client().Transport)
+	assertErrorIsNil(t, err)
+	p := &provider{spClient: graphClient}
+
+	groups, err := p.ListServicePrincipalGroups(context.Background(), "sp-id")
+	assertErrorIsNil(t, err)
+	equal(t, []api.Group{{ID: "group-1"}, {ID: "group-2"}, {ID: "group-3"}}, groups)
+	equal(t, 2, len(paths))
+	for _, path := range paths {
+		if !strings.HasSuffix(path, "/servicePrincipals/sp-id/memberOf/graph.group") {
+			t.Fatalf("unexpected request path %q", path)
+		}
+	}
+}
+
+// decodeGraphBody decodes the JSON body of a Graph request, which the Graph
+// SDK compresses.
+func decodeGraphBody(t *testing.T, r *http.Request) map[string]interface{} {
+	t.Helper()
+
+	reader := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		assertErrorIsNil(t, err)
+		reader = gz
+	}
+	var body map[string]interface{}
+	assertErrorIsNil(t, json.NewDecoder(reader).Decode(&body))
+	return body
+}
+
+func TestProviderApplicationOwners(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = decodeGraphBody(t, r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    "app-object-id",
+			"appId": "app-id",
+		})
+	}))
+	defer srv.Close()
+
+	graphClient, err := api.NewMSGraphClient(srv.URL, staticTokenCredential{}, srv.Client().Transport)
+	assertErrorIsNil(t, err)
+	p := &provider{appClient: graphClient}
+
+	// Owners are bound under the Graph endpoint of the configured cloud
+	_, err = p.CreateApplication(context.Background(), api.Application{
+		DisplayName: "app",
+		Owners:      []string{"owner-1"},
+	})
+	assertErrorIsNil(t, err)
+	equal(t, []interface{}{srv.URL + "/v1.0/directoryObjects/owner-1"}, body["owners@odata.bind"])
+}
+
+func TestProviderGroupReferences(t *testing.T) {
+	bodies := make(map[string]interface{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodies[r.URL.Path] = decodeGraphBody(t, r)["@odata.id"]
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	graphClient, err := api.NewMSGraphClient(srv.URL, staticTokenCredential{}, srv.Client().Transport)
+	assertErrorIsNil(t, err)
+	p := &provider{groupsClient: graphClient}
+
+	// Members and owners are referenced under the Graph endpoint of the
+	// configured cloud
+	assertErrorIsNil(t, p.AddGroupMember(context.Background(), "group-1", "member-1"))
+	assertErrorIsNil(t, p.AddGroupOwner(context.Background(), "group-1", "owner-1"))
+	equal(t, map[string]interface{}{
+		"/v1.0/groups/group-1/members/$ref": srv.URL + "/v1.0/directoryObjects/member-1",
+		"/v1.0/groups/group-1/owners/$ref":  srv.URL + "/v1.0/directoryObjects/owner-1",
+	}, bodies)
+}
+
+func TestProviderKeyVaultSecret(t *testing.T) {
+	var requests []string
+	var bodies []map[string]interface{}
+	// The test certificate is valid for *.example.com, which is the DNS suffix
+	// of the key vaults of the test cloud.
+	const vaultURL = "https://kv.example.com"
+	keyVault := cloud.ServiceConfiguration{Endpoint: "example.com", Audience: "https://example.com"}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+"?api-version="+r.URL.Query().Get("api-version"))
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/secrets/app-secret":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":    vaultURL + "/secrets/app-secret/v1",
+				"value": body["value"],
+			})
+		case r.Method == http.MethodPatch && r.URL.Path == "/secrets/app-secret/v1":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"SecretNotFound","message":"not found"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	// Requests to the key vault are sent to the test server
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	p := &provider{
+		keyVault: keyVault,
+		keyVaultPipeline: newKeyVaultPipeline(staticTokenCredential{}, &arm.ClientOptions{
+			ClientOptions: policy.ClientOptions{
+				Transport: &http.Client{Transport: transport},
+				Retry: policy.RetryOptions{
+					MaxRetries: -1,
+				},
+			},
+		}, keyVault),
+	}
+
+	ctx := context.Background()
+
+	id, err := p.SetKeyVaultSecret(ctx, vaultURL, "app-secret", "secret", "client_secret", map[string]string{"vault_role": "test"})
+	assertErrorIsNil(t, err)
+	equal(t, vaultURL+"/secrets/app-secret/v1", id)
+
+	assertErrorIsNil(t, p.DisableKeyVaultSecret(ctx, id))
+
+	equal(t, []string{
+		"PUT /secrets/app-secret?api-version=" + keyVaultAPIVersion,
+		"PATCH /secrets/app-secret/v1?api-version=" + keyVaultAPIVersion,
+	}, requests)
+	equal(t, []map[string]interface{}{
+		{
+			"value":       "secret",
+			"contentType": "client_secret",
+			"tags":        map[string]interface{}{"vault_role": "test"},
+		},
+		{
+			"attributes": map[string]interface{}{"enabled": false},
+		},
+	}, bodies)
+
+	if err := p.DisableKeyVaultSecret(ctx, vaultURL+"/secrets/missing/v1"); !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+
+	// Requests to hosts outside of the key vaults of the cloud are refused
+	if _, err := p.SetKeyVaultSecret(ctx, srv.URL, "app-secret", "secret", "client_secret", nil); err == nil {
+		t.Fatal("expected an error for a host that is not a key vault")
+	}
+	equal(t, 3, len(requests))
+}
+
+func TestKeyVaultScope(t *testing.T) {
+	for vaultURL, tc := range map[string]struct {
+		environment string
+		scope       string
+	}{
+		"https://example.vault.azure.net":                  {"AZUREPUBLICCLOUD", "https://vault.azure.net/.default"},
+		"https://example.vault.azure.cn/secrets/s/v1":      {"AZURECHINACLOUD", "https://vault.azure.cn/.default"},
+		"https://EXAMPLE.vault.usgovcloudapi.net:443/path": {"AZUREUSGOVERNMENTCLOUD", "https://vault.usgovcloudapi.net/.default"},
+	} {
+		scope, err := keyVaultScope(vaultURL, testKeyVaultService(t, tc.environment))
+		assertErrorIsNil(t, err)
+		equal(t, tc.scope, scope)
+	}
+
+	// Only key vaults of the configured cloud are accepted
+	keyVault := testKeyVaultService(t, "AZUREPUBLICCLOUD")
+	for _, vaultURL := range []string{
+		"http://example.vault.azure.net",
+		"https://localhost",
+		"https://example.",
+		"https://vault.azure.net",
+		"https://example.vault.azure.cn",
+		"https://example.vault.azure.net.attacker.com",
+		"https://attacker.com/example.vault.azure.net",
+		"https://a.b.vault.azure.net",
+	} {
+		if _, err := keyVaultScope(vaultURL, keyVault); err == nil {
+			t.Fatalf("expected an error for %q", vaultURL)
+		}
+	}
+
+	if _, err := keyVaultScope("https://example.vault.azure.net", cloud.ServiceConfiguration{}); err == nil {
+		t.Fatal("expected an error for a cloud without key vaults")
+	}
+}
+
+func TestNewAzureProvider(t *testing.T) {
+	cloudConfig, err := cloudConfigFromName(azurePublicCloudEnvName)
+	assertErrorIsNil(t, err)
+
+	p, err := newAzureProvider(&clientSettings{
+		SubscriptionID: "sub1",
+		TenantID:       "tenant",
+		ClientID:       "client",
+		ClientSecret:   "secret",
+		GraphURI:       azurePublicCloudBaseURI,
+		CloudConfig:    cloudConfig,
+	})
+	assertErrorIsNil(t, err)
+
+	// The generic ARM client is created without an SDK module version
+	azureProvider := p.(*instrumentedProvider).next.(*provider)
+	equal(t, cloud.AzurePublic.Services[cloud.ResourceManager].Endpoint, azureProvider.armClient.Endpoint())
+}
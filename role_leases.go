@@ -0,0 +1,195 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// roleLeasesStoragePath holds a record of every outstanding lease, keyed
+	// by role name and tracking ID.
+	roleLeasesStoragePath = "role-leases"
+
+	// leaseTrackingIDKey is the key of the tracking ID in the internal data of
+	// a secret.
+	leaseTrackingIDKey = "lease_tracking_id"
+)
+
+// errIssueLimit is returned when issuing credentials would exceed the limits
+// of a role.
+var errIssueLimit = errors.New("issue limit exceeded")
+
+// roleLease is the record of an outstanding lease. It holds what is needed to
+// revoke the credentials without the lease.
+type roleLease struct {
+	SecretType   string                 `json:"secret_type"`
+	InternalData map[string]interface{} `json:"internal_data"`
+	IssueTime    time.Time              `json:"issue_time"`
+}
+
+// trackLease records the secret in resp as an outstanding lease of the role.
+func trackLease(ctx context.Context, s logical.Storage, roleName string, resp *logical.Response) error {
+	id := uuid.New().String()
+	resp.Secret.InternalData[leaseTrackingIDKey] = id
+
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s/%s", roleLeasesStoragePath, roleName, id), &roleLease{
+		SecretType:   resp.Secret.InternalData["secret_type"].(string),
+		InternalData: resp.Secret.InternalData,
+		IssueTime:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// untrackLease removes the record of a revoked lease. Leases issued before
+// leases were tracked have no tracking ID and are ignored.
+func untrackLease(ctx context.Context, s logical.Storage, secret *logical.Secret) error {
+	roleName, _ := secret.InternalData["role"].(string)
+	id, _ := secret.InternalData[leaseTrackingIDKey].(string)
+	if roleName == "" || id == "" {
+		return nil
+	}
+
+	return s.Delete(ctx, fmt.Sprintf("%s/%s/%s", roleLeasesStoragePath, roleName, id))
+}
+
+// roleLeaseIDs returns the tracking IDs of the outstanding leases of a role.
+func roleLeaseIDs(ctx context.Context, s logical.Storage, roleName string) ([]string, error) {
+	return s.List(ctx, fmt.Sprintf("%s/%s/", roleLeasesStoragePath, roleName))
+}
+
+// revokeRoleLeases revokes the credentials of every outstanding lease of a
+// role, as revoking the leases by prefix would. The leases themselves remain
+// in Vault until they expire or are revoked, at which point revocation is a
+// no-op. An attempt is made to revoke all credentials, and not return
+// immediately if there is an error.
+func (b *azureSecretBackend) revokeRoleLeases(ctx context.Context, s logical.Storage, roleName string) error {
+	ids, err := roleLeaseIDs(ctx, s, roleName)
+	if err != nil {
+		return err
+	}
+
+	var merr *multierror.Error
+	for _, id := range ids {
+		entry, err := s.Get(ctx, fmt.Sprintf("%s/%s/%s", roleLeasesStoragePath, roleName, id))
+		if err != nil {
+			merr = multierror.Append(merr, err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+
+		var lease roleLease
+		if err := entry.DecodeJSON(&lease); err != nil {
+			merr = multierror.Append(merr, err)
+			continue
+		}
+
+		if err := b.revokeCredentials(ctx, s, lease.SecretType, lease.InternalData); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("error revoking lease %q: %w", id, err))
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// revokeCredentials revokes the credentials of a lease from its internal
+// data, as stored in Vault.
+func (b *azureSecretBackend) revokeCredentials(ctx context.Context, s logical.Storage, secretType string, internalData map[string]interface{}) error {
+	req := &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret: &logical.Secret{
+			InternalData: internalData,
+		},
+	}
+
+	var err error
+	switch secretType {
+	case SecretTypeSP:
+		_, err = b.spRevoke(ctx, req, nil)
+	case SecretTypeStaticSP:
+		_, err = b.staticSPRevoke(ctx, req, nil)
+	case SecretTypeManagedIdentity:
+		_, err = b.managedIdentityRevoke(ctx, req, nil)
+	default:
+		err = fmt.Errorf("unknown secret type %q", secretType)
+	}
+	return err
+}
+
+// revokeUntrackedSecret revokes the credentials of a secret whose lease
+// couldn't be tracked. The WALs of the Azure objects created for it have
+// already been deleted, so they would otherwise be left without a lease.
+func (b *azureSecretBackend) revokeUntrackedSecret(ctx context.Context, s logical.Storage, secret *logical.Secret) error {
+	// Revocation expects the internal data as it is decoded from storage
+	raw, err := jsonutil.EncodeJSON(secret.InternalData)
+	if err != nil {
+		return err
+	}
+	var internalData map[string]interface{}
+	if err := jsonutil.DecodeJSON(raw, &internalData); err != nil {
+		return err
+	}
+
+	secretType, _ := internalData["secret_type"].(string)
+	return b.revokeCredentials(ctx, s, secretType, internalData)
+}
+
+// roleIssueLimiter limits the rate at which credentials are issued for a role.
+type roleIssueLimiter struct {
+	perMinute int
+	limiter   *rate.Limiter
+}
+
+// checkIssueLimits returns an error if issuing credentials for the role would
+// exceed its limits. Callers must hold the issue lock of the role if it limits
+// its number of active credentials.
+func (b *azureSecretBackend) checkIssueLimits(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) error {
+	if role.MaxActiveCredentials > 0 {
+		ids, err := roleLeaseIDs(ctx, s, roleName)
+		if err != nil {
+			return fmt.Errorf("error listing leases: %w", err)
+		}
+		if len(ids) >= role.MaxActiveCredentials {
+			return fmt.Errorf("%w: role %q has reached its limit of %d active credentials", errIssueLimit, roleName, role.MaxActiveCredentials)
+		}
+	}
+
+	if role.MaxIssueRate > 0 && !b.issueLimiter(roleName, role.MaxIssueRate).Allow() {
+		return fmt.Errorf("%w: role %q has reached its limit of %d credentials issued per minute", errIssueLimit, roleName, role.MaxIssueRate)
+	}
+
+	return nil
+}
+
+// issueLimiter returns the rate limiter of a role, replacing it if the
+// role's rate has changed.
+func (b *azureSecretBackend) issueLimiter(roleName string, perMinute int) *rate.Limiter {
+	if l, ok := b.issueLimiters.Load(roleName); ok && l.(*roleIssueLimiter).perMinute == perMinute {
+		return l.(*roleIssueLimiter).limiter
+	}
+
+	l := &roleIssueLimiter{
+		perMinute: perMinute,
+		limiter:   rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute),
+	}
+	b.issueLimiters.Store(roleName, l)
+
+	return l.limiter
+}
@@ -0,0 +1,202 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// Values of verify_role_permissions
+	verifyRolePermissionsWarn = "warn"
+	verifyRolePermissionsFail = "fail"
+	verifyRolePermissionsSkip = "skip"
+
+	// roleAssignmentsWriteAction is the action needed to assign roles.
+	roleAssignmentsWriteAction = "Microsoft.Authorization/roleAssignments/write"
+
+	// roleDefinitionIDAttribute is the request attribute that conditions use to
+	// limit which roles may be assigned.
+	roleDefinitionIDAttribute = "Microsoft.Authorization/roleAssignments:RoleDefinitionId"
+)
+
+// verifyRolePermissions checks that the configured identity can assign the
+// Azure roles of the role at their scopes. Depending on the
+// verify_role_permissions config, the roles that can't be assigned result in
+// an error response or in warnings. Roles that couldn't be checked always
+// result in warnings.
+func verifyRolePermissions(ctx context.Context, c *client, config *azureConfig, role *roleEntry) (*logical.Response, []string) {
+	mode := verifyRolePermissionsWarn
+	if config != nil && config.VerifyRolePermissions != "" {
+		mode = config.VerifyRolePermissions
+	}
+
+	// Roles are only assigned to apps created by Vault
+	if mode == verifyRolePermissionsSkip || (role.ApplicationObjectID != "" && !role.PersistApp) {
+		return nil, nil
+	}
+
+	denied, warnings := c.checkAssignPermissions(ctx, role.AzureRoles)
+	if len(denied) > 0 && mode == verifyRolePermissionsFail {
+		return logical.ErrorResponse(strings.Join(denied, "; ")), nil
+	}
+
+	return nil, append(denied, warnings...)
+}
+
+// checkAssignPermissions checks the effective permissions of the configured
+// identity at the scope of each role. It returns a message for each role the
+// identity can't assign, and warnings for the roles that may not be assignable
+// or couldn't be checked. Templated scopes are only known when credentials are
+// generated and are not checked.
+func (c *client) checkAssignPermissions(ctx context.Context, roles []*AzureRole) (denied []string, warnings []string) {
+	type scopePermissions struct {
+		permissions []Permission
+		err         error
+	}
+	scopes := make(map[string]scopePermissions)
+
+	for _, r := range roles {
+		if hasTemplate(r.Scope) {
+			continue
+		}
+
+		key := strings.ToLower(r.Scope)
+		sp, ok := scopes[key]
+		if !ok {
+			sp.permissions, sp.err = c.provider.ListPermissions(ctx, r.Scope)
+			scopes[key] = sp
+		}
+		if sp.err != nil {
+			warnings = append(warnings, fmt.Sprintf("unable to verify that role %q can be assigned at scope %q: %s", r.RoleName, r.Scope, sp.err))
+			continue
+		}
+
+		var allowed []Permission
+		for _, p := range sp.permissions {
+			if permissionAllows(p, roleAssignmentsWriteAction) {
+				allowed = append(allowed, p)
+			}
+		}
+		if len(allowed) == 0 {
+			denied = append(denied, fmt.Sprintf("the configured identity is not allowed %s at scope %q, needed to assign role %q", roleAssignmentsWriteAction, r.Scope, r.RoleName))
+			continue
+		}
+
+		switch conditionsAllow(allowed, r.RoleID) {
+		case conditionDenies:
+			denied = append(denied, fmt.Sprintf("a condition on the role assignments of the configured identity at scope %q doesn't allow it to assign role %q", r.Scope, r.RoleName))
+		case conditionUnknown:
+			warnings = append(warnings, fmt.Sprintf("a condition on the role assignments of the configured identity at scope %q may not allow it to assign role %q", r.Scope, r.RoleName))
+		}
+	}
+
+	return denied, warnings
+}
+
+type conditionResult int
+
+const (
+	conditionAllows conditionResult = iota
+	conditionDenies
+	conditionUnknown
+)
+
+// roleDefinitionConditionRegex matches an expression of a condition on the
+// role definition ID of the role assignment, capturing its operator and the
+// set of IDs it compares to.
+var roleDefinitionConditionRegex = regexp.MustCompile(`(?i)@Request\[` + regexp.QuoteMeta(roleDefinitionIDAttribute) + `\]\s+([a-z:]+)\s*\{([^}]*)\}`)
+
+// conditionsAllow reports whether the conditions of the permissions allow
+// assigning the role definition. Only one of the permissions needs to allow
+// it. Only conditions that allow a list of role definitions to be assigned,
+// with the GuidEquals operator, are evaluated. Any other condition can't be
+// evaluated before the assignment is made.
+func conditionsAllow(permissions []Permission, roleID string) conditionResult {
+	result := conditionDenies
+	roleDefID := strings.ToLower(roleID[strings.LastIndex(roleID, "/")+1:])
+
+	for _, p := range permissions {
+		switch allowListAllows(p.Condition, roleDefID) {
+		case conditionAllows:
+			return conditionAllows
+		case conditionUnknown:
+			result = conditionUnknown
+		}
+	}
+
+	return result
+}
+
+// allowListAllows evaluates a condition that only allows the role definitions
+// it lists to be assigned. Conditions of any other form are unknown.
+func allowListAllows(condition string, roleDefID string) conditionResult {
+	if condition == "" {
+		return conditionAllows
+	}
+
+	exprs := roleDefinitionConditionRegex.FindAllStringSubmatchIndex(condition, -1)
+	lower := strings.ToLower(condition)
+	if len(exprs) == 0 || len(exprs) != strings.Count(lower, strings.ToLower(roleDefinitionIDAttribute)) {
+		return conditionUnknown
+	}
+
+	var listed, unlisted int
+	for _, expr := range exprs {
+		operator := lower[expr[2]:expr[3]]
+		if operator != "foranyofanyvalues:guidequals" && operator != "guidequals" {
+			return conditionUnknown
+		}
+
+		// A negated allow-list is a deny-list
+		prefix := strings.TrimRight(lower[:expr[0]], " \t\r\n(")
+		if strings.HasSuffix(prefix, "!") || strings.HasSuffix(prefix, "not") {
+			return conditionUnknown
+		}
+
+		found := false
+		for _, id := range strings.Split(lower[expr[4]:expr[5]], ",") {
+			if roleDefID != "" && strings.TrimSpace(id) == roleDefID {
+				found = true
+			}
+		}
+		if found {
+			listed++
+		} else {
+			unlisted++
+		}
+	}
+
+	switch {
+	case unlisted == 0:
+		return conditionAllows
+	case listed == 0:
+		return conditionDenies
+	default:
+		return conditionUnknown
+	}
+}
+
+// permissionAllows reports whether the actions of the permission include
+// action and its not actions don't exclude it.
+func permissionAllows(p Permission, action string) bool {
+	return matchesAnyAction(p.Actions, action) && !matchesAnyAction(p.NotActions, action)
+}
+
+// matchesAnyAction reports whether action matches any of the patterns.
+// Actions are case insensitive and patterns may contain * wildcards.
+func matchesAnyAction(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		expr := "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if matched, err := regexp.MatchString(expr, action); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// sasVersion is the storage service version that SAS tokens are signed
+	// for.
+	sasVersion = "2021-12-02"
+
+	// sasTimeFormat is the format of the times in SAS tokens.
+	sasTimeFormat = "2006-01-02T15:04:05Z"
+
+	// sasProtocol limits SAS tokens to HTTPS.
+	sasProtocol = "https"
+
+	// accountSASPermissions are the permissions of an account SAS, in the
+	// order they must be given.
+	accountSASPermissions = "rwdxylacuptfi"
+
+	// containerSASPermissions are the permissions of a container SAS, in the
+	// order they must be given.
+	containerSASPermissions = "racwdxyltfmeopi"
+)
+
+// sasServices maps the services of an account SAS to their signed service
+// letters. sasServiceOrder and sasResourceTypeOrder give the order of the
+// letters in a token.
+var (
+	sasServices = map[string]string{
+		"blob":  "b",
+		"file":  "f",
+		"queue": "q",
+		"table": "t",
+	}
+	sasServiceOrder = "bfqt"
+
+	sasResourceTypes = map[string]string{
+		"service":   "s",
+		"container": "c",
+		"object":    "o",
+	}
+	sasResourceTypeOrder = "sco"
+)
+
+// sasToken holds the values that are common to account and user delegation
+// SAS tokens.
+type sasToken struct {
+	Permissions string
+	Start       time.Time
+	Expiry      time.Time
+	IPRange     string
+}
+
+// signAccountSAS returns an account SAS for the services and resource types,
+// signed with a base64 encoded key of the account.
+func signAccountSAS(accountName, accountKey string, services, resourceTypes []string, token sasToken) (string, error) {
+	ss, err := sasLetters(services, sasServices, sasServiceOrder)
+	if err != nil {
+		return "", fmt.Errorf("invalid services: %w", err)
+	}
+	srt, err := sasLetters(resourceTypes, sasResourceTypes, sasResourceTypeOrder)
+	if err != nil {
+		return "", fmt.Errorf("invalid resource types: %w", err)
+	}
+	sp, err := normalizeSASPermissions(token.Permissions, accountSASPermissions)
+	if err != nil {
+		return "", err
+	}
+	st := token.Start.UTC().Format(sasTimeFormat)
+	se := token.Expiry.UTC().Format(sasTimeFormat)
+
+	stringToSign := strings.Join([]string{
+		accountName,
+		sp,
+		ss,
+		srt,
+		st,
+		se,
+		token.IPRange,
+		sasProtocol,
+		sasVersion,
+		"", // encryption scope
+		"",
+	}, "\n")
+
+	sig, err := signSAS(accountKey, stringToSign)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"sv":  {sasVersion},
+		"ss":  {ss},
+		"srt": {srt},
+		"sp":  {sp},
+		"st":  {st},
+		"se":  {se},
+		"spr": {sasProtocol},
+		"sig": {sig},
+	}
+	if token.IPRange != "" {
+		q.Set("sip", token.IPRange)
+	}
+
+	return q.Encode(), nil
+}
+
+// signUserDelegationSAS returns a SAS for a blob container, signed with a
+// user delegation key.
+func signUserDelegationSAS(accountName, container string, key UserDelegationKey, token sasToken) (string, error) {
+	sp, err := normalizeSASPermissions(token.Permissions, containerSASPermissions)
+	if err != nil {
+		return "", err
+	}
+	st := token.Start.UTC().Format(sasTimeFormat)
+	se := token.Expiry.UTC().Format(sasTimeFormat)
+	skt := key.SignedStart.UTC().Format(sasTimeFormat)
+	ske := key.SignedExpiry.UTC().Format(sasTimeFormat)
+
+	stringToSign := strings.Join([]string{
+		sp,
+		st,
+		se,
+		"/blob/" + accountName + "/" + container,
+		key.SignedOID,
+		key.SignedTID,
+		skt,
+		ske,
+		key.SignedService,
+		key.SignedVersion,
+		"", // authorized object ID
+		"", // unauthorized object ID
+		"", // correlation ID
+		token.IPRange,
+		sasProtocol,
+		sasVersion,
+		"c", // signed resource
+		"",  // snapshot time
+		"",  // encryption scope
+		"",  // cache control
+		"",  // content disposition
+		"",  // content encoding
+		"",  // content language
+		"",  // content type
+	}, "\n")
+
+	sig, err := signSAS(key.Value, stringToSign)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"sv":    {sasVersion},
+		"sr":    {"c"},
+		"sp":    {sp},
+		"st":    {st},
+		"se":    {se},
+		"spr":   {sasProtocol},
+		"skoid": {key.SignedOID},
+		"sktid": {key.SignedTID},
+		"skt":   {skt},
+		"ske":   {ske},
+		"sks":   {key.SignedService},
+		"skv":   {key.SignedVersion},
+		"sig":   {sig},
+	}
+	if token.IPRange != "" {
+		q.Set("sip", token.IPRange)
+	}
+
+	return q.Encode(), nil
+}
+
+func signSAS(key, stringToSign string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid signing key: %w", err)
+	}
+
+	h := hmac.New(sha256.New, decoded)
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// sasLetters returns the letters of the names, in the given order.
+func sasLetters(names []string, letters map[string]string, order string) (string, error) {
+	if len(names) == 0 {
+		return "", fmt.Errorf("at least one is required")
+	}
+
+	set := make(map[string]bool)
+	for _, name := range names {
+		l, ok := letters[strings.ToLower(name)]
+		if !ok {
+			return "", fmt.Errorf("unknown value %q", name)
+		}
+		set[l] = true
+	}
+
+	var sb strings.Builder
+	for _, l := range order {
+		if set[string(l)] {
+			sb.WriteRune(l)
+		}
+	}
+	return sb.String(), nil
+}
+
+// normalizeSASPermissions checks that the permissions are allowed and returns
+// them in the order they must be given.
+func normalizeSASPermissions(permissions, allowed string) (string, error) {
+	if permissions == "" {
+		return "", fmt.Errorf("permissions are required")
+	}
+	for _, p := range permissions {
+		if !strings.ContainsRune(allowed, p) {
+			return "", fmt.Errorf("invalid permission %q; allowed permissions are %q", p, allowed)
+		}
+	}
+
+	var sb strings.Builder
+	for _, p := range allowed {
+		if strings.ContainsRune(permissions, p) {
+			sb.WriteRune(p)
+		}
+	}
+	return sb.String(), nil
+}
+
+// parseSASIPRange parses an IPv4 address or a range of IPv4 addresses
+// separated by a dash, as used in SAS tokens.
+func parseSASIPRange(r string) (start, end uint32, err error) {
+	first, last, isRange := strings.Cut(r, "-")
+	if !isRange {
+		last = first
+	}
+
+	start, err = parseIPv4(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = parseIPv4(last)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid IP range %q: start is after end", r)
+	}
+	return start, end, nil
+}
+
+func parseIPv4(s string) (uint32, error) {
+	ip := net.ParseIP(strings.TrimSpace(s)).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	return binary.BigEndian.Uint32(ip), nil
+}
+
+// sasIPRangeWithin reports whether the IP range r is within the range outer.
+// Both ranges must be valid.
+func sasIPRangeWithin(r, outer string) bool {
+	start, end, err := parseSASIPRange(r)
+	if err != nil {
+		return false
+	}
+	outerStart, outerEnd, err := parseSASIPRange(outer)
+	if err != nil {
+		return false
+	}
+	return start >= outerStart && end <= outerEnd
+}
@@ -0,0 +1,125 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/hashicorp/vault-plugin-secrets-azure"
+
+// Attributes of the spans of Vault requests and Azure calls. The request IDs
+// are the ones Azure support asks for to look into a request.
+const (
+	attrVaultOperation       = attribute.Key("vault.operation")
+	attrVaultPath            = attribute.Key("vault.path")
+	attrService              = attribute.Key("azure.service")
+	attrOperation            = attribute.Key("azure.operation")
+	attrAttempts             = attribute.Key("azure.attempts")
+	attrRequestID            = attribute.Key("azure.request_id")
+	attrClientRequestID      = attribute.Key("azure.client_request_id")
+	attrCorrelationRequestID = attribute.Key("azure.correlation_request_id")
+)
+
+// tracer returns the tracer of the globally registered tracer provider,
+// which doesn't record anything unless tracing is configured.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// HandleRequest handles a Vault request in a span, which the spans of the
+// Azure calls made for the request are children of.
+func (b *azureSecretBackend) HandleRequest(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	ctx, span := tracer().Start(ctx, "vault "+string(req.Operation), trace.WithAttributes(
+		attrVaultOperation.String(string(req.Operation)),
+		attrVaultPath.String(req.Path),
+	))
+	defer span.End()
+
+	resp, err := b.Backend.HandleRequest(ctx, req)
+	setSpanError(span, respErr(resp, err))
+	return resp, err
+}
+
+// setSpanError records the error, if any, as the status of the span.
+func setSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// sendAttempt sends an HTTP attempt of a provider call in a child span of the
+// call, and records the request IDs of the attempt on the span.
+func sendAttempt(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		))
+	defer span.End()
+
+	resp, err := send(req.WithContext(ctx))
+
+	requestIDs := requestIDAttributes(req, resp)
+	span.SetAttributes(requestIDs...)
+	switch {
+	case err != nil:
+		setSpanError(span, err)
+	case resp.StatusCode >= http.StatusBadRequest:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
+	default:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+
+	recordAttempt(req.Context(), resp, requestIDs)
+	return resp, err
+}
+
+// requestIDAttributes returns the IDs of an HTTP attempt. ARM, Storage and Key
+// Vault return them in x-ms-* headers, and Graph in headers without the prefix.
+// The client request ID is set by the SDKs, so it is known even if no response
+// was received.
+func requestIDAttributes(req *http.Request, resp *http.Response) []attribute.KeyValue {
+	var header http.Header
+	if resp != nil {
+		header = resp.Header
+	}
+
+	var attrs []attribute.KeyValue
+	add := func(key attribute.Key, values ...string) {
+		for _, v := range values {
+			if v != "" {
+				attrs = append(attrs, key.String(v))
+				return
+			}
+		}
+	}
+	add(attrRequestID, header.Get("x-ms-request-id"), header.Get("request-id"))
+	add(attrClientRequestID,
+		header.Get("x-ms-client-request-id"), header.Get("client-request-id"),
+		req.Header.Get("x-ms-client-request-id"), req.Header.Get("client-request-id"))
+	add(attrCorrelationRequestID, header.Get("x-ms-correlation-request-id"))
+
+	return attrs
+}
+
+// tracePropagationWait adds an event to the span of the request when retry
+// waits for Azure to propagate an object before attempting again.
+func tracePropagationWait(ctx context.Context, operation string, attempts int) {
+	trace.SpanFromContext(ctx).AddEvent("waiting for propagation", trace.WithAttributes(
+		attrOperation.String(operation),
+		attrAttempts.Int(attempts),
+	))
+}
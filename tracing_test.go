@@ -0,0 +1,207 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package azuresecrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/hashicorp/vault-plugin-secrets-azure/api"
+)
+
+// newTestTracing records the spans ended during the test.
+func newTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+	})
+	return recorder
+}
+
+// findSpan returns the ended span with the name.
+func findSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("expected a span named %q", name)
+	return nil
+}
+
+// spanAttributes returns the attributes of the span as strings.
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	attrs := make(map[attribute.Key]string)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestARMTracing(t *testing.T) {
+	recorder := newTestTracing(t)
+	accountID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.DocumentDB/databaseAccounts/cosmos"
+
+	var clientRequestIDs []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientRequestIDs = append(clientRequestIDs, r.Header.Get("x-ms-client-request-id"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("x-ms-request-id", "arm-request-id")
+		w.Header().Set("x-ms-correlation-request-id", "arm-correlation-id")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+	}))
+	defer srv.Close()
+
+	opts := &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Endpoint: srv.URL,
+						Audience: srv.URL,
+					},
+				},
+			},
+			Transport: transporter{sender: srv.Client()},
+			Retry: policy.RetryOptions{
+				MaxRetries: -1,
+			},
+		},
+	}
+	armClient, err := arm.NewClient("test", "v0.0.0", staticTokenCredential{}, opts)
+	assertErrorIsNil(t, err)
+	var logs bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{Output: &logs, Level: hclog.Debug})
+	p := newInstrumentedProvider(&provider{armClient: armClient}, logger)
+
+	ctx, parent := tracer().Start(context.Background(), "parent")
+	_, err = p.GetCosmosDBAccount(ctx, accountID)
+	parent.End()
+	if !isResourceNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+
+	equal(t, 1, len(clientRequestIDs))
+	expectedIDs := map[attribute.Key]string{
+		attrRequestID:            "arm-request-id",
+		attrClientRequestID:      clientRequestIDs[0],
+		attrCorrelationRequestID: "arm-correlation-id",
+	}
+
+	// The IDs are recorded on the span of the HTTP attempt and of the call
+	httpSpan := findSpan(t, recorder, "HTTP GET")
+	callSpan := findSpan(t, recorder, "GetCosmosDBAccount")
+	equal(t, callSpan.SpanContext().SpanID(), httpSpan.Parent().SpanID())
+	equal(t, parent.SpanContext().SpanID(), callSpan.Parent().SpanID())
+
+	for _, span := range []sdktrace.ReadOnlySpan{httpSpan, callSpan} {
+		attrs := spanAttributes(span)
+		for key, value := range expectedIDs {
+			equal(t, value, attrs[key])
+		}
+		equal(t, codes.Error, span.Status().Code)
+	}
+	equal(t, "404", spanAttributes(httpSpan)["http.response.status_code"])
+	equal(t, serviceARM, spanAttributes(callSpan)[attrService])
+
+	// The IDs of the failed call are logged as well
+	for _, expected := range []string{
+		"operation=GetCosmosDBAccount",
+		"status_code=404",
+		"request_id=arm-request-id",
+		"correlation_request_id=arm-correlation-id",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Fatalf("expected the log to contain %q, got: %s", expected, logs.String())
+		}
+	}
+}
+
+func TestGraphTracing(t *testing.T) {
+	recorder := newTestTracing(t)
+
+	var clientRequestID string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientRequestID = r.Header.Get("client-request-id")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("request-id", "graph-request-id")
+		w.Header().Set("client-request-id", clientRequestID)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":          "group-id",
+			"displayName": "group",
+		})
+	}))
+	defer srv.Close()
+
+	graphClient, err := api.NewMSGraphClient(srv.URL, staticTokenCredential{}, attemptTransport{next: srv.Client().Transport})
+	assertErrorIsNil(t, err)
+	p := newInstrumentedProvider(&provider{groupsClient: graphClient}, nil)
+
+	group, err := p.GetGroup(context.Background(), "group-id")
+	assertErrorIsNil(t, err)
+	equal(t, "group", group.DisplayName)
+
+	if clientRequestID == "" {
+		t.Fatal("expected the Graph SDK to send a client request ID")
+	}
+	attrs := spanAttributes(findSpan(t, recorder, "GetGroup"))
+	equal(t, "graph-request-id", attrs[attrRequestID])
+	equal(t, clientRequestID, attrs[attrClientRequestID])
+	equal(t, serviceGraph, attrs[attrService])
+}
+
+func TestRequestTracing(t *testing.T) {
+	recorder := newTestTracing(t)
+	b, s := getTestBackendMocked(t, true)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/missing_role",
+		Storage:   s,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected an error response for a missing role, got: %v, %v", resp, err)
+	}
+
+	span := findSpan(t, recorder, "vault read")
+	equal(t, "creds/missing_role", spanAttributes(span)[attrVaultPath])
+	equal(t, codes.Error, span.Status().Code)
+
+	// Waiting for propagation is recorded on the span of the request
+	ctx, parent := tracer().Start(context.Background(), "parent")
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	retry(ctx, "CreateRoleAssignment", func() (interface{}, bool, error) {
+		return nil, false, nil
+	})
+	parent.End()
+
+	events := findSpan(t, recorder, "parent").Events()
+	equal(t, 1, len(events))
+	equal(t, "waiting for propagation", events[0].Name)
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/mitchellh/mapstructure"
 )
@@ -18,22 +19,71 @@ const (
 	walAppKey            = "appCreate"
 	walRotateRootCreds   = "rotateRootCreds"
 	walAppRoleAssignment = "appRoleAssign"
+	walGroupMembership   = "groupMembership"
+	walGrantRemoval      = "grantRemoval"
+	walAppRetire         = "appRetire"
+	walACRToken          = "acrToken"
+
+	walManagedIdentityKey = "managedIdentityCreate"
 )
 
 // Eventually expire the WAL if for some reason the rollback operation consistently fails
 var maxWALAge = 24 * time.Hour
 
 func (b *azureSecretBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	var err error
 	switch kind {
 	case walAppKey:
-		return b.rollbackAppWAL(ctx, req, data)
+		err = b.rollbackAppWAL(ctx, req, data)
 	case walRotateRootCreds:
-		return b.rollbackRootWAL(ctx, req, data)
+		err = b.rollbackRootWAL(ctx, req, data)
 	case walAppRoleAssignment:
-		return b.rollbackRoleAssignWAL(ctx, req, data)
+		err = b.rollbackRoleAssignWAL(ctx, req, data)
+	case walGroupMembership:
+		err = b.rollbackGroupMemberWAL(ctx, req, data)
+	case walGrantRemoval:
+		err = b.rollbackGrantRemovalWAL(ctx, req, data)
+	case walAppRetire:
+		err = b.rollbackAppRetireWAL(ctx, req, data)
+	case walACRToken:
+		err = b.rollbackACRTokenWAL(ctx, req, data)
+	case walManagedIdentityKey:
+		err = b.rollbackManagedIdentityWAL(ctx, req, data)
 	default:
 		return fmt.Errorf("unknown rollback type %q", kind)
 	}
+	recordWALRollback(kind, err)
+	if err != nil {
+		return err
+	}
+
+	b.sendEvent(ctx, eventWALRollback, walEventMetadata(kind, data)...)
+	return nil
+}
+
+// walEventMetadata returns the event metadata of a rolled back WAL entry: its
+// kind and the Azure objects it refers to.
+func walEventMetadata(kind string, data interface{}) []string {
+	metadata := []string{
+		logical.EventMetadataOperation, "rollback",
+		logical.EventMetadataModified, "true",
+		"wal_kind", kind,
+	}
+
+	fields, _ := data.(map[string]interface{})
+	for field, key := range map[string]string{
+		"RoleName":   "role",
+		"AppObjID":   "app_object_id",
+		"SpID":       "sp_object_id",
+		"IdentityID": "identity_id",
+		"RegistryID": "registry_id",
+	} {
+		if v, ok := fields[field].(string); ok && v != "" {
+			metadata = append(metadata, key, v)
+		}
+	}
+
+	return metadata
 }
 
 type walApp struct {
@@ -170,3 +220,251 @@ func (b *azureSecretBackend) rollbackRoleAssignWAL(ctx context.Context, req *log
 	}
 	return nil
 }
+
+type walGroupMember struct {
+	SpID       string
+	GroupID    string
+	Expiration time.Time
+}
+
+func (b *azureSecretBackend) rollbackGroupMemberWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	// Decode the WAL data
+	var entry walGroupMember
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("rolling back group membership for service principal", "ID", entry.SpID, "group", entry.GroupID)
+
+	if err := client.removeGroupMemberships(ctx, entry.SpID, []string{entry.GroupID}); err != nil {
+		b.Logger().Warn("rollback error removing group membership", "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("group membership WAL expired prior to rollback; resources may still exist")
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// walGrantRemove records a role assignment or group membership that is no
+// longer granted by a role. Rolling it back retries the removal.
+type walGrantRemove struct {
+	SpID             string
+	RoleAssignmentID string
+	GroupID          string
+	Expiration       time.Time
+}
+
+func (r *walGrantRemove) remove(ctx context.Context, c *client) error {
+	if r.RoleAssignmentID != "" {
+		if err := c.unassignRoles(ctx, []string{r.RoleAssignmentID}); err != nil {
+			return err
+		}
+	}
+	if r.GroupID != "" {
+		if err := c.removeGroupMemberships(ctx, r.SpID, []string{r.GroupID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *azureSecretBackend) rollbackGrantRemovalWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	// Decode the WAL data
+	var entry walGrantRemove
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("removing grants no longer used by role", "ID", entry.SpID)
+
+	if err := entry.remove(ctx, client); err != nil {
+		b.Logger().Warn("rollback error removing grant", "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("grant removal WAL expired prior to rollback; resources may still exist")
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// walAppRetirement records a managed app that is no longer used by its role.
+// Rolling it back retires the app, unless the role still uses it because
+// saving the role failed.
+type walAppRetirement struct {
+	RoleName           string
+	AppObjID           string
+	SpID               string
+	RoleAssignmentIDs  []string
+	GroupMembershipIDs []string
+	PermanentlyDelete  bool
+	Expiration         time.Time
+}
+
+func (b *azureSecretBackend) rollbackAppRetireWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	// Decode the WAL data
+	var entry walAppRetirement
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	lock := locksutil.LockForKey(b.roleLocks, entry.RoleName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getRole(ctx, entry.RoleName, req.Storage)
+	if err != nil {
+		return err
+	}
+	if role != nil && role.ManagedApplicationObjectID == entry.AppObjID {
+		b.Logger().Debug("persisted app is still used by role", "role", entry.RoleName, "appObjID", entry.AppObjID)
+		return nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("retiring persisted app", "role", entry.RoleName, "appObjID", entry.AppObjID)
+
+	if _, err := b.retireApp(ctx, req.Storage, client, &entry); err != nil {
+		b.Logger().Warn("rollback error retiring persisted app", "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("app retirement WAL expired prior to rollback; resources may still exist")
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+type walACR struct {
+	RegistryID string
+	Name       string
+	Expiration time.Time
+}
+
+// rollbackACRTokenWAL deletes the token and scope map of a container registry
+// credential that wasn't fully created.
+func (b *azureSecretBackend) rollbackACRTokenWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	var entry walACR
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("rolling back ACR token", "registryID", entry.RegistryID, "name", entry.Name)
+
+	// The token must be deleted before its scope map. Neither may have been
+	// created, so not found errors are ignored.
+	err = client.provider.DeleteRegistryToken(ctx, entry.RegistryID, entry.Name)
+	if err == nil || isResourceNotFound(err) {
+		err = client.provider.DeleteScopeMap(ctx, entry.RegistryID, entry.Name)
+	}
+	if err != nil && !isResourceNotFound(err) {
+		b.Logger().Warn("rollback error deleting ACR token", "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("ACR token WAL expired prior to rollback; resources may still exist")
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+type walManagedIdentity struct {
+	IdentityID string
+	Expiration time.Time
+}
+
+func (b *azureSecretBackend) rollbackManagedIdentityWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	var entry walManagedIdentity
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("rolling back managed identity", "identityID", entry.IdentityID)
+
+	// The identity may not have been created, so not found errors are ignored.
+	if err := client.provider.DeleteUserAssignedIdentity(ctx, entry.IdentityID); err != nil && !isResourceNotFound(err) {
+		b.Logger().Warn("rollback error deleting managed identity", "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("managed identity WAL expired prior to rollback; resources may still exist")
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}